@@ -0,0 +1,279 @@
+/*
+The l2tpdump command decodes L2TPv2 and L2TPv3 control messages offline.
+
+l2tpdump reads either a capture file in pcap or pcapng format, or hex-encoded
+control frames, and prints the decoded messages.  Input is read from the file
+named on the command line, or from stdin if no file is specified.  The input
+format is detected automatically.
+
+For each message the header fields and sequence numbers are shown, followed by
+each AVP along with its mandatory (M) and hidden (H) bits, vendor and decoded
+value.  AVPs which l2tpdump doesn't recognise are marked as unknown, and their
+values are shown as raw bytes.  Messages which don't conform to the RFCs are
+flagged as such.
+
+Capture files are searched for L2TP control frames carried over UDP and
+over IP (protocol 115).  By default only UDP traffic to or from port 1701 is
+examined: use the -port argument to specify a different port, or -port 0 to
+examine all UDP traffic.
+
+Hex input should have one control frame per line, starting with the L2TP
+header.  Whitespace, colons and commas between bytes are ignored, as are
+"0x" prefixes.  Blank lines and lines starting with "#" are skipped.
+
+	$ echo "c8 02 00 14 00 00 00 00 00 00 00 00 80 08 00 00 00 00 00 06" | l2tpdump
+	#1
+	  L2TPv2 avpMsgTypeHello tid 0 sid 0 ns 0 nr 0 len 20
+	    avpTypeMessage [M-] (message ID) avpMsgTypeHello
+
+Run with the -json argument for JSON output, in which case one JSON object is
+printed per message.
+
+Run with the -help argument for documentation of the command line arguments.
+*/
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+// jsonAVP is the JSON representation of an AVP.
+type jsonAVP struct {
+	VendorID  uint16 `json:"vendor_id"`
+	Type      uint16 `json:"type"`
+	Name      string `json:"name"`
+	Mandatory bool   `json:"mandatory"`
+	Hidden    bool   `json:"hidden"`
+	Value     string `json:"value"`
+	Raw       string `json:"raw"`
+	Unknown   bool   `json:"unknown,omitempty"`
+}
+
+// jsonMessage is the JSON representation of a control message.
+type jsonMessage struct {
+	Frame     int       `json:"frame"`
+	Time      string    `json:"time,omitempty"`
+	Src       string    `json:"src,omitempty"`
+	Dst       string    `json:"dst,omitempty"`
+	Version   int       `json:"version,omitempty"`
+	Type      string    `json:"type,omitempty"`
+	TunnelID  uint32    `json:"tunnel_id"`
+	SessionID uint32    `json:"session_id"`
+	Ns        uint16    `json:"ns"`
+	Nr        uint16    `json:"nr"`
+	Length    int       `json:"length,omitempty"`
+	AVPs      []jsonAVP `json:"avps,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type dumper struct {
+	out  io.Writer
+	json bool
+}
+
+func (d *dumper) dumpFrame(f *frame) error {
+	msgs, err := l2tp.DecodeRawMessages(f.b)
+	if d.json {
+		return d.dumpFrameJSON(f, msgs, err)
+	}
+	return d.dumpFrameText(f, msgs, err)
+}
+
+func (d *dumper) dumpFrameText(f *frame, msgs []*l2tp.RawMessage, err error) error {
+	var out strings.Builder
+
+	out.WriteString(fmt.Sprintf("#%d", f.index))
+	if !f.ts.IsZero() {
+		out.WriteString(fmt.Sprintf(" %s", f.ts.UTC().Format(time.RFC3339Nano)))
+	}
+	if f.src != "" {
+		out.WriteString(fmt.Sprintf(" %s > %s", f.src, f.dst))
+	}
+	out.WriteString("\n")
+
+	if err != nil {
+		out.WriteString(fmt.Sprintf("  decode failed: %v\n", err))
+		out.WriteString(fmt.Sprintf("  %x\n", f.b))
+	}
+
+	for _, m := range msgs {
+		out.WriteString(fmt.Sprintf("  %v\n", m))
+		for i := range m.AVPs {
+			a := &m.AVPs[i]
+			if a.IsRecognised() {
+				out.WriteString(fmt.Sprintf("    %v\n", a))
+			} else {
+				out.WriteString(fmt.Sprintf("    %v (unknown)\n", a))
+			}
+		}
+		if verr := m.Validate(); verr != nil {
+			out.WriteString(fmt.Sprintf("  invalid message: %v\n", verr))
+		}
+	}
+
+	_, err = io.WriteString(d.out, out.String())
+	return err
+}
+
+func (d *dumper) dumpFrameJSON(f *frame, msgs []*l2tp.RawMessage, err error) error {
+	var out []jsonMessage
+
+	base := jsonMessage{
+		Frame: f.index,
+		Src:   f.src,
+		Dst:   f.dst,
+	}
+	if !f.ts.IsZero() {
+		base.Time = f.ts.UTC().Format(time.RFC3339Nano)
+	}
+
+	if err != nil {
+		m := base
+		m.Error = err.Error()
+		out = append(out, m)
+	}
+
+	for _, msg := range msgs {
+		m := base
+		m.Version = int(msg.Version)
+		m.Type = msg.Type.String()
+		m.TunnelID = uint32(msg.TunnelID)
+		m.SessionID = uint32(msg.SessionID)
+		m.Ns = msg.Ns
+		m.Nr = msg.Nr
+		m.Length = msg.Length
+		for i := range msg.AVPs {
+			a := &msg.AVPs[i]
+			m.AVPs = append(m.AVPs, jsonAVP{
+				VendorID:  a.VendorID(),
+				Type:      a.Type(),
+				Name:      a.TypeName(),
+				Mandatory: a.IsMandatory(),
+				Hidden:    a.IsHidden(),
+				Value:     a.Value(),
+				Raw:       hex.EncodeToString(a.Bytes()),
+				Unknown:   !a.IsRecognised(),
+			})
+		}
+		if verr := msg.Validate(); verr != nil {
+			m.Error = verr.Error()
+		}
+		out = append(out, m)
+	}
+
+	enc := json.NewEncoder(d.out)
+	for _, m := range out {
+		err = enc.Encode(m)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decodeHexLine decodes a line of hex input.
+func decodeHexLine(line string) ([]byte, error) {
+	line = strings.TrimSpace(line)
+	line = strings.Replace(line, "0x", "", -1)
+	line = strings.Replace(line, "0X", "", -1)
+	line = strings.Map(func(r rune) rune {
+		switch r {
+		case ' ', '\t', ':', ',':
+			return -1
+		}
+		return r
+	}, line)
+	return hex.DecodeString(line)
+}
+
+// readHex reads hex-encoded frames, one per line.
+func readHex(b []byte, fn func(f *frame) error) error {
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(make([]byte, 65536), 1<<20)
+	lineno := 0
+	index := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fb, err := decodeHexLine(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %v", lineno, err)
+		}
+		index++
+		err = fn(&frame{index: index, b: fb})
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func main() {
+	jsonPtr := flag.Bool("json", false, "print messages as JSON")
+	portPtr := flag.Int("port", l2tpUDPPort, "UDP port to examine in capture files, or 0 for all ports")
+	flag.Parse()
+
+	if flag.NArg() > 1 {
+		stdlog.Fatalf("expected a single input file")
+	}
+
+	var in io.Reader = os.Stdin
+	if flag.NArg() == 1 && flag.Arg(0) != "-" {
+		file, err := os.Open(flag.Arg(0))
+		if err != nil {
+			stdlog.Fatalf("failed to open input: %v", err)
+		}
+		defer file.Close()
+		in = file
+	}
+
+	b, err := ioutil.ReadAll(in)
+	if err != nil {
+		stdlog.Fatalf("failed to read input: %v", err)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	d := &dumper{out: out, json: *jsonPtr}
+
+	if isPcap(b) {
+		index := 0
+		var werr error
+		err = readPcap(b, func(ts time.Time, linkType uint32, pkt []byte) {
+			index++
+			f, ok := extractL2TP(linkType, pkt, *portPtr)
+			if !ok || werr != nil {
+				return
+			}
+			f.index = index
+			f.ts = ts
+			werr = d.dumpFrame(f)
+		})
+		if err == nil {
+			err = werr
+		}
+	} else {
+		err = readHex(b, d.dumpFrame)
+	}
+	if err != nil {
+		out.Flush()
+		stdlog.Fatalf("%v", err)
+	}
+}
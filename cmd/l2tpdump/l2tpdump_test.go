@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+// testHelloUnknownAVP is an L2TPv2 HELLO message carrying an unknown
+// vendor AVP with the mandatory bit set
+var testHelloUnknownAVP = []byte{
+	0xc8, 0x02, 0x00, 0x1c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06,
+	0x80, 0x08, 0x00, 0x09, 0x01, 0xef, 0x00, 0x01,
+}
+
+func TestDumpUnknownAVP(t *testing.T) {
+	t.Run("text", func(t *testing.T) {
+		var out bytes.Buffer
+		d := &dumper{out: &out}
+		err := d.dumpFrame(&frame{index: 1, b: testHelloUnknownAVP})
+		if err != nil {
+			t.Fatalf("dumpFrame(): %v", err)
+		}
+		s := out.String()
+		if strings.Contains(s, "decode failed") {
+			t.Fatalf("expected frame to decode, got:\n%s", s)
+		}
+		if !strings.Contains(s, "avpTypeMessage [M-] (message ID) avpMsgTypeHello\n") {
+			t.Errorf("expected message type AVP, got:\n%s", s)
+		}
+		if !strings.Contains(s, "Vendor 9 AVP 495 [M-] (byte array) 0001 (unknown)\n") {
+			t.Errorf("expected unknown AVP to be marked, got:\n%s", s)
+		}
+		if !strings.Contains(s, "invalid message: ") {
+			t.Errorf("expected message to be flagged as invalid, got:\n%s", s)
+		}
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var out bytes.Buffer
+		d := &dumper{out: &out, json: true}
+		err := d.dumpFrame(&frame{index: 1, b: testHelloUnknownAVP})
+		if err != nil {
+			t.Fatalf("dumpFrame(): %v", err)
+		}
+		var m jsonMessage
+		err = json.Unmarshal(out.Bytes(), &m)
+		if err != nil {
+			t.Fatalf("json.Unmarshal(): %v", err)
+		}
+		if m.Type != "avpMsgTypeHello" {
+			t.Errorf("expected type avpMsgTypeHello, got %q", m.Type)
+		}
+		if len(m.AVPs) != 2 {
+			t.Fatalf("expected 2 AVPs, got %d", len(m.AVPs))
+		}
+		if m.AVPs[0].Unknown {
+			t.Errorf("expected message type AVP to be known")
+		}
+		a := m.AVPs[1]
+		if !a.Unknown || !a.Mandatory || a.VendorID != 9 || a.Type != 495 || a.Raw != "0001" {
+			t.Errorf("unexpected unknown AVP %+v", a)
+		}
+		if m.Error == "" {
+			t.Errorf("expected message to be flagged as invalid")
+		}
+	})
+}
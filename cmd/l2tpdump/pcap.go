@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+// frame is an L2TP control frame extracted from the input.
+type frame struct {
+	index    int
+	ts       time.Time
+	src, dst string
+	b        []byte
+}
+
+// Link types as per https://www.tcpdump.org/linktypes.html
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+	linkTypeSLL2     = 276
+)
+
+const (
+	etherTypeIPv4  = 0x0800
+	etherTypeIPv6  = 0x86dd
+	etherTypeVLAN  = 0x8100
+	etherTypeQinQ  = 0x88a8
+	ipProtoUDP     = 17
+	ipProtoL2TP    = 115
+	l2tpUDPPort    = 1701
+	pcapMagicUsec  = 0xa1b2c3d4
+	pcapMagicNsec  = 0xa1b23c4d
+	pcapngBlockSHB = 0x0a0d0d0a
+	pcapngBlockIDB = 0x00000001
+	pcapngBlockSPB = 0x00000003
+	pcapngBlockEPB = 0x00000006
+	pcapngMagic    = 0x1a2b3c4d
+)
+
+// isPcap returns true if the buffer starts with a pcap or pcapng header.
+func isPcap(b []byte) bool {
+	if len(b) < 4 {
+		return false
+	}
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		switch order.Uint32(b) {
+		case pcapMagicUsec, pcapMagicNsec, pcapngBlockSHB:
+			return true
+		}
+	}
+	return false
+}
+
+// packetHandler is called for each packet read from a capture file.
+type packetHandler func(ts time.Time, linkType uint32, pkt []byte)
+
+// readPcap reads packets from a pcap or pcapng file.
+func readPcap(b []byte, fn packetHandler) error {
+	if len(b) < 4 {
+		return errors.New("capture file is too short")
+	}
+	if binary.LittleEndian.Uint32(b) == pcapngBlockSHB {
+		return readPcapng(b, fn)
+	}
+	return readPcapClassic(b, fn)
+}
+
+func readPcapClassic(b []byte, fn packetHandler) error {
+	if len(b) < 24 {
+		return errors.New("pcap file header is truncated")
+	}
+
+	var order binary.ByteOrder = binary.LittleEndian
+	magic := order.Uint32(b)
+	if magic != pcapMagicUsec && magic != pcapMagicNsec {
+		order = binary.BigEndian
+		magic = order.Uint32(b)
+	}
+	tsScale := time.Microsecond
+	if magic == pcapMagicNsec {
+		tsScale = time.Nanosecond
+	}
+	linkType := order.Uint32(b[20:]) & 0x0fffffff
+
+	b = b[24:]
+	for len(b) > 0 {
+		if len(b) < 16 {
+			return errors.New("pcap record header is truncated")
+		}
+		sec := order.Uint32(b[0:])
+		frac := order.Uint32(b[4:])
+		capLen := order.Uint32(b[8:])
+		if uint64(capLen) > uint64(len(b)-16) {
+			return errors.New("pcap record is truncated")
+		}
+		ts := time.Unix(int64(sec), int64(frac)*int64(tsScale))
+		fn(ts, linkType, b[16:16+capLen])
+		b = b[16+capLen:]
+	}
+	return nil
+}
+
+type pcapngInterface struct {
+	linkType uint32
+	tsUnit   time.Duration
+	tsDiv    uint64
+}
+
+func readPcapng(b []byte, fn packetHandler) error {
+	var order binary.ByteOrder
+	var ifaces []pcapngInterface
+
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return errors.New("pcapng block is truncated")
+		}
+
+		if binary.LittleEndian.Uint32(b) == pcapngBlockSHB {
+			// Each section may use a different byte order
+			if len(b) < 16 {
+				return errors.New("pcapng section header is truncated")
+			}
+			order = binary.LittleEndian
+			if order.Uint32(b[8:]) != pcapngMagic {
+				order = binary.BigEndian
+				if order.Uint32(b[8:]) != pcapngMagic {
+					return errors.New("pcapng section header has bad byte order magic")
+				}
+			}
+			ifaces = nil
+		} else if order == nil {
+			return errors.New("pcapng file doesn't start with a section header")
+		}
+
+		blockType := order.Uint32(b[0:])
+		blockLen := order.Uint32(b[4:])
+		if blockLen < 12 || uint64(blockLen) > uint64(len(b)) {
+			return fmt.Errorf("pcapng block has bad length %d", blockLen)
+		}
+		body := b[8 : blockLen-4]
+
+		switch blockType {
+		case pcapngBlockIDB:
+			if len(body) < 8 {
+				return errors.New("pcapng interface description is truncated")
+			}
+			iface := pcapngInterface{
+				linkType: uint32(order.Uint16(body[0:])),
+				tsUnit:   time.Microsecond,
+				tsDiv:    1,
+			}
+			parsePcapngIDBOptions(order, body[8:], &iface)
+			ifaces = append(ifaces, iface)
+
+		case pcapngBlockEPB:
+			if len(body) < 20 {
+				return errors.New("pcapng packet block is truncated")
+			}
+			id := order.Uint32(body[0:])
+			if int(id) >= len(ifaces) {
+				return fmt.Errorf("pcapng packet block references unknown interface %d", id)
+			}
+			iface := ifaces[id]
+			ts := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			capLen := order.Uint32(body[12:])
+			if uint64(capLen) > uint64(len(body)-20) {
+				return errors.New("pcapng packet block is truncated")
+			}
+			fn(pcapngTime(ts, iface), iface.linkType, body[20:20+capLen])
+
+		case pcapngBlockSPB:
+			if len(body) < 4 || len(ifaces) == 0 {
+				return errors.New("pcapng simple packet block is invalid")
+			}
+			origLen := order.Uint32(body[0:])
+			pkt := body[4:]
+			if uint64(origLen) < uint64(len(pkt)) {
+				pkt = pkt[:origLen]
+			}
+			fn(time.Time{}, ifaces[0].linkType, pkt)
+		}
+
+		b = b[blockLen:]
+	}
+	return nil
+}
+
+// parsePcapngIDBOptions handles the if_tsresol option, which sets the
+// timestamp resolution for the interface.
+func parsePcapngIDBOptions(order binary.ByteOrder, opts []byte, iface *pcapngInterface) {
+	const optEndOfOpt = 0
+	const optTsResol = 9
+
+	for len(opts) >= 4 {
+		code := order.Uint16(opts[0:])
+		length := int(order.Uint16(opts[2:]))
+		// Option values are padded to a 32 bit boundary
+		padded := (length + 3) &^ 3
+		if code == optEndOfOpt || 4+padded > len(opts) {
+			return
+		}
+		if code == optTsResol && length >= 1 {
+			res := opts[4]
+			if (res&0x80 == 0 && res > 19) || res&0x7f > 63 {
+				// Resolution can't be represented
+				return
+			}
+			if res&0x80 == 0 {
+				// Negative power of 10
+				iface.tsUnit = time.Second
+				iface.tsDiv = 1
+				for i := byte(0); i < res; i++ {
+					iface.tsDiv *= 10
+				}
+			} else {
+				// Negative power of 2
+				iface.tsUnit = time.Second
+				iface.tsDiv = 1 << (res & 0x7f)
+			}
+		}
+		opts = opts[4+padded:]
+	}
+}
+
+func pcapngTime(ts uint64, iface pcapngInterface) time.Time {
+	if iface.tsUnit == time.Microsecond {
+		return time.Unix(0, int64(ts)*int64(time.Microsecond))
+	}
+	sec := ts / iface.tsDiv
+	frac := ts % iface.tsDiv
+	return time.Unix(int64(sec), int64(float64(frac)/float64(iface.tsDiv)*float64(time.Second)))
+}
+
+// extractL2TP extracts an L2TP control frame from a captured packet.
+// Packets which don't carry L2TP control frames are ignored.
+func extractL2TP(linkType uint32, pkt []byte, port int) (f *frame, ok bool) {
+	ip, ok := linkPayload(linkType, pkt)
+	if !ok || len(ip) < 1 {
+		return nil, false
+	}
+
+	var src, dst net.IP
+	var proto uint8
+	var payload []byte
+
+	switch ip[0] >> 4 {
+	case 4:
+		ihl := int(ip[0]&0x0f) * 4
+		if ihl < 20 || len(ip) < ihl {
+			return nil, false
+		}
+		// Skip all but the first fragment of fragmented datagrams
+		if binary.BigEndian.Uint16(ip[6:])&0x1fff != 0 {
+			return nil, false
+		}
+		totalLen := int(binary.BigEndian.Uint16(ip[2:]))
+		if totalLen < ihl || totalLen > len(ip) {
+			totalLen = len(ip)
+		}
+		proto = ip[9]
+		src, dst = net.IP(ip[12:16]), net.IP(ip[16:20])
+		payload = ip[ihl:totalLen]
+	case 6:
+		if len(ip) < 40 {
+			return nil, false
+		}
+		proto = ip[6]
+		src, dst = net.IP(ip[8:24]), net.IP(ip[24:40])
+		payload = ip[40:]
+		if plen := int(binary.BigEndian.Uint16(ip[4:])); plen <= len(payload) {
+			payload = payload[:plen]
+		}
+	default:
+		return nil, false
+	}
+
+	switch proto {
+	case ipProtoUDP:
+		if len(payload) < 8 {
+			return nil, false
+		}
+		sport := int(binary.BigEndian.Uint16(payload[0:]))
+		dport := int(binary.BigEndian.Uint16(payload[2:]))
+		if port != 0 && sport != port && dport != port {
+			return nil, false
+		}
+		b := payload[8:]
+		// The T bit is set for control messages
+		if len(b) < 1 || b[0]&0x80 == 0 {
+			return nil, false
+		}
+		return &frame{
+			src: net.JoinHostPort(src.String(), strconv.Itoa(sport)),
+			dst: net.JoinHostPort(dst.String(), strconv.Itoa(dport)),
+			b:   b,
+		}, true
+	case ipProtoL2TP:
+		// Control messages carry a zero session ID, RFC3931 section 4.1.1.2
+		if len(payload) < 5 || binary.BigEndian.Uint32(payload) != 0 {
+			return nil, false
+		}
+		return &frame{
+			src: src.String(),
+			dst: dst.String(),
+			b:   payload[4:],
+		}, true
+	}
+	return nil, false
+}
+
+// linkPayload strips the link layer header from a captured packet.
+func linkPayload(linkType uint32, pkt []byte) ([]byte, bool) {
+	switch linkType {
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		return pkt, true
+	case linkTypeNull:
+		if len(pkt) < 4 {
+			return nil, false
+		}
+		return pkt[4:], true
+	case linkTypeEthernet:
+		if len(pkt) < 14 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(pkt[12:])
+		pkt = pkt[14:]
+		for etherType == etherTypeVLAN || etherType == etherTypeQinQ {
+			if len(pkt) < 4 {
+				return nil, false
+			}
+			etherType = binary.BigEndian.Uint16(pkt[2:])
+			pkt = pkt[4:]
+		}
+		return pkt, etherType == etherTypeIPv4 || etherType == etherTypeIPv6
+	case linkTypeLinuxSLL:
+		if len(pkt) < 16 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(pkt[14:])
+		return pkt[16:], etherType == etherTypeIPv4 || etherType == etherTypeIPv6
+	case linkTypeSLL2:
+		if len(pkt) < 20 {
+			return nil, false
+		}
+		etherType := binary.BigEndian.Uint16(pkt[0:])
+		return pkt[20:], etherType == etherTypeIPv4 || etherType == etherTypeIPv6
+	}
+	return nil, false
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// testHello is an L2TPv2 HELLO message
+var testHello = []byte{
+	0xc8, 0x02, 0x00, 0x14, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x80, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x06,
+}
+
+type testPacket struct {
+	ts       time.Time
+	linkType uint32
+	pkt      []byte
+}
+
+func testReadPackets(b []byte, read func([]byte, packetHandler) error) ([]testPacket, error) {
+	var pkts []testPacket
+	err := read(b, func(ts time.Time, linkType uint32, pkt []byte) {
+		pkts = append(pkts, testPacket{ts: ts, linkType: linkType, pkt: pkt})
+	})
+	return pkts, err
+}
+
+func testPcapClassic(order binary.ByteOrder, magic uint32, linkType uint32, records ...[]byte) []byte {
+	b := make([]byte, 24)
+	order.PutUint32(b[0:], magic)
+	order.PutUint16(b[4:], 2)
+	order.PutUint16(b[6:], 4)
+	order.PutUint32(b[16:], 65535)
+	order.PutUint32(b[20:], linkType)
+	return append(b, bytes.Join(records, nil)...)
+}
+
+func testPcapRecord(order binary.ByteOrder, sec, frac uint32, pkt []byte) []byte {
+	b := make([]byte, 16)
+	order.PutUint32(b[0:], sec)
+	order.PutUint32(b[4:], frac)
+	order.PutUint32(b[8:], uint32(len(pkt)))
+	order.PutUint32(b[12:], uint32(len(pkt)))
+	return append(b, pkt...)
+}
+
+func testPcapngBlock(order binary.ByteOrder, blockType uint32, body []byte) []byte {
+	b := make([]byte, 8, 12+len(body))
+	order.PutUint32(b[0:], blockType)
+	order.PutUint32(b[4:], uint32(12+len(body)))
+	b = append(b, body...)
+	return append(b, b[4:8]...)
+}
+
+func testPcapngSHB(order binary.ByteOrder) []byte {
+	body := make([]byte, 16)
+	order.PutUint32(body[0:], pcapngMagic)
+	order.PutUint16(body[4:], 1)
+	binary.BigEndian.PutUint64(body[8:], 0xffffffffffffffff)
+	b := testPcapngBlock(order, pcapngBlockSHB, body)
+	// The block type is byte order independent
+	binary.LittleEndian.PutUint32(b, pcapngBlockSHB)
+	return b
+}
+
+func testPcapngIDB(order binary.ByteOrder, linkType uint16, opts []byte) []byte {
+	body := make([]byte, 8)
+	order.PutUint16(body[0:], linkType)
+	order.PutUint32(body[4:], 65535)
+	return testPcapngBlock(order, pcapngBlockIDB, append(body, opts...))
+}
+
+func testPcapngEPB(order binary.ByteOrder, id uint32, ts uint64, pkt []byte) []byte {
+	body := make([]byte, 20)
+	order.PutUint32(body[0:], id)
+	order.PutUint32(body[4:], uint32(ts>>32))
+	order.PutUint32(body[8:], uint32(ts))
+	order.PutUint32(body[12:], uint32(len(pkt)))
+	order.PutUint32(body[16:], uint32(len(pkt)))
+	body = append(body, pkt...)
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	return testPcapngBlock(order, pcapngBlockEPB, body)
+}
+
+func testIPv4(proto uint8, src, dst net.IP, payload []byte) []byte {
+	b := make([]byte, 20)
+	b[0] = 0x45
+	binary.BigEndian.PutUint16(b[2:], uint16(20+len(payload)))
+	b[8] = 64
+	b[9] = proto
+	copy(b[12:], src.To4())
+	copy(b[16:], dst.To4())
+	return append(b, payload...)
+}
+
+func testIPv6(proto uint8, src, dst net.IP, payload []byte) []byte {
+	b := make([]byte, 40)
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:], uint16(len(payload)))
+	b[6] = proto
+	b[7] = 64
+	copy(b[8:], src.To16())
+	copy(b[24:], dst.To16())
+	return append(b, payload...)
+}
+
+func testUDP(sport, dport uint16, payload []byte) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint16(b[0:], sport)
+	binary.BigEndian.PutUint16(b[2:], dport)
+	binary.BigEndian.PutUint16(b[4:], uint16(8+len(payload)))
+	return append(b, payload...)
+}
+
+func testEthernet(etherType uint16, vlans int, payload []byte) []byte {
+	b := make([]byte, 12)
+	for i := 0; i < vlans; i++ {
+		b = append(b, 0x81, 0x00, 0x00, byte(i+1))
+	}
+	b = append(b, byte(etherType>>8), byte(etherType))
+	return append(b, payload...)
+}
+
+func TestReadPcapClassic(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	cases := []struct {
+		name   string
+		in     []byte
+		expect []testPacket
+		fails  bool
+	}{
+		{
+			name: "little endian microseconds",
+			in: testPcapClassic(le, pcapMagicUsec, linkTypeEthernet,
+				testPcapRecord(le, 10, 20, []byte{1, 2, 3}),
+				testPcapRecord(le, 11, 0, []byte{4})),
+			expect: []testPacket{
+				{ts: time.Unix(10, 20000), linkType: linkTypeEthernet, pkt: []byte{1, 2, 3}},
+				{ts: time.Unix(11, 0), linkType: linkTypeEthernet, pkt: []byte{4}},
+			},
+		},
+		{
+			name: "big endian nanoseconds",
+			in: testPcapClassic(be, pcapMagicNsec, linkTypeRaw,
+				testPcapRecord(be, 10, 20, []byte{1, 2})),
+			expect: []testPacket{
+				{ts: time.Unix(10, 20), linkType: linkTypeRaw, pkt: []byte{1, 2}},
+			},
+		},
+		{
+			name: "link type FCS bits are ignored",
+			in: testPcapClassic(le, pcapMagicUsec, 0x10000000|linkTypeLinuxSLL,
+				testPcapRecord(le, 1, 0, []byte{1})),
+			expect: []testPacket{
+				{ts: time.Unix(1, 0), linkType: linkTypeLinuxSLL, pkt: []byte{1}},
+			},
+		},
+		{
+			name:  "truncated file header",
+			in:    testPcapClassic(le, pcapMagicUsec, linkTypeRaw)[:20],
+			fails: true,
+		},
+		{
+			name:  "truncated record header",
+			in:    append(testPcapClassic(le, pcapMagicUsec, linkTypeRaw), 0, 0, 0, 0),
+			fails: true,
+		},
+		{
+			name: "truncated record",
+			in: testPcapClassic(le, pcapMagicUsec, linkTypeRaw,
+				testPcapRecord(le, 1, 0, []byte{1, 2, 3, 4})[:18]),
+			fails: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pkts, err := testReadPackets(c.in, readPcapClassic)
+			if c.fails {
+				if err == nil {
+					t.Fatalf("readPcapClassic() succeeded, expected failure")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readPcapClassic(): %v", err)
+			}
+			testCheckPackets(t, pkts, c.expect)
+		})
+	}
+}
+
+func TestReadPcapng(t *testing.T) {
+	le, be := binary.LittleEndian, binary.BigEndian
+	join := func(blocks ...[]byte) []byte { return bytes.Join(blocks, nil) }
+	cases := []struct {
+		name   string
+		in     []byte
+		expect []testPacket
+		fails  bool
+	}{
+		{
+			name: "little endian",
+			in: join(testPcapngSHB(le),
+				testPcapngIDB(le, linkTypeEthernet, nil),
+				testPcapngEPB(le, 0, 10000020, []byte{1, 2, 3})),
+			expect: []testPacket{
+				{ts: time.Unix(10, 20000), linkType: linkTypeEthernet, pkt: []byte{1, 2, 3}},
+			},
+		},
+		{
+			name: "big endian",
+			in: join(testPcapngSHB(be),
+				testPcapngIDB(be, linkTypeRaw, nil),
+				testPcapngEPB(be, 0, 1000000, []byte{1})),
+			expect: []testPacket{
+				{ts: time.Unix(1, 0), linkType: linkTypeRaw, pkt: []byte{1}},
+			},
+		},
+		{
+			name: "multiple interfaces",
+			in: join(testPcapngSHB(le),
+				testPcapngIDB(le, linkTypeEthernet, nil),
+				testPcapngIDB(le, linkTypeLinuxSLL, nil),
+				testPcapngEPB(le, 1, 0, []byte{1}),
+				testPcapngEPB(le, 0, 0, []byte{2})),
+			expect: []testPacket{
+				{ts: time.Unix(0, 0), linkType: linkTypeLinuxSLL, pkt: []byte{1}},
+				{ts: time.Unix(0, 0), linkType: linkTypeEthernet, pkt: []byte{2}},
+			},
+		},
+		{
+			name: "nanosecond resolution",
+			in: join(testPcapngSHB(le),
+				testPcapngIDB(le, linkTypeRaw, []byte{9, 0, 1, 0, 9, 0, 0, 0, 0, 0, 0, 0}),
+				testPcapngEPB(le, 0, 2000000003, []byte{1})),
+			expect: []testPacket{
+				{ts: time.Unix(2, 3), linkType: linkTypeRaw, pkt: []byte{1}},
+			},
+		},
+		{
+			name: "options after padding",
+			in: join(testPcapngSHB(le),
+				testPcapngIDB(le, linkTypeRaw, []byte{
+					2, 0, 3, 0, 'e', 't', 'h', 0,
+					9, 0, 1, 0, 3, 0, 0, 0,
+					0, 0, 0, 0}),
+				testPcapngEPB(le, 0, 1002, []byte{1})),
+			expect: []testPacket{
+				{ts: time.Unix(1, 2000000), linkType: linkTypeRaw, pkt: []byte{1}},
+			},
+		},
+		{
+			name: "unpadded options",
+			in: join(testPcapngSHB(le),
+				testPcapngIDB(le, linkTypeRaw, []byte{9, 0, 1, 0, 9}),
+				testPcapngEPB(le, 0, 5, []byte{1})),
+			expect: []testPacket{
+				{ts: time.Unix(0, 5000), linkType: linkTypeRaw, pkt: []byte{1}},
+			},
+		},
+		{
+			name: "truncated options",
+			in: join(testPcapngSHB(le),
+				testPcapngIDB(le, linkTypeRaw, []byte{2, 0, 0xff, 0, 'e', 't', 'h', 0}),
+				testPcapngEPB(le, 0, 5, []byte{1})),
+			expect: []testPacket{
+				{ts: time.Unix(0, 5000), linkType: linkTypeRaw, pkt: []byte{1}},
+			},
+		},
+		{
+			name: "simple packet block",
+			in: join(testPcapngSHB(le),
+				testPcapngIDB(le, linkTypeRaw, nil),
+				testPcapngBlock(le, pcapngBlockSPB, []byte{2, 0, 0, 0, 1, 2, 0, 0})),
+			expect: []testPacket{
+				{linkType: linkTypeRaw, pkt: []byte{1, 2}},
+			},
+		},
+		{
+			name: "unknown blocks are skipped",
+			in: join(testPcapngSHB(le),
+				testPcapngIDB(le, linkTypeRaw, nil),
+				testPcapngBlock(le, 0x0bad, []byte{1, 2, 3, 4}),
+				testPcapngEPB(le, 0, 0, []byte{1})),
+			expect: []testPacket{
+				{ts: time.Unix(0, 0), linkType: linkTypeRaw, pkt: []byte{1}},
+			},
+		},
+		{
+			name:  "no section header",
+			in:    testPcapngIDB(le, linkTypeRaw, nil),
+			fails: true,
+		},
+		{
+			name:  "bad byte order magic",
+			in:    testPcapngBlock(le, pcapngBlockSHB, make([]byte, 16)),
+			fails: true,
+		},
+		{
+			name: "bad block length",
+			in: join(testPcapngSHB(le),
+				testPcapngIDB(le, linkTypeRaw, nil)[:16]),
+			fails: true,
+		},
+		{
+			name: "truncated interface description",
+			in: join(testPcapngSHB(le),
+				testPcapngBlock(le, pcapngBlockIDB, []byte{1, 0, 0, 0})),
+			fails: true,
+		},
+		{
+			name: "unknown interface",
+			in: join(testPcapngSHB(le),
+				testPcapngIDB(le, linkTypeRaw, nil),
+				testPcapngEPB(le, 1, 0, []byte{1})),
+			fails: true,
+		},
+		{
+			name: "truncated packet",
+			in: join(testPcapngSHB(le),
+				testPcapngIDB(le, linkTypeRaw, nil),
+				testPcapngBlock(le, pcapngBlockEPB, []byte{
+					0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+					8, 0, 0, 0, 8, 0, 0, 0, 1, 2, 3, 4})),
+			fails: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			pkts, err := testReadPackets(c.in, readPcapng)
+			if c.fails {
+				if err == nil {
+					t.Fatalf("readPcapng() succeeded, expected failure")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readPcapng(): %v", err)
+			}
+			testCheckPackets(t, pkts, c.expect)
+		})
+	}
+}
+
+func testCheckPackets(t *testing.T, got, expect []testPacket) {
+	if len(got) != len(expect) {
+		t.Fatalf("expected %d packets, got %d", len(expect), len(got))
+	}
+	for i := range expect {
+		if !got[i].ts.Equal(expect[i].ts) {
+			t.Errorf("packet %d: expected timestamp %v, got %v", i, expect[i].ts, got[i].ts)
+		}
+		if got[i].linkType != expect[i].linkType {
+			t.Errorf("packet %d: expected link type %d, got %d", i, expect[i].linkType, got[i].linkType)
+		}
+		if !bytes.Equal(got[i].pkt, expect[i].pkt) {
+			t.Errorf("packet %d: expected %x, got %x", i, expect[i].pkt, got[i].pkt)
+		}
+	}
+}
+
+func TestExtractL2TP(t *testing.T) {
+	src4, dst4 := net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")
+	src6, dst6 := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	data := []byte{0x02, 0x02, 0x00, 0x01, 0x00, 0x01}
+	fragment := testIPv4(ipProtoUDP, src4, dst4, testUDP(1701, 1701, testHello))
+	fragment[7] = 0x10
+
+	cases := []struct {
+		name     string
+		linkType uint32
+		pkt      []byte
+		port     int
+		expect   *frame
+	}{
+		{
+			name:     "IPv4 UDP",
+			linkType: linkTypeRaw,
+			pkt:      testIPv4(ipProtoUDP, src4, dst4, testUDP(5000, 1701, testHello)),
+			port:     l2tpUDPPort,
+			expect:   &frame{src: "10.0.0.1:5000", dst: "10.0.0.2:1701", b: testHello},
+		},
+		{
+			name:     "IPv4 UDP with trailing padding",
+			linkType: linkTypeEthernet,
+			pkt: testEthernet(etherTypeIPv4, 0,
+				append(testIPv4(ipProtoUDP, src4, dst4, testUDP(1701, 1701, testHello)), 0, 0, 0)),
+			port:   l2tpUDPPort,
+			expect: &frame{src: "10.0.0.1:1701", dst: "10.0.0.2:1701", b: testHello},
+		},
+		{
+			name:     "IPv6 UDP",
+			linkType: linkTypeIPv6,
+			pkt:      testIPv6(ipProtoUDP, src6, dst6, testUDP(1701, 6000, testHello)),
+			port:     l2tpUDPPort,
+			expect:   &frame{src: "[2001:db8::1]:1701", dst: "[2001:db8::2]:6000", b: testHello},
+		},
+		{
+			name:     "UDP on another port",
+			linkType: linkTypeRaw,
+			pkt:      testIPv4(ipProtoUDP, src4, dst4, testUDP(5000, 6000, testHello)),
+			port:     l2tpUDPPort,
+		},
+		{
+			name:     "UDP on any port",
+			linkType: linkTypeRaw,
+			pkt:      testIPv4(ipProtoUDP, src4, dst4, testUDP(5000, 6000, testHello)),
+			port:     0,
+			expect:   &frame{src: "10.0.0.1:5000", dst: "10.0.0.2:6000", b: testHello},
+		},
+		{
+			name:     "UDP data message",
+			linkType: linkTypeRaw,
+			pkt:      testIPv4(ipProtoUDP, src4, dst4, testUDP(1701, 1701, data)),
+			port:     l2tpUDPPort,
+		},
+		{
+			name:     "truncated UDP header",
+			linkType: linkTypeRaw,
+			pkt:      testIPv4(ipProtoUDP, src4, dst4, []byte{0x06, 0xa5, 0x06, 0xa5}),
+			port:     l2tpUDPPort,
+		},
+		{
+			name:     "IPv4 fragment",
+			linkType: linkTypeRaw,
+			pkt:      fragment,
+			port:     l2tpUDPPort,
+		},
+		{
+			name:     "IPv4 L2TP",
+			linkType: linkTypeRaw,
+			pkt:      testIPv4(ipProtoL2TP, src4, dst4, append([]byte{0, 0, 0, 0}, 0xc8, 0x03)),
+			port:     l2tpUDPPort,
+			expect:   &frame{src: "10.0.0.1", dst: "10.0.0.2", b: []byte{0xc8, 0x03}},
+		},
+		{
+			name:     "IPv6 L2TP",
+			linkType: linkTypeRaw,
+			pkt:      testIPv6(ipProtoL2TP, src6, dst6, append([]byte{0, 0, 0, 0}, 0xc8, 0x03)),
+			port:     l2tpUDPPort,
+			expect:   &frame{src: "2001:db8::1", dst: "2001:db8::2", b: []byte{0xc8, 0x03}},
+		},
+		{
+			name:     "L2TP data message",
+			linkType: linkTypeRaw,
+			pkt:      testIPv4(ipProtoL2TP, src4, dst4, []byte{0, 0, 0, 1, 0xaa}),
+			port:     l2tpUDPPort,
+		},
+		{
+			name:     "other protocol",
+			linkType: linkTypeRaw,
+			pkt:      testIPv4(6, src4, dst4, testUDP(1701, 1701, testHello)),
+			port:     l2tpUDPPort,
+		},
+		{
+			name:     "truncated IPv4 header",
+			linkType: linkTypeRaw,
+			pkt:      testIPv4(ipProtoUDP, src4, dst4, nil)[:12],
+			port:     l2tpUDPPort,
+		},
+		{
+			name:     "truncated IPv6 header",
+			linkType: linkTypeRaw,
+			pkt:      testIPv6(ipProtoUDP, src6, dst6, nil)[:32],
+			port:     l2tpUDPPort,
+		},
+		{
+			name:     "not IP",
+			linkType: linkTypeEthernet,
+			pkt:      testEthernet(0x0806, 0, make([]byte, 28)),
+			port:     l2tpUDPPort,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			f, ok := extractL2TP(c.linkType, c.pkt, c.port)
+			if c.expect == nil {
+				if ok {
+					t.Fatalf("extractL2TP() extracted %+v, expected nothing", f)
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("extractL2TP() extracted nothing")
+			}
+			if f.src != c.expect.src || f.dst != c.expect.dst {
+				t.Errorf("expected %s > %s, got %s > %s", c.expect.src, c.expect.dst, f.src, f.dst)
+			}
+			if !bytes.Equal(f.b, c.expect.b) {
+				t.Errorf("expected frame %x, got %x", c.expect.b, f.b)
+			}
+		})
+	}
+}
+
+func TestLinkPayload(t *testing.T) {
+	ip := testIPv4(ipProtoUDP, net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), nil)
+	sll := append([]byte{
+		0, 0, 0, 1, 0, 6, 0, 0, 0, 0, 0, 0, 0, 0, 0x86, 0xdd}, ip...)
+	sll2 := append([]byte{
+		0x08, 0x00, 0, 0, 0, 0, 0, 2, 0, 1, 0, 6, 0, 0, 0, 0, 0, 0, 0, 0}, ip...)
+
+	cases := []struct {
+		name     string
+		linkType uint32
+		pkt      []byte
+		expect   []byte
+		ok       bool
+	}{
+		{name: "raw", linkType: linkTypeRaw, pkt: ip, expect: ip, ok: true},
+		{name: "IPv4", linkType: linkTypeIPv4, pkt: ip, expect: ip, ok: true},
+		{name: "IPv6", linkType: linkTypeIPv6, pkt: ip, expect: ip, ok: true},
+		{name: "null", linkType: linkTypeNull, pkt: append([]byte{2, 0, 0, 0}, ip...), expect: ip, ok: true},
+		{name: "truncated null", linkType: linkTypeNull, pkt: []byte{2, 0}},
+		{name: "ethernet", linkType: linkTypeEthernet, pkt: testEthernet(etherTypeIPv4, 0, ip), expect: ip, ok: true},
+		{name: "ethernet IPv6", linkType: linkTypeEthernet, pkt: testEthernet(etherTypeIPv6, 0, ip), expect: ip, ok: true},
+		{name: "ethernet VLAN", linkType: linkTypeEthernet, pkt: testEthernet(etherTypeIPv4, 1, ip), expect: ip, ok: true},
+		{name: "ethernet QinQ", linkType: linkTypeEthernet, pkt: testEthernet(etherTypeIPv4, 2, ip), expect: ip, ok: true},
+		{name: "ethernet ARP", linkType: linkTypeEthernet, pkt: testEthernet(0x0806, 0, ip)},
+		{name: "truncated ethernet", linkType: linkTypeEthernet, pkt: testEthernet(etherTypeIPv4, 0, nil)[:13]},
+		{name: "truncated VLAN tag", linkType: linkTypeEthernet, pkt: testEthernet(etherTypeIPv4, 1, nil)[:16]},
+		{name: "linux SLL", linkType: linkTypeLinuxSLL, pkt: sll, expect: ip, ok: true},
+		{name: "truncated linux SLL", linkType: linkTypeLinuxSLL, pkt: sll[:15]},
+		{name: "linux SLL2", linkType: linkTypeSLL2, pkt: sll2, expect: ip, ok: true},
+		{name: "truncated linux SLL2", linkType: linkTypeSLL2, pkt: sll2[:19]},
+		{name: "unknown link type", linkType: 147, pkt: ip},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			payload, ok := linkPayload(c.linkType, c.pkt)
+			if ok != c.ok {
+				t.Fatalf("expected ok %v, got %v", c.ok, ok)
+			}
+			if ok && !bytes.Equal(payload, c.expect) {
+				t.Errorf("expected payload %x, got %x", c.expect, payload)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+// statsTunnel is the part of l2tp.Tunnel used for metrics reporting.
+type statsTunnel interface {
+	Stats() (*l2tp.TunnelStats, error)
+}
+
+// metricsTunnel tracks a tunnel and its sessions for metrics reporting.
+type metricsTunnel struct {
+	tunl     statsTunnel
+	sessions map[string]l2tp.Session
+}
+
+// metricsExporter serves tunnel, session and transport metrics in the
+// Prometheus text exposition format:
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+//
+// Tunnels and sessions are removed from the exporter as they go down,
+// so the exporter must be registered as an event handler with the
+// context the tunnels were created in.
+type metricsExporter struct {
+	stats func() l2tp.ContextStats
+	// mutex protects the fields below
+	mutex   sync.Mutex
+	tunnels map[string]*metricsTunnel
+}
+
+type metricSample struct {
+	labels string
+	value  float64
+}
+
+type metricFamily struct {
+	name, help, kind string
+	samples          []metricSample
+}
+
+type metricSet struct {
+	families []*metricFamily
+	byName   map[string]*metricFamily
+}
+
+func newMetricsExporter(stats func() l2tp.ContextStats) *metricsExporter {
+	return &metricsExporter{
+		stats:   stats,
+		tunnels: make(map[string]*metricsTunnel),
+	}
+}
+
+func (e *metricsExporter) addTunnel(name string, tunl statsTunnel) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.tunnels[name] = &metricsTunnel{
+		tunl:     tunl,
+		sessions: make(map[string]l2tp.Session),
+	}
+}
+
+func (e *metricsExporter) addSession(tname, sname string, s l2tp.Session) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if mt, ok := e.tunnels[tname]; ok {
+		mt.sessions[sname] = s
+	}
+}
+
+// HandleEvent implements l2tp.EventHandler, removing tunnels and
+// sessions which have gone down.
+func (e *metricsExporter) HandleEvent(event interface{}) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	switch ev := event.(type) {
+	case *l2tp.TunnelDownEvent:
+		delete(e.tunnels, ev.TunnelName)
+	case *l2tp.SessionDownEvent:
+		if mt, ok := e.tunnels[ev.TunnelName]; ok {
+			delete(mt.sessions, ev.SessionName)
+		}
+	}
+}
+
+// snapshot returns a copy of the tracked tunnels and sessions, so that
+// their statistics may be gathered without blocking event handling.
+func (e *metricsExporter) snapshot() map[string]*metricsTunnel {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	tunnels := make(map[string]*metricsTunnel, len(e.tunnels))
+	for tname, mt := range e.tunnels {
+		sessions := make(map[string]l2tp.Session, len(mt.sessions))
+		for sname, s := range mt.sessions {
+			sessions[sname] = s
+		}
+		tunnels[tname] = &metricsTunnel{tunl: mt.tunl, sessions: sessions}
+	}
+	return tunnels
+}
+
+func (ms *metricSet) add(name, kind, help, labels string, value float64) {
+	if ms.byName == nil {
+		ms.byName = make(map[string]*metricFamily)
+	}
+	f, ok := ms.byName[name]
+	if !ok {
+		f = &metricFamily{name: name, help: help, kind: kind}
+		ms.byName[name] = f
+		ms.families = append(ms.families, f)
+	}
+	f.samples = append(f.samples, metricSample{labels: labels, value: value})
+}
+
+func (ms *metricSet) write(w io.Writer) error {
+	var out strings.Builder
+	for _, f := range ms.families {
+		out.WriteString(fmt.Sprintf("# HELP %s %s\n", f.name, f.help))
+		out.WriteString(fmt.Sprintf("# TYPE %s %s\n", f.name, f.kind))
+		for _, s := range f.samples {
+			out.WriteString(fmt.Sprintf("%s%s %v\n", f.name, s.labels, s.value))
+		}
+	}
+	_, err := io.WriteString(w, out.String())
+	return err
+}
+
+// metricLabels renders label name/value pairs, escaping values as
+// required by the exposition format.
+func metricLabels(kv ...string) string {
+	var pairs []string
+	for i := 0; i+1 < len(kv); i += 2 {
+		v := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(kv[i+1])
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", kv[i], v))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (e *metricsExporter) collect() *metricSet {
+	ms := &metricSet{}
+
+	cs := e.stats()
+	ms.add("l2tp_tunnels_created_total", "counter", "Tunnels created.", "", float64(cs.TunnelsCreated))
+	ms.add("l2tp_tunnels_closed_total", "counter", "Tunnels closed.", "", float64(cs.TunnelsClosed))
+	ms.add("l2tp_sessions_created_total", "counter", "Sessions created.", "", float64(cs.SessionsCreated))
+	ms.add("l2tp_sessions_closed_total", "counter", "Sessions closed.", "", float64(cs.SessionsClosed))
+	ms.add("l2tp_transport_failures_total", "counter",
+		"Tunnels torn down due to control plane transport failure.", "", float64(cs.TransportFailures))
+
+	tunnels := e.snapshot()
+	var tnames []string
+	for tname := range tunnels {
+		tnames = append(tnames, tname)
+	}
+	sort.Strings(tnames)
+
+	for _, tname := range tnames {
+		mt := tunnels[tname]
+		tl := metricLabels("tunnel", tname)
+
+		ts, err := mt.tunl.Stats()
+		up := 0.0
+		if err == nil {
+			up = 1.0
+		}
+		ms.add("l2tp_tunnel_up", "gauge", "Whether the tunnel is up.", tl, up)
+
+		if ts != nil && ts.Transport != nil {
+			xs := ts.Transport
+			ms.add("l2tp_transport_cwnd", "gauge",
+				"Transport congestion window.", tl, float64(xs.Cwnd))
+			ms.add("l2tp_transport_thresh", "gauge",
+				"Transport slow start threshold.", tl, float64(xs.Thresh))
+			ms.add("l2tp_transport_in_flight", "gauge",
+				"Messages sent and awaiting acknowledgement.", tl, float64(xs.InFlight))
+			ms.add("l2tp_transport_tx_queue_length", "gauge",
+				"Messages waiting for the transmit window to open.", tl, float64(xs.TxQueueLen))
+			ms.add("l2tp_transport_ack_queue_length", "gauge",
+				"Messages waiting to be acknowledged.", tl, float64(xs.AckQueueLen))
+			ms.add("l2tp_transport_rx_queue_length", "gauge",
+				"Messages received out of sequence.", tl, float64(xs.RxQueueLen))
+			ms.add("l2tp_transport_messages_sent_total", "counter",
+				"Control messages sent, including retransmits and acks.", tl, float64(xs.MessagesSent))
+			ms.add("l2tp_transport_messages_received_total", "counter",
+				"Control messages received in sequence.", tl, float64(xs.MessagesReceived))
+			ms.add("l2tp_transport_retransmits_total", "counter",
+				"Control messages retransmitted.", tl, float64(xs.Retransmits))
+			ms.add("l2tp_transport_hello_rtt_seconds", "gauge",
+				"Round trip time of the last acknowledged HELLO.", tl, xs.HelloRTT.Seconds())
+		}
+
+		var snames []string
+		for sname := range mt.sessions {
+			snames = append(snames, sname)
+		}
+		sort.Strings(snames)
+
+		for _, sname := range snames {
+			ss, err := mt.sessions[sname].Stats()
+			if err != nil {
+				continue
+			}
+			sl := metricLabels("tunnel", tname, "session", sname)
+			ms.add("l2tp_session_tx_packets_total", "counter", "Data packets sent.", sl, float64(ss.TxPackets))
+			ms.add("l2tp_session_tx_bytes_total", "counter", "Data bytes sent.", sl, float64(ss.TxBytes))
+			ms.add("l2tp_session_tx_errors_total", "counter", "Data transmit errors.", sl, float64(ss.TxErrors))
+			ms.add("l2tp_session_rx_packets_total", "counter", "Data packets received.", sl, float64(ss.RxPackets))
+			ms.add("l2tp_session_rx_bytes_total", "counter", "Data bytes received.", sl, float64(ss.RxBytes))
+			ms.add("l2tp_session_rx_seq_discards_total", "counter",
+				"Data packets discarded due to sequence number errors.", sl, float64(ss.RxSeqDiscards))
+			ms.add("l2tp_session_rx_oos_packets_total", "counter",
+				"Data packets received out of sequence.", sl, float64(ss.RxOOSPackets))
+			ms.add("l2tp_session_rx_errors_total", "counter", "Data receive errors.", sl, float64(ss.RxErrors))
+		}
+	}
+	return ms
+}
+
+func (e *metricsExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_ = e.collect().write(w)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/katalix/go-l2tp/l2tp"
+)
+
+type fakeStatsTunnel struct {
+	stats *l2tp.TunnelStats
+}
+
+func (t *fakeStatsTunnel) Stats() (*l2tp.TunnelStats, error) {
+	if t.stats == nil {
+		return nil, errors.New("tunnel is closed")
+	}
+	return t.stats, nil
+}
+
+type fakeStatsSession struct {
+	stats *l2tp.SessionStats
+}
+
+func (s *fakeStatsSession) Close() {}
+
+func (s *fakeStatsSession) CloseContext(cctx context.Context) error {
+	return nil
+}
+
+func (s *fakeStatsSession) Stats() (*l2tp.SessionStats, error) {
+	if s.stats == nil {
+		return nil, errors.New("session is closed")
+	}
+	return s.stats, nil
+}
+
+const expectMetrics = `# HELP l2tp_tunnels_created_total Tunnels created.
+# TYPE l2tp_tunnels_created_total counter
+l2tp_tunnels_created_total 3
+# HELP l2tp_tunnels_closed_total Tunnels closed.
+# TYPE l2tp_tunnels_closed_total counter
+l2tp_tunnels_closed_total 1
+# HELP l2tp_sessions_created_total Sessions created.
+# TYPE l2tp_sessions_created_total counter
+l2tp_sessions_created_total 4
+# HELP l2tp_sessions_closed_total Sessions closed.
+# TYPE l2tp_sessions_closed_total counter
+l2tp_sessions_closed_total 2
+# HELP l2tp_transport_failures_total Tunnels torn down due to control plane transport failure.
+# TYPE l2tp_transport_failures_total counter
+l2tp_transport_failures_total 0
+# HELP l2tp_tunnel_up Whether the tunnel is up.
+# TYPE l2tp_tunnel_up gauge
+l2tp_tunnel_up{tunnel="t\"1\\"} 1
+l2tp_tunnel_up{tunnel="t0"} 0
+# HELP l2tp_transport_cwnd Transport congestion window.
+# TYPE l2tp_transport_cwnd gauge
+l2tp_transport_cwnd{tunnel="t\"1\\"} 4
+# HELP l2tp_transport_thresh Transport slow start threshold.
+# TYPE l2tp_transport_thresh gauge
+l2tp_transport_thresh{tunnel="t\"1\\"} 8
+# HELP l2tp_transport_in_flight Messages sent and awaiting acknowledgement.
+# TYPE l2tp_transport_in_flight gauge
+l2tp_transport_in_flight{tunnel="t\"1\\"} 2
+# HELP l2tp_transport_tx_queue_length Messages waiting for the transmit window to open.
+# TYPE l2tp_transport_tx_queue_length gauge
+l2tp_transport_tx_queue_length{tunnel="t\"1\\"} 1
+# HELP l2tp_transport_ack_queue_length Messages waiting to be acknowledged.
+# TYPE l2tp_transport_ack_queue_length gauge
+l2tp_transport_ack_queue_length{tunnel="t\"1\\"} 2
+# HELP l2tp_transport_rx_queue_length Messages received out of sequence.
+# TYPE l2tp_transport_rx_queue_length gauge
+l2tp_transport_rx_queue_length{tunnel="t\"1\\"} 0
+# HELP l2tp_transport_messages_sent_total Control messages sent, including retransmits and acks.
+# TYPE l2tp_transport_messages_sent_total counter
+l2tp_transport_messages_sent_total{tunnel="t\"1\\"} 12
+# HELP l2tp_transport_messages_received_total Control messages received in sequence.
+# TYPE l2tp_transport_messages_received_total counter
+l2tp_transport_messages_received_total{tunnel="t\"1\\"} 10
+# HELP l2tp_transport_retransmits_total Control messages retransmitted.
+# TYPE l2tp_transport_retransmits_total counter
+l2tp_transport_retransmits_total{tunnel="t\"1\\"} 3
+# HELP l2tp_transport_hello_rtt_seconds Round trip time of the last acknowledged HELLO.
+# TYPE l2tp_transport_hello_rtt_seconds gauge
+l2tp_transport_hello_rtt_seconds{tunnel="t\"1\\"} 0.25
+# HELP l2tp_session_tx_packets_total Data packets sent.
+# TYPE l2tp_session_tx_packets_total counter
+l2tp_session_tx_packets_total{tunnel="t\"1\\",session="s\n1"} 100
+# HELP l2tp_session_tx_bytes_total Data bytes sent.
+# TYPE l2tp_session_tx_bytes_total counter
+l2tp_session_tx_bytes_total{tunnel="t\"1\\",session="s\n1"} 6400
+# HELP l2tp_session_tx_errors_total Data transmit errors.
+# TYPE l2tp_session_tx_errors_total counter
+l2tp_session_tx_errors_total{tunnel="t\"1\\",session="s\n1"} 1
+# HELP l2tp_session_rx_packets_total Data packets received.
+# TYPE l2tp_session_rx_packets_total counter
+l2tp_session_rx_packets_total{tunnel="t\"1\\",session="s\n1"} 200
+# HELP l2tp_session_rx_bytes_total Data bytes received.
+# TYPE l2tp_session_rx_bytes_total counter
+l2tp_session_rx_bytes_total{tunnel="t\"1\\",session="s\n1"} 12800
+# HELP l2tp_session_rx_seq_discards_total Data packets discarded due to sequence number errors.
+# TYPE l2tp_session_rx_seq_discards_total counter
+l2tp_session_rx_seq_discards_total{tunnel="t\"1\\",session="s\n1"} 2
+# HELP l2tp_session_rx_oos_packets_total Data packets received out of sequence.
+# TYPE l2tp_session_rx_oos_packets_total counter
+l2tp_session_rx_oos_packets_total{tunnel="t\"1\\",session="s\n1"} 3
+# HELP l2tp_session_rx_errors_total Data receive errors.
+# TYPE l2tp_session_rx_errors_total counter
+l2tp_session_rx_errors_total{tunnel="t\"1\\",session="s\n1"} 4
+`
+
+func TestMetricsExporter(t *testing.T) {
+	e := newMetricsExporter(func() l2tp.ContextStats {
+		return l2tp.ContextStats{
+			TunnelsCreated:  3,
+			TunnelsClosed:   1,
+			SessionsCreated: 4,
+			SessionsClosed:  2,
+		}
+	})
+
+	// Tunnels are rendered in name order, and the samples of each
+	// family grouped together regardless of which tunnel they're for
+	e.addTunnel("t0", &fakeStatsTunnel{})
+	e.addTunnel("t\"1\\", &fakeStatsTunnel{stats: &l2tp.TunnelStats{
+		Transport: &l2tp.TransportStats{
+			Cwnd:             4,
+			Thresh:           8,
+			InFlight:         2,
+			TxQueueLen:       1,
+			AckQueueLen:      2,
+			MessagesSent:     12,
+			MessagesReceived: 10,
+			Retransmits:      3,
+			HelloRTT:         250 * time.Millisecond,
+		},
+	}})
+	e.addSession("t\"1\\", "s\n1", &fakeStatsSession{stats: &l2tp.SessionStats{
+		TxPackets:     100,
+		TxBytes:       6400,
+		TxErrors:      1,
+		RxPackets:     200,
+		RxBytes:       12800,
+		RxSeqDiscards: 2,
+		RxOOSPackets:  3,
+		RxErrors:      4,
+	}})
+
+	// Sessions whose statistics can't be read aren't rendered
+	e.addSession("t\"1\\", "s2", &fakeStatsSession{})
+
+	// Tunnels and sessions which have gone down aren't rendered
+	e.addTunnel("t2", &fakeStatsTunnel{stats: &l2tp.TunnelStats{}})
+	e.addSession("t2", "s1", &fakeStatsSession{stats: &l2tp.SessionStats{}})
+	e.addSession("t\"1\\", "s3", &fakeStatsSession{stats: &l2tp.SessionStats{}})
+	e.HandleEvent(&l2tp.SessionDownEvent{TunnelName: "t\"1\\", SessionName: "s3"})
+	e.HandleEvent(&l2tp.SessionDownEvent{TunnelName: "t2", SessionName: "s1"})
+	e.HandleEvent(&l2tp.TunnelDownEvent{TunnelName: "t2"})
+
+	// Events for unknown instances are ignored
+	e.HandleEvent(&l2tp.SessionDownEvent{TunnelName: "t3", SessionName: "s1"})
+	e.HandleEvent(&l2tp.TunnelDownEvent{TunnelName: "t3"})
+	e.HandleEvent(&l2tp.CircuitStatusEvent{TunnelName: "t0"})
+
+	var out bytes.Buffer
+	err := e.collect().write(&out)
+	if err != nil {
+		t.Fatalf("write(): %v", err)
+	}
+	if out.String() != expectMetrics {
+		t.Errorf("expected metrics:\n%s\ngot:\n%s", expectMetrics, out.String())
+	}
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("expected text exposition content type, got %q", ct)
+	}
+	if rec.Body.String() != expectMetrics {
+		t.Errorf("expected metrics:\n%s\ngot:\n%s", expectMetrics, rec.Body.String())
+	}
+}
@@ -18,12 +18,26 @@ a minimal control plane transport is set up to send and acknowledge keep-alive
 (HELLO) messages.  This mode of operation extends static mode by allowing tunnel
 failure to be detected.  If a given tunnel is determined to have failed (HELLO message
 transmission fails) then the sessions in that tunnel are automatically torn down.
+
+If the -dynamic argument is set, tunnels are instead created as dynamic tunnels,
+which establish a control connection with the peer before the data plane is
+created, learning the peer's tunnel ID in the process.  Two instances of ql2tpd
+configured with dynamic tunnels to each other may be started in any order.  The
+tunnel configurations must not set peer_tid.
+
+If the -metrics argument is set to an address, e.g. ":9101", ql2tpd serves metrics
+for its tunnels and sessions over HTTP at /metrics, in the Prometheus text format.
+These include the tunnel and session lifecycle event counts, the state of each
+tunnel's control plane transport, and the data plane statistics the kernel
+maintains for each session.  Tunnels and sessions are removed from the metrics
+once they go down.
 */
 package main
 
 import (
 	"flag"
 	stdlog "log"
+	"net/http"
 	"os"
 	"os/signal"
 
@@ -41,6 +55,8 @@ func main() {
 
 	cfgPathPtr := flag.String("config", "/etc/ql2tpd/ql2tpd.toml", "specify configuration file path")
 	verbosePtr := flag.Bool("verbose", false, "toggle verbose log output")
+	dynamicPtr := flag.Bool("dynamic", false, "establish control connections for dynamic tunnels")
+	metricsPtr := flag.String("metrics", "", "serve Prometheus metrics at /metrics on the specified address")
 	flag.Parse()
 
 	config, err := l2tp.LoadConfigFile(*cfgPathPtr)
@@ -61,18 +77,59 @@ func main() {
 	}
 	defer l2tpCtx.Close()
 
-	for tnam, tcfg := range config.GetTunnels() {
-		tunl, err := l2tpCtx.NewQuiescentTunnel(tnam, tcfg)
-		if err != nil {
-			stdlog.Fatalf("failed to instantiate tunnel %v: %v", tnam, err)
+	metrics := newMetricsExporter(l2tpCtx.Stats)
+	l2tpCtx.RegisterEventHandler(metrics)
+
+	// Dynamic tunnel creation blocks until the peer responds, so the
+	// tunnels are created concurrently: the peer may be waiting for one
+	// tunnel while we wait for another.
+	type created struct {
+		name string
+		cfg  *l2tp.TunnelConfig
+		tunl l2tp.Tunnel
+		err  error
+	}
+	tunnels := config.GetTunnels()
+	createdChan := make(chan created, len(tunnels))
+	for tnam, tcfg := range tunnels {
+		go func(tnam string, tcfg *l2tp.TunnelConfig) {
+			var tunl l2tp.Tunnel
+			var err error
+			if *dynamicPtr {
+				tunl, err = l2tpCtx.NewDynamicTunnel(tnam, tcfg)
+			} else {
+				tunl, err = l2tpCtx.NewQuiescentTunnel(tnam, tcfg)
+			}
+			createdChan <- created{name: tnam, cfg: tcfg, tunl: tunl, err: err}
+		}(tnam, tcfg)
+	}
+
+	for range tunnels {
+		c := <-createdChan
+		tnam, tcfg, tunl := c.name, c.cfg, c.tunl
+		if c.err != nil {
+			stdlog.Fatalf("failed to instantiate tunnel %v: %v", tnam, c.err)
 		}
+		metrics.addTunnel(tnam, tunl)
 		for snam, scfg := range tcfg.Sessions {
-			_, err := tunl.NewSession(snam, scfg)
+			s, err := tunl.NewSession(snam, scfg)
 			if err != nil {
 				stdlog.Fatalf("failed to instantiate session %v in tunnel %v: %v", snam, tnam, err)
 			}
+			metrics.addSession(tnam, snam, s)
 		}
 	}
 
+	if *metricsPtr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		go func() {
+			err := http.ListenAndServe(*metricsPtr, mux)
+			level.Error(logger).Log(
+				"message", "metrics server failed",
+				"error", err)
+		}()
+	}
+
 	<-sigs
 }
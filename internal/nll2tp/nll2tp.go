@@ -1,9 +1,11 @@
 package nll2tp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
+	"time"
 
 	"github.com/mdlayher/genetlink"
 	"github.com/mdlayher/netlink"
@@ -91,10 +93,25 @@ type SessionConfig struct {
 	DebugFlags L2tpDebugFlags
 }
 
+// SessionStats holds the data plane statistics the kernel maintains
+// for an L2TP session.
+type SessionStats struct {
+	TxPackets     uint64
+	TxBytes       uint64
+	TxErrors      uint64
+	RxPackets     uint64
+	RxBytes       uint64
+	RxSeqDiscards uint64
+	RxOOSPackets  uint64
+	RxErrors      uint64
+}
+
 type msgRequest struct {
-	msg    genetlink.Message
-	family uint16
-	flags  netlink.HeaderFlags
+	ctx     context.Context
+	msg     genetlink.Message
+	family  uint16
+	flags   netlink.HeaderFlags
+	rspChan chan *msgResponse
 }
 
 type msgResponse struct {
@@ -102,12 +119,28 @@ type msgResponse struct {
 	err error
 }
 
+// genlConn is the part of *genetlink.Conn used by Conn, so that tests
+// can substitute a connection of their own.
+type genlConn interface {
+	Execute(m genetlink.Message, family uint16, flags netlink.HeaderFlags) ([]genetlink.Message, error)
+	SetDeadline(t time.Time) error
+	Close() error
+}
+
 // Conn represents the genetlink L2TP connection to the kernel.
+//
+// Each request takes a context: if the context is cancelled or its
+// deadline expires before the kernel responds, the request returns
+// the context's error.  The context sets the deadline of the netlink
+// socket while the request is executed, so a kernel which doesn't
+// respond doesn't hold up later requests.  The kernel may still act on
+// a request which has returned the context's error.
 type Conn struct {
 	genlFamily genetlink.Family
-	c          *genetlink.Conn
+	c          genlConn
 	reqChan    chan *msgRequest
-	rspChan    chan *msgResponse
+	closeChan  chan struct{}
+	closeOnce  sync.Once
 	wg         sync.WaitGroup
 }
 
@@ -124,24 +157,36 @@ func Dial() (*Conn, error) {
 		return nil, err
 	}
 
+	return newConn(c, id), nil
+}
+
+func newConn(c genlConn, family genetlink.Family) *Conn {
 	conn := &Conn{
-		genlFamily: id,
+		genlFamily: family,
 		c:          c,
 		reqChan:    make(chan *msgRequest),
-		rspChan:    make(chan *msgResponse),
+		closeChan:  make(chan struct{}),
 	}
 
 	conn.wg.Add(1)
 	go runConn(conn, &conn.wg)
 
-	return conn, nil
+	return conn
 }
 
-// Close connection, releasing associated resources
+// Close connection, releasing associated resources.
+// Close may be called more than once: requests made once
+// the connection is closed fail.  Closing the socket unblocks
+// a request the kernel hasn't responded to.
 func (c *Conn) Close() {
-	close(c.reqChan)
-	c.wg.Wait()
-	c.c.Close()
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+		// Closing a socket doesn't necessarily interrupt a blocked
+		// read, but expiring its deadline does.
+		_ = c.c.SetDeadline(time.Now())
+		c.c.Close()
+		c.wg.Wait()
+	})
 }
 
 // CreateManagedTunnel creates a new managed tunnel instance in the kernel.
@@ -149,7 +194,7 @@ func (c *Conn) Close() {
 // by a userspace process.  A managed tunnel's lifetime is bound by the lifetime
 // of the tunnel socket fd, and may optionally be destroyed using explicit
 // netlink commands.
-func (c *Conn) CreateManagedTunnel(fd int, config *TunnelConfig) (err error) {
+func (c *Conn) CreateManagedTunnel(ctx context.Context, fd int, config *TunnelConfig) (err error) {
 	if fd < 0 {
 		return errors.New("managed tunnel needs a valid socket file descriptor")
 	}
@@ -159,7 +204,7 @@ func (c *Conn) CreateManagedTunnel(fd int, config *TunnelConfig) (err error) {
 		return err
 	}
 
-	return c.createTunnel(append(attr, netlink.Attribute{
+	return c.createTunnel(ctx, append(attr, netlink.Attribute{
 		Type: AttrFd,
 		Data: nlenc.Uint32Bytes(uint32(fd)),
 	}))
@@ -169,7 +214,7 @@ func (c *Conn) CreateManagedTunnel(fd int, config *TunnelConfig) (err error) {
 // A "static" tunnel is one whose tunnel socket fd is implicitly created
 // by the kernel.  A static tunnel must be explicitly deleted using netlink
 // commands.
-func (c *Conn) CreateStaticTunnel(
+func (c *Conn) CreateStaticTunnel(ctx context.Context,
 	localAddr []byte, localPort uint16,
 	peerAddr []byte, peerPort uint16,
 	config *TunnelConfig) (err error) {
@@ -221,7 +266,7 @@ func (c *Conn) CreateStaticTunnel(
 		panic("unexpected address length")
 	}
 
-	return c.createTunnel(append(attr, netlink.Attribute{
+	return c.createTunnel(ctx, append(attr, netlink.Attribute{
 		Type: AttrUdpSport,
 		Data: nlenc.Uint16Bytes(localPort),
 	}, netlink.Attribute{
@@ -233,7 +278,7 @@ func (c *Conn) CreateStaticTunnel(
 // DeleteTunnel deletes a tunnel instance from the kernel.
 // Deleting a tunnel instance implicitly destroys any sessions
 // running in that tunnel.
-func (c *Conn) DeleteTunnel(config *TunnelConfig) error {
+func (c *Conn) DeleteTunnel(ctx context.Context, config *TunnelConfig) error {
 	if config == nil {
 		return errors.New("invalid nil tunnel config")
 	}
@@ -256,14 +301,14 @@ func (c *Conn) DeleteTunnel(config *TunnelConfig) error {
 		Data: b,
 	}
 
-	_, err = c.execute(req, c.genlFamily.ID, netlink.Request|netlink.Acknowledge)
+	_, err = c.execute(ctx, req, c.genlFamily.ID, netlink.Request|netlink.Acknowledge)
 	return err
 }
 
 // CreateSession creates a session instance in the kernel.
 // The parent tunnel instance referenced by the tunnel IDs in
 // the session configuration must already exist in the kernel.
-func (c *Conn) CreateSession(config *SessionConfig) error {
+func (c *Conn) CreateSession(ctx context.Context, config *SessionConfig) error {
 	attr, err := sessionCreateAttr(config)
 	if err != nil {
 		return err
@@ -282,12 +327,12 @@ func (c *Conn) CreateSession(config *SessionConfig) error {
 		Data: b,
 	}
 
-	_, err = c.execute(req, c.genlFamily.ID, netlink.Request|netlink.Acknowledge)
+	_, err = c.execute(ctx, req, c.genlFamily.ID, netlink.Request|netlink.Acknowledge)
 	return err
 }
 
 // DeleteSession deletes a session instance from the kernel.
-func (c *Conn) DeleteSession(config *SessionConfig) error {
+func (c *Conn) DeleteSession(ctx context.Context, config *SessionConfig) error {
 	if config == nil {
 		return errors.New("invalid nil session config")
 	}
@@ -314,11 +359,298 @@ func (c *Conn) DeleteSession(config *SessionConfig) error {
 		Data: b,
 	}
 
-	_, err = c.execute(req, c.genlFamily.ID, netlink.Request|netlink.Acknowledge)
+	_, err = c.execute(ctx, req, c.genlFamily.ID, netlink.Request|netlink.Acknowledge)
 	return err
 }
 
-func (c *Conn) createTunnel(attr []netlink.Attribute) error {
+// GetTunnel queries the kernel for the configuration of a tunnel instance.
+// Only the tunnel ID in the configuration passed is used.
+func (c *Conn) GetTunnel(ctx context.Context, config *TunnelConfig) (*TunnelConfig, error) {
+	if config == nil {
+		return nil, errors.New("invalid nil tunnel config")
+	}
+
+	rsp, err := c.get(ctx, CmdTunnelGet, []netlink.Attribute{
+		{
+			Type: AttrConnId,
+			Data: nlenc.Uint32Bytes(uint32(config.Tid)),
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTunnelConfig(rsp)
+}
+
+// ModifyTunnel modifies a tunnel instance in the kernel.
+// The kernel only allows the debug flags of a tunnel to be modified.
+func (c *Conn) ModifyTunnel(ctx context.Context, config *TunnelConfig) error {
+	if config == nil {
+		return errors.New("invalid nil tunnel config")
+	}
+
+	return c.modify(ctx, CmdTunnelModify, []netlink.Attribute{
+		{
+			Type: AttrConnId,
+			Data: nlenc.Uint32Bytes(uint32(config.Tid)),
+		},
+		{
+			Type: AttrDebug,
+			Data: nlenc.Uint32Bytes(uint32(config.DebugFlags)),
+		},
+	})
+}
+
+// GetSession queries the kernel for the configuration of a session instance.
+// Only the tunnel and session IDs in the configuration passed are used.
+func (c *Conn) GetSession(ctx context.Context, config *SessionConfig) (*SessionConfig, error) {
+	if config == nil {
+		return nil, errors.New("invalid nil session config")
+	}
+
+	rsp, err := c.get(ctx, CmdSessionGet, sessionIDAttr(config))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSessionConfig(rsp)
+}
+
+// ModifySession modifies a session instance in the kernel.
+// The kernel only allows the debug flags, data sequence number
+// settings, and reorder timeout of a session to be modified.
+func (c *Conn) ModifySession(ctx context.Context, config *SessionConfig) error {
+	if config == nil {
+		return errors.New("invalid nil session config")
+	}
+
+	return c.modify(ctx, CmdSessionModify, append(sessionIDAttr(config),
+		netlink.Attribute{
+			Type: AttrDebug,
+			Data: nlenc.Uint32Bytes(uint32(config.DebugFlags)),
+		},
+		netlink.Attribute{
+			Type: AttrSendSeq,
+			Data: nlenc.Uint8Bytes(boolToUint8(config.SendSeq)),
+		},
+		netlink.Attribute{
+			Type: AttrRecvSeq,
+			Data: nlenc.Uint8Bytes(boolToUint8(config.RecvSeq)),
+		},
+		netlink.Attribute{
+			Type: AttrLnsMode,
+			Data: nlenc.Uint8Bytes(boolToUint8(config.IsLNS)),
+		},
+		netlink.Attribute{
+			Type: AttrRecvTimeout,
+			Data: nlenc.Uint64Bytes(config.ReorderTimeout),
+		}))
+}
+
+// GetSessionStats queries the kernel for the data plane statistics
+// of a session instance.
+func (c *Conn) GetSessionStats(ctx context.Context, config *SessionConfig) (*SessionStats, error) {
+	if config == nil {
+		return nil, errors.New("invalid nil session config")
+	}
+
+	rsp, err := c.get(ctx, CmdSessionGet, sessionIDAttr(config))
+	if err != nil {
+		return nil, err
+	}
+
+	return parseSessionStats(rsp)
+}
+
+func (c *Conn) get(ctx context.Context, cmd uint8, attr []netlink.Attribute) ([]byte, error) {
+	b, err := netlink.MarshalAttributes(attr)
+	if err != nil {
+		return nil, err
+	}
+
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: cmd,
+			Version: c.genlFamily.Version,
+		},
+		Data: b,
+	}
+
+	rsp, err := c.execute(ctx, req, c.genlFamily.ID, netlink.Request)
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp) != 1 {
+		return nil, fmt.Errorf("expected 1 get response, got %v", len(rsp))
+	}
+
+	return rsp[0].Data, nil
+}
+
+func (c *Conn) modify(ctx context.Context, cmd uint8, attr []netlink.Attribute) error {
+	b, err := netlink.MarshalAttributes(attr)
+	if err != nil {
+		return err
+	}
+
+	req := genetlink.Message{
+		Header: genetlink.Header{
+			Command: cmd,
+			Version: c.genlFamily.Version,
+		},
+		Data: b,
+	}
+
+	_, err = c.execute(ctx, req, c.genlFamily.ID, netlink.Request|netlink.Acknowledge)
+	return err
+}
+
+func sessionIDAttr(config *SessionConfig) []netlink.Attribute {
+	return []netlink.Attribute{
+		{
+			Type: AttrConnId,
+			Data: nlenc.Uint32Bytes(uint32(config.Tid)),
+		},
+		{
+			Type: AttrSessionId,
+			Data: nlenc.Uint32Bytes(uint32(config.Sid)),
+		},
+	}
+}
+
+func boolToUint8(b bool) uint8 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// parseTunnelConfig extracts the tunnel configuration from a tunnel
+// get response.
+func parseTunnelConfig(b []byte) (*TunnelConfig, error) {
+	ad, err := netlink.NewAttributeDecoder(b)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &TunnelConfig{}
+	for ad.Next() {
+		switch ad.Type() {
+		case AttrConnId:
+			config.Tid = L2tpTunnelID(ad.Uint32())
+		case AttrPeerConnId:
+			config.Ptid = L2tpTunnelID(ad.Uint32())
+		case AttrProtoVersion:
+			config.Version = L2tpProtocolVersion(ad.Uint8())
+		case AttrEncapType:
+			config.Encap = L2tpEncapType(ad.Uint16())
+		case AttrDebug:
+			config.DebugFlags = L2tpDebugFlags(ad.Uint32())
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// parseSessionConfig extracts the session configuration from a session
+// get response.
+func parseSessionConfig(b []byte) (*SessionConfig, error) {
+	ad, err := netlink.NewAttributeDecoder(b)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &SessionConfig{}
+	for ad.Next() {
+		switch ad.Type() {
+		case AttrConnId:
+			config.Tid = L2tpTunnelID(ad.Uint32())
+		case AttrPeerConnId:
+			config.Ptid = L2tpTunnelID(ad.Uint32())
+		case AttrSessionId:
+			config.Sid = L2tpSessionID(ad.Uint32())
+		case AttrPeerSessionId:
+			config.Psid = L2tpSessionID(ad.Uint32())
+		case AttrPwType:
+			config.PseudowireType = L2tpPwtype(ad.Uint16())
+		case AttrSendSeq:
+			config.SendSeq = ad.Uint8() != 0
+		case AttrRecvSeq:
+			config.RecvSeq = ad.Uint8() != 0
+		case AttrLnsMode:
+			config.IsLNS = ad.Uint8() != 0
+		case AttrRecvTimeout:
+			config.ReorderTimeout = ad.Uint64()
+		case AttrCookie:
+			config.LocalCookie = ad.Bytes()
+		case AttrPeerCookie:
+			config.PeerCookie = ad.Bytes()
+		case AttrIfname:
+			config.IfName = ad.String()
+		case AttrL2specType:
+			config.L2SpecType = L2tpL2specType(ad.Uint8())
+		case AttrDebug:
+			config.DebugFlags = L2tpDebugFlags(ad.Uint32())
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// parseSessionStats extracts the nested statistics attributes from
+// a session get response.
+func parseSessionStats(b []byte) (*SessionStats, error) {
+	ad, err := netlink.NewAttributeDecoder(b)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &SessionStats{}
+	found := false
+	for ad.Next() {
+		if ad.Type() != AttrStats {
+			continue
+		}
+		found = true
+		ad.Nested(func(nad *netlink.AttributeDecoder) error {
+			for nad.Next() {
+				switch nad.Type() {
+				case AttrTxPackets:
+					stats.TxPackets = nad.Uint64()
+				case AttrTxBytes:
+					stats.TxBytes = nad.Uint64()
+				case AttrTxErrors:
+					stats.TxErrors = nad.Uint64()
+				case AttrRxPackets:
+					stats.RxPackets = nad.Uint64()
+				case AttrRxBytes:
+					stats.RxBytes = nad.Uint64()
+				case AttrRxSeqDiscards:
+					stats.RxSeqDiscards = nad.Uint64()
+				case AttrRxOosPackets:
+					stats.RxOOSPackets = nad.Uint64()
+				case AttrRxErrors:
+					stats.RxErrors = nad.Uint64()
+				}
+			}
+			return nil
+		})
+	}
+	if err := ad.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errors.New("session get response has no statistics")
+	}
+	return stats, nil
+}
+
+func (c *Conn) createTunnel(ctx context.Context, attr []netlink.Attribute) error {
 	b, err := netlink.MarshalAttributes(attr)
 	if err != nil {
 		return err
@@ -332,23 +664,35 @@ func (c *Conn) createTunnel(attr []netlink.Attribute) error {
 		Data: b,
 	}
 
-	_, err = c.execute(req, c.genlFamily.ID, netlink.Request|netlink.Acknowledge)
+	_, err = c.execute(ctx, req, c.genlFamily.ID, netlink.Request|netlink.Acknowledge)
 	return err
 }
 
-func (c *Conn) execute(msg genetlink.Message, family uint16, flags netlink.HeaderFlags) ([]genetlink.Message, error) {
-	c.reqChan <- &msgRequest{
-		msg:    msg,
-		family: family,
-		flags:  flags,
+func (c *Conn) execute(ctx context.Context, msg genetlink.Message, family uint16, flags netlink.HeaderFlags) ([]genetlink.Message, error) {
+	// The response channel is buffered so that the connection
+	// goroutine isn't blocked if the caller gives up waiting.
+	req := &msgRequest{
+		ctx:     ctx,
+		msg:     msg,
+		family:  family,
+		flags:   flags,
+		rspChan: make(chan *msgResponse, 1),
 	}
 
-	rsp, ok := <-c.rspChan
-	if !ok {
+	select {
+	case c.reqChan <- req:
+	case <-c.closeChan:
 		return nil, errors.New("netlink connection closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
 
-	return rsp.msg, rsp.err
+	select {
+	case rsp := <-req.rspChan:
+		return rsp.msg, rsp.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
 }
 
 func tunnelCreateAttr(config *TunnelConfig) ([]netlink.Attribute, error) {
@@ -547,11 +891,57 @@ func sessionCreateAttr(config *SessionConfig) ([]netlink.Attribute, error) {
 
 func runConn(c *Conn, wg *sync.WaitGroup) {
 	defer wg.Done()
-	for req := range c.reqChan {
-		m, err := c.c.Execute(req.msg, req.family, req.flags)
-		c.rspChan <- &msgResponse{
-			msg: m,
-			err: err,
+	for {
+		select {
+		case <-c.closeChan:
+			return
+		case req := <-c.reqChan:
+			m, err := c.executeRequest(req)
+			req.rspChan <- &msgResponse{
+				msg: m,
+				err: err,
+			}
+		}
+	}
+}
+
+// executeRequest executes a request with the socket deadline set from
+// the request's context.  Cancelling the context moves the deadline
+// into the past to unblock the request.
+func (c *Conn) executeRequest(req *msgRequest) ([]genetlink.Message, error) {
+	// Don't act on a request the caller has given up on
+	if err := req.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	deadline, _ := req.ctx.Deadline()
+	if err := c.c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	doneChan := make(chan struct{})
+	stoppedChan := make(chan struct{})
+	go func() {
+		defer close(stoppedChan)
+		select {
+		case <-req.ctx.Done():
+			_ = c.c.SetDeadline(time.Unix(1, 0))
+		case <-doneChan:
+		}
+	}()
+
+	m, err := c.c.Execute(req.msg, req.family, req.flags)
+	close(doneChan)
+	<-stoppedChan
+
+	// The socket deadline may expire a moment before the context's
+	if err != nil {
+		if cerr := req.ctx.Err(); cerr != nil {
+			return nil, cerr
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, context.DeadlineExceeded
 		}
 	}
+	return m, err
 }
@@ -0,0 +1,123 @@
+package nll2tp
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/genetlink"
+	"github.com/mdlayher/netlink"
+)
+
+// fakeGenlConn is a genetlink connection to a kernel which never
+// responds.  Execute blocks until the socket deadline expires, or, if
+// the connection ignores deadlines, until it's closed.
+type fakeGenlConn struct {
+	ignoreDeadline bool
+	executing      chan struct{}
+	closeChan      chan struct{}
+	closeOnce      sync.Once
+	// mutex protects the fields below
+	mutex        sync.Mutex
+	deadline     time.Time
+	deadlineChan chan struct{}
+}
+
+func newFakeGenlConn(ignoreDeadline bool) *fakeGenlConn {
+	return &fakeGenlConn{
+		ignoreDeadline: ignoreDeadline,
+		executing:      make(chan struct{}, 1),
+		closeChan:      make(chan struct{}),
+		deadlineChan:   make(chan struct{}),
+	}
+}
+
+func (f *fakeGenlConn) Execute(m genetlink.Message, family uint16, flags netlink.HeaderFlags) ([]genetlink.Message, error) {
+	select {
+	case f.executing <- struct{}{}:
+	default:
+	}
+	for {
+		f.mutex.Lock()
+		deadline, deadlineChan := f.deadline, f.deadlineChan
+		f.mutex.Unlock()
+
+		var expired <-chan time.Time
+		if !deadline.IsZero() && !f.ignoreDeadline {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			expired = timer.C
+		}
+
+		select {
+		case <-f.closeChan:
+			return nil, errors.New("use of closed file")
+		case <-expired:
+			return nil, errors.New("i/o timeout")
+		case <-deadlineChan:
+		}
+	}
+}
+
+func (f *fakeGenlConn) SetDeadline(t time.Time) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.deadline = t
+	close(f.deadlineChan)
+	f.deadlineChan = make(chan struct{})
+	return nil
+}
+
+func (f *fakeGenlConn) Close() error {
+	f.closeOnce.Do(func() { close(f.closeChan) })
+	return nil
+}
+
+func TestRequestContext(t *testing.T) {
+	conn := newConn(newFakeGenlConn(false), genetlink.Family{})
+	defer conn.Close()
+
+	// Each request is unblocked in turn by its context, rather than
+	// queueing behind the one before it
+	cctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := conn.GetTunnel(cctx, &TunnelConfig{Tid: 1})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+
+	cctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	_, err = conn.GetTunnel(cctx, &TunnelConfig{Tid: 1})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected cancellation, got %v", err)
+	}
+}
+
+func TestCloseWedged(t *testing.T) {
+	fake := newFakeGenlConn(true)
+	conn := newConn(fake, genetlink.Family{})
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := conn.GetTunnel(context.Background(), &TunnelConfig{Tid: 1})
+		errChan <- err
+	}()
+	<-fake.executing
+
+	closed := make(chan struct{})
+	go func() {
+		conn.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close() blocked by wedged request")
+	}
+	if err := <-errChan; err == nil {
+		t.Errorf("expected wedged request to fail")
+	}
+}
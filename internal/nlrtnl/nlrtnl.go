@@ -0,0 +1,358 @@
+/*
+Package nlrtnl provides the subset of the Linux rtnetlink API used to
+follow the state of network interfaces, and to signal the operational
+state of L2TP session interfaces.
+*/
+package nlrtnl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// Operational states of a network interface per RFC2863, as reported
+// and set using IFLA_OPERSTATE.
+const (
+	OperStateUnknown        = 0
+	OperStateNotPresent     = 1
+	OperStateDown           = 2
+	OperStateLowerLayerDown = 3
+	OperStateTesting        = 4
+	OperStateDormant        = 5
+	OperStateUp             = 6
+)
+
+// linkModeDormant is IF_LINK_MODE_DORMANT: in dormant mode user space
+// may move an interface between the dormant and up operational states.
+const linkModeDormant = 1
+
+// rtmgrpLink is the multicast group bit for link notifications,
+// RTMGRP_LINK.
+const rtmgrpLink = 1 << (unix.RTNLGRP_LINK - 1)
+
+// Link describes the state of a network interface.
+type Link struct {
+	// Index is the kernel's index for the interface.
+	Index int
+	// Name is the interface name.
+	Name string
+	// Flags are the interface flags, e.g. unix.IFF_UP.
+	Flags uint32
+	// OperState is the RFC2863 operational state of the interface.
+	OperState uint8
+	// Deleted is set if the link notification reports the removal
+	// of the interface.
+	Deleted bool
+}
+
+// Running returns true if the interface is administratively up and
+// has carrier.
+func (l *Link) Running() bool {
+	return !l.Deleted &&
+		l.Flags&unix.IFF_UP != 0 &&
+		l.Flags&unix.IFF_LOWER_UP != 0
+}
+
+// ErrBadMessage is wrapped by the error ReceiveLinks returns if the
+// kernel sends a link notification which can't be parsed.
+var ErrBadMessage = errors.New("malformed link notification")
+
+type msgRequest struct {
+	ctx     context.Context
+	msg     netlink.Message
+	rspChan chan *msgResponse
+}
+
+type msgResponse struct {
+	msg []netlink.Message
+	err error
+}
+
+// netlinkConn is the part of *netlink.Conn used by Conn, so that tests
+// can substitute a connection of their own.
+type netlinkConn interface {
+	Execute(m netlink.Message) ([]netlink.Message, error)
+	Receive() ([]netlink.Message, error)
+	SetDeadline(t time.Time) error
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// Conn represents the rtnetlink connection to the kernel.
+//
+// Requests are made over one socket, while link notifications are read
+// from another so that they aren't interleaved with responses.  Each
+// request takes a context: if the context is cancelled or its deadline
+// expires before the kernel responds, the request returns the context's
+// error.  The context sets the deadline of the request socket while the
+// request is executed, so a kernel which doesn't respond doesn't hold up
+// later requests.  The kernel may still act on a request which has
+// returned the context's error.
+type Conn struct {
+	c         netlinkConn
+	events    netlinkConn
+	reqChan   chan *msgRequest
+	closeChan chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// Dial creates a new rtnetlink connection to the kernel in the network
+// namespace of the calling thread.
+func Dial() (*Conn, error) {
+	c, err := netlink.Dial(unix.NETLINK_ROUTE, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := netlink.Dial(unix.NETLINK_ROUTE, &netlink.Config{Groups: rtmgrpLink})
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return newConn(c, events), nil
+}
+
+func newConn(c, events netlinkConn) *Conn {
+	conn := &Conn{
+		c:         c,
+		events:    events,
+		reqChan:   make(chan *msgRequest),
+		closeChan: make(chan struct{}),
+	}
+
+	conn.wg.Add(1)
+	go runConn(conn, &conn.wg)
+
+	return conn
+}
+
+// Close connection, releasing associated resources.
+// Close may be called more than once: requests made once the
+// connection is closed fail, as does a blocked ReceiveLinks call.
+// Closing the sockets unblocks a request the kernel hasn't responded to.
+func (c *Conn) Close() {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+		// Closing a socket doesn't necessarily interrupt a blocked
+		// read, but expiring its deadline does.
+		_ = c.c.SetDeadline(time.Now())
+		c.c.Close()
+		_ = c.events.SetReadDeadline(time.Now())
+		c.events.Close()
+		c.wg.Wait()
+	})
+}
+
+// GetLink queries the kernel for the state of the named interface.
+func (c *Conn) GetLink(ctx context.Context, name string) (*Link, error) {
+	ae := netlink.NewAttributeEncoder()
+	ae.String(unix.IFLA_IFNAME, name)
+	b, err := ae.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	rsp, err := c.execute(ctx, netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_GETLINK,
+			Flags: netlink.Request,
+		},
+		Data: append(ifInfomsgBytes(0), b...),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(rsp) != 1 {
+		return nil, fmt.Errorf("expected 1 response message, got %d", len(rsp))
+	}
+	return parseLink(rsp[0])
+}
+
+// SetOperState sets the operational state of an interface, which must
+// be one of OperStateUp or OperStateDormant.  The interface is put into
+// dormant link mode to allow this.
+func (c *Conn) SetOperState(ctx context.Context, index int, state uint8) error {
+	if state != OperStateUp && state != OperStateDormant {
+		return fmt.Errorf("cannot set operational state %v", state)
+	}
+
+	ae := netlink.NewAttributeEncoder()
+	ae.Uint8(unix.IFLA_LINKMODE, linkModeDormant)
+	ae.Uint8(unix.IFLA_OPERSTATE, state)
+	b, err := ae.Encode()
+	if err != nil {
+		return err
+	}
+
+	_, err = c.execute(ctx, netlink.Message{
+		Header: netlink.Header{
+			Type:  unix.RTM_SETLINK,
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: append(ifInfomsgBytes(index), b...),
+	})
+	return err
+}
+
+// ReceiveLinks blocks until the kernel reports changes to the state of
+// one or more interfaces.  If the kernel drops notifications, e.g.
+// because they're not being read quickly enough, ReceiveLinks returns
+// an error wrapping unix.ENOBUFS: the caller should then query the
+// state of any interfaces it's interested in using GetLink.
+//
+// Notifications which can't be parsed are skipped: ReceiveLinks then
+// returns the links it could parse together with an error wrapping
+// ErrBadMessage, and the caller should query the state of its
+// interfaces as for ENOBUFS.
+func (c *Conn) ReceiveLinks() ([]Link, error) {
+	msgs, err := c.events.Receive()
+	if err != nil {
+		return nil, err
+	}
+
+	var links []Link
+	var parseErr error
+	for _, m := range msgs {
+		if m.Header.Type != unix.RTM_NEWLINK && m.Header.Type != unix.RTM_DELLINK {
+			continue
+		}
+		link, err := parseLink(m)
+		if err != nil {
+			if parseErr == nil {
+				parseErr = fmt.Errorf("%w: %v", ErrBadMessage, err)
+			}
+			continue
+		}
+		links = append(links, *link)
+	}
+	return links, parseErr
+}
+
+func (c *Conn) execute(ctx context.Context, msg netlink.Message) ([]netlink.Message, error) {
+	// The response channel is buffered so that the connection
+	// goroutine isn't blocked if the caller gives up waiting.
+	req := &msgRequest{
+		ctx:     ctx,
+		msg:     msg,
+		rspChan: make(chan *msgResponse, 1),
+	}
+
+	select {
+	case c.reqChan <- req:
+	case <-c.closeChan:
+		return nil, errors.New("netlink connection closed")
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	select {
+	case rsp := <-req.rspChan:
+		return rsp.msg, rsp.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// ifInfomsgBytes encodes struct ifinfomsg for the specified interface
+// index.  The index is zero when looking an interface up by name.
+func ifInfomsgBytes(index int) []byte {
+	b := make([]byte, unix.SizeofIfInfomsg)
+	b[0] = unix.AF_UNSPEC
+	nlenc.PutInt32(b[4:8], int32(index))
+	return b
+}
+
+func parseLink(m netlink.Message) (*Link, error) {
+	if len(m.Data) < unix.SizeofIfInfomsg {
+		return nil, fmt.Errorf("link message too short: %d bytes", len(m.Data))
+	}
+
+	link := &Link{
+		Index:   int(nlenc.Int32(m.Data[4:8])),
+		Flags:   nlenc.Uint32(m.Data[8:12]),
+		Deleted: m.Header.Type == unix.RTM_DELLINK,
+	}
+
+	ad, err := netlink.NewAttributeDecoder(m.Data[unix.SizeofIfInfomsg:])
+	if err != nil {
+		return nil, err
+	}
+	for ad.Next() {
+		switch ad.Type() {
+		case unix.IFLA_IFNAME:
+			link.Name = ad.String()
+		case unix.IFLA_OPERSTATE:
+			link.OperState = ad.Uint8()
+		}
+	}
+	if err := ad.Err(); err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+func runConn(c *Conn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	for {
+		select {
+		case <-c.closeChan:
+			return
+		case req := <-c.reqChan:
+			m, err := c.executeRequest(req)
+			req.rspChan <- &msgResponse{
+				msg: m,
+				err: err,
+			}
+		}
+	}
+}
+
+// executeRequest executes a request with the socket deadline set from
+// the request's context.  Cancelling the context moves the deadline
+// into the past to unblock the request.
+func (c *Conn) executeRequest(req *msgRequest) ([]netlink.Message, error) {
+	// Don't act on a request the caller has given up on
+	if err := req.ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	deadline, _ := req.ctx.Deadline()
+	if err := c.c.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	doneChan := make(chan struct{})
+	stoppedChan := make(chan struct{})
+	go func() {
+		defer close(stoppedChan)
+		select {
+		case <-req.ctx.Done():
+			_ = c.c.SetDeadline(time.Unix(1, 0))
+		case <-doneChan:
+		}
+	}()
+
+	m, err := c.c.Execute(req.msg)
+	close(doneChan)
+	<-stoppedChan
+
+	// The socket deadline may expire a moment before the context's
+	if err != nil {
+		if cerr := req.ctx.Err(); cerr != nil {
+			return nil, cerr
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return nil, context.DeadlineExceeded
+		}
+	}
+	return m, err
+}
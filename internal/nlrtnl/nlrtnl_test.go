@@ -0,0 +1,118 @@
+package nlrtnl
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mdlayher/netlink"
+	"github.com/mdlayher/netlink/nlenc"
+	"golang.org/x/sys/unix"
+)
+
+// fakeNetlinkConn is a netlink connection to a kernel which never
+// responds to requests and ignores socket deadlines, so that Execute
+// blocks until the connection is closed.  Receive returns the queued
+// notifications.
+type fakeNetlinkConn struct {
+	executing chan struct{}
+	notify    chan []netlink.Message
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+func newFakeNetlinkConn() *fakeNetlinkConn {
+	return &fakeNetlinkConn{
+		executing: make(chan struct{}, 1),
+		notify:    make(chan []netlink.Message, 1),
+		closeChan: make(chan struct{}),
+	}
+}
+
+func (f *fakeNetlinkConn) Execute(m netlink.Message) ([]netlink.Message, error) {
+	select {
+	case f.executing <- struct{}{}:
+	default:
+	}
+	<-f.closeChan
+	return nil, errors.New("use of closed file")
+}
+
+func (f *fakeNetlinkConn) Receive() ([]netlink.Message, error) {
+	select {
+	case msgs := <-f.notify:
+		return msgs, nil
+	case <-f.closeChan:
+		return nil, errors.New("use of closed file")
+	}
+}
+
+func (f *fakeNetlinkConn) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (f *fakeNetlinkConn) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (f *fakeNetlinkConn) Close() error {
+	f.closeOnce.Do(func() { close(f.closeChan) })
+	return nil
+}
+
+func TestCloseWedged(t *testing.T) {
+	fake := newFakeNetlinkConn()
+	conn := newConn(fake, newFakeNetlinkConn())
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := conn.GetLink(context.Background(), "eth0")
+		errChan <- err
+	}()
+	<-fake.executing
+
+	closed := make(chan struct{})
+	go func() {
+		conn.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Close() blocked by wedged request")
+	}
+	if err := <-errChan; err == nil {
+		t.Errorf("expected wedged request to fail")
+	}
+}
+
+func TestReceiveLinksBadMessage(t *testing.T) {
+	events := newFakeNetlinkConn()
+	conn := newConn(newFakeNetlinkConn(), events)
+	defer conn.Close()
+
+	ae := netlink.NewAttributeEncoder()
+	ae.String(unix.IFLA_IFNAME, "eth0")
+	attrs, err := ae.Encode()
+	if err != nil {
+		t.Fatalf("Encode(): %v", err)
+	}
+	good := ifInfomsgBytes(3)
+	nlenc.PutUint32(good[8:12], unix.IFF_UP|unix.IFF_LOWER_UP)
+	good = append(good, attrs...)
+
+	// The short message is skipped, while the link after it is parsed
+	events.notify <- []netlink.Message{
+		{Header: netlink.Header{Type: unix.RTM_NEWLINK}, Data: []byte{0}},
+		{Header: netlink.Header{Type: unix.RTM_NEWLINK}, Data: good},
+	}
+	links, err := conn.ReceiveLinks()
+	if !errors.Is(err, ErrBadMessage) {
+		t.Errorf("expected bad message error, got %v", err)
+	}
+	if len(links) != 1 || links[0].Name != "eth0" || links[0].Index != 3 || !links[0].Running() {
+		t.Errorf("expected running link eth0, got %+v", links)
+	}
+}
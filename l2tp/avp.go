@@ -63,6 +63,29 @@ type resultCode struct {
 	errMsg  string
 }
 
+// q931CauseCode represents an RFC2661/RFC3931 Q.931 Cause Code AVP
+type q931CauseCode struct {
+	causeCode uint16
+	causeMsg  uint8
+	advisory  string
+}
+
+// callErrors represents an RFC2661 Call Errors AVP
+type callErrors struct {
+	crcErrors        uint32
+	framingErrors    uint32
+	hardwareOverruns uint32
+	bufferOverruns   uint32
+	timeoutErrors    uint32
+	alignmentErrors  uint32
+}
+
+// accm represents an RFC2661 ACCM AVP
+type accm struct {
+	sendACCM uint32
+	recvACCM uint32
+}
+
 const (
 	avpHeaderLen = 6
 	// vendorIDIetf is the namespace used for standard AVPS described
@@ -89,6 +112,14 @@ const (
 	avpDataTypeResultCode avpDataType = iota
 	// avpDataTypeMsgID represents an AVP carrying the message type identifier
 	avpDataTypeMsgID avpDataType = iota
+	// avpDataTypeUint16Array represents an AVP carrying an array of uint16 values
+	avpDataTypeUint16Array avpDataType = iota
+	// avpDataTypeQ931CauseCode represents an AVP carrying a Q.931 cause code
+	avpDataTypeQ931CauseCode avpDataType = iota
+	// avpDataTypeCallErrors represents an AVP carrying RFC2661 call error counters
+	avpDataTypeCallErrors avpDataType = iota
+	// avpDataTypeACCM represents an AVP carrying RFC2661 ACCM values
+	avpDataTypeACCM avpDataType = iota
 	// avpDataTypeUnimplemented represents an AVP carrying a currently unimplemented data type
 	avpDataTypeUnimplemented avpDataType = iota
 	// avpDataTypeIllegal represents an AVP carrying an illegal data type.
@@ -105,14 +136,14 @@ var avpInfoTable = [...]avpInfo{
 	{avpType: avpTypeProtocolVersion, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
 	{avpType: avpTypeFramingCap, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeUint32},
 	{avpType: avpTypeBearerCap, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeUint32},
-	{avpType: avpTypeTiebreaker, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUnimplemented}, // TODO
+	{avpType: avpTypeTiebreaker, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint64},
 	{avpType: avpTypeFirmwareRevision, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint16},
 	{avpType: avpTypeHostName, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeString},
 	{avpType: avpTypeVendorName, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeString},
 	{avpType: avpTypeTunnelID, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeUint16},
 	{avpType: avpTypeRxWindowSize, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeUint16},
 	{avpType: avpTypeChallenge, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeBytes},
-	{avpType: avpTypeQ931CauseCode, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeUnimplemented}, // TODO
+	{avpType: avpTypeQ931CauseCode, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeQ931CauseCode},
 	{avpType: avpTypeChallengeResponse, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeBytes},
 	{avpType: avpTypeSessionID, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeUint16},
 	{avpType: avpTypeCallSerialNumber, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeUint32},
@@ -134,8 +165,8 @@ var avpInfoTable = [...]avpInfo{
 	{avpType: avpTypeProxyAuthChallenge, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
 	{avpType: avpTypeProxyAuthID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
 	{avpType: avpTypeProxyAuthResponse, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
-	{avpType: avpTypeCallErrors, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeUnimplemented}, // TODO
-	{avpType: avpTypeAccm, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeUnimplemented},       // TODO
+	{avpType: avpTypeCallErrors, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeCallErrors},
+	{avpType: avpTypeAccm, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeACCM},
 	{avpType: avpTypeRandomVector, VendorID: vendorIDIetf, isMandatory: true, dataType: avpDataTypeBytes},
 	{avpType: avpTypePrivGroupID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeString},
 	{avpType: avpTypeRxConnectSpeed, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
@@ -162,7 +193,7 @@ var avpInfoTable = [...]avpInfo{
 	{avpType: avpTypeMessageDigest, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
 	{avpType: avpTypeRouterID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
 	{avpType: avpTypeAssignedConnID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
-	{avpType: avpTypePseudowireCaps, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUnimplemented},
+	{avpType: avpTypePseudowireCaps, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint16Array},
 	{avpType: avpTypeLocalSessionID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
 	{avpType: avpTypeRemoteSessionID, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeUint32},
 	{avpType: avpTypeAssignedCookie, VendorID: vendorIDIetf, isMandatory: false, dataType: avpDataTypeBytes},
@@ -609,6 +640,14 @@ func (t avpDataType) String() string {
 		return "result code"
 	case avpDataTypeMsgID:
 		return "message ID"
+	case avpDataTypeUint16Array:
+		return "uint16 array"
+	case avpDataTypeQ931CauseCode:
+		return "Q.931 cause code"
+	case avpDataTypeCallErrors:
+		return "call errors"
+	case avpDataTypeACCM:
+		return "ACCM"
 	case avpDataTypeUnimplemented:
 		return "unimplemented AVP data type"
 	case avpDataTypeIllegal:
@@ -640,9 +679,13 @@ func (hdr avpHeader) String() string {
 var _ fmt.Stringer = (*avpPayload)(nil)
 
 func (p avpPayload) String() string {
-	var str strings.Builder
+	return fmt.Sprintf("(%s) %s", p.dataType, p.valueString())
+}
 
-	str.WriteString(fmt.Sprintf("(%s) ", p.dataType))
+// valueString represents the value carried by the payload as a
+// human-readable string.
+func (p avpPayload) valueString() string {
+	var str strings.Builder
 
 	switch p.dataType {
 	case avpDataTypeUint8:
@@ -661,7 +704,29 @@ func (p avpPayload) String() string {
 		s, _ := p.toString()
 		str.WriteString(s)
 	case avpDataTypeBytes:
-		str.WriteString(fmt.Sprintf("%s", p.data))
+		str.WriteString(fmt.Sprintf("%x", p.data))
+	case avpDataTypeResultCode:
+		v, _ := p.toResultCode()
+		str.WriteString(fmt.Sprintf("result %d error %d", v.result, v.errCode))
+		if v.errMsg != "" {
+			str.WriteString(fmt.Sprintf(" %s", v.errMsg))
+		}
+	case avpDataTypeMsgID:
+		v, _ := p.toUint16()
+		str.WriteString(avpMsgType(v).String())
+	case avpDataTypeUint16Array:
+		v, _ := p.toUint16Array()
+		str.WriteString(fmt.Sprintf("%v", v))
+	case avpDataTypeQ931CauseCode:
+		v, _ := p.toQ931CauseCode()
+		str.WriteString(fmt.Sprintf("cause %d msg %d %s", v.causeCode, v.causeMsg, v.advisory))
+	case avpDataTypeCallErrors:
+		v, _ := p.toCallErrors()
+		str.WriteString(fmt.Sprintf("crc %d framing %d hw overrun %d buf overrun %d timeout %d alignment %d",
+			v.crcErrors, v.framingErrors, v.hardwareOverruns, v.bufferOverruns, v.timeoutErrors, v.alignmentErrors))
+	case avpDataTypeACCM:
+		v, _ := p.toACCM()
+		str.WriteString(fmt.Sprintf("send %#08x recv %#08x", v.sendACCM, v.recvACCM))
 	case avpDataTypeEmpty, avpDataTypeUnimplemented, avpDataTypeIllegal:
 		str.WriteString("")
 	}
@@ -712,6 +777,15 @@ func (avp *avp) isMandatory() bool {
 	return avp.header.isMandatory()
 }
 
+// setMandatory sets or clears the AVP's mandatory bit.
+func (avp *avp) setMandatory(mandatory bool) {
+	if mandatory {
+		avp.header.FlagLen |= 0x8000
+	} else {
+		avp.header.FlagLen &^= 0x8000
+	}
+}
+
 // isHidden returns true if a given AVP has been obscured using the hiding
 // algorithm described by RFC2661 Section 4.3.
 func (avp *avp) isHidden() bool {
@@ -737,70 +811,106 @@ func (avp *avp) totalLen() int {
 }
 
 func getAVPInfo(avpType avpType, VendorID avpVendorID) (*avpInfo, error) {
-	for _, info := range avpInfoTable {
-		if info.avpType == avpType && info.VendorID == VendorID {
-			return &info, nil
+	if VendorID != vendorIDIetf {
+		return getVendorAVPInfo(avpType, VendorID)
+	}
+	// Return the table entry itself rather than the address of a copy,
+	// which would be allocated for every AVP parsed.
+	for i := range avpInfoTable {
+		if avpInfoTable[i].avpType == avpType && avpInfoTable[i].VendorID == VendorID {
+			return &avpInfoTable[i], nil
 		}
 	}
 	return nil, errors.New("unrecognised AVP type")
 }
 
+// unknownMandatoryAVPError is returned when validating a control message
+// carrying an unrecognised AVP with the mandatory bit set.
+type unknownMandatoryAVPError struct {
+	vendorID avpVendorID
+	avpType  avpType
+}
+
+func (e *unknownMandatoryAVPError) Error() string {
+	return fmt.Sprintf("unrecognised AVP type %v (%v) with mandatory bit set",
+		uint16(e.avpType), e.vendorID)
+}
+
 // parseAVPBuffer takes a byte slice of encoded AVP data and parses it
-// into an array of AVP instances.
+// into an array of AVP instances.  The AVP payloads refer to b rather
+// than holding copies of the data.
 func parseAVPBuffer(b []byte) (avps []avp, err error) {
-	r := bytes.NewReader(b)
-	for r.Len() >= avpHeaderLen {
-		var h avpHeader
-		var info *avpInfo
-		var cursor int64
-
-		// Read the AVP header in
-		if err := binary.Read(r, binary.BigEndian, &h); err != nil {
-			return nil, err
-		}
+	return appendAVPs(nil, b)
+}
 
-		// Look up the AVP
-		info, err := getAVPInfo(h.AvpType, h.VendorID)
-		if err != nil {
-			if h.isMandatory() {
-				return nil, err
-			}
-			// RFC2661 section 4.1 says unrecognised AVPs without the
-			// mandatory bit set MUST be ignored
-			continue
+// appendAVPs is like parseAVPBuffer, but appends the AVPs to avps,
+// growing it if need be.
+func appendAVPs(avps []avp, b []byte) ([]avp, error) {
+	// Bounds check the AVPs and count them, so that the AVP array
+	// is grown just once.
+	n := 0
+	for cursor := 0; len(b)-cursor >= avpHeaderLen; n++ {
+		h := decodeAvpHeader(b[cursor:])
+
+		if h.dataLen() < 0 {
+			return nil, errors.New("malformed AVP buffer: current AVP length is shorter than the AVP header")
 		}
-
-		// Bounds check the AVP
-		if h.dataLen() > r.Len() {
+		if h.dataLen() > len(b)-cursor-avpHeaderLen {
 			return nil, errors.New("malformed AVP buffer: current AVP length exceeds buffer length")
 		}
+		cursor += h.totalLen()
+	}
 
-		if cursor, err = r.Seek(0, io.SeekCurrent); err != nil {
-			return nil, errors.New("malformed AVP buffer: unable to determine offset of current AVP")
+	// We must have parsed at least one AVP
+	if n == 0 {
+		return nil, errors.New("no AVPs present in the input buffer")
+	}
+
+	if cap(avps)-len(avps) < n {
+		grown := make([]avp, len(avps), 2*cap(avps)+n)
+		copy(grown, avps)
+		avps = grown
+	}
+	for cursor, i := 0, 0; i < n; i++ {
+		h := decodeAvpHeader(b[cursor:])
+		cursor += avpHeaderLen
+
+		// Look up the AVP.
+		// Unrecognised AVPs are retained as raw bytes for inspection.
+		// RFC2661 section 4.1 says those without the mandatory bit set
+		// MUST be ignored, while those with it set require the tunnel or
+		// session to be torn down: that's up to the caller, since it
+		// depends on the message the AVP is carried by.
+		dataType := avpDataTypeBytes
+		if info, err := getAVPInfo(h.AvpType, h.VendorID); err == nil {
+			dataType = info.dataType
 		}
 
 		avps = append(avps, avp{
 			header: h,
 			payload: avpPayload{
-				dataType: info.dataType,
-				data:     b[cursor : cursor+int64(h.dataLen())],
+				dataType: dataType,
+				data:     b[cursor : cursor+h.dataLen() : cursor+h.dataLen()],
 			},
 		})
 
 		// Step on to the next AVP in the buffer
-		if _, err := r.Seek(int64(h.dataLen()), io.SeekCurrent); err != nil {
-			return nil, errors.New("malformed AVP buffer: invalid length for current AVP")
-		}
-	}
-
-	// We must have parsed at least one AVP
-	if len(avps) == 0 {
-		return nil, errors.New("no AVPs present in the input buffer")
+		cursor += h.dataLen()
 	}
 
 	return avps, nil
 }
 
+// decodeAvpHeader decodes an AVP header from the start of b, which
+// must hold at least avpHeaderLen bytes.
+func decodeAvpHeader(b []byte) avpHeader {
+	return avpHeader{
+		FlagLen:  avpFlagLen(binary.BigEndian.Uint16(b[0:])),
+		VendorID: avpVendorID(binary.BigEndian.Uint16(b[2:])),
+		AvpType:  avpType(binary.BigEndian.Uint16(b[4:])),
+	}
+}
+
 // newAvp builds an AVP containing the specified data
 func newAvp(vendorID avpVendorID, avpType avpType, value interface{}) (a *avp, err error) {
 	var info *avpInfo
@@ -813,6 +923,7 @@ func newAvp(vendorID avpVendorID, avpType avpType, value interface{}) (a *avp, e
 	var ok bool
 	switch info.dataType {
 	case avpDataTypeEmpty:
+		ok = value == nil
 	case avpDataTypeUint8:
 		_, ok = value.(uint8)
 	case avpDataTypeUint16:
@@ -829,6 +940,14 @@ func newAvp(vendorID avpVendorID, avpType avpType, value interface{}) (a *avp, e
 		_, ok = value.(avpMsgType)
 	case avpDataTypeResultCode:
 		_, ok = value.(resultCode)
+	case avpDataTypeUint16Array:
+		_, ok = value.([]uint16)
+	case avpDataTypeQ931CauseCode:
+		_, ok = value.(q931CauseCode)
+	case avpDataTypeCallErrors:
+		_, ok = value.(callErrors)
+	case avpDataTypeACCM:
+		_, ok = value.(accm)
 	case avpDataTypeUnimplemented, avpDataTypeIllegal:
 		return nil, fmt.Errorf("AVP %v is not currently supported", avpType)
 	}
@@ -838,7 +957,7 @@ func newAvp(vendorID avpVendorID, avpType avpType, value interface{}) (a *avp, e
 			value, avpType, info.dataType)
 	}
 
-	if err = binary.Write(encBuf, binary.BigEndian, value); err != nil {
+	if err = encodeAvpValue(encBuf, value); err != nil {
 		return nil, err
 	}
 
@@ -851,6 +970,58 @@ func newAvp(vendorID avpVendorID, avpType avpType, value interface{}) (a *avp, e
 	}, nil
 }
 
+// encodeAvpValue writes the wire representation of an AVP value to buf.
+func encodeAvpValue(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		buf.WriteString(v)
+		return nil
+	case []byte:
+		buf.Write(v)
+		return nil
+	case resultCode:
+		// The error code and message are optional, but the message
+		// may only be present if the error code is
+		err := binary.Write(buf, binary.BigEndian, uint16(v.result))
+		if err == nil && (v.errCode != avpErrorCodeNoError || v.errMsg != "") {
+			err = binary.Write(buf, binary.BigEndian, uint16(v.errCode))
+			buf.WriteString(v.errMsg)
+		}
+		return err
+	case q931CauseCode:
+		err := binary.Write(buf, binary.BigEndian, struct {
+			CauseCode uint16
+			CauseMsg  uint8
+		}{v.causeCode, v.causeMsg})
+		buf.WriteString(v.advisory)
+		return err
+	case callErrors:
+		// Two reserved octets precede the counters
+		return binary.Write(buf, binary.BigEndian, struct {
+			Reserved uint16
+			Counters [6]uint32
+		}{
+			Counters: [6]uint32{
+				v.crcErrors, v.framingErrors, v.hardwareOverruns,
+				v.bufferOverruns, v.timeoutErrors, v.alignmentErrors,
+			},
+		})
+	case accm:
+		// Two reserved octets precede the ACCM values
+		return binary.Write(buf, binary.BigEndian, struct {
+			Reserved uint16
+			Send     uint32
+			Recv     uint32
+		}{
+			Send: v.sendACCM,
+			Recv: v.recvACCM,
+		})
+	}
+	return binary.Write(buf, binary.BigEndian, value)
+}
+
 // rawData returns the data type for the AVP, along with the raw byte
 // slice for the data carried by the AVP.
 func (avp *avp) rawData() (dataType avpDataType, buffer []byte) {
@@ -863,31 +1034,42 @@ func (avp *avp) isDataType(dt avpDataType) bool {
 }
 
 func (p *avpPayload) toUint8() (out uint8, err error) {
+	if len(p.data) < 1 {
+		return 0, io.ErrUnexpectedEOF
+	}
 	return p.data[0], nil
 }
 
+// checkLen checks the payload holds at least n bytes, returning the
+// errors binary.Read would for a short payload.
+func (p *avpPayload) checkLen(n int) error {
+	if len(p.data) == 0 {
+		return io.EOF
+	} else if len(p.data) < n {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
+
 func (p *avpPayload) toUint16() (out uint16, err error) {
-	r := bytes.NewReader(p.data)
-	if err = binary.Read(r, binary.BigEndian, &out); err != nil {
+	if err = p.checkLen(2); err != nil {
 		return 0, err
 	}
-	return out, err
+	return binary.BigEndian.Uint16(p.data), nil
 }
 
 func (p *avpPayload) toUint32() (out uint32, err error) {
-	r := bytes.NewReader(p.data)
-	if err = binary.Read(r, binary.BigEndian, &out); err != nil {
+	if err = p.checkLen(4); err != nil {
 		return 0, err
 	}
-	return out, err
+	return binary.BigEndian.Uint32(p.data), nil
 }
 
 func (p *avpPayload) toUint64() (out uint64, err error) {
-	r := bytes.NewReader(p.data)
-	if err = binary.Read(r, binary.BigEndian, &out); err != nil {
+	if err = p.checkLen(8); err != nil {
 		return 0, err
 	}
-	return out, err
+	return binary.BigEndian.Uint64(p.data), nil
 }
 
 func (p *avpPayload) toString() (out string, err error) {
@@ -918,6 +1100,61 @@ func (p *avpPayload) toResultCode() (out resultCode, err error) {
 	}, nil
 }
 
+func (p *avpPayload) toUint16Array() (out []uint16, err error) {
+	if len(p.data)%2 != 0 {
+		return nil, errors.New("uint16 array has odd length")
+	}
+	for i := 0; i < len(p.data); i += 2 {
+		out = append(out, binary.BigEndian.Uint16(p.data[i:]))
+	}
+	return out, nil
+}
+
+func (p *avpPayload) toQ931CauseCode() (out q931CauseCode, err error) {
+	if len(p.data) < 3 {
+		return q931CauseCode{}, errors.New("Q.931 cause code too short")
+	}
+	return q931CauseCode{
+		causeCode: binary.BigEndian.Uint16(p.data[0:]),
+		causeMsg:  p.data[2],
+		advisory:  string(p.data[3:]),
+	}, nil
+}
+
+func (p *avpPayload) toCallErrors() (out callErrors, err error) {
+	if len(p.data) != 26 {
+		return callErrors{}, fmt.Errorf("call errors has length %d, expect 26", len(p.data))
+	}
+	return callErrors{
+		crcErrors:        binary.BigEndian.Uint32(p.data[2:]),
+		framingErrors:    binary.BigEndian.Uint32(p.data[6:]),
+		hardwareOverruns: binary.BigEndian.Uint32(p.data[10:]),
+		bufferOverruns:   binary.BigEndian.Uint32(p.data[14:]),
+		timeoutErrors:    binary.BigEndian.Uint32(p.data[18:]),
+		alignmentErrors:  binary.BigEndian.Uint32(p.data[22:]),
+	}, nil
+}
+
+func (p *avpPayload) toACCM() (out accm, err error) {
+	if len(p.data) != 10 {
+		return accm{}, fmt.Errorf("ACCM has length %d, expect 10", len(p.data))
+	}
+	return accm{
+		sendACCM: binary.BigEndian.Uint32(p.data[2:]),
+		recvACCM: binary.BigEndian.Uint32(p.data[6:]),
+	}, nil
+}
+
+// decodeUint8Data decodes an AVP holding a uint8 value.
+// It is an error to call this function on an AVP which doesn't
+// contain a uint8 payload.
+func (avp *avp) decodeUint8Data() (value uint8, err error) {
+	if !avp.isDataType(avpDataTypeUint8) {
+		return 0, errors.New("AVP data is not of type uint8, cannot decode")
+	}
+	return avp.payload.toUint8()
+}
+
 // decodeUint16Data decodes an AVP holding a uint16 value.
 // It is an error to call this function on an AVP which doesn't
 // contain a uint16 payload.
@@ -979,6 +1216,46 @@ func (avp *avp) decodeMsgType() (value avpMsgType, err error) {
 	return avpMsgType(out), err
 }
 
+// decodeUint16ArrayData decodes an AVP holding an array of uint16 values.
+// It is an error to call this function on an AVP which doesn't
+// contain a uint16 array payload.
+func (avp *avp) decodeUint16ArrayData() (value []uint16, err error) {
+	if !avp.isDataType(avpDataTypeUint16Array) {
+		return nil, errors.New("AVP data is not of type uint16 array, cannot decode")
+	}
+	return avp.payload.toUint16Array()
+}
+
+// decodeQ931CauseCode decodes an AVP holding a Q.931 Cause Code.
+// It is an error to call this function on an AVP which doesn't contain
+// a Q.931 cause code payload.
+func (avp *avp) decodeQ931CauseCode() (value q931CauseCode, err error) {
+	if !avp.isDataType(avpDataTypeQ931CauseCode) {
+		return q931CauseCode{}, errors.New("AVP is not of type Q.931 cause code, cannot decode")
+	}
+	return avp.payload.toQ931CauseCode()
+}
+
+// decodeCallErrors decodes an AVP holding RFC2661 Call Errors.
+// It is an error to call this function on an AVP which doesn't contain
+// a call errors payload.
+func (avp *avp) decodeCallErrors() (value callErrors, err error) {
+	if !avp.isDataType(avpDataTypeCallErrors) {
+		return callErrors{}, errors.New("AVP is not of type call errors, cannot decode")
+	}
+	return avp.payload.toCallErrors()
+}
+
+// decodeACCM decodes an AVP holding RFC2661 ACCM values.
+// It is an error to call this function on an AVP which doesn't contain
+// an ACCM payload.
+func (avp *avp) decodeACCM() (value accm, err error) {
+	if !avp.isDataType(avpDataTypeACCM) {
+		return accm{}, errors.New("AVP is not of type ACCM, cannot decode")
+	}
+	return avp.payload.toACCM()
+}
+
 // avpsLengthBytes returns the length of a slice of AVPs in bytes
 func avpsLengthBytes(avps []avp) int {
 	var nb int
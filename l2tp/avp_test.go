@@ -1,6 +1,7 @@
 package l2tp
 
 import (
+	"bytes"
 	"fmt"
 	"reflect"
 	"testing"
@@ -102,9 +103,6 @@ func TestParseAVPBufferBad(t *testing.T) {
 		{
 			in: []byte{0x1, 0x2, 0x3, 0x4}, // short avp data
 		},
-		{
-			in: []byte{0x80, 0x08, 0x01, 0xef, 0x00, 0x00, 0x00, 0x06}, // mandatory vendor AVP
-		},
 	}
 	for _, c := range cases {
 		avps, err := parseAVPBuffer(c.in)
@@ -450,3 +448,100 @@ func TestAvpDataTypeStringer(t *testing.T) {
 		}
 	}
 }
+
+func TestAVPEncodeDecode(t *testing.T) {
+	cases := []struct {
+		avpType avpType
+		value   interface{}
+		want    []byte
+	}{
+		{
+			avpType: avpTypeTiebreaker,
+			value:   uint64(0x0102030405060708),
+			want:    []byte{0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08},
+		},
+		{
+			avpType: avpTypeResultCode,
+			value:   resultCode{result: avpStopCCNResultCodeClearConnection},
+			want:    []byte{0x00, 0x01},
+		},
+		{
+			avpType: avpTypeResultCode,
+			value: resultCode{
+				result:  avpStopCCNResultCodeGeneralError,
+				errCode: avpErrorCodeBadValue,
+				errMsg:  "bad",
+			},
+			want: []byte{0x00, 0x02, 0x00, 0x03, 0x62, 0x61, 0x64},
+		},
+		{
+			avpType: avpTypeQ931CauseCode,
+			value:   q931CauseCode{causeCode: 16, causeMsg: 0x45, advisory: "ok"},
+			want:    []byte{0x00, 0x10, 0x45, 0x6f, 0x6b},
+		},
+		{
+			avpType: avpTypeCallErrors,
+			value: callErrors{
+				crcErrors:        1,
+				framingErrors:    2,
+				hardwareOverruns: 3,
+				bufferOverruns:   4,
+				timeoutErrors:    5,
+				alignmentErrors:  6,
+			},
+			want: []byte{
+				0x00, 0x00,
+				0x00, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x02,
+				0x00, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x04,
+				0x00, 0x00, 0x00, 0x05, 0x00, 0x00, 0x00, 0x06,
+			},
+		},
+		{
+			avpType: avpTypeAccm,
+			value:   accm{sendACCM: 0xffffffff, recvACCM: 0x000a0000},
+			want: []byte{
+				0x00, 0x00,
+				0xff, 0xff, 0xff, 0xff, 0x00, 0x0a, 0x00, 0x00,
+			},
+		},
+		{
+			avpType: avpTypePseudowireCaps,
+			value:   []uint16{0x0005, 0x0007},
+			want:    []byte{0x00, 0x05, 0x00, 0x07},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.avpType.String(), func(t *testing.T) {
+			a, err := newAvp(vendorIDIetf, c.avpType, c.value)
+			if err != nil {
+				t.Fatalf("newAvp(%v, %v): %v", c.avpType, c.value, err)
+			}
+			_, got := a.rawData()
+			if !bytes.Equal(got, c.want) {
+				t.Fatalf("newAvp(%v, %v): encoded %v, want %v", c.avpType, c.value, got, c.want)
+			}
+
+			var val interface{}
+			switch c.value.(type) {
+			case uint64:
+				val, err = a.decodeUint64Data()
+			case resultCode:
+				val, err = a.decodeResultCode()
+			case q931CauseCode:
+				val, err = a.decodeQ931CauseCode()
+			case callErrors:
+				val, err = a.decodeCallErrors()
+			case accm:
+				val, err = a.decodeACCM()
+			case []uint16:
+				val, err = a.decodeUint16ArrayData()
+			}
+			if err != nil {
+				t.Fatalf("decode %v: %v", a, err)
+			}
+			if !reflect.DeepEqual(val, c.value) {
+				t.Fatalf("decode %v: got %v, want %v", a, val, c.value)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package l2tp
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// AVPDataType indicates the type of the data value carried by an AVP.
+type AVPDataType int
+
+// AVP data types which may be used for vendor-specific AVPs.
+const (
+	// AVPDataTypeEmpty represents an AVP with no value
+	AVPDataTypeEmpty AVPDataType = iota
+	// AVPDataTypeUint8 represents an AVP carrying a single uint8 value
+	AVPDataTypeUint8
+	// AVPDataTypeUint16 represents an AVP carrying a single uint16 value
+	AVPDataTypeUint16
+	// AVPDataTypeUint32 represents an AVP carrying a single uint32 value
+	AVPDataTypeUint32
+	// AVPDataTypeUint64 represents an AVP carrying a single uint64 value
+	AVPDataTypeUint64
+	// AVPDataTypeString represents an AVP carrying an ASCII string
+	AVPDataTypeString
+	// AVPDataTypeBytes represents an AVP carrying a raw byte array
+	AVPDataTypeBytes
+)
+
+// VendorAVPInfo describes a vendor-specific AVP.
+type VendorAVPInfo struct {
+	// VendorID is the vendor's SMI Network Management Private Enterprise Code.
+	VendorID uint16
+	// Type is the attribute type within the vendor's namespace.
+	Type uint16
+	// Mandatory indicates whether the AVP should be sent with the
+	// mandatory bit set.
+	Mandatory bool
+	// DataType is the type of the data value carried by the AVP.
+	DataType AVPDataType
+}
+
+// AVP represents an attribute-value pair carried by an L2TP control message.
+type AVP struct {
+	avp avp
+}
+
+type vendorAVPKey struct {
+	vendorID avpVendorID
+	avpType  avpType
+}
+
+var vendorAVPRegistry = struct {
+	sync.RWMutex
+	avps map[vendorAVPKey]avpInfo
+}{
+	avps: make(map[vendorAVPKey]avpInfo),
+}
+
+var _ fmt.Stringer = (*AVPDataType)(nil)
+
+// String represents the AVP data type as a human-readable string.
+func (t AVPDataType) String() string {
+	if dt, err := t.toInternal(); err == nil {
+		return dt.String()
+	}
+	return "Unrecognised AVP data type"
+}
+
+func (t AVPDataType) toInternal() (avpDataType, error) {
+	switch t {
+	case AVPDataTypeEmpty:
+		return avpDataTypeEmpty, nil
+	case AVPDataTypeUint8:
+		return avpDataTypeUint8, nil
+	case AVPDataTypeUint16:
+		return avpDataTypeUint16, nil
+	case AVPDataTypeUint32:
+		return avpDataTypeUint32, nil
+	case AVPDataTypeUint64:
+		return avpDataTypeUint64, nil
+	case AVPDataTypeString:
+		return avpDataTypeString, nil
+	case AVPDataTypeBytes:
+		return avpDataTypeBytes, nil
+	}
+	return avpDataTypeIllegal, fmt.Errorf("unsupported AVP data type %d", t)
+}
+
+// RegisterVendorAVP registers a vendor-specific AVP.
+//
+// Once registered, vendor AVPs are decoded on receipt as per their
+// data type, and may be built using NewVendorAVP.  Unregistered
+// vendor AVPs without the mandatory bit set are retained as raw bytes,
+// while receipt of an unregistered vendor AVP with the mandatory bit
+// set causes the session or tunnel the message is for to be torn down
+// as per RFC2661 section 4.1.
+//
+// The IETF vendor ID 0 is reserved for the standard AVPs and may not
+// be registered.
+func RegisterVendorAVP(info VendorAVPInfo) error {
+	if info.VendorID == vendorIDIetf {
+		return errors.New("vendor ID 0 is reserved for IETF AVPs")
+	}
+
+	dt, err := info.DataType.toInternal()
+	if err != nil {
+		return err
+	}
+
+	key := vendorAVPKey{vendorID: avpVendorID(info.VendorID), avpType: avpType(info.Type)}
+
+	vendorAVPRegistry.Lock()
+	defer vendorAVPRegistry.Unlock()
+
+	if _, ok := vendorAVPRegistry.avps[key]; ok {
+		return fmt.Errorf("AVP %d for vendor %d is already registered", info.Type, info.VendorID)
+	}
+
+	vendorAVPRegistry.avps[key] = avpInfo{
+		avpType:     key.avpType,
+		VendorID:    key.vendorID,
+		isMandatory: info.Mandatory,
+		dataType:    dt,
+	}
+
+	return nil
+}
+
+func getVendorAVPInfo(avpType avpType, vendorID avpVendorID) (*avpInfo, error) {
+	vendorAVPRegistry.RLock()
+	defer vendorAVPRegistry.RUnlock()
+
+	if info, ok := vendorAVPRegistry.avps[vendorAVPKey{vendorID: vendorID, avpType: avpType}]; ok {
+		return &info, nil
+	}
+	return nil, errors.New("unrecognised vendor AVP type")
+}
+
+// NewVendorAVP builds a vendor-specific AVP carrying the specified value.
+//
+// The AVP must have been registered using RegisterVendorAVP, and the
+// Go type of the value must match the registered data type: uint8,
+// uint16, uint32 and uint64 for the integer types, string for
+// AVPDataTypeString, []byte for AVPDataTypeBytes, and nil for
+// AVPDataTypeEmpty.
+func NewVendorAVP(vendorID, typ uint16, value interface{}) (*AVP, error) {
+	if vendorID == vendorIDIetf {
+		return nil, errors.New("vendor ID 0 is reserved for IETF AVPs")
+	}
+	a, err := newAvp(avpVendorID(vendorID), avpType(typ), value)
+	if err != nil {
+		return nil, err
+	}
+	return &AVP{avp: *a}, nil
+}
+
+var _ fmt.Stringer = (*AVP)(nil)
+
+// String represents the AVP as a human-readable string.
+func (a *AVP) String() string {
+	return a.avp.String()
+}
+
+// VendorID returns the vendor ID of the AVP.
+// Standard AVPs per RFC2661 and RFC3931 use the IETF vendor ID 0.
+func (a *AVP) VendorID() uint16 {
+	return uint16(a.avp.vendorID())
+}
+
+// Type returns the attribute type of the AVP.
+func (a *AVP) Type() uint16 {
+	return uint16(a.avp.getType())
+}
+
+// IsMandatory returns true if the AVP has the mandatory bit set.
+func (a *AVP) IsMandatory() bool {
+	return a.avp.isMandatory()
+}
+
+// IsHidden returns true if the AVP has the hidden bit set.
+func (a *AVP) IsHidden() bool {
+	return a.avp.isHidden()
+}
+
+// TypeName returns the name of the attribute type of the AVP.
+func (a *AVP) TypeName() string {
+	if a.avp.vendorID() == vendorIDIetf {
+		return a.avp.getType().String()
+	}
+	return fmt.Sprintf("Vendor %d AVP %d", a.avp.vendorID(), uint16(a.avp.getType()))
+}
+
+// Value represents the value carried by the AVP as a human-readable
+// string.  The values of hidden AVPs are obscured, and so are rendered
+// as raw bytes.
+func (a *AVP) Value() string {
+	if a.avp.isHidden() {
+		return fmt.Sprintf("%x", a.Bytes())
+	}
+	return a.avp.payload.valueString()
+}
+
+// IsRecognised returns true if the AVP is either a standard AVP, or a
+// vendor-specific AVP which has been registered using RegisterVendorAVP.
+// The value of unrecognised AVPs may only be accessed using Bytes.
+func (a *AVP) IsRecognised() bool {
+	_, err := getAVPInfo(a.avp.getType(), a.avp.vendorID())
+	return err == nil
+}
+
+// Bytes returns the raw value carried by the AVP.
+func (a *AVP) Bytes() []byte {
+	_, b := a.avp.rawData()
+	return b
+}
+
+// DecodeUint8 decodes an AVP holding a uint8 value.
+func (a *AVP) DecodeUint8() (uint8, error) {
+	return a.avp.decodeUint8Data()
+}
+
+// DecodeUint16 decodes an AVP holding a uint16 value.
+func (a *AVP) DecodeUint16() (uint16, error) {
+	return a.avp.decodeUint16Data()
+}
+
+// DecodeUint32 decodes an AVP holding a uint32 value.
+func (a *AVP) DecodeUint32() (uint32, error) {
+	return a.avp.decodeUint32Data()
+}
+
+// DecodeUint64 decodes an AVP holding a uint64 value.
+func (a *AVP) DecodeUint64() (uint64, error) {
+	return a.avp.decodeUint64Data()
+}
+
+// DecodeString decodes an AVP holding a string value.
+func (a *AVP) DecodeString() (string, error) {
+	return a.avp.decodeStringData()
+}
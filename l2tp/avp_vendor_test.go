@@ -0,0 +1,136 @@
+package l2tp
+
+import (
+	"bytes"
+	"testing"
+)
+
+func resetVendorAVPRegistry() {
+	vendorAVPRegistry.Lock()
+	defer vendorAVPRegistry.Unlock()
+	vendorAVPRegistry.avps = make(map[vendorAVPKey]avpInfo)
+}
+
+func TestRegisterVendorAVP(t *testing.T) {
+	defer resetVendorAVPRegistry()
+	cases := []struct {
+		name       string
+		info       VendorAVPInfo
+		expectFail bool
+	}{
+		{
+			name: "register uint32 AVP",
+			info: VendorAVPInfo{VendorID: 9, Type: 1, Mandatory: true, DataType: AVPDataTypeUint32},
+		},
+		{
+			name: "register string AVP",
+			info: VendorAVPInfo{VendorID: 9, Type: 2, DataType: AVPDataTypeString},
+		},
+		{
+			name:       "reject duplicate registration",
+			info:       VendorAVPInfo{VendorID: 9, Type: 1, DataType: AVPDataTypeUint16},
+			expectFail: true,
+		},
+		{
+			name:       "reject IETF vendor ID",
+			info:       VendorAVPInfo{VendorID: vendorIDIetf, Type: 100, DataType: AVPDataTypeUint16},
+			expectFail: true,
+		},
+		{
+			name:       "reject bad data type",
+			info:       VendorAVPInfo{VendorID: 9, Type: 3, DataType: AVPDataType(42)},
+			expectFail: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := RegisterVendorAVP(c.info)
+			if c.expectFail && err == nil {
+				t.Fatalf("RegisterVendorAVP(%v) succeeded when we expected an error", c.info)
+			} else if !c.expectFail && err != nil {
+				t.Fatalf("RegisterVendorAVP(%v): %v", c.info, err)
+			}
+		})
+	}
+}
+
+func TestVendorAVPEncodeDecode(t *testing.T) {
+	defer resetVendorAVPRegistry()
+	err := RegisterVendorAVP(VendorAVPInfo{VendorID: 4491, Type: 7, Mandatory: true, DataType: AVPDataTypeUint16})
+	if err != nil {
+		t.Fatalf("RegisterVendorAVP(): %v", err)
+	}
+
+	a, err := NewVendorAVP(4491, 7, uint16(1701))
+	if err != nil {
+		t.Fatalf("NewVendorAVP(): %v", err)
+	}
+	if !a.IsMandatory() {
+		t.Errorf("expected AVP to be mandatory")
+	}
+
+	_, err = NewVendorAVP(4491, 7, "wrong type")
+	if err == nil {
+		t.Errorf("NewVendorAVP() accepted the wrong data type")
+	}
+	_, err = NewVendorAVP(4491, 8, uint16(1701))
+	if err == nil {
+		t.Errorf("NewVendorAVP() accepted an unregistered AVP")
+	}
+
+	// Encode the AVP into a buffer along with an unregistered,
+	// non-mandatory vendor AVP, and parse the result
+	b := []byte{
+		0x80, 0x08, 0x11, 0x8b, 0x00, 0x07, 0x06, 0xa5,
+		0x00, 0x09, 0x11, 0x8b, 0x00, 0x09, 0xaa, 0xbb, 0xcc,
+	}
+	avps, err := parseAVPBuffer(b)
+	if err != nil {
+		t.Fatalf("parseAVPBuffer(): %v", err)
+	}
+	if len(avps) != 2 {
+		t.Fatalf("expected 2 AVPs, got %d", len(avps))
+	}
+
+	got := AVP{avp: avps[0]}
+	if got.VendorID() != 4491 || got.Type() != 7 || !got.IsRecognised() {
+		t.Errorf("unexpected AVP %v", &got)
+	}
+	v, err := got.DecodeUint16()
+	if err != nil || v != 1701 {
+		t.Errorf("DecodeUint16(): got %v, %v, want 1701", v, err)
+	}
+	if !bytes.Equal(got.Bytes(), a.Bytes()) {
+		t.Errorf("parsed AVP %v doesn't match encoded AVP %v", got.Bytes(), a.Bytes())
+	}
+
+	unknown := AVP{avp: avps[1]}
+	if unknown.IsRecognised() {
+		t.Errorf("expected AVP %v to be unrecognised", &unknown)
+	}
+	if !bytes.Equal(unknown.Bytes(), []byte{0xaa, 0xbb, 0xcc}) {
+		t.Errorf("unexpected unrecognised AVP data %v", unknown.Bytes())
+	}
+}
+
+func TestUnknownMandatoryVendorAVP(t *testing.T) {
+	// HELLO carrying an unregistered vendor AVP with the mandatory bit set
+	b := []byte{
+		0xc8, 0x02, 0x00, 0x1a, 0x00, 0x2a, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x80, 0x08, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x06, 0x80, 0x06, 0x01, 0xef,
+		0x00, 0x01,
+	}
+	messages, err := parseMessageBuffer(b)
+	if err != nil {
+		t.Fatalf("parseMessageBuffer(): %v", err)
+	}
+	avps := messages[0].getAvps()
+	if len(avps) != 2 || avps[1].vendorID() != 0x1ef || !avps[1].isMandatory() {
+		t.Fatalf("expected unknown mandatory AVP to be retained, got %v", avps)
+	}
+	err = validateMessage(messages[0])
+	if _, ok := err.(*unknownMandatoryAVPError); !ok {
+		t.Fatalf("validateMessage(): expected unknown mandatory AVP error, got %v", err)
+	}
+}
@@ -0,0 +1,328 @@
+package l2tp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// capture writes control frames to a file in pcapng format:
+// https://github.com/pcapng/pcapng.
+//
+// The control plane socket doesn't give us access to the IP and UDP
+// headers of the frames it sends and receives, so these are synthesized
+// from the socket addresses.  The capture uses the raw IP link type, and
+// so may be opened directly using Wireshark or tcpdump.
+//
+// If a maximum file size is set the capture file is rotated once it
+// reaches that size, with the previous capture being renamed to have
+// the suffix ".1".
+type capture struct {
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+	nframes int
+}
+
+// pcapng block types
+const (
+	pcapngBlockSHB uint32 = 0x0a0d0d0a
+	pcapngBlockIDB uint32 = 0x00000001
+	pcapngBlockEPB uint32 = 0x00000006
+)
+
+const (
+	pcapngByteOrderMagic uint32 = 0x1a2b3c4d
+	pcapngLinkTypeRaw    uint16 = 101
+	pcapngSnapLen        uint32 = 65535
+	pcapngOptEndOfOpt    uint16 = 0
+	pcapngOptEPBFlags    uint16 = 2
+	pcapngEPBInbound     uint32 = 1
+	pcapngEPBOutbound    uint32 = 2
+)
+
+const (
+	ipProtoUDP      = 17
+	ipProtoL2TP     = 115
+	captureIPv4TTL  = 64
+	captureIPv6Hops = 64
+)
+
+var pcapngByteOrder = binary.LittleEndian
+
+// newCapture creates a new capture file, truncating any existing file
+// at the specified path.  If maxSize is non-zero the capture file is
+// rotated when it reaches maxSize bytes.
+func newCapture(path string, maxSize int64) (*capture, error) {
+	c := &capture{
+		path:    path,
+		maxSize: maxSize,
+	}
+	err := c.open()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *capture) open() error {
+	file, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open capture file: %v", err)
+	}
+	c.file = file
+	c.size = 0
+	c.nframes = 0
+
+	// Each file is a self-contained pcapng section with a single
+	// interface.
+	err = c.writeBlock(pcapngBlockSHB, newPcapngSHB())
+	if err == nil {
+		err = c.writeBlock(pcapngBlockIDB, newPcapngIDB())
+	}
+	if err != nil {
+		_ = c.close()
+		return err
+	}
+	return nil
+}
+
+func (c *capture) rotate() error {
+	err := c.close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(c.path, c.path+".1")
+	if err != nil {
+		return fmt.Errorf("failed to rotate capture file: %v", err)
+	}
+	return c.open()
+}
+
+func (c *capture) close() (err error) {
+	if c.file != nil {
+		err = c.file.Close()
+		c.file = nil
+	}
+	return
+}
+
+// writeFrame writes a control frame to the capture file, synthesizing
+// IP and UDP headers using the source and destination addresses.
+func (c *capture) writeFrame(b []byte, src, dst unix.Sockaddr, outbound bool, ts time.Time) error {
+	if c.file == nil {
+		return fmt.Errorf("capture file is closed")
+	}
+
+	pkt, err := synthesizeIPFrame(b, src, dst)
+	if err != nil {
+		return err
+	}
+
+	flags := pcapngEPBInbound
+	if outbound {
+		flags = pcapngEPBOutbound
+	}
+	epb := newPcapngEPB(pkt, flags, ts)
+
+	// Always write at least one frame to each file, otherwise a frame
+	// larger than the maximum file size would never be written.
+	if c.maxSize > 0 && c.nframes > 0 && c.size+pcapngBlockLen(epb) > c.maxSize {
+		err = c.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = c.writeBlock(pcapngBlockEPB, epb)
+	if err == nil {
+		c.nframes++
+	}
+	return err
+}
+
+// pcapngBlockLen returns the total length of a block with the specified body.
+func pcapngBlockLen(body []byte) int64 {
+	return int64(12 + len(body))
+}
+
+func (c *capture) writeBlock(blockType uint32, body []byte) error {
+	buf := new(bytes.Buffer)
+	blockLen := uint32(pcapngBlockLen(body))
+	_ = binary.Write(buf, pcapngByteOrder, blockType)
+	_ = binary.Write(buf, pcapngByteOrder, blockLen)
+	buf.Write(body)
+	_ = binary.Write(buf, pcapngByteOrder, blockLen)
+
+	n, err := c.file.Write(buf.Bytes())
+	c.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write capture file: %v", err)
+	}
+	return nil
+}
+
+func pcapngPad(buf *bytes.Buffer) {
+	for buf.Len()%4 != 0 {
+		buf.WriteByte(0)
+	}
+}
+
+func newPcapngSHB() []byte {
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, pcapngByteOrder, struct {
+		Magic         uint32
+		Major, Minor  uint16
+		SectionLength int64
+	}{
+		Magic:         pcapngByteOrderMagic,
+		Major:         1,
+		Minor:         0,
+		SectionLength: -1,
+	})
+	return buf.Bytes()
+}
+
+func newPcapngIDB() []byte {
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, pcapngByteOrder, struct {
+		LinkType uint16
+		Reserved uint16
+		SnapLen  uint32
+	}{
+		LinkType: pcapngLinkTypeRaw,
+		SnapLen:  pcapngSnapLen,
+	})
+	return buf.Bytes()
+}
+
+func newPcapngEPB(pkt []byte, flags uint32, ts time.Time) []byte {
+	// The default timestamp resolution is microseconds
+	usec := uint64(ts.UnixNano() / 1000)
+
+	buf := new(bytes.Buffer)
+	_ = binary.Write(buf, pcapngByteOrder, struct {
+		InterfaceID   uint32
+		TsHigh, TsLow uint32
+		CapLen        uint32
+		OrigLen       uint32
+	}{
+		TsHigh:  uint32(usec >> 32),
+		TsLow:   uint32(usec),
+		CapLen:  uint32(len(pkt)),
+		OrigLen: uint32(len(pkt)),
+	})
+	buf.Write(pkt)
+	pcapngPad(buf)
+
+	// Record the direction of the frame using the epb_flags option
+	_ = binary.Write(buf, pcapngByteOrder, struct {
+		Code, Len uint16
+		Flags     uint32
+		End, Zero uint16
+	}{
+		Code:  pcapngOptEPBFlags,
+		Len:   4,
+		Flags: flags,
+		End:   pcapngOptEndOfOpt,
+	})
+	return buf.Bytes()
+}
+
+// synthesizeIPFrame builds an IP packet carrying the control frame.
+//
+// For UDP encapsulation the control frame is carried in a UDP datagram.
+// For IP encapsulation the control frame is prefixed by the zero session
+// ID which the kernel adds on transmit and strips on receipt, as per
+// RFC3931 section 4.1.1.2.
+func synthesizeIPFrame(b []byte, src, dst unix.Sockaddr) ([]byte, error) {
+	srcAddr, srcPort, err := sockaddrAddrPort(src)
+	if err != nil {
+		return nil, err
+	}
+	dstAddr, dstPort, err := sockaddrAddrPort(dst)
+	if err != nil {
+		return nil, err
+	}
+	if len(srcAddr) != len(dstAddr) {
+		return nil, fmt.Errorf("capture addresses %v and %v are of different address families",
+			sockaddrString(src), sockaddrString(dst))
+	}
+
+	var proto uint8
+	var payload []byte
+
+	switch src.(type) {
+	case *unix.SockaddrInet4, *unix.SockaddrInet6:
+		proto = ipProtoUDP
+		payload = make([]byte, 8+len(b))
+		binary.BigEndian.PutUint16(payload[0:], srcPort)
+		binary.BigEndian.PutUint16(payload[2:], dstPort)
+		binary.BigEndian.PutUint16(payload[4:], uint16(len(payload)))
+		copy(payload[8:], b)
+		csum := ipChecksum(payload, ipPseudoHeaderSum(srcAddr, dstAddr, proto, len(payload)))
+		if csum == 0 {
+			csum = 0xffff
+		}
+		binary.BigEndian.PutUint16(payload[6:], csum)
+	default:
+		proto = ipProtoL2TP
+		payload = make([]byte, 4+len(b))
+		copy(payload[4:], b)
+	}
+
+	if len(srcAddr) == 4 {
+		hdr := make([]byte, 20)
+		hdr[0] = 0x45
+		binary.BigEndian.PutUint16(hdr[2:], uint16(len(hdr)+len(payload)))
+		binary.BigEndian.PutUint16(hdr[6:], 0x4000) // don't fragment
+		hdr[8] = captureIPv4TTL
+		hdr[9] = proto
+		copy(hdr[12:], srcAddr)
+		copy(hdr[16:], dstAddr)
+		binary.BigEndian.PutUint16(hdr[10:], ipChecksum(hdr, 0))
+		return append(hdr, payload...), nil
+	}
+
+	hdr := make([]byte, 40)
+	hdr[0] = 0x60
+	binary.BigEndian.PutUint16(hdr[4:], uint16(len(payload)))
+	hdr[6] = proto
+	hdr[7] = captureIPv6Hops
+	copy(hdr[8:], srcAddr)
+	copy(hdr[24:], dstAddr)
+	return append(hdr, payload...), nil
+}
+
+// ipPseudoHeaderSum sums the IPv4 or IPv6 pseudo header used in
+// computing transport layer checksums.
+func ipPseudoHeaderSum(src, dst []byte, proto uint8, length int) uint32 {
+	var sum uint32
+	for _, a := range [][]byte{src, dst} {
+		for i := 0; i < len(a); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(a[i:]))
+		}
+	}
+	sum += uint32(proto)
+	sum += uint32(length)
+	return sum
+}
+
+// ipChecksum computes the internet checksum as per RFC1071.
+func ipChecksum(b []byte, sum uint32) uint16 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 != 0 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	return ^uint16(sum)
+}
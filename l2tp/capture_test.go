@@ -0,0 +1,330 @@
+package l2tp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+type testPcapngBlock struct {
+	blockType uint32
+	body      []byte
+}
+
+func testReadPcapng(path string) (blocks []testPcapngBlock, err error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	for len(b) > 0 {
+		if len(b) < 12 {
+			return nil, fmt.Errorf("truncated pcapng block at offset %v", len(b))
+		}
+		blockType := binary.LittleEndian.Uint32(b[0:])
+		blockLen := binary.LittleEndian.Uint32(b[4:])
+		if blockLen < 12 || int(blockLen) > len(b) || blockLen%4 != 0 {
+			return nil, fmt.Errorf("truncated pcapng block at offset %v", len(b))
+		}
+		if binary.LittleEndian.Uint32(b[blockLen-4:]) != blockLen {
+			return nil, fmt.Errorf("truncated pcapng block at offset %v", len(b))
+		}
+		blocks = append(blocks, testPcapngBlock{blockType: blockType, body: b[8 : blockLen-4]})
+		b = b[blockLen:]
+	}
+	return blocks, nil
+}
+
+func TestCaptureFrames(t *testing.T) {
+	cases := []struct {
+		name     string
+		src, dst unix.Sockaddr
+		outbound bool
+		proto    uint8
+		ipHdrLen int
+		l2tpOff  int
+	}{
+		{
+			name:     "udp4",
+			src:      &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 1701},
+			dst:      &unix.SockaddrInet4{Addr: [4]byte{10, 1, 2, 3}, Port: 5000},
+			outbound: true,
+			proto:    ipProtoUDP,
+			ipHdrLen: 20,
+			l2tpOff:  28,
+		},
+		{
+			name:     "udp6",
+			src:      &unix.SockaddrInet6{Addr: [16]byte{0xfe, 0x80, 15: 1}, Port: 1701},
+			dst:      &unix.SockaddrInet6{Addr: [16]byte{0xfe, 0x80, 15: 2}, Port: 1701},
+			proto:    ipProtoUDP,
+			ipHdrLen: 40,
+			l2tpOff:  48,
+		},
+		{
+			name:     "ip4",
+			src:      &unix.SockaddrL2TPIP{Addr: [4]byte{127, 0, 0, 1}, ConnId: 42},
+			dst:      &unix.SockaddrL2TPIP{Addr: [4]byte{127, 0, 0, 2}, ConnId: 90},
+			proto:    ipProtoL2TP,
+			ipHdrLen: 20,
+			l2tpOff:  24,
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "l2tp-capture")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(dir, c.name+".pcapng")
+			capture, err := newCapture(path, 0)
+			if err != nil {
+				t.Fatalf("newCapture(): %v", err)
+			}
+
+			msg, err := testBasicSendRecvSenderNewHelloMsg(&transportConfig{
+				Version:           ProtocolVersion3,
+				PeerControlConnID: 90,
+			})
+			if err != nil {
+				t.Fatalf("failed to build Hello message: %v", err)
+			}
+			frame, err := msg.toBytes()
+			if err != nil {
+				t.Fatalf("toBytes(): %v", err)
+			}
+
+			err = capture.writeFrame(frame, c.src, c.dst, c.outbound, time.Unix(1000, 5000))
+			if err != nil {
+				t.Fatalf("writeFrame(): %v", err)
+			}
+			err = capture.close()
+			if err != nil {
+				t.Fatalf("close(): %v", err)
+			}
+
+			blocks, err := testReadPcapng(path)
+			if err != nil {
+				t.Fatalf("failed to read capture: %v", err)
+			}
+			if len(blocks) != 3 ||
+				blocks[0].blockType != pcapngBlockSHB ||
+				blocks[1].blockType != pcapngBlockIDB ||
+				blocks[2].blockType != pcapngBlockEPB {
+				t.Fatalf("expected SHB, IDB and EPB, got %v", blocks)
+			}
+			if binary.LittleEndian.Uint32(blocks[0].body) != pcapngByteOrderMagic {
+				t.Errorf("bad byte order magic")
+			}
+			if binary.LittleEndian.Uint16(blocks[1].body) != pcapngLinkTypeRaw {
+				t.Errorf("expected raw IP link type")
+			}
+
+			epb := blocks[2].body
+			usec := uint64(binary.LittleEndian.Uint32(epb[4:]))<<32 | uint64(binary.LittleEndian.Uint32(epb[8:]))
+			if usec != 1000000005 {
+				t.Errorf("expected timestamp 1000000005us, got %v", usec)
+			}
+			capLen := binary.LittleEndian.Uint32(epb[12:])
+			pkt := epb[20 : 20+capLen]
+
+			if int(capLen) != c.l2tpOff+len(frame) {
+				t.Fatalf("expected captured length %v, got %v", c.l2tpOff+len(frame), capLen)
+			}
+			if !bytes.Equal(pkt[c.l2tpOff:], frame) {
+				t.Errorf("captured frame doesn't match")
+			}
+
+			srcAddr, srcPort, _ := sockaddrAddrPort(c.src)
+			dstAddr, dstPort, _ := sockaddrAddrPort(c.dst)
+			payload := pkt[c.ipHdrLen:]
+
+			if c.ipHdrLen == 20 {
+				if pkt[0] != 0x45 || pkt[9] != c.proto {
+					t.Errorf("bad IPv4 header % x", pkt[:20])
+				}
+				if ipChecksum(pkt[:20], 0) != 0 {
+					t.Errorf("bad IPv4 header checksum")
+				}
+				if !bytes.Equal(pkt[12:16], srcAddr) || !bytes.Equal(pkt[16:20], dstAddr) {
+					t.Errorf("bad IPv4 addresses")
+				}
+			} else {
+				if pkt[0]>>4 != 6 || pkt[6] != c.proto {
+					t.Errorf("bad IPv6 header % x", pkt[:40])
+				}
+				if !bytes.Equal(pkt[8:24], srcAddr) || !bytes.Equal(pkt[24:40], dstAddr) {
+					t.Errorf("bad IPv6 addresses")
+				}
+			}
+
+			if c.proto == ipProtoUDP {
+				if binary.BigEndian.Uint16(payload[0:]) != srcPort ||
+					binary.BigEndian.Uint16(payload[2:]) != dstPort {
+					t.Errorf("bad UDP ports")
+				}
+				if ipChecksum(payload, ipPseudoHeaderSum(srcAddr, dstAddr, c.proto, len(payload))) != 0 {
+					t.Errorf("bad UDP checksum")
+				}
+			} else if !bytes.Equal(payload[:4], []byte{0, 0, 0, 0}) {
+				t.Errorf("expected zero session ID, got % x", payload[:4])
+			}
+
+			// Direction is recorded using epb_flags
+			opts := epb[20+((capLen+3)&^3):]
+			flags := binary.LittleEndian.Uint32(opts[4:])
+			if binary.LittleEndian.Uint16(opts) != pcapngOptEPBFlags ||
+				(c.outbound && flags != pcapngEPBOutbound) ||
+				(!c.outbound && flags != pcapngEPBInbound) {
+				t.Errorf("bad epb_flags option % x", opts)
+			}
+		})
+	}
+}
+
+func TestCaptureRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l2tp-capture")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "rotate.pcapng")
+	src := &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 1701}
+	dst := &unix.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}, Port: 1702}
+	frame := make([]byte, 100)
+
+	// Room for the SHB, the IDB, and two EPBs each carrying a 128 byte
+	// IP packet and the epb_flags option
+	capture, err := newCapture(path, 28+20+2*(12+20+128+12))
+	if err != nil {
+		t.Fatalf("newCapture(): %v", err)
+	}
+	defer capture.close()
+
+	for i := 0; i < 3; i++ {
+		err = capture.writeFrame(frame, src, dst, true, time.Now())
+		if err != nil {
+			t.Fatalf("writeFrame(): %v", err)
+		}
+	}
+
+	for path, nframes := range map[string]int{path: 1, path + ".1": 2} {
+		blocks, err := testReadPcapng(path)
+		if err != nil {
+			t.Fatalf("failed to read capture %v: %v", path, err)
+		}
+		if len(blocks) != 2+nframes || blocks[0].blockType != pcapngBlockSHB {
+			t.Errorf("expected %v frames in %v, got %v blocks", nframes, path, len(blocks))
+		}
+	}
+}
+
+func TestTransportCapture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "l2tp-capture")
+	if err != nil {
+		t.Fatalf("TempDir(): %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+
+	cp, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(): %v", err)
+	}
+
+	err = cp.bind()
+	if err != nil {
+		t.Fatalf("cp.bind(): %v", err)
+	}
+
+	err = cp.connect()
+	if err != nil {
+		t.Fatalf("cp.connect(): %v", err)
+	}
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9001})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer peer.Close()
+
+	xport, err := newTransport(
+		level.NewFilter(log.NewLogfmtLogger(os.Stderr),
+			level.AllowDebug(), level.AllowInfo()),
+		cp, transportConfig{
+			Version:           ProtocolVersion2,
+			AckTimeout:        5 * time.Millisecond,
+			PeerControlConnID: 90,
+			ControlConnID:     42,
+		})
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+
+	path := filepath.Join(dir, "xport.pcapng")
+	err = xport.startCapture(path, 0)
+	if err != nil {
+		t.Fatalf("startCapture(): %v", err)
+	}
+
+	hello, err := testBasicSendRecvSenderNewHelloMsg(&transportConfig{
+		Version:           ProtocolVersion2,
+		PeerControlConnID: 42,
+	})
+	if err != nil {
+		t.Fatalf("failed to build Hello message: %v", err)
+	}
+	b, err := hello.toBytes()
+	if err != nil {
+		t.Fatalf("toBytes(): %v", err)
+	}
+	_, err = peer.WriteToUDP(b, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000})
+	if err != nil {
+		t.Fatalf("WriteToUDP(): %v", err)
+	}
+
+	_, err = xport.recv()
+	if err != nil {
+		t.Fatalf("recv(): %v", err)
+	}
+	_, err = testPeerRecvMessage(peer)
+	if err != nil {
+		t.Fatalf("expected ack: %v", err)
+	}
+
+	xport.close()
+
+	// Expect the HELLO received and the ZLB sent in response
+	blocks, err := testReadPcapng(path)
+	if err != nil {
+		t.Fatalf("failed to read capture: %v", err)
+	}
+	if len(blocks) != 4 {
+		t.Fatalf("expected 2 frames, got %v blocks", len(blocks))
+	}
+	for i, flags := range []uint32{pcapngEPBInbound, pcapngEPBOutbound} {
+		epb := blocks[2+i].body
+		capLen := binary.LittleEndian.Uint32(epb[12:])
+		opts := epb[20+((capLen+3)&^3):]
+		if binary.LittleEndian.Uint32(opts[4:]) != flags {
+			t.Errorf("frame %v: expected flags %v, got % x", i, flags, opts)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+package l2tp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/katalix/go-l2tp/internal/nlrtnl"
+	"golang.org/x/sys/unix"
+)
+
+// routeConn is the interface to the Linux kernel rtnetlink subsystem
+// used to follow the state of attachment circuits, and to apply the
+// status of the peer's circuit to session interfaces.  It is implemented
+// by nlrtnl.Conn, and by an in-memory fake kernel for testing.
+type routeConn interface {
+	GetLink(ctx context.Context, name string) (*nlrtnl.Link, error)
+	SetOperState(ctx context.Context, index int, state uint8) error
+	ReceiveLinks() ([]nlrtnl.Link, error)
+	Close()
+}
+
+// circuitStatus is the value of the Circuit Status AVP, per RFC3931
+// section 5.4.5.
+type circuitStatus uint16
+
+const (
+	// circuitStatusActive is set if the circuit is up
+	circuitStatusActive circuitStatus = 0x1
+	// circuitStatusNew is set if the circuit has just been provisioned
+	circuitStatusNew circuitStatus = 0x2
+)
+
+func newCircuitStatus(up, isNew bool) (status circuitStatus) {
+	if up {
+		status |= circuitStatusActive
+	}
+	if isNew {
+		status |= circuitStatusNew
+	}
+	return
+}
+
+// findCircuitStatus returns the circuit status carried by a message,
+// if present.
+func findCircuitStatus(msg controlMessage) (status circuitStatus, ok bool) {
+	for _, a := range msg.getAvps() {
+		if a.vendorID() == vendorIDIetf && a.getType() == avpTypeCircuitStatus {
+			value, err := a.decodeUint16Data()
+			return circuitStatus(value), err == nil
+		}
+	}
+	return 0, false
+}
+
+// dialRtnetlink establishes an rtnetlink connection to the kernel in
+// the specified network namespace.
+func dialRtnetlink(netns string) (routeConn, error) {
+	var conn *nlrtnl.Conn
+	err := withNetns(netns, func() (err error) {
+		conn, err = nlrtnl.Dial()
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// linkMonitor follows the state of the network interfaces in a network
+// namespace, passing changes in the state of watched interfaces to the
+// watchers.
+type linkMonitor struct {
+	logger    log.Logger
+	conn      routeConn
+	wg        sync.WaitGroup
+	closeChan chan struct{}
+	// mutex protects the fields below
+	mutex   sync.Mutex
+	closed  bool
+	watches map[string]map[*linkWatch]bool
+}
+
+// linkWatch calls onChange whenever the state of a network interface
+// changes.  onChange is called with the monitor lock held, and so must
+// not block.
+type linkWatch struct {
+	monitor  *linkMonitor
+	name     string
+	onChange func(up, isNew bool)
+	// the monitor mutex protects the fields below
+	known   bool
+	running bool
+}
+
+func newLinkMonitor(logger log.Logger, conn routeConn) *linkMonitor {
+	m := &linkMonitor{
+		logger:    logger,
+		conn:      conn,
+		closeChan: make(chan struct{}),
+		watches:   make(map[string]map[*linkWatch]bool),
+	}
+	m.wg.Add(1)
+	go m.run()
+	return m
+}
+
+// linkMonitorRetryInterval is how long the monitor waits before trying
+// again when it fails to receive link notifications.
+const linkMonitorRetryInterval = time.Second
+
+// run follows link notifications until the monitor is closed.  Whenever
+// notifications may have been missed, the watched interfaces are looked
+// up again.
+func (m *linkMonitor) run() {
+	defer m.wg.Done()
+	for {
+		links, err := m.conn.ReceiveLinks()
+		for _, link := range links {
+			m.update(link.Name, link.Running())
+		}
+		if err == nil {
+			continue
+		}
+
+		m.mutex.Lock()
+		closed := m.closed
+		m.mutex.Unlock()
+		if closed {
+			return
+		}
+
+		// The kernel dropping notifications, or sending one we can't
+		// parse, leaves us unsure of the state of the interfaces, while
+		// any other error may persist, so we wait before trying again.
+		if !errors.Is(err, unix.ENOBUFS) {
+			level.Error(m.logger).Log(
+				"message", "failed to receive link notifications",
+				"error", err)
+			if !errors.Is(err, nlrtnl.ErrBadMessage) {
+				select {
+				case <-time.After(linkMonitorRetryInterval):
+				case <-m.closeChan:
+					return
+				}
+			}
+		}
+		m.resync()
+	}
+}
+
+// watch starts watching the named interface.  onChange is called with
+// the current state of the interface, flagged as new, before watch returns.
+// An interface which doesn't exist is considered to be down.
+func (m *linkMonitor) watch(cctx context.Context, name string, onChange func(up, isNew bool)) *linkWatch {
+	w := &linkWatch{
+		monitor:  m,
+		name:     name,
+		onChange: onChange,
+	}
+
+	m.mutex.Lock()
+	if m.watches[name] == nil {
+		m.watches[name] = make(map[*linkWatch]bool)
+	}
+	m.watches[name][w] = true
+	m.mutex.Unlock()
+
+	running, err := m.getRunning(cctx, name)
+	if err != nil {
+		level.Error(m.logger).Log(
+			"message", "failed to look up interface",
+			"interface_name", name,
+			"error", err)
+	}
+
+	m.mutex.Lock()
+	m.apply(w, running)
+	m.mutex.Unlock()
+
+	return w
+}
+
+// getRunning looks up whether the named interface is running.
+func (m *linkMonitor) getRunning(cctx context.Context, name string) (bool, error) {
+	link, err := m.conn.GetLink(cctx, name)
+	if err != nil {
+		if errors.Is(err, unix.ENODEV) {
+			return false, nil
+		}
+		return false, err
+	}
+	return link.Running(), nil
+}
+
+// apply passes the state of an interface to a watcher if it has changed.
+// The caller must hold the monitor lock.
+func (m *linkMonitor) apply(w *linkWatch, running bool) {
+	if w.known && w.running == running {
+		return
+	}
+	isNew := !w.known
+	w.known = true
+	w.running = running
+	w.onChange(running, isNew)
+}
+
+func (m *linkMonitor) update(name string, running bool) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for w := range m.watches[name] {
+		m.apply(w, running)
+	}
+}
+
+// resync looks up the state of every watched interface.
+func (m *linkMonitor) resync() {
+	m.mutex.Lock()
+	names := make([]string, 0, len(m.watches))
+	for name := range m.watches {
+		names = append(names, name)
+	}
+	m.mutex.Unlock()
+
+	for _, name := range names {
+		running, err := m.getRunning(context.Background(), name)
+		if err != nil {
+			level.Error(m.logger).Log(
+				"message", "failed to look up interface",
+				"interface_name", name,
+				"error", err)
+			continue
+		}
+		m.update(name, running)
+	}
+}
+
+// setOperState sets the operational state of the named interface to
+// up or dormant.
+func (m *linkMonitor) setOperState(cctx context.Context, name string, up bool) error {
+	link, err := m.conn.GetLink(cctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to look up interface %q: %w", name, err)
+	}
+	state := uint8(nlrtnl.OperStateDormant)
+	if up {
+		state = nlrtnl.OperStateUp
+	}
+	err = m.conn.SetOperState(cctx, link.Index, state)
+	if err != nil {
+		return fmt.Errorf("failed to set operational state of interface %q: %w", name, err)
+	}
+	return nil
+}
+
+func (m *linkMonitor) close() {
+	m.mutex.Lock()
+	m.closed = true
+	m.mutex.Unlock()
+	close(m.closeChan)
+	m.conn.Close()
+	m.wg.Wait()
+}
+
+// stop stops watching the interface.  Once stop returns onChange
+// will not be called again.
+func (w *linkWatch) stop() {
+	m := w.monitor
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.watches[w.name], w)
+	if len(m.watches[w.name]) == 0 {
+		delete(m.watches, w.name)
+	}
+}
+
+// isRunning returns the last known state of the interface.
+func (w *linkWatch) isRunning() bool {
+	w.monitor.mutex.Lock()
+	defer w.monitor.mutex.Unlock()
+	return w.running
+}
+
+// serialQueue runs functions one at a time in the order they're queued.
+// The goroutine running them only exists while there's work to do, so an
+// idle queue costs no goroutines.
+type serialQueue struct {
+	wg sync.WaitGroup
+	// mutex protects the fields below
+	mutex   sync.Mutex
+	closed  bool
+	running bool
+	pending []func()
+}
+
+// run queues f.  It never blocks.  Functions queued once the queue is
+// closed are discarded.
+func (q *serialQueue) run(f func()) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return
+	}
+	q.pending = append(q.pending, f)
+	if !q.running {
+		q.running = true
+		q.wg.Add(1)
+		go q.drain()
+	}
+}
+
+func (q *serialQueue) drain() {
+	defer q.wg.Done()
+	for {
+		q.mutex.Lock()
+		if len(q.pending) == 0 {
+			q.running = false
+			q.mutex.Unlock()
+			return
+		}
+		f := q.pending[0]
+		q.pending[0] = nil
+		q.pending = q.pending[1:]
+		q.mutex.Unlock()
+		f()
+	}
+}
+
+// close discards further functions, and waits for those already queued
+// to be run.
+func (q *serialQueue) close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.mutex.Unlock()
+	q.wg.Wait()
+}
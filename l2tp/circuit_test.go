@@ -0,0 +1,418 @@
+package l2tp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/katalix/go-l2tp/internal/nlrtnl"
+	"golang.org/x/sys/unix"
+)
+
+// fakeRoute is an in-memory implementation of routeConn, allowing link
+// monitoring and operational state changes to be tested without
+// privileges.
+type fakeRoute struct {
+	events    chan []nlrtnl.Link
+	errs      chan error
+	closeChan chan struct{}
+	closeOnce sync.Once
+	// mutex protects the fields below
+	mutex     sync.Mutex
+	links     map[string]*nlrtnl.Link
+	nextIndex int
+}
+
+func newFakeRoute() *fakeRoute {
+	return &fakeRoute{
+		events:    make(chan []nlrtnl.Link, 16),
+		errs:      make(chan error, 1),
+		closeChan: make(chan struct{}),
+		links:     make(map[string]*nlrtnl.Link),
+		nextIndex: 1,
+	}
+}
+
+// setLink creates or updates an interface, and notifies the change.
+func (f *fakeRoute) setLink(name string, running bool) {
+	f.events <- []nlrtnl.Link{f.updateLink(name, running)}
+}
+
+// updateLink creates or updates an interface without notifying the
+// change, returning the notification.
+func (f *fakeRoute) updateLink(name string, running bool) nlrtnl.Link {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	link, ok := f.links[name]
+	if !ok {
+		link = &nlrtnl.Link{Index: f.nextIndex, Name: name}
+		f.links[name] = link
+		f.nextIndex++
+	}
+	link.Flags = 0
+	if running {
+		link.Flags = unix.IFF_UP | unix.IFF_LOWER_UP
+	}
+	return *link
+}
+
+// failReceive has the next ReceiveLinks call fail.
+func (f *fakeRoute) failReceive(err error) {
+	f.errs <- err
+}
+
+// operState returns the operational state of an interface.
+func (f *fakeRoute) operState(name string) uint8 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if link, ok := f.links[name]; ok {
+		return link.OperState
+	}
+	return nlrtnl.OperStateNotPresent
+}
+
+func (f *fakeRoute) GetLink(ctx context.Context, name string) (*nlrtnl.Link, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	link, ok := f.links[name]
+	if !ok {
+		return nil, unix.ENODEV
+	}
+	l := *link
+	return &l, nil
+}
+
+func (f *fakeRoute) SetOperState(ctx context.Context, index int, state uint8) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, link := range f.links {
+		if link.Index == index {
+			link.OperState = state
+			return nil
+		}
+	}
+	return unix.ENODEV
+}
+
+func (f *fakeRoute) ReceiveLinks() ([]nlrtnl.Link, error) {
+	select {
+	case links := <-f.events:
+		return links, nil
+	case err := <-f.errs:
+		return nil, err
+	case <-f.closeChan:
+		return nil, errors.New("netlink connection closed")
+	}
+}
+
+func (f *fakeRoute) Close() {
+	f.closeOnce.Do(func() { close(f.closeChan) })
+}
+
+type linkChange struct {
+	up, isNew bool
+}
+
+func TestLinkMonitor(t *testing.T) {
+	route := newFakeRoute()
+	m := newLinkMonitor(log.NewNopLogger(), route)
+	defer m.close()
+
+	changes := make(chan linkChange, 16)
+	expect := func(want linkChange) {
+		select {
+		case got := <-changes:
+			if got != want {
+				t.Errorf("expected change %+v, got %+v", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for change %+v", want)
+		}
+	}
+
+	// An interface which doesn't exist is down
+	w := m.watch(context.Background(), "eth1", func(up, isNew bool) {
+		changes <- linkChange{up, isNew}
+	})
+	expect(linkChange{up: false, isNew: true})
+
+	route.setLink("eth1", true)
+	expect(linkChange{up: true})
+
+	// Notifications for other interfaces, or which don't change the
+	// state of the interface, aren't passed on
+	route.setLink("eth2", false)
+	route.setLink("eth1", true)
+	route.setLink("eth1", false)
+	expect(linkChange{up: false})
+
+	// A notification which can't be parsed is skipped, and the watched
+	// interfaces looked up in case it reported a change, after which
+	// monitoring carries on
+	route.updateLink("eth1", true)
+	route.failReceive(fmt.Errorf("%w: link message too short", nlrtnl.ErrBadMessage))
+	expect(linkChange{up: true})
+	route.setLink("eth1", false)
+	expect(linkChange{up: false})
+
+	w.stop()
+	route.setLink("eth1", true)
+	if running := w.isRunning(); running {
+		t.Errorf("expected stopped watch to keep its last state")
+	}
+	select {
+	case c := <-changes:
+		t.Errorf("unexpected change %+v once stopped", c)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestSerialQueue(t *testing.T) {
+	var q serialQueue
+	var mutex sync.Mutex
+	var got []int
+	for i := 0; i < 100; i++ {
+		i := i
+		q.run(func() {
+			mutex.Lock()
+			got = append(got, i)
+			mutex.Unlock()
+		})
+	}
+	q.close()
+	q.run(func() { t.Errorf("function queued once closed was run") })
+
+	if len(got) != 100 {
+		t.Fatalf("expected 100 functions to run, got %v", len(got))
+	}
+	for i, v := range got {
+		if v != i {
+			t.Fatalf("functions run out of order: %v", got)
+		}
+	}
+}
+
+type testEventHandler chan interface{}
+
+func (h testEventHandler) HandleEvent(event interface{}) {
+	select {
+	case h <- event:
+	default:
+	}
+}
+
+func TestCircuitStatus(t *testing.T) {
+	cases := []struct {
+		name        string
+		cfg         *ContextConfig
+		local, peer string
+	}{
+		{"goroutines", nil, "127.0.0.1:6100", "127.0.0.1:5100"},
+		{"reactor", &ContextConfig{ReactorWorkers: 2}, "127.0.0.1:6102", "127.0.0.1:5102"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			testCircuitStatus(t, c.cfg, c.local, c.peer)
+		})
+	}
+}
+
+func testCircuitStatus(t *testing.T, cfg *ContextConfig, local, peer string) {
+	dial, _ := newFakeNetlinkDialer()
+	route := newFakeRoute()
+	ctx, err := newContext(nil, cfg, withNetlinkDialer(dial),
+		withRouteDialer(func(netns string) (routeConn, error) {
+			return route, nil
+		}))
+	if err != nil {
+		t.Fatalf("newContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	events := make(testEventHandler, 16)
+	ctx.RegisterEventHandler(events)
+	expectEvent := func(want CircuitStatusEvent) {
+		select {
+		case got := <-events:
+			if e, ok := got.(*CircuitStatusEvent); !ok || *e != want {
+				t.Errorf("expected event %+v, got %+v", want, got)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for event %+v", want)
+		}
+	}
+
+	tcfg := &TunnelConfig{
+		Local:        local,
+		Peer:         peer,
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 1001,
+		Encap:        EncapTypeUDP,
+	}
+	qt, err := ctx.NewQuiescentTunnel("t1", tcfg)
+	if err != nil {
+		t.Fatalf("NewQuiescentTunnel(): %v", err)
+	}
+
+	// The peer runs a transport so that our messages are acked
+	sa, sb, err := newUDPAddressPair(tcfg.Peer, tcfg.Local)
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	cp, err := newL2tpControlPlane(sa, sb)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(): %v", err)
+	}
+	if err = cp.bind(); err == nil {
+		err = cp.connect()
+	}
+	if err != nil {
+		cp.close()
+		t.Fatalf("failed to set up peer control plane: %v", err)
+	}
+	peerXport, err := newTransport(log.NewNopLogger(), cp, transportConfig{
+		Version:           ProtocolVersion3,
+		PeerControlConnID: tcfg.TunnelID,
+		ControlConnID:     tcfg.PeerTunnelID,
+	})
+	if err != nil {
+		cp.close()
+		t.Fatalf("newTransport(): %v", err)
+	}
+	defer peerXport.close()
+
+	peerRecvd := make(chan controlMessage, 16)
+	go func() {
+		for {
+			msg, err := peerXport.recv()
+			if err != nil {
+				return
+			}
+			peerRecvd <- msg
+		}
+	}()
+	peerExpect := func(msgType avpMsgType, want circuitStatus) {
+		select {
+		case msg := <-peerRecvd:
+			if msg.getType() != msgType {
+				t.Fatalf("expected %v, got %v", msgType, msg.getType())
+			}
+			localSID, peerSID := messageSessionIDs(msg)
+			if localSID != 20 || peerSID != 10 {
+				t.Errorf("expected session IDs 20 and 10, got %v and %v", localSID, peerSID)
+			}
+			status, ok := findCircuitStatus(msg)
+			if !ok || status != want {
+				t.Errorf("expected circuit status %v, got %v", want, status)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %v", msgType)
+		}
+	}
+	peerSend := func(msg controlMessage, err error) {
+		if err == nil {
+			err = peerXport.send(msg)
+		}
+		if err != nil {
+			t.Fatalf("failed to send to tunnel: %v", err)
+		}
+	}
+
+	// Circuit status is only signalled for Ethernet pseudowires
+	_, err = qt.NewSession("ppp", &SessionConfig{
+		SessionID:        11,
+		PeerSessionID:    21,
+		Pseudowire:       PseudowireTypePPP,
+		CircuitInterface: "eth1",
+	})
+	if err == nil {
+		t.Errorf("expected circuit status for a PPP pseudowire to fail")
+	}
+
+	route.setLink("eth1", true)
+	route.setLink("l2tpeth7", true)
+
+	_, err = qt.NewSession("s1", &SessionConfig{
+		SessionID:        10,
+		PeerSessionID:    20,
+		Pseudowire:       PseudowireTypeEth,
+		InterfaceName:    "l2tpeth7",
+		CircuitInterface: "eth1",
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	// The initial status of our circuit is signalled as new
+	expectEvent(CircuitStatusEvent{TunnelName: "t1", SessionName: "s1", Up: true})
+	peerExpect(avpMsgTypeSli, circuitStatusActive|circuitStatusNew)
+
+	route.setLink("eth1", false)
+	expectEvent(CircuitStatusEvent{TunnelName: "t1", SessionName: "s1"})
+	peerExpect(avpMsgTypeSli, 0)
+
+	// The peer's circuit status is applied to the session interface
+	peerSend(newCircuitStatusMessage(avpMsgTypeSli, tcfg.TunnelID, 20, 10, 0))
+	expectEvent(CircuitStatusEvent{TunnelName: "t1", SessionName: "s1", Peer: true})
+	if state := route.operState("l2tpeth7"); state != nlrtnl.OperStateDormant {
+		t.Errorf("expected session interface to be dormant, got state %v", state)
+	}
+
+	peerSend(newCircuitStatusMessage(avpMsgTypeCsun, tcfg.TunnelID, 20, 10, circuitStatusActive))
+	expectEvent(CircuitStatusEvent{TunnelName: "t1", SessionName: "s1", Peer: true, Up: true})
+	if state := route.operState("l2tpeth7"); state != nlrtnl.OperStateUp {
+		t.Errorf("expected session interface to be up, got state %v", state)
+	}
+
+	// A request for our circuit status is answered with CSUN
+	msgAvp, _ := newAvp(vendorIDIetf, avpTypeMessage, avpMsgTypeCsurq)
+	lsidAvp, _ := newAvp(vendorIDIetf, avpTypeLocalSessionID, uint32(20))
+	rsidAvp, _ := newAvp(vendorIDIetf, avpTypeRemoteSessionID, uint32(10))
+	peerSend(newV3ControlMessage(tcfg.TunnelID, []avp{*msgAvp, *lsidAvp, *rsidAvp}))
+	peerExpect(avpMsgTypeCsun, 0)
+
+	// Nothing is signalled once the tunnel is closed
+	qt.Close()
+	route.setLink("eth1", true)
+	select {
+	case msg := <-peerRecvd:
+		t.Errorf("unexpected %v once closed", msg.getType())
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestStaticCircuitStatus(t *testing.T) {
+	dial, _ := newFakeNetlinkDialer()
+	ctx, err := newContext(nil, nil, withNetlinkDialer(dial))
+	if err != nil {
+		t.Fatalf("newContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	st, err := ctx.NewStaticTunnel("t1", &TunnelConfig{
+		Local:        "127.0.0.1:6101",
+		Peer:         "127.0.0.1:5101",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 1001,
+		Encap:        EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+
+	_, err = st.NewSession("s1", &SessionConfig{
+		SessionID:        10,
+		PeerSessionID:    20,
+		Pseudowire:       PseudowireTypeEth,
+		CircuitInterface: "eth1",
+	})
+	if err == nil {
+		t.Errorf("expected circuit status for a static tunnel to fail")
+	}
+}
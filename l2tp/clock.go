@@ -0,0 +1,61 @@
+package l2tp
+
+import (
+	"time"
+)
+
+// clock abstracts the passage of time so that timer-driven behaviour,
+// such as transport retransmission, can be tested deterministically.
+type clock interface {
+	// Now returns the current time.
+	Now() time.Time
+	// NewTimer creates a timer which sends the current time on its
+	// channel after duration d.
+	NewTimer(d time.Duration) clockTimer
+	// AfterFunc creates a timer which calls f in its own goroutine
+	// after duration d.
+	AfterFunc(d time.Duration, f func()) clockTimer
+}
+
+// clockTimer is a timer created by a clock, with the semantics of
+// time.Timer.
+type clockTimer interface {
+	// C returns the channel on which the timer delivers the time.
+	// Timers created by AfterFunc return a nil channel.
+	C() <-chan time.Time
+	// Stop prevents the timer from firing.
+	Stop() bool
+	// Reset changes the timer to expire after duration d.
+	Reset(d time.Duration) bool
+}
+
+// realClock is a clock using the time package.
+type realClock struct{}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) clockTimer {
+	return &realTimer{t: time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return &realTimer{t: time.AfterFunc(d, f)}
+}
+
+func (rt *realTimer) C() <-chan time.Time {
+	return rt.t.C
+}
+
+func (rt *realTimer) Stop() bool {
+	return rt.t.Stop()
+}
+
+func (rt *realTimer) Reset(d time.Duration) bool {
+	return rt.t.Reset(d)
+}
@@ -0,0 +1,389 @@
+package l2tp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+// fakeClock is a clock whose time only moves when advanced by the test.
+// Timers fire in expiry order as the clock is advanced past them.
+type fakeClock struct {
+	mutex  sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock  *fakeClock
+	when   time.Time
+	active bool
+	c      chan time.Time
+	f      func()
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1000000, 0)}
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	return fc.now
+}
+
+func (fc *fakeClock) NewTimer(d time.Duration) clockTimer {
+	return fc.addTimer(d, nil)
+}
+
+func (fc *fakeClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return fc.addTimer(d, f)
+}
+
+func (fc *fakeClock) addTimer(d time.Duration, f func()) *fakeTimer {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	ft := &fakeTimer{
+		clock:  fc,
+		when:   fc.now.Add(d),
+		active: true,
+		f:      f,
+	}
+	if f == nil {
+		ft.c = make(chan time.Time, 1)
+	}
+	fc.timers = append(fc.timers, ft)
+	return ft
+}
+
+// Advance moves the clock forward by d, firing any timers which
+// expire along the way.
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mutex.Lock()
+	end := fc.now.Add(d)
+	for {
+		var next *fakeTimer
+		for _, ft := range fc.timers {
+			if ft.active && !ft.when.After(end) && (next == nil || ft.when.Before(next.when)) {
+				next = ft
+			}
+		}
+		if next == nil {
+			break
+		}
+		next.active = false
+		fc.now = next.when
+		fc.mutex.Unlock()
+		next.fire()
+		fc.mutex.Lock()
+	}
+	fc.now = end
+	fc.pruneTimers()
+	fc.mutex.Unlock()
+}
+
+// pruneTimers drops inactive timers which can't be reset, since
+// nothing holds a reference to them.
+func (fc *fakeClock) pruneTimers() {
+	active := fc.timers[:0]
+	for _, ft := range fc.timers {
+		if ft.active || ft.f == nil {
+			active = append(active, ft)
+		}
+	}
+	fc.timers = active
+}
+
+// activeTimers returns the expiry times of the active timers.
+func (fc *fakeClock) activeTimers() (when []time.Duration) {
+	fc.mutex.Lock()
+	defer fc.mutex.Unlock()
+	for _, ft := range fc.timers {
+		if ft.active {
+			when = append(when, ft.when.Sub(fc.now))
+		}
+	}
+	sort.Slice(when, func(i, j int) bool { return when[i] < when[j] })
+	return
+}
+
+// waitForTimers blocks until n timers are active.  Timers are armed by
+// other goroutines, so tests must wait for them before advancing the clock.
+func (fc *fakeClock) waitForTimers(n int) error {
+	for i := 0; i < 1000; i++ {
+		if len(fc.activeTimers()) == n {
+			return nil
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return fmt.Errorf("expected %v active timers, got %v", n, fc.activeTimers())
+}
+
+func (ft *fakeTimer) fire() {
+	if ft.f != nil {
+		go ft.f()
+		return
+	}
+	select {
+	case ft.c <- ft.clock.Now():
+	default:
+	}
+}
+
+func (ft *fakeTimer) C() <-chan time.Time {
+	return ft.c
+}
+
+func (ft *fakeTimer) Stop() bool {
+	ft.clock.mutex.Lock()
+	defer ft.clock.mutex.Unlock()
+	wasActive := ft.active
+	ft.active = false
+	return wasActive
+}
+
+func (ft *fakeTimer) Reset(d time.Duration) bool {
+	ft.clock.mutex.Lock()
+	defer ft.clock.mutex.Unlock()
+	wasActive := ft.active
+	ft.active = true
+	ft.when = ft.clock.now.Add(d)
+	return wasActive
+}
+
+func TestFakeClock(t *testing.T) {
+	fc := newFakeClock()
+	start := fc.Now()
+
+	funcChan := make(chan bool, 1)
+	t1 := fc.NewTimer(2 * time.Second)
+	fc.AfterFunc(time.Second, func() { funcChan <- true })
+	t3 := fc.NewTimer(3 * time.Second)
+
+	fc.Advance(500 * time.Millisecond)
+	select {
+	case <-t1.C():
+		t.Fatalf("timer fired early")
+	default:
+	}
+
+	if !t3.Stop() {
+		t.Errorf("expected Stop() to report an active timer")
+	}
+
+	fc.Advance(time.Hour)
+	<-funcChan
+	if fired := (<-t1.C()).Sub(start); fired != 2*time.Second {
+		t.Errorf("expected timer to fire at 2s, got %v", fired)
+	}
+	select {
+	case <-t3.C():
+		t.Errorf("stopped timer fired")
+	default:
+	}
+
+	if t1.Reset(time.Minute) {
+		t.Errorf("expected Reset() to report an expired timer")
+	}
+	fc.Advance(time.Minute)
+	if now := (<-t1.C()).Sub(start); now != time.Hour+time.Minute+500*time.Millisecond {
+		t.Errorf("expected reset timer to fire at 1h1m0.5s, got %v", now)
+	}
+}
+
+// TestTransportRetransmitBackoff drives a HELLO through its full sequence
+// of retransmits using a fake clock, checking the exponential backoff
+// intervals, which are capped at 8 seconds, and that the transport fails
+// once retries are exhausted.
+func TestTransportRetransmitBackoff(t *testing.T) {
+	const maxRetries = 13
+	const retryTimeout = time.Second
+	const helloTimeout = 2 * time.Hour
+
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+
+	cp, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(): %v", err)
+	}
+
+	err = cp.bind()
+	if err != nil {
+		t.Fatalf("cp.bind(): %v", err)
+	}
+
+	err = cp.connect()
+	if err != nil {
+		t.Fatalf("cp.connect(): %v", err)
+	}
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9001})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer peer.Close()
+
+	fc := newFakeClock()
+	start := fc.Now()
+
+	xport, err := newTransport(
+		level.NewFilter(log.NewLogfmtLogger(os.Stderr),
+			level.AllowInfo()),
+		cp, transportConfig{
+			Version:           ProtocolVersion2,
+			HelloTimeout:      helloTimeout,
+			MaxRetries:        maxRetries,
+			RetryTimeout:      retryTimeout,
+			PeerControlConnID: 90,
+			ControlConnID:     42,
+			Clock:             fc,
+		})
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+	defer xport.close()
+
+	// Only the HELLO timer should be running
+	err = fc.waitForTimers(1)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	fc.Advance(helloTimeout)
+
+	// Each transmission re-arms the HELLO timer and the retry timer
+	retryAt := time.Duration(0)
+	for i := 0; i < maxRetries; i++ {
+		msg, err := testPeerRecvMessage(peer)
+		if err != nil {
+			t.Fatalf("transmit %v: expected HELLO: %v", i, err)
+		}
+		if msg.getType() != avpMsgTypeHello || msg.ns() != 0 {
+			t.Fatalf("transmit %v: expected HELLO with ns 0, got %v ns %v", i, msg.getType(), msg.ns())
+		}
+		if elapsed := fc.Now().Sub(start); elapsed != helloTimeout+retryAt {
+			t.Fatalf("transmit %v: expected at %v, got %v", i, helloTimeout+retryAt, elapsed)
+		}
+
+		err = fc.waitForTimers(2)
+		if err != nil {
+			t.Fatalf("transmit %v: %v", i, err)
+		}
+		timeout := retryTimeout * (1 << uint(i))
+		if timeout > maxRetryTimeout {
+			timeout = maxRetryTimeout
+		}
+		if next := fc.activeTimers()[0]; next != timeout {
+			t.Fatalf("transmit %v: expected retry after %v, got %v", i, timeout, next)
+		}
+		retryAt += timeout
+		fc.Advance(timeout)
+	}
+
+	// The final retry timeout exhausts the retries and the transport fails
+	_, err = xport.recv()
+	if err == nil {
+		t.Fatalf("expected transport to fail after %v retries", maxRetries)
+	}
+	if elapsed := fc.Now().Sub(start); elapsed != helloTimeout+retryAt {
+		t.Errorf("expected failure after %v, got %v", helloTimeout+retryAt, elapsed)
+	}
+}
+
+// TestTransportAdaptiveRetry checks that in adaptive mode the retry
+// timeout follows the round trip time measured from the peer's acks.
+func TestTransportAdaptiveRetry(t *testing.T) {
+	sa, sb := testMemAddressPair(t)
+	cpa, peer := newMemControlPlanePair(sa, sb, memLinkConfig{}, memLinkConfig{})
+	defer peer.close()
+
+	fc := newFakeClock()
+	xport, err := newTransport(
+		level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo()),
+		cpa, transportConfig{
+			Version:           ProtocolVersion3,
+			RetryTimeout:      time.Second,
+			RetryMode:         RetryModeAdaptive,
+			PeerControlConnID: 1,
+			Clock:             fc,
+		})
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+	defer xport.close()
+
+	cfg := xport.getConfig()
+	ackAvp, err := newAvp(vendorIDIetf, avpTypeMessage, avpMsgTypeAck)
+	if err != nil {
+		t.Fatalf("newAvp(): %v", err)
+	}
+
+	// Each HELLO is acked by the peer after the delay, and the retry
+	// timer for the next HELLO reflects the measurements so far.
+	cases := []struct {
+		delay, retryTimeout time.Duration
+	}{
+		{delay: 200 * time.Millisecond, retryTimeout: time.Second},
+		{delay: 200 * time.Millisecond, retryTimeout: 600 * time.Millisecond},
+		{delay: 200 * time.Millisecond, retryTimeout: 500 * time.Millisecond},
+	}
+	for i, c := range cases {
+		msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+		if err != nil {
+			t.Fatalf("failed to build Hello message: %v", err)
+		}
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- xport.send(msg)
+		}()
+
+		sent, err := testMemPeerRecv(peer)
+		if err != nil {
+			t.Fatalf("HELLO %v: %v", i, err)
+		}
+
+		found := false
+		for j := 0; j < 1000 && !found; j++ {
+			for _, when := range fc.activeTimers() {
+				if when == c.retryTimeout {
+					found = true
+				}
+			}
+			time.Sleep(time.Millisecond)
+		}
+		if !found {
+			t.Fatalf("HELLO %v: expected retry after %v, got timers %v", i, c.retryTimeout, fc.activeTimers())
+		}
+
+		fc.Advance(c.delay)
+		ack, err := newV3ControlMessage(1, []avp{*ackAvp})
+		if err != nil {
+			t.Fatalf("newV3ControlMessage(): %v", err)
+		}
+		err = testMemPeerSend(peer, ack, 0, seqIncrement(sent.ns()))
+		if err != nil {
+			t.Fatalf("HELLO %v: failed to ack: %v", i, err)
+		}
+		err = <-errChan
+		if err != nil {
+			t.Fatalf("HELLO %v: send(): %v", i, err)
+		}
+	}
+
+	stats, err := xport.getStats()
+	if err != nil {
+		t.Fatalf("getStats(): %v", err)
+	}
+	if stats.SRTT != 200*time.Millisecond || stats.Retransmits != 0 {
+		t.Errorf("unexpected stats: %+v", stats)
+	}
+}
@@ -20,16 +20,27 @@ type Config struct {
 // connection between two L2TP hosts.  Each tunnel may contain
 // multiple sessions.
 type TunnelConfig struct {
-	Local        string
-	Peer         string
-	Encap        EncapType
-	Version      ProtocolVersion
-	TunnelID     ControlConnID
-	PeerTunnelID ControlConnID
-	WindowSize   uint16
-	HelloTimeout time.Duration
-	RetryTimeout time.Duration
-	MaxRetries   uint
+	Local         string
+	Peer          string
+	Encap         EncapType
+	Version       ProtocolVersion
+	TunnelID      ControlConnID
+	PeerTunnelID  ControlConnID
+	WindowSize    uint16
+	RxWindowSize  uint16
+	HelloTimeout  time.Duration
+	RetryTimeout  time.Duration
+	RetryMode     RetryMode
+	MaxRetries    uint
+	DeferConnect  bool
+	NATTraversal  bool
+	BindInterface string
+	Netns         string
+	VRF           string
+	// CaptureFile if set enables capture of control messages to a
+	// pcapng file, which is rotated when it reaches CaptureMaxSize bytes.
+	CaptureFile    string
+	CaptureMaxSize uint
 	// map of sessions within the tunnel
 	Sessions map[string]*SessionConfig
 }
@@ -46,6 +57,9 @@ type SessionConfig struct {
 	PeerCookie     []byte
 	InterfaceName  string
 	L2SpecType     L2SpecType
+	// CircuitInterface if set names the network interface of the
+	// session's attachment circuit, whose status is signalled to the peer.
+	CircuitInterface string
 }
 
 func toBool(v interface{}) (bool, error) {
@@ -124,8 +138,10 @@ func toVersion(v interface{}) (ProtocolVersion, error) {
 			return ProtocolVersion2, nil
 		case "l2tpv3":
 			return ProtocolVersion3, nil
+		case "l2tpv3fallback":
+			return ProtocolVersion3Fallback, nil
 		}
-		return 0, fmt.Errorf("expect 'l2tpv2' or 'l2tpv3'")
+		return 0, fmt.Errorf("expect 'l2tpv2', 'l2tpv3' or 'l2tpv3fallback'")
 	}
 	return 0, err
 }
@@ -172,6 +188,20 @@ func toL2SpecType(v interface{}) (L2SpecType, error) {
 	return L2SpecTypeNone, err
 }
 
+func toRetryMode(v interface{}) (RetryMode, error) {
+	s, err := toString(v)
+	if err == nil {
+		switch s {
+		case "fixed":
+			return RetryModeFixed, nil
+		case "adaptive":
+			return RetryModeAdaptive, nil
+		}
+		return 0, fmt.Errorf("expect 'fixed' or 'adaptive'")
+	}
+	return 0, err
+}
+
 func toCCID(v interface{}) (ControlConnID, error) {
 	u, err := toUint32(v)
 	return ControlConnID(u), err
@@ -221,6 +251,8 @@ func newSessionConfig(scfg map[string]interface{}) (*SessionConfig, error) {
 			sc.InterfaceName, err = toString(v)
 		case "l2spec_type":
 			sc.L2SpecType, err = toL2SpecType(v)
+		case "circuit_interface":
+			sc.CircuitInterface, err = toString(v)
 		default:
 			return nil, fmt.Errorf("unrecognised parameter '%v'", k)
 		}
@@ -271,14 +303,34 @@ func newTunnelConfig(tcfg map[string]interface{}) (*TunnelConfig, error) {
 			tc.PeerTunnelID, err = toCCID(v)
 		case "window_size":
 			tc.WindowSize, err = toUint16(v)
+		case "rx_window_size":
+			tc.RxWindowSize, err = toUint16(v)
 		case "hello_timeout":
 			tc.HelloTimeout, err = toDurationMs(v)
 		case "retry_timeout":
 			tc.RetryTimeout, err = toDurationMs(v)
+		case "retry_mode":
+			tc.RetryMode, err = toRetryMode(v)
 		case "max_retries":
 			if u, err := toUint16(v); err == nil {
 				tc.MaxRetries = uint(u)
 			}
+		case "defer_connect":
+			tc.DeferConnect, err = toBool(v)
+		case "nat_traversal":
+			tc.NATTraversal, err = toBool(v)
+		case "bind_interface":
+			tc.BindInterface, err = toString(v)
+		case "netns":
+			tc.Netns, err = toString(v)
+		case "vrf":
+			tc.VRF, err = toString(v)
+		case "capture_file":
+			tc.CaptureFile, err = toString(v)
+		case "capture_max_size":
+			var u uint32
+			u, err = toUint32(v)
+			tc.CaptureMaxSize = uint(u)
 		case "session":
 			err = tc.loadSessions(v)
 		default:
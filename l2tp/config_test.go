@@ -19,6 +19,9 @@ func TestGetTunnels(t *testing.T) {
 				 peer = "82.9.90.101:1701"
 				 tid = 412
 				 ptid = 8192
+				 vrf = "vrf-blue"
+				 capture_file = "/tmp/t1.pcapng"
+				 capture_max_size = 1048576
 
 				 [tunnel.t2]
 				 encap = "udp"
@@ -26,27 +29,42 @@ func TestGetTunnels(t *testing.T) {
 				 peer = "[2001:0000:1234:0000:0000:C1C0:ABCD:0876]:6543"
 				 hello_timeout = 250
 				 window_size = 10
+				 rx_window_size = 8
 				 retry_timeout = 250
+				 retry_mode = "adaptive"
 				 max_retries = 2
+				 defer_connect = true
+				 nat_traversal = true
+				 bind_interface = "eth1"
+				 netns = "tenant1"
 				 `,
 			want: map[string]*TunnelConfig{
 				"t1": &TunnelConfig{
-					Encap:        EncapTypeIP,
-					Version:      ProtocolVersion3,
-					Peer:         "82.9.90.101:1701",
-					TunnelID:     412,
-					PeerTunnelID: 8192,
-					Sessions:     make(map[string]*SessionConfig),
+					Encap:          EncapTypeIP,
+					Version:        ProtocolVersion3,
+					Peer:           "82.9.90.101:1701",
+					TunnelID:       412,
+					PeerTunnelID:   8192,
+					VRF:            "vrf-blue",
+					CaptureFile:    "/tmp/t1.pcapng",
+					CaptureMaxSize: 1048576,
+					Sessions:       make(map[string]*SessionConfig),
 				},
 				"t2": &TunnelConfig{
-					Encap:        EncapTypeUDP,
-					Version:      ProtocolVersion2,
-					Peer:         "[2001:0000:1234:0000:0000:C1C0:ABCD:0876]:6543",
-					Sessions:     make(map[string]*SessionConfig),
-					HelloTimeout: 250 * time.Millisecond,
-					WindowSize:   10,
-					RetryTimeout: 250 * time.Millisecond,
-					MaxRetries:   2,
+					Encap:         EncapTypeUDP,
+					Version:       ProtocolVersion2,
+					Peer:          "[2001:0000:1234:0000:0000:C1C0:ABCD:0876]:6543",
+					Sessions:      make(map[string]*SessionConfig),
+					HelloTimeout:  250 * time.Millisecond,
+					WindowSize:    10,
+					RxWindowSize:  8,
+					RetryTimeout:  250 * time.Millisecond,
+					RetryMode:     RetryModeAdaptive,
+					MaxRetries:    2,
+					DeferConnect:  true,
+					NATTraversal:  true,
+					BindInterface: "eth1",
+					Netns:         "tenant1",
 				},
 			},
 		},
@@ -63,6 +81,7 @@ func TestGetTunnels(t *testing.T) {
 				 seqnum = true
 				 reorder_timeout = 1500
 				 l2spec_type = "none"
+				 circuit_interface = "eth1"
 
 				 [tunnel.t1.session.s2]
 				 pseudowire = "ppp"
@@ -78,12 +97,13 @@ func TestGetTunnels(t *testing.T) {
 					Peer:    "127.0.0.1:5001",
 					Sessions: map[string]*SessionConfig{
 						"s1": &SessionConfig{
-							Pseudowire:     PseudowireTypeEth,
-							Cookie:         []byte{0x34, 0x04, 0xa9, 0xbe},
-							PeerCookie:     []byte{0x80, 0x12, 0xff, 0x5b},
-							SeqNum:         true,
-							ReorderTimeout: time.Millisecond * 1500,
-							L2SpecType:     L2SpecTypeNone,
+							Pseudowire:       PseudowireTypeEth,
+							Cookie:           []byte{0x34, 0x04, 0xa9, 0xbe},
+							PeerCookie:       []byte{0x80, 0x12, 0xff, 0x5b},
+							SeqNum:           true,
+							ReorderTimeout:   time.Millisecond * 1500,
+							L2SpecType:       L2SpecTypeNone,
+							CircuitInterface: "eth1",
 						},
 						"s2": &SessionConfig{
 							Pseudowire:    PseudowireTypePPP,
@@ -96,6 +116,19 @@ func TestGetTunnels(t *testing.T) {
 				},
 			},
 		},
+		{
+			in: `[tunnel.t1]
+				 version = "l2tpv3fallback"
+				 peer = "127.0.0.1:5001"
+				`,
+			want: map[string]*TunnelConfig{
+				"t1": &TunnelConfig{
+					Version:  ProtocolVersion3Fallback,
+					Peer:     "127.0.0.1:5001",
+					Sessions: make(map[string]*SessionConfig),
+				},
+			},
+		},
 	}
 	for _, c := range cases {
 		cfg, err := LoadConfigString(c.in)
@@ -149,7 +182,13 @@ func TestBadConfig(t *testing.T) {
 			name: "Bad value (unrecognised version)",
 			in: `[tunnel.t1]
 				 version = "2001"`,
-			estr: "expect 'l2tpv2' or 'l2tpv3'",
+			estr: "expect 'l2tpv2', 'l2tpv3' or 'l2tpv3fallback'",
+		},
+		{
+			name: "Bad value (unrecognised retry mode)",
+			in: `[tunnel.t1]
+				 retry_mode = "eventually"`,
+			estr: "expect 'fixed' or 'adaptive'",
 		},
 		{
 			name: "Bad value (unrecognised pseudowire)",
@@ -8,7 +8,12 @@ import (
 type ProtocolVersion int
 
 const (
-	// ProtocolVersion3Fallback is used for RFC3931 fallback mode
+	// ProtocolVersion3Fallback is used for RFC3931 fallback mode, in
+	// which an L2TPv3 control connection is started by an SCCRQ using
+	// L2TPv2 framing.  The SCCRQ carries the L2TPv3 AVPs alongside the
+	// L2TPv2 ones, so that a peer supporting only L2TPv2 can ignore
+	// them.  Once the SCCRQ has been accepted the control connection
+	// runs L2TPv3.
 	ProtocolVersion3Fallback = 1
 	// ProtocolVersion2 is used for RFC2661
 	ProtocolVersion2 = nll2tp.ProtocolVersion2
@@ -80,6 +85,28 @@ const (
 	L2SpecTypeDefault = nll2tp.L2spectypeDefault
 )
 
+// RetryMode selects how the reliable transport determines how long to
+// wait for the peer to ack a control message before retransmitting it.
+type RetryMode int
+
+const (
+	// RetryModeFixed starts from the configured retry timeout
+	RetryModeFixed RetryMode = iota
+	// RetryModeAdaptive starts from a timeout derived from the round trip
+	// time measured using the peer's acks, as per RFC6298
+	RetryModeAdaptive
+)
+
+func (m RetryMode) String() string {
+	switch m {
+	case RetryModeFixed:
+		return "fixed"
+	case RetryModeAdaptive:
+		return "adaptive"
+	}
+	panic("unhandled retry mode")
+}
+
 // TunnelType define the runtime behaviour of a tunnel instance.
 type TunnelType int
 
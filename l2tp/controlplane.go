@@ -1,19 +1,73 @@
 package l2tp
 
 import (
+	"bytes"
 	"fmt"
+	"net"
 	"os"
+	"strconv"
 	"syscall"
 
 	"golang.org/x/sys/unix"
 )
 
+// controlPlaneConn is the interface the transport uses to send and
+// receive control frames.  It is implemented by controlPlane using a
+// tunnel socket, and by an in-memory pair for testing.
+type controlPlaneConn interface {
+	// recvFrom blocks until a frame is received, returning the
+	// frame length and the address of the sender.
+	recvFrom(p []byte) (n int, addr unix.Sockaddr, err error)
+	// recvBatch blocks until at least one frame is received, and reads
+	// up to len(msgs) frames into messages from newRawMsg, returning
+	// the number of frames read.  The caller frees the messages.
+	recvBatch(msgs []*rawMsg) (n int, err error)
+	// write sends a frame to the peer.
+	write(b []byte) (n int, err error)
+	// close releases resources and unblocks recvFrom.
+	close() error
+	// localAddr and remoteAddr return the addresses of the connection.
+	localAddr() unix.Sockaddr
+	remoteAddr() unix.Sockaddr
+	// isConnected returns true once the connection has been connected
+	// to the peer: prior to this frames may be received from any host.
+	isConnected() bool
+	// connectTo connects to the peer at the specified address.
+	connectTo(sa unix.Sockaddr) error
+	// isPeer returns true if sa is from the peer host.
+	isPeer(sa unix.Sockaddr) bool
+	// natListener returns the NAT traversal listener, or nil if NAT
+	// traversal isn't enabled.
+	natListener() controlPlaneConn
+}
+
+// pollableConn is a controlPlaneConn whose socket may be polled by a
+// reactor rather than being read by a goroutine blocking in recvBatch.
+type pollableConn interface {
+	controlPlaneConn
+	// pollFd returns the socket file descriptor to poll for readability.
+	pollFd() int
+	// tryRecvBatch is like recvBatch, but returns unix.EAGAIN rather
+	// than blocking if no frames are waiting.
+	tryRecvBatch(msgs []*rawMsg) (n int, err error)
+}
+
 type controlPlane struct {
 	local, remote unix.Sockaddr
 	fd            int
 	file          *os.File
 	rc            syscall.RawConn
 	connected     bool
+	// onConnect, if set, is called once the control plane socket
+	// has been connected to the peer.
+	onConnect func(cp *controlPlane) error
+	// listener, if set, is an unconnected socket bound to the same
+	// local address, used for NAT traversal: c.f. enableNATTraversal.
+	listener *controlPlane
+	// lastAddr caches the sender address of the last frame read.  It is
+	// only accessed by the socket's reader, which is either a goroutine
+	// calling recvBatch or a reactor calling tryRecvBatch.
+	lastAddr rawSockaddrCache
 }
 
 func (cp *controlPlane) recvFrom(p []byte) (n int, addr unix.Sockaddr, err error) {
@@ -27,6 +81,54 @@ func (cp *controlPlane) recvFrom(p []byte) (n int, addr unix.Sockaddr, err error
 	return n, addr, cerr
 }
 
+func (cp *controlPlane) recvBatch(msgs []*rawMsg) (n int, err error) {
+	mb := mmsgBatchPool.Get().(*mmsgBatch)
+	defer mmsgBatchPool.Put(mb)
+
+	// Frame buffers are only held while recvmmsg runs, so that idle
+	// tunnels don't tie them up waiting for the socket to be readable.
+	cerr := cp.rc.Read(func(fd uintptr) bool {
+		n, err = mb.recv(fd, msgs)
+		return err != unix.EAGAIN && err != unix.EWOULDBLOCK
+	})
+	if err == nil {
+		err = cerr
+	}
+	return cp.finishBatch(mb, msgs, n, err)
+}
+
+func (cp *controlPlane) tryRecvBatch(msgs []*rawMsg) (n int, err error) {
+	mb := mmsgBatchPool.Get().(*mmsgBatch)
+	defer mmsgBatchPool.Put(mb)
+
+	cerr := cp.rc.Control(func(fd uintptr) {
+		n, err = mb.recv(fd, msgs)
+	})
+	if err == nil {
+		err = cerr
+	}
+	return cp.finishBatch(mb, msgs, n, err)
+}
+
+// finishBatch sets the sender addresses of the messages read by
+// mmsgBatch.recv, or frees them on error.
+func (cp *controlPlane) finishBatch(mb *mmsgBatch, msgs []*rawMsg, n int, err error) (int, error) {
+	for i := 0; i < n && err == nil; i++ {
+		msgs[i].sa, err = cp.lastAddr.sockaddr(&mb.names[i], cp.local)
+	}
+	if err != nil {
+		for _, m := range msgs[:n] {
+			m.free()
+		}
+		return 0, err
+	}
+	return n, nil
+}
+
+func (cp *controlPlane) pollFd() int {
+	return cp.fd
+}
+
 func (cp *controlPlane) write(b []byte) (n int, err error) {
 	if cp.connected {
 		return cp.file.Write(b)
@@ -50,6 +152,9 @@ func (cp *controlPlane) sendto(p []byte, to unix.Sockaddr) (err error) {
 }
 
 func (cp *controlPlane) close() (err error) {
+	if cp.listener != nil {
+		_ = cp.listener.close()
+	}
 	if cp.file != nil {
 		err = cp.file.Close()
 		cp.file = nil
@@ -57,18 +162,123 @@ func (cp *controlPlane) close() (err error) {
 	return
 }
 
+func (cp *controlPlane) localAddr() unix.Sockaddr {
+	return cp.local
+}
+
+func (cp *controlPlane) remoteAddr() unix.Sockaddr {
+	return cp.remote
+}
+
+func (cp *controlPlane) isConnected() bool {
+	return cp.connected
+}
+
+func (cp *controlPlane) natListener() controlPlaneConn {
+	// Avoid returning a nil pointer as a non-nil interface
+	if cp.listener == nil {
+		return nil
+	}
+	return cp.listener
+}
+
+// enableNATTraversal creates an unconnected listener socket bound to
+// the same local address as the control plane socket.
+//
+// Once the control plane socket is connected the kernel will deliver
+// frames from the peer to it, while frames from any other address are
+// delivered to the listener.  This allows the transport to detect the
+// peer's address changing, e.g. due to a NAT binding being reassigned.
+//
+// enableNATTraversal must be called prior to bind.
+func (cp *controlPlane) enableNATTraversal() (err error) {
+	switch cp.local.(type) {
+	case *unix.SockaddrInet4, *unix.SockaddrInet6:
+	default:
+		return fmt.Errorf("NAT traversal is only supported for UDP encapsulation")
+	}
+
+	cp.listener, err = newL2tpControlPlane(cp.local, cp.remote)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range []*controlPlane{cp, cp.listener} {
+		err = unix.SetsockoptInt(c.fd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)
+		if err != nil {
+			return fmt.Errorf("failed to set SO_REUSEADDR: %v", err)
+		}
+	}
+
+	return cp.listener.bind()
+}
+
 func (cp *controlPlane) connect() error {
-	err := tunnelSocketConnect(cp.fd, cp.remote)
-	if err == nil {
-		cp.connected = true
+	return cp.connectTo(cp.remote)
+}
+
+// connectTo connects the control plane socket to the specified peer
+// address, which may differ from the address the control plane was
+// created with if the peer has replied from a different port.
+func (cp *controlPlane) connectTo(sa unix.Sockaddr) error {
+	switch sa.(type) {
+	case *unix.SockaddrL2TPIP, *unix.SockaddrL2TPIP6:
+		// The peer's control connection ID isn't reported by recvfrom,
+		// and IP encapsulation has no ports to float, so we always use
+		// the address we were configured with.
+		sa = cp.remote
 	}
-	return err
+	err := tunnelSocketConnect(cp.fd, sa)
+	if err != nil {
+		return err
+	}
+	cp.remote = sa
+	cp.connected = true
+	if cp.onConnect != nil {
+		return cp.onConnect(cp)
+	}
+	return nil
+}
+
+// isPeer returns true if the address sa is from the peer host the
+// control plane was created for.  The port is not considered since
+// RFC2661 peers may reply from a different port to the one we targeted.
+func (cp *controlPlane) isPeer(sa unix.Sockaddr) bool {
+	a1, _, err := sockaddrAddrPort(sa)
+	if err != nil {
+		return false
+	}
+	a2, _, err := sockaddrAddrPort(cp.remote)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(a1, a2)
 }
 
 func (cp *controlPlane) bind() error {
 	return tunnelSocketBind(cp.fd, cp.local)
 }
 
+// bindToDevice binds the control plane socket, and the NAT traversal
+// listener if present, to the specified network interface.
+// bindToDevice must be called prior to bind.
+func (cp *controlPlane) bindToDevice(ifname string) error {
+	err := tunnelSocketBindToDevice(cp.fd, ifname)
+	if err == nil && cp.listener != nil {
+		err = cp.listener.bindToDevice(ifname)
+	}
+	return err
+}
+
+// sockaddrString renders a socket address in a human-readable form.
+func sockaddrString(sa unix.Sockaddr) string {
+	addr, port, err := sockaddrAddrPort(sa)
+	if err != nil {
+		return "invalid address"
+	}
+	return net.JoinHostPort(net.IP(addr).String(), strconv.Itoa(int(port)))
+}
+
 func tunnelSocket(family, protocol int) (fd int, err error) {
 
 	fd, err = unix.Socket(family, unix.SOCK_DGRAM, protocol)
@@ -100,6 +310,14 @@ func tunnelSocketBind(fd int, local unix.Sockaddr) error {
 	return unix.Bind(fd, local)
 }
 
+func tunnelSocketBindToDevice(fd int, ifname string) error {
+	err := unix.SetsockoptString(fd, unix.SOL_SOCKET, unix.SO_BINDTODEVICE, ifname)
+	if err != nil {
+		return fmt.Errorf("failed to bind to device %q: %v", ifname, err)
+	}
+	return nil
+}
+
 func tunnelSocketConnect(fd int, remote unix.Sockaddr) error {
 	return unix.Connect(fd, remote)
 }
@@ -0,0 +1,661 @@
+package l2tp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+// memLinkConfig describes the impairments applied to frames written
+// to one end of an in-memory control plane pair.
+type memLinkConfig struct {
+	// Probability of a frame being dropped
+	lossRate float64
+	// Probability of a frame being delivered twice
+	dupRate float64
+	// Probability of a frame being held back and delivered after the
+	// next frame written
+	reorderRate float64
+	// Delay before a frame is delivered
+	delay time.Duration
+	// Clock used to delay frames.  If nil, the system clock is used.
+	clock clock
+	// Seed for the impairment random number generator
+	seed int64
+}
+
+type memFrame struct {
+	b  []byte
+	sa unix.Sockaddr
+}
+
+// memControlPlane is one end of an in-memory pair implementing
+// controlPlaneConn, allowing the transport to be tested without
+// sockets or privileges.
+type memControlPlane struct {
+	local, remote unix.Sockaddr
+	cfg           memLinkConfig
+	peer          *memControlPlane
+	rxChan        chan *memFrame
+	closeChan     chan struct{}
+	closeOnce     sync.Once
+	// mutex protects the fields below
+	mutex     sync.Mutex
+	connected bool
+	rng       *rand.Rand
+	held      *memFrame
+}
+
+// newMemControlPlanePair creates a connected pair of in-memory control
+// planes.  Frames written to a are impaired according to cfgA, while
+// frames written to b are impaired according to cfgB.
+func newMemControlPlanePair(sa, sb unix.Sockaddr, cfgA, cfgB memLinkConfig) (a, b *memControlPlane) {
+	newEnd := func(local, remote unix.Sockaddr, cfg memLinkConfig) *memControlPlane {
+		if cfg.clock == nil {
+			cfg.clock = realClock{}
+		}
+		return &memControlPlane{
+			local:     local,
+			remote:    remote,
+			cfg:       cfg,
+			rxChan:    make(chan *memFrame, 1024),
+			closeChan: make(chan struct{}),
+			connected: true,
+			rng:       rand.New(rand.NewSource(cfg.seed)),
+		}
+	}
+	a = newEnd(sa, sb, cfgA)
+	b = newEnd(sb, sa, cfgB)
+	a.peer, b.peer = b, a
+	return
+}
+
+func (m *memControlPlane) recvFrom(p []byte) (n int, addr unix.Sockaddr, err error) {
+	select {
+	case f := <-m.rxChan:
+		return copy(p, f.b), f.sa, nil
+	case <-m.closeChan:
+		return 0, nil, errors.New("control plane closed")
+	}
+}
+
+func (m *memControlPlane) recvBatch(msgs []*rawMsg) (n int, err error) {
+	read := func(f *memFrame) {
+		msgs[n] = newRawMsg()
+		msgs[n].b = msgs[n].buf[:copy(msgs[n].buf, f.b)]
+		msgs[n].sa = f.sa
+		n++
+	}
+	select {
+	case f := <-m.rxChan:
+		read(f)
+	case <-m.closeChan:
+		return 0, errors.New("control plane closed")
+	}
+	for n < len(msgs) {
+		select {
+		case f := <-m.rxChan:
+			read(f)
+		default:
+			return n, nil
+		}
+	}
+	return n, nil
+}
+
+func (m *memControlPlane) write(b []byte) (n int, err error) {
+	select {
+	case <-m.closeChan:
+		return 0, errors.New("control plane closed")
+	default:
+	}
+
+	f := &memFrame{b: append([]byte(nil), b...), sa: m.local}
+
+	m.mutex.Lock()
+	var out []*memFrame
+	if m.rng.Float64() >= m.cfg.lossRate {
+		out = append(out, f)
+		if m.rng.Float64() < m.cfg.dupRate {
+			out = append(out, f)
+		}
+	}
+	if m.held != nil {
+		out = append(out, m.held)
+		m.held = nil
+	} else if len(out) > 0 && m.rng.Float64() < m.cfg.reorderRate {
+		m.held = out[0]
+		out = out[1:]
+	}
+	m.mutex.Unlock()
+
+	for _, f := range out {
+		m.deliver(f)
+	}
+	return len(b), nil
+}
+
+func (m *memControlPlane) deliver(f *memFrame) {
+	enqueue := func() {
+		select {
+		case m.peer.rxChan <- f:
+		default:
+			// Receive buffer full, drop the frame as a socket would
+		}
+	}
+	if m.cfg.delay > 0 {
+		m.cfg.clock.AfterFunc(m.cfg.delay, enqueue)
+	} else {
+		enqueue()
+	}
+}
+
+func (m *memControlPlane) close() error {
+	m.closeOnce.Do(func() { close(m.closeChan) })
+	return nil
+}
+
+func (m *memControlPlane) localAddr() unix.Sockaddr {
+	return m.local
+}
+
+func (m *memControlPlane) remoteAddr() unix.Sockaddr {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.remote
+}
+
+func (m *memControlPlane) isConnected() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.connected
+}
+
+func (m *memControlPlane) connectTo(sa unix.Sockaddr) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.remote = sa
+	m.connected = true
+	return nil
+}
+
+func (m *memControlPlane) isPeer(sa unix.Sockaddr) bool {
+	a1, _, err := sockaddrAddrPort(sa)
+	if err != nil {
+		return false
+	}
+	a2, _, err := sockaddrAddrPort(m.remoteAddr())
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(a1, a2)
+}
+
+func (m *memControlPlane) natListener() controlPlaneConn {
+	return nil
+}
+
+func testMemAddressPair(t *testing.T) (sa, sb unix.Sockaddr) {
+	sa, sb, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	return
+}
+
+func TestMemControlPlane(t *testing.T) {
+	cases := []struct {
+		name   string
+		cfg    memLinkConfig
+		writes [][]byte
+		expect [][]byte
+	}{
+		{
+			name:   "clean",
+			writes: [][]byte{{1}, {2}, {3}},
+			expect: [][]byte{{1}, {2}, {3}},
+		},
+		{
+			name:   "loss",
+			cfg:    memLinkConfig{lossRate: 1},
+			writes: [][]byte{{1}, {2}},
+		},
+		{
+			name:   "duplication",
+			cfg:    memLinkConfig{dupRate: 1},
+			writes: [][]byte{{1}, {2}},
+			expect: [][]byte{{1}, {1}, {2}, {2}},
+		},
+		{
+			name:   "reordering",
+			cfg:    memLinkConfig{reorderRate: 1},
+			writes: [][]byte{{1}, {2}, {3}, {4}},
+			expect: [][]byte{{2}, {1}, {4}, {3}},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sa, sb := testMemAddressPair(t)
+			a, b := newMemControlPlanePair(sa, sb, c.cfg, memLinkConfig{})
+			defer a.close()
+			defer b.close()
+
+			for _, w := range c.writes {
+				_, err := a.write(w)
+				if err != nil {
+					t.Fatalf("write(): %v", err)
+				}
+			}
+
+			var got [][]byte
+			for len(b.rxChan) > 0 {
+				p := make([]byte, 16)
+				n, addr, err := b.recvFrom(p)
+				if err != nil {
+					t.Fatalf("recvFrom(): %v", err)
+				}
+				if !b.isPeer(addr) {
+					t.Errorf("recvFrom(): unexpected sender %v", sockaddrString(addr))
+				}
+				got = append(got, p[:n])
+			}
+			if len(got) != len(c.expect) {
+				t.Fatalf("expected %v, got %v", c.expect, got)
+			}
+			for i := range got {
+				if !bytes.Equal(got[i], c.expect[i]) {
+					t.Fatalf("expected %v, got %v", c.expect, got)
+				}
+			}
+		})
+	}
+}
+
+func TestMemControlPlaneDelay(t *testing.T) {
+	fc := newFakeClock()
+	sa, sb := testMemAddressPair(t)
+	a, b := newMemControlPlanePair(sa, sb,
+		memLinkConfig{delay: 300 * time.Millisecond, clock: fc},
+		memLinkConfig{})
+	defer a.close()
+	defer b.close()
+
+	_, err := a.write([]byte{1})
+	if err != nil {
+		t.Fatalf("write(): %v", err)
+	}
+
+	fc.Advance(299 * time.Millisecond)
+	if len(b.rxChan) != 0 {
+		t.Fatalf("frame delivered before delay expired")
+	}
+	fc.Advance(time.Millisecond)
+
+	p := make([]byte, 16)
+	n, _, err := b.recvFrom(p)
+	if err != nil || n != 1 || p[0] != 1 {
+		t.Fatalf("recvFrom(): got %v, %v", p[:n], err)
+	}
+
+	// Closing unblocks the reader
+	go a.close()
+	_, _, err = a.recvFrom(p)
+	if err == nil {
+		t.Fatalf("expected recvFrom() to fail once closed")
+	}
+}
+
+// TestTransportImpairedLink checks that the reliable transport delivers
+// messages in order, exactly once, over links which lose, duplicate,
+// reorder and delay frames.
+func TestTransportImpairedLink(t *testing.T) {
+	cases := []struct {
+		name string
+		link memLinkConfig
+	}{
+		{
+			name: "clean",
+		},
+		{
+			name: "loss",
+			link: memLinkConfig{lossRate: 0.3, seed: 5},
+		},
+		{
+			name: "duplication",
+			link: memLinkConfig{dupRate: 0.5, seed: 2},
+		},
+		{
+			name: "reordering",
+			link: memLinkConfig{reorderRate: 0.5, seed: 3},
+		},
+		{
+			name: "delay",
+			link: memLinkConfig{delay: 2 * time.Millisecond},
+		},
+		{
+			name: "everything",
+			link: memLinkConfig{lossRate: 0.2, dupRate: 0.2, reorderRate: 0.2, delay: time.Millisecond, seed: 4},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sa, sb := testMemAddressPair(t)
+			peerLink := c.link
+			peerLink.seed++
+			cpa, cpb := newMemControlPlanePair(sa, sb, c.link, peerLink)
+
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+			xcfg := transportConfig{
+				Version:      ProtocolVersion3,
+				MaxRetries:   10,
+				RetryTimeout: 10 * time.Millisecond,
+				AckTimeout:   2 * time.Millisecond,
+			}
+
+			xcfg.PeerControlConnID = 2
+			sender, err := newTransport(logger, cpa, xcfg)
+			if err != nil {
+				t.Fatalf("newTransport(): %v", err)
+			}
+			defer sender.close()
+
+			xcfg.PeerControlConnID = 1
+			receiver, err := newTransport(logger, cpb, xcfg)
+			if err != nil {
+				t.Fatalf("newTransport(): %v", err)
+			}
+			defer receiver.close()
+
+			errChan := make(chan error, 1)
+			go func() {
+				errChan <- testBasicSendRecvHelloReceiver(receiver)
+			}()
+
+			err = testBasicSendRecvHelloSender(sender)
+			if err != nil {
+				t.Fatalf("sender: %v", err)
+			}
+			err = <-errChan
+			if err != nil {
+				t.Fatalf("receiver: %v", err)
+			}
+		})
+	}
+}
+
+// TestTransportSendContext checks that a send abandoned by the caller
+// withdraws the message if it's still queued, but leaves a message which
+// has already been transmitted to be retransmitted.
+func TestTransportSendContext(t *testing.T) {
+	sa, sb := testMemAddressPair(t)
+	cpa, cpb := newMemControlPlanePair(sa, sb, memLinkConfig{lossRate: 1}, memLinkConfig{})
+	defer cpb.close()
+
+	logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+	xport, err := newTransport(logger, cpa, transportConfig{
+		Version:           ProtocolVersion3,
+		TxWindowSize:      1,
+		RetryTimeout:      time.Minute,
+		PeerControlConnID: 2,
+	})
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+	defer xport.close()
+
+	cases := []struct {
+		name                    string
+		txQueueLen, ackQueueLen int
+	}{
+		{
+			name:        "transmitted",
+			txQueueLen:  0,
+			ackQueueLen: 1,
+		},
+		{
+			name:        "queued",
+			txQueueLen:  0,
+			ackQueueLen: 1,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			cfg := xport.getConfig()
+			msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+			if err != nil {
+				t.Fatalf("failed to build Hello message: %v", err)
+			}
+
+			cctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			err = xport.sendContext(cctx, msg)
+			if err != context.DeadlineExceeded {
+				t.Fatalf("sendContext(): expected %v, got %v", context.DeadlineExceeded, err)
+			}
+
+			stats, err := xport.getStats()
+			if err != nil {
+				t.Fatalf("getStats(): %v", err)
+			}
+			if stats.TxQueueLen != c.txQueueLen || stats.AckQueueLen != c.ackQueueLen {
+				t.Errorf("expect tx/ack queue lengths %v/%v, got %v/%v",
+					c.txQueueLen, c.ackQueueLen, stats.TxQueueLen, stats.AckQueueLen)
+			}
+		})
+	}
+
+	// A context which is already done fails without blocking.
+	cctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cfg := xport.getConfig()
+	msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+	if err != nil {
+		t.Fatalf("failed to build Hello message: %v", err)
+	}
+	err = xport.sendContext(cctx, msg)
+	if err != context.Canceled {
+		t.Errorf("sendContext(): expected %v, got %v", context.Canceled, err)
+	}
+}
+
+// testNewUDPControlPlanePair creates a pair of UDP control plane
+// sockets, bound and connected to each other.
+func testNewUDPControlPlanePair(t testing.TB, local, remote string) (a, b *controlPlane) {
+	sa, sb, err := newUDPAddressPair(local, remote)
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	a, err = newL2tpControlPlane(sa, sb)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(): %v", err)
+	}
+	b, err = newL2tpControlPlane(sb, sa)
+	if err != nil {
+		a.close()
+		t.Fatalf("newL2tpControlPlane(): %v", err)
+	}
+	for _, cp := range []*controlPlane{a, b} {
+		if err = cp.bind(); err == nil {
+			err = cp.connect()
+		}
+		if err != nil {
+			a.close()
+			b.close()
+			t.Fatalf("failed to set up control plane: %v", err)
+		}
+	}
+	return
+}
+
+func TestControlPlaneRecvBatch(t *testing.T) {
+	cases := []struct {
+		local, remote string
+	}{
+		{local: "127.0.0.1:9000", remote: "127.0.0.1:9001"},
+		{local: "[::1]:9000", remote: "[::1]:9001"},
+	}
+	for _, c := range cases {
+		a, b := testNewUDPControlPlanePair(t, c.local, c.remote)
+
+		// Frames which are waiting on the socket are read in one go
+		frames := rawMsgBatchLen + 2
+		for i := 0; i < frames; i++ {
+			if _, err := a.write([]byte{byte(i)}); err != nil {
+				t.Fatalf("%v: write(): %v", c.local, err)
+			}
+		}
+
+		msgs := make([]*rawMsg, rawMsgBatchLen)
+		for i := 0; i < frames; {
+			n, err := b.recvBatch(msgs)
+			if err != nil {
+				t.Fatalf("%v: recvBatch(): %v", c.local, err)
+			}
+			if i == 0 && n != rawMsgBatchLen {
+				t.Errorf("%v: expected a full batch, got %v frames", c.local, n)
+			}
+			for _, msg := range msgs[:n] {
+				if !bytes.Equal(msg.b, []byte{byte(i)}) {
+					t.Errorf("%v: frame %v: got %v", c.local, i, msg.b)
+				}
+				if sockaddrString(msg.sa) != sockaddrString(a.localAddr()) {
+					t.Errorf("%v: frame %v: unexpected sender %v", c.local, i, sockaddrString(msg.sa))
+				}
+				msg.free()
+				i++
+			}
+		}
+
+		a.close()
+		b.close()
+	}
+}
+
+func TestRawToSockaddr(t *testing.T) {
+	sa4, _, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	sa6, _, err := newUDPAddressPair("[::1]:9000", "[::1]:9001")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	ip4, err := newIPTunnelAddress("127.0.0.1:0", 42)
+	if err != nil {
+		t.Fatalf("newIPTunnelAddress(): %v", err)
+	}
+
+	cases := []struct {
+		name  string
+		local unix.Sockaddr
+		raw   unix.RawSockaddrAny
+		want  string
+	}{
+		{
+			name:  "UDP/IPv4",
+			local: sa4,
+			raw: func() (raw unix.RawSockaddrAny) {
+				pp := (*unix.RawSockaddrInet4)(unsafe.Pointer(&raw))
+				pp.Family = unix.AF_INET
+				p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+				p[0], p[1] = 0x06, 0xa5
+				pp.Addr = [4]byte{192, 168, 1, 1}
+				return
+			}(),
+			want: "192.168.1.1:1701",
+		},
+		{
+			name:  "UDP/IPv6",
+			local: sa6,
+			raw: func() (raw unix.RawSockaddrAny) {
+				pp := (*unix.RawSockaddrInet6)(unsafe.Pointer(&raw))
+				pp.Family = unix.AF_INET6
+				p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+				p[0], p[1] = 0x06, 0xa5
+				pp.Addr[15] = 1
+				return
+			}(),
+			want: "[::1]:1701",
+		},
+		{
+			name:  "L2TPIP",
+			local: ip4,
+			raw: func() (raw unix.RawSockaddrAny) {
+				pp := (*unix.RawSockaddrL2TPIP)(unsafe.Pointer(&raw))
+				pp.Family = unix.AF_INET
+				pp.Addr = [4]byte{10, 0, 0, 1}
+				return
+			}(),
+			want: "10.0.0.1:0",
+		},
+		{
+			name:  "family mismatch",
+			local: sa6,
+			raw: func() (raw unix.RawSockaddrAny) {
+				raw.Addr.Family = unix.AF_INET
+				return
+			}(),
+		},
+	}
+	for _, c := range cases {
+		var cache rawSockaddrCache
+		sa, err := cache.sockaddr(&c.raw, c.local)
+		if c.want == "" {
+			if err == nil {
+				t.Errorf("%v: expected error, got %v", c.name, sockaddrString(sa))
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%v: sockaddr(): %v", c.name, err)
+		}
+		if got := sockaddrString(sa); got != c.want {
+			t.Errorf("%v: expected %v, got %v", c.name, c.want, got)
+		}
+		// Converting the same address again reuses the cached Sockaddr
+		sa2, err := cache.sockaddr(&c.raw, c.local)
+		if err != nil || sa2 != sa {
+			t.Errorf("%v: expected cached address, got %v, %v", c.name, sa2, err)
+		}
+	}
+}
+
+func BenchmarkControlPlaneRecvBatch(b *testing.B) {
+	a, r := testNewUDPControlPlanePair(b, "127.0.0.1:9000", "127.0.0.1:9001")
+	defer a.close()
+	defer r.close()
+
+	frame := make([]byte, 64)
+	msgs := make([]*rawMsg, rawMsgBatchLen)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; {
+		for j := 0; j < rawMsgBatchLen; j++ {
+			if _, err := a.write(frame); err != nil {
+				b.Fatalf("write(): %v", err)
+			}
+		}
+		for j := 0; j < rawMsgBatchLen; {
+			n, err := r.recvBatch(msgs)
+			if err != nil {
+				b.Fatalf("recvBatch(): %v", err)
+			}
+			for _, msg := range msgs[:n] {
+				msg.free()
+			}
+			j += n
+			i += n
+		}
+	}
+}
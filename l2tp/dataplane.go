@@ -1,14 +1,32 @@
 package l2tp
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/katalix/go-l2tp/internal/nll2tp"
 	"golang.org/x/sys/unix"
 )
 
+// netlinkConn is the interface to the Linux kernel L2TP subsystem used
+// to instantiate tunnel and session data planes.  It is implemented by
+// nll2tp.Conn, and by an in-memory fake kernel for testing.
+type netlinkConn interface {
+	CreateManagedTunnel(ctx context.Context, fd int, config *nll2tp.TunnelConfig) error
+	CreateStaticTunnel(ctx context.Context, localAddr []byte, localPort uint16, peerAddr []byte, peerPort uint16, config *nll2tp.TunnelConfig) error
+	GetTunnel(ctx context.Context, config *nll2tp.TunnelConfig) (*nll2tp.TunnelConfig, error)
+	ModifyTunnel(ctx context.Context, config *nll2tp.TunnelConfig) error
+	DeleteTunnel(ctx context.Context, config *nll2tp.TunnelConfig) error
+	CreateSession(ctx context.Context, config *nll2tp.SessionConfig) error
+	GetSession(ctx context.Context, config *nll2tp.SessionConfig) (*nll2tp.SessionConfig, error)
+	GetSessionStats(ctx context.Context, config *nll2tp.SessionConfig) (*nll2tp.SessionStats, error)
+	ModifySession(ctx context.Context, config *nll2tp.SessionConfig) error
+	DeleteSession(ctx context.Context, config *nll2tp.SessionConfig) error
+	Close()
+}
+
 type dataPlane interface {
-	close(nl *nll2tp.Conn)
+	close(cctx context.Context, nl netlinkConn)
 }
 
 type tunnelDataPlane struct {
@@ -34,11 +52,17 @@ func sockaddrAddrPort(sa unix.Sockaddr) (addr []byte, port uint16, err error) {
 }
 
 func tunnelCfgToNl(cfg *TunnelConfig) (*nll2tp.TunnelConfig, error) {
+	// Fallback mode only affects the control protocol: the data
+	// plane is L2TPv3.
+	version := cfg.Version
+	if version == ProtocolVersion3Fallback {
+		version = ProtocolVersion3
+	}
 	// TODO: facilitate kernel level debug
 	return &nll2tp.TunnelConfig{
 		Tid:        nll2tp.L2tpTunnelID(cfg.TunnelID),
 		Ptid:       nll2tp.L2tpTunnelID(cfg.PeerTunnelID),
-		Version:    nll2tp.L2tpProtocolVersion(cfg.Version),
+		Version:    nll2tp.L2tpProtocolVersion(version),
 		Encap:      nll2tp.L2tpEncapType(cfg.Encap),
 		DebugFlags: nll2tp.L2tpDebugFlags(0)}, nil
 }
@@ -74,7 +98,7 @@ func sessionCfgToNl(tid, ptid ControlConnID, cfg *SessionConfig) (*nll2tp.Sessio
 		DebugFlags:     nll2tp.L2tpDebugFlags(0)}, nil
 }
 
-func newStaticTunnelDataPlane(nl *nll2tp.Conn, local, peer unix.Sockaddr, cfg *TunnelConfig) (dataPlane, error) {
+func newStaticTunnelDataPlane(cctx context.Context, nl netlinkConn, local, peer unix.Sockaddr, cfg *TunnelConfig) (dataPlane, error) {
 
 	nlcfg, err := tunnelCfgToNl(cfg)
 	if err != nil {
@@ -91,46 +115,63 @@ func newStaticTunnelDataPlane(nl *nll2tp.Conn, local, peer unix.Sockaddr, cfg *T
 		return nil, fmt.Errorf("invalid remote address %v: %v", peer, err)
 	}
 
-	err = nl.CreateStaticTunnel(la, lp, ra, rp, nlcfg)
+	err = nl.CreateStaticTunnel(cctx, la, lp, ra, rp, nlcfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to instantiate tunnel via. netlink: %v", err)
+		return nil, fmt.Errorf("failed to instantiate tunnel via. netlink: %w", err)
 	}
 
 	return &tunnelDataPlane{nlcfg}, nil
 }
 
-func newManagedTunnelDataPlane(nl *nll2tp.Conn, fd int, cfg *TunnelConfig) (dataPlane, error) {
+func newManagedTunnelDataPlane(cctx context.Context, nl netlinkConn, fd int, cfg *TunnelConfig) (dataPlane, error) {
 	nlcfg, err := tunnelCfgToNl(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to convert tunnel config for netlink use: %v", err)
 	}
 
-	err = nl.CreateManagedTunnel(fd, nlcfg)
+	err = nl.CreateManagedTunnel(cctx, fd, nlcfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to instantiate tunnel via. netlink: %v", err)
+		return nil, fmt.Errorf("failed to instantiate tunnel via. netlink: %w", err)
 	}
 
 	return &tunnelDataPlane{nlcfg}, nil
 }
 
-func newSessionDataPlane(nl *nll2tp.Conn, tid, ptid ControlConnID, cfg *SessionConfig) (dataPlane, error) {
+func newSessionDataPlane(cctx context.Context, nl netlinkConn, tid, ptid ControlConnID, cfg *SessionConfig) (dataPlane, error) {
 	nlcfg, err := sessionCfgToNl(tid, ptid, cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to convert session config for netlink use: %v", err)
 	}
 
-	err = nl.CreateSession(nlcfg)
+	err = nl.CreateSession(cctx, nlcfg)
 	if err != nil {
-		return nil, fmt.Errorf("failed to instantiate session via. netlink: %v", err)
+		return nil, fmt.Errorf("failed to instantiate session via. netlink: %w", err)
 	}
 
 	return &sessionDataPlane{nlcfg}, nil
 }
 
-func (t *tunnelDataPlane) close(nl *nll2tp.Conn) {
-	_ = nl.DeleteTunnel(t.cfg)
+func (t *tunnelDataPlane) close(cctx context.Context, nl netlinkConn) {
+	_ = nl.DeleteTunnel(cctx, t.cfg)
 }
 
-func (s *sessionDataPlane) close(nl *nll2tp.Conn) {
-	_ = nl.DeleteSession(s.cfg)
+func (s *sessionDataPlane) close(cctx context.Context, nl netlinkConn) {
+	_ = nl.DeleteSession(cctx, s.cfg)
+}
+
+func (s *sessionDataPlane) stats(cctx context.Context, nl netlinkConn) (*SessionStats, error) {
+	nls, err := nl.GetSessionStats(cctx, s.cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get session stats via. netlink: %w", err)
+	}
+	return &SessionStats{
+		TxPackets:     nls.TxPackets,
+		TxBytes:       nls.TxBytes,
+		TxErrors:      nls.TxErrors,
+		RxPackets:     nls.RxPackets,
+		RxBytes:       nls.RxBytes,
+		RxSeqDiscards: nls.RxSeqDiscards,
+		RxOOSPackets:  nls.RxOOSPackets,
+		RxErrors:      nls.RxErrors,
+	}, nil
 }
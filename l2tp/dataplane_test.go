@@ -0,0 +1,1093 @@
+package l2tp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/katalix/go-l2tp/internal/nll2tp"
+	"golang.org/x/sys/unix"
+)
+
+type fakeTunnel struct {
+	cfg      nll2tp.TunnelConfig
+	fd       int
+	sessions map[nll2tp.L2tpSessionID]*nll2tp.SessionConfig
+}
+
+// fakeNetlink is an in-memory implementation of netlinkConn which
+// enforces the semantics of the kernel L2TP subsystem, allowing tunnel
+// and session lifecycle to be tested without privileges.
+type fakeNetlink struct {
+	mutex   sync.Mutex
+	closed  bool
+	wedge   chan struct{}
+	tunnels map[nll2tp.L2tpTunnelID]*fakeTunnel
+}
+
+func newFakeNetlink() *fakeNetlink {
+	return &fakeNetlink{
+		tunnels: make(map[nll2tp.L2tpTunnelID]*fakeTunnel),
+	}
+}
+
+// newFakeNetlinkDialer returns a dialer for use with withNetlinkDialer
+// which creates a fake kernel per network namespace.  The kernels are
+// returned by the map so that tests can inspect them.
+func newFakeNetlinkDialer() (dial func(netns string) (netlinkConn, error), kernels map[string]*fakeNetlink) {
+	kernels = make(map[string]*fakeNetlink)
+	dial = func(netns string) (netlinkConn, error) {
+		if _, ok := kernels[netns]; !ok {
+			kernels[netns] = newFakeNetlink()
+		}
+		return kernels[netns], nil
+	}
+	return
+}
+
+// setWedged simulates a wedged netlink socket: while wedged, requests
+// block until their context is done.
+func (f *fakeNetlink) setWedged(wedged bool) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if wedged && f.wedge == nil {
+		f.wedge = make(chan struct{})
+	} else if !wedged && f.wedge != nil {
+		close(f.wedge)
+		f.wedge = nil
+	}
+}
+
+func (f *fakeNetlink) wait(ctx context.Context) error {
+	f.mutex.Lock()
+	wedge := f.wedge
+	f.mutex.Unlock()
+	if wedge != nil {
+		select {
+		case <-wedge:
+		case <-ctx.Done():
+		}
+	}
+	return ctx.Err()
+}
+
+func (f *fakeNetlink) checkTunnelConfig(config *nll2tp.TunnelConfig) error {
+	if f.closed {
+		return errors.New("netlink connection closed")
+	}
+	if config == nil {
+		return errors.New("invalid nil tunnel config")
+	}
+	if config.Tid == 0 || config.Ptid == 0 {
+		return unix.EINVAL
+	}
+	if config.Version != nll2tp.ProtocolVersion2 && config.Version != nll2tp.ProtocolVersion3 {
+		return unix.EINVAL
+	}
+	if config.Version == nll2tp.ProtocolVersion2 && config.Encap != nll2tp.EncaptypeUdp {
+		return unix.EPROTONOSUPPORT
+	}
+	if _, ok := f.tunnels[config.Tid]; ok {
+		return unix.EEXIST
+	}
+	return nil
+}
+
+func (f *fakeNetlink) CreateManagedTunnel(ctx context.Context, fd int, config *nll2tp.TunnelConfig) error {
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err := f.checkTunnelConfig(config)
+	if err != nil {
+		return err
+	}
+	if fd < 0 {
+		return unix.EBADF
+	}
+	// A socket may only be used by one tunnel
+	for _, t := range f.tunnels {
+		if t.fd == fd {
+			return unix.EBUSY
+		}
+	}
+	f.tunnels[config.Tid] = &fakeTunnel{
+		cfg:      *config,
+		fd:       fd,
+		sessions: make(map[nll2tp.L2tpSessionID]*nll2tp.SessionConfig),
+	}
+	return nil
+}
+
+func (f *fakeNetlink) CreateStaticTunnel(ctx context.Context, localAddr []byte, localPort uint16, peerAddr []byte, peerPort uint16, config *nll2tp.TunnelConfig) error {
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	err := f.checkTunnelConfig(config)
+	if err != nil {
+		return err
+	}
+	if len(localAddr) == 0 || len(localAddr) != len(peerAddr) {
+		return unix.EINVAL
+	}
+	if config.Encap == nll2tp.EncaptypeUdp && (localPort == 0 || peerPort == 0) {
+		return unix.EINVAL
+	}
+	f.tunnels[config.Tid] = &fakeTunnel{
+		cfg:      *config,
+		fd:       -1,
+		sessions: make(map[nll2tp.L2tpSessionID]*nll2tp.SessionConfig),
+	}
+	return nil
+}
+
+func (f *fakeNetlink) getTunnel(tid nll2tp.L2tpTunnelID) (*fakeTunnel, error) {
+	if f.closed {
+		return nil, errors.New("netlink connection closed")
+	}
+	t, ok := f.tunnels[tid]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	return t, nil
+}
+
+func (f *fakeNetlink) GetTunnel(ctx context.Context, config *nll2tp.TunnelConfig) (*nll2tp.TunnelConfig, error) {
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	t, err := f.getTunnel(config.Tid)
+	if err != nil {
+		return nil, err
+	}
+	cfg := t.cfg
+	return &cfg, nil
+}
+
+func (f *fakeNetlink) ModifyTunnel(ctx context.Context, config *nll2tp.TunnelConfig) error {
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	t, err := f.getTunnel(config.Tid)
+	if err != nil {
+		return err
+	}
+	t.cfg.DebugFlags = config.DebugFlags
+	return nil
+}
+
+func (f *fakeNetlink) DeleteTunnel(ctx context.Context, config *nll2tp.TunnelConfig) error {
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, err := f.getTunnel(config.Tid)
+	if err != nil {
+		return err
+	}
+	// Deleting a tunnel implicitly deletes its sessions
+	delete(f.tunnels, config.Tid)
+	return nil
+}
+
+func (f *fakeNetlink) CreateSession(ctx context.Context, config *nll2tp.SessionConfig) error {
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if config.Sid == 0 || config.Psid == 0 {
+		return unix.EINVAL
+	}
+	t, err := f.getTunnel(config.Tid)
+	if err != nil {
+		return err
+	}
+	if t.cfg.Version == nll2tp.ProtocolVersion2 {
+		if config.PseudowireType != nll2tp.PwtypePpp {
+			return unix.EPROTONOSUPPORT
+		}
+		if _, ok := t.sessions[config.Sid]; ok {
+			return unix.EEXIST
+		}
+	}
+	for _, ot := range f.tunnels {
+		for _, s := range ot.sessions {
+			// L2TPv3 session IDs are unique to the host
+			if t.cfg.Version == nll2tp.ProtocolVersion3 &&
+				ot.cfg.Version == nll2tp.ProtocolVersion3 &&
+				s.Sid == config.Sid {
+				return unix.EEXIST
+			}
+			if config.IfName != "" && s.IfName == config.IfName {
+				return unix.EEXIST
+			}
+		}
+	}
+	cfg := *config
+	t.sessions[config.Sid] = &cfg
+	return nil
+}
+
+func (f *fakeNetlink) getSession(config *nll2tp.SessionConfig) (*nll2tp.SessionConfig, error) {
+	t, err := f.getTunnel(config.Tid)
+	if err != nil {
+		return nil, err
+	}
+	s, ok := t.sessions[config.Sid]
+	if !ok {
+		return nil, unix.ENOENT
+	}
+	return s, nil
+}
+
+func (f *fakeNetlink) GetSession(ctx context.Context, config *nll2tp.SessionConfig) (*nll2tp.SessionConfig, error) {
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s, err := f.getSession(config)
+	if err != nil {
+		return nil, err
+	}
+	cfg := *s
+	return &cfg, nil
+}
+
+func (f *fakeNetlink) GetSessionStats(ctx context.Context, config *nll2tp.SessionConfig) (*nll2tp.SessionStats, error) {
+	if err := f.wait(ctx); err != nil {
+		return nil, err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, err := f.getSession(config)
+	if err != nil {
+		return nil, err
+	}
+	return &nll2tp.SessionStats{}, nil
+}
+
+func (f *fakeNetlink) ModifySession(ctx context.Context, config *nll2tp.SessionConfig) error {
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	s, err := f.getSession(config)
+	if err != nil {
+		return err
+	}
+	s.DebugFlags = config.DebugFlags
+	s.SendSeq = config.SendSeq
+	s.RecvSeq = config.RecvSeq
+	s.IsLNS = config.IsLNS
+	s.ReorderTimeout = config.ReorderTimeout
+	return nil
+}
+
+func (f *fakeNetlink) DeleteSession(ctx context.Context, config *nll2tp.SessionConfig) error {
+	if err := f.wait(ctx); err != nil {
+		return err
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	_, err := f.getSession(config)
+	if err != nil {
+		return err
+	}
+	delete(f.tunnels[config.Tid].sessions, config.Sid)
+	return nil
+}
+
+func (f *fakeNetlink) Close() {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.closed = true
+}
+
+// counts returns the number of tunnels and sessions in the fake kernel.
+func (f *fakeNetlink) counts() (tunnels, sessions int) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	for _, t := range f.tunnels {
+		sessions += len(t.sessions)
+	}
+	return len(f.tunnels), sessions
+}
+
+func TestFakeNetlink(t *testing.T) {
+	v2 := func(tid nll2tp.L2tpTunnelID) *nll2tp.TunnelConfig {
+		return &nll2tp.TunnelConfig{Tid: tid, Ptid: 100, Version: nll2tp.ProtocolVersion2, Encap: nll2tp.EncaptypeUdp}
+	}
+	v3 := func(tid nll2tp.L2tpTunnelID) *nll2tp.TunnelConfig {
+		return &nll2tp.TunnelConfig{Tid: tid, Ptid: 100, Version: nll2tp.ProtocolVersion3, Encap: nll2tp.EncaptypeIp}
+	}
+	session := func(tid nll2tp.L2tpTunnelID, sid nll2tp.L2tpSessionID, pw nll2tp.L2tpPwtype) *nll2tp.SessionConfig {
+		return &nll2tp.SessionConfig{Tid: tid, Ptid: 100, Sid: sid, Psid: 200, PseudowireType: pw}
+	}
+	addr := []byte{127, 0, 0, 1}
+	bg := context.Background()
+
+	cases := []struct {
+		name   string
+		op     func(f *fakeNetlink) error
+		expect error
+	}{
+		{
+			name: "duplicate tunnel ID",
+			op: func(f *fakeNetlink) error {
+				_ = f.CreateManagedTunnel(bg, 10, v2(1))
+				return f.CreateStaticTunnel(bg, addr, 1701, addr, 1701, v3(1))
+			},
+			expect: unix.EEXIST,
+		},
+		{
+			name: "tunnel socket in use",
+			op: func(f *fakeNetlink) error {
+				_ = f.CreateManagedTunnel(bg, 10, v2(1))
+				return f.CreateManagedTunnel(bg, 10, v2(2))
+			},
+			expect: unix.EBUSY,
+		},
+		{
+			name: "L2TPv2 IP encapsulation",
+			op: func(f *fakeNetlink) error {
+				cfg := v2(1)
+				cfg.Encap = nll2tp.EncaptypeIp
+				return f.CreateManagedTunnel(bg, 10, cfg)
+			},
+			expect: unix.EPROTONOSUPPORT,
+		},
+		{
+			name: "delete missing tunnel",
+			op: func(f *fakeNetlink) error {
+				return f.DeleteTunnel(bg, v3(1))
+			},
+			expect: unix.ENOENT,
+		},
+		{
+			name: "session with missing parent tunnel",
+			op: func(f *fakeNetlink) error {
+				return f.CreateSession(bg, session(1, 1, nll2tp.PwtypePpp))
+			},
+			expect: unix.ENOENT,
+		},
+		{
+			name: "L2TPv2 session IDs are per tunnel",
+			op: func(f *fakeNetlink) error {
+				_ = f.CreateManagedTunnel(bg, 10, v2(1))
+				_ = f.CreateManagedTunnel(bg, 11, v2(2))
+				_ = f.CreateSession(bg, session(1, 1, nll2tp.PwtypePpp))
+				return f.CreateSession(bg, session(2, 1, nll2tp.PwtypePpp))
+			},
+		},
+		{
+			name: "L2TPv2 duplicate session ID",
+			op: func(f *fakeNetlink) error {
+				_ = f.CreateManagedTunnel(bg, 10, v2(1))
+				_ = f.CreateSession(bg, session(1, 1, nll2tp.PwtypePpp))
+				return f.CreateSession(bg, session(1, 1, nll2tp.PwtypePpp))
+			},
+			expect: unix.EEXIST,
+		},
+		{
+			name: "L2TPv2 Ethernet pseudowire",
+			op: func(f *fakeNetlink) error {
+				_ = f.CreateManagedTunnel(bg, 10, v2(1))
+				return f.CreateSession(bg, session(1, 1, nll2tp.PwtypeEth))
+			},
+			expect: unix.EPROTONOSUPPORT,
+		},
+		{
+			name: "L2TPv3 session IDs are per host",
+			op: func(f *fakeNetlink) error {
+				_ = f.CreateManagedTunnel(bg, 10, v3(1))
+				_ = f.CreateManagedTunnel(bg, 11, v3(2))
+				_ = f.CreateSession(bg, session(1, 1, nll2tp.PwtypeEth))
+				return f.CreateSession(bg, session(2, 1, nll2tp.PwtypeEth))
+			},
+			expect: unix.EEXIST,
+		},
+		{
+			name: "duplicate interface name",
+			op: func(f *fakeNetlink) error {
+				_ = f.CreateManagedTunnel(bg, 10, v3(1))
+				s1 := session(1, 1, nll2tp.PwtypeEth)
+				s1.IfName = "l2tpeth0"
+				s2 := session(1, 2, nll2tp.PwtypeEth)
+				s2.IfName = "l2tpeth0"
+				_ = f.CreateSession(bg, s1)
+				return f.CreateSession(bg, s2)
+			},
+			expect: unix.EEXIST,
+		},
+		{
+			name: "tunnel delete removes sessions",
+			op: func(f *fakeNetlink) error {
+				_ = f.CreateManagedTunnel(bg, 10, v3(1))
+				_ = f.CreateSession(bg, session(1, 1, nll2tp.PwtypeEth))
+				_ = f.DeleteTunnel(bg, v3(1))
+				_ = f.CreateManagedTunnel(bg, 10, v3(1))
+				_, err := f.GetSession(bg, session(1, 1, nll2tp.PwtypeEth))
+				return err
+			},
+			expect: unix.ENOENT,
+		},
+		{
+			name: "modify session",
+			op: func(f *fakeNetlink) error {
+				_ = f.CreateManagedTunnel(bg, 10, v3(1))
+				_ = f.CreateSession(bg, session(1, 1, nll2tp.PwtypeEth))
+				s := session(1, 1, nll2tp.PwtypeEth)
+				s.SendSeq = true
+				s.DebugFlags = nll2tp.MsgData
+				err := f.ModifySession(bg, s)
+				if err != nil {
+					return err
+				}
+				got, err := f.GetSession(bg, s)
+				if err != nil {
+					return err
+				}
+				if !got.SendSeq || got.DebugFlags != nll2tp.MsgData {
+					return fmt.Errorf("modify not applied: %+v", got)
+				}
+				return nil
+			},
+		},
+		{
+			name: "modify missing tunnel",
+			op: func(f *fakeNetlink) error {
+				return f.ModifyTunnel(bg, v3(1))
+			},
+			expect: unix.ENOENT,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := c.op(newFakeNetlink())
+			if err != c.expect {
+				t.Errorf("expected %v, got %v", c.expect, err)
+			}
+		})
+	}
+}
+
+func TestContextLifecycle(t *testing.T) {
+	dial, kernels := newFakeNetlinkDialer()
+	ctx, err := newContext(nil, nil, withNetlinkDialer(dial))
+	if err != nil {
+		t.Fatalf("newContext(): %v", err)
+	}
+	kernel := kernels[""]
+
+	// Instances which fail to be created never go down
+	events := make(testEventHandler, 16)
+	ctx.RegisterEventHandler(events)
+
+	tcfg := &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 1001,
+		Encap:        EncapTypeUDP,
+	}
+	st, err := ctx.NewStaticTunnel("static", tcfg)
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+
+	// The kernel refuses a second tunnel with the same ID
+	_, err = ctx.NewStaticTunnel("clash", tcfg)
+	if err == nil {
+		t.Fatalf("expected NewStaticTunnel() to fail for a duplicate tunnel ID")
+	}
+
+	// The kernel can't scope a static tunnel's link-local addresses
+	_, err = ctx.NewStaticTunnel("linklocal", &TunnelConfig{
+		Local:        "[fe80::1%lo]:6000",
+		Peer:         "[fe80::2%lo]:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     3,
+		PeerTunnelID: 1003,
+		Encap:        EncapTypeUDP,
+	})
+	if err == nil {
+		t.Fatalf("expected NewStaticTunnel() to fail for link-local addresses")
+	}
+
+	scfg := &SessionConfig{
+		SessionID:     10,
+		PeerSessionID: 20,
+		Pseudowire:    PseudowireTypeEth,
+	}
+	s, err := st.NewSession("s1", scfg)
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+	_, err = s.Stats()
+	if err != nil {
+		t.Errorf("Stats(): %v", err)
+	}
+
+	// L2TPv3 session IDs are unique to the host
+	_, err = st.NewSession("s2", scfg)
+	if err == nil {
+		t.Fatalf("expected NewSession() to fail for a duplicate session ID")
+	}
+
+	// Quiescent tunnels create the data plane once connected
+	qcfg := &TunnelConfig{
+		Local:        "127.0.0.1:6001",
+		Peer:         "127.0.0.1:5001",
+		Version:      ProtocolVersion2,
+		TunnelID:     2,
+		PeerTunnelID: 1002,
+		Encap:        EncapTypeUDP,
+	}
+	qt, err := ctx.NewQuiescentTunnel("quiescent", qcfg)
+	if err != nil {
+		t.Fatalf("NewQuiescentTunnel(): %v", err)
+	}
+	_, err = qt.NewSession("s1", &SessionConfig{
+		SessionID:     10,
+		PeerSessionID: 20,
+		Pseudowire:    PseudowireTypePPP,
+	})
+	if err != nil {
+		t.Fatalf("NewSession(): %v", err)
+	}
+
+	if nt, ns := kernel.counts(); nt != 2 || ns != 2 {
+		t.Errorf("expected 2 tunnels and 2 sessions in the kernel, got %v and %v", nt, ns)
+	}
+
+	s.Close()
+	if nt, ns := kernel.counts(); nt != 2 || ns != 1 {
+		t.Errorf("expected 2 tunnels and 1 session in the kernel, got %v and %v", nt, ns)
+	}
+
+	ctx.Close()
+	if nt, ns := kernel.counts(); nt != 0 || ns != 0 {
+		t.Errorf("expected an empty kernel, got %v tunnels and %v sessions", nt, ns)
+	}
+
+	stats := ctx.Stats()
+	expect := ContextStats{
+		TunnelsCreated:  2,
+		TunnelsClosed:   2,
+		SessionsCreated: 2,
+		SessionsClosed:  2,
+	}
+	if stats != expect {
+		t.Errorf("expected stats %+v, got %+v", expect, stats)
+	}
+
+	// Each session goes down before its tunnel, but the context closes
+	// its tunnels in no particular order
+	var down []interface{}
+	for len(events) > 0 {
+		down = append(down, <-events)
+	}
+	indexOf := func(want interface{}) int {
+		for i, got := range down {
+			switch e := got.(type) {
+			case *TunnelDownEvent:
+				if w, ok := want.(TunnelDownEvent); ok && *e == w {
+					return i
+				}
+			case *SessionDownEvent:
+				if w, ok := want.(SessionDownEvent); ok && *e == w {
+					return i
+				}
+			}
+		}
+		t.Fatalf("expected event %+v, got %+v", want, down)
+		return -1
+	}
+	if len(down) != 4 {
+		t.Fatalf("expected 4 events, got %+v", down)
+	}
+	if indexOf(SessionDownEvent{TunnelName: "static", SessionName: "s1"}) != 0 {
+		t.Errorf("expected static session to go down first, got %+v", down)
+	}
+	if indexOf(SessionDownEvent{TunnelName: "quiescent", SessionName: "s1"}) >
+		indexOf(TunnelDownEvent{TunnelName: "quiescent"}) {
+		t.Errorf("expected quiescent session to go down before its tunnel, got %+v", down)
+	}
+	indexOf(TunnelDownEvent{TunnelName: "static"})
+}
+
+// TestFallbackDataPlane checks that tunnels using RFC3931 fallback mode
+// instantiate an L2TPv3 data plane.
+func TestFallbackDataPlane(t *testing.T) {
+	cases := []struct {
+		name   string
+		create func(ctx *Context, name string, cfg *TunnelConfig) (Tunnel, error)
+	}{
+		{name: "static", create: (*Context).NewStaticTunnel},
+		{name: "quiescent", create: (*Context).NewQuiescentTunnel},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			dial, kernels := newFakeNetlinkDialer()
+			ctx, err := newContext(nil, nil, withNetlinkDialer(dial))
+			if err != nil {
+				t.Fatalf("newContext(): %v", err)
+			}
+			defer ctx.Close()
+
+			_, err = c.create(ctx, "t1", &TunnelConfig{
+				Local:        "127.0.0.1:6007",
+				Peer:         "127.0.0.1:5007",
+				Version:      ProtocolVersion3Fallback,
+				TunnelID:     1,
+				PeerTunnelID: 1001,
+				Encap:        EncapTypeUDP,
+			})
+			if err != nil {
+				t.Fatalf("failed to create tunnel: %v", err)
+			}
+
+			tcfg, err := kernels[""].GetTunnel(context.Background(), &nll2tp.TunnelConfig{Tid: 1})
+			if err != nil {
+				t.Fatalf("GetTunnel(): %v", err)
+			}
+			if tcfg.Version != nll2tp.ProtocolVersion3 {
+				t.Errorf("expected an L2TPv3 kernel tunnel, got version %v", tcfg.Version)
+			}
+		})
+	}
+}
+
+// TestConcurrentLifecycle hammers tunnel and session creation and
+// teardown from many goroutines, including creation failing due to name
+// and kernel ID clashes.  It's intended to be run with -race.
+func TestConcurrentLifecycle(t *testing.T) {
+	const workers = 8
+	const iterations = 50
+
+	dial, kernels := newFakeNetlinkDialer()
+	ctx, err := newContext(nil, nil, withNetlinkDialer(dial))
+	if err != nil {
+		t.Fatalf("newContext(): %v", err)
+	}
+
+	st, err := ctx.NewStaticTunnel("static", &TunnelConfig{
+		Local:        "127.0.0.1:6000",
+		Peer:         "127.0.0.1:5000",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 1001,
+		Encap:        EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewStaticTunnel(): %v", err)
+	}
+
+	qt, err := ctx.NewQuiescentTunnel("quiescent", &TunnelConfig{
+		Local:        "127.0.0.1:6001",
+		Peer:         "127.0.0.1:5001",
+		Version:      ProtocolVersion3,
+		TunnelID:     2,
+		PeerTunnelID: 1002,
+		Encap:        EncapTypeUDP,
+	})
+	if err != nil {
+		t.Fatalf("NewQuiescentTunnel(): %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < iterations; j++ {
+				// Tunnel names clash between workers, while kernel tunnel
+				// IDs clash between iterations of each worker.
+				tunl, err := ctx.NewStaticTunnel(fmt.Sprintf("t%d", j%4), &TunnelConfig{
+					Local:        "127.0.0.1:6000",
+					Peer:         "127.0.0.1:5000",
+					Version:      ProtocolVersion3,
+					TunnelID:     ControlConnID(100 + i*10 + j%3),
+					PeerTunnelID: 1001,
+					Encap:        EncapTypeUDP,
+				})
+				if err == nil && j%2 == 0 {
+					tunl.Close()
+				}
+
+				// Session names and kernel session IDs clash between workers
+				for _, parent := range []Tunnel{st, qt} {
+					s, err := parent.NewSession(fmt.Sprintf("s%d", j%8), &SessionConfig{
+						SessionID:     ControlConnID(j%16 + 1),
+						PeerSessionID: 1,
+						Pseudowire:    PseudowireTypeEth,
+					})
+					if err != nil {
+						continue
+					}
+					_, _ = s.Stats()
+					_, _ = parent.Stats()
+					if j%3 != 0 {
+						s.Close()
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ctx.Close()
+	if nt, ns := kernels[""].counts(); nt != 0 || ns != 0 {
+		t.Errorf("expected an empty kernel, got %v tunnels and %v sessions", nt, ns)
+	}
+
+	stats := ctx.Stats()
+	if stats.TunnelsCreated != stats.TunnelsClosed {
+		t.Errorf("created %v tunnels but closed %v", stats.TunnelsCreated, stats.TunnelsClosed)
+	}
+	if stats.SessionsCreated != stats.SessionsClosed {
+		t.Errorf("created %v sessions but closed %v", stats.SessionsCreated, stats.SessionsClosed)
+	}
+}
+
+// waitForGoroutines waits for the number of running goroutines to fall
+// to n, allowing time for goroutines which are exiting to do so.
+func waitForGoroutines(n int) error {
+	for i := 0; i < 500; i++ {
+		if runtime.NumGoroutine() <= n {
+			return nil
+		}
+		time.Sleep(2 * time.Millisecond)
+	}
+	return fmt.Errorf("expected %v goroutines, got %v", n, runtime.NumGoroutine())
+}
+
+// TestTunnelTeardown checks that tunnels may be closed any number of
+// times, concurrently, and before or after transport failure, without
+// deadlocking, leaking goroutines or leaving objects in the kernel.
+func TestTunnelTeardown(t *testing.T) {
+	// The peer address has nothing listening, so HELLOs fail quickly
+	failingCfg := &TunnelConfig{
+		Local:        "127.0.0.1:6002",
+		Peer:         "127.0.0.1:5002",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 1001,
+		Encap:        EncapTypeUDP,
+		HelloTimeout: 5 * time.Millisecond,
+		RetryTimeout: 5 * time.Millisecond,
+		MaxRetries:   1,
+	}
+	quiescentCfg := &TunnelConfig{
+		Local:        "127.0.0.1:6003",
+		Peer:         "127.0.0.1:5003",
+		Version:      ProtocolVersion3,
+		TunnelID:     2,
+		PeerTunnelID: 1002,
+		Encap:        EncapTypeUDP,
+	}
+	staticCfg := &TunnelConfig{
+		Local:        "127.0.0.1:6004",
+		Peer:         "127.0.0.1:5004",
+		Version:      ProtocolVersion3,
+		TunnelID:     3,
+		PeerTunnelID: 1003,
+		Encap:        EncapTypeUDP,
+	}
+
+	cases := []struct {
+		name string
+		fn   func(t *testing.T, ctx *Context)
+	}{
+		{
+			name: "close after transport failure",
+			fn: func(t *testing.T, ctx *Context) {
+				tunl, err := ctx.NewQuiescentTunnel("t1", failingCfg)
+				if err != nil {
+					t.Fatalf("NewQuiescentTunnel(): %v", err)
+				}
+				for i := 0; i < 500 && ctx.Stats().TunnelsClosed == 0; i++ {
+					time.Sleep(2 * time.Millisecond)
+				}
+				if ctx.Stats().TransportFailures != 1 {
+					t.Fatalf("expected the transport to fail")
+				}
+				tunl.Close()
+				tunl.Close()
+			},
+		},
+		{
+			name: "concurrent close racing transport failure",
+			fn: func(t *testing.T, ctx *Context) {
+				tunl, err := ctx.NewQuiescentTunnel("t1", failingCfg)
+				if err != nil {
+					t.Fatalf("NewQuiescentTunnel(): %v", err)
+				}
+				_, err = tunl.NewSession("s1", &SessionConfig{
+					SessionID:     1,
+					PeerSessionID: 1,
+					Pseudowire:    PseudowireTypeEth,
+				})
+				if err != nil {
+					t.Fatalf("NewSession(): %v", err)
+				}
+				var wg sync.WaitGroup
+				for i := 0; i < 8; i++ {
+					wg.Add(1)
+					go func(i int) {
+						defer wg.Done()
+						time.Sleep(time.Duration(i) * time.Millisecond)
+						tunl.Close()
+					}(i)
+				}
+				wg.Wait()
+			},
+		},
+		{
+			name: "concurrent close of tunnels, sessions and context",
+			fn: func(t *testing.T, ctx *Context) {
+				qt, err := ctx.NewQuiescentTunnel("t1", quiescentCfg)
+				if err != nil {
+					t.Fatalf("NewQuiescentTunnel(): %v", err)
+				}
+				st, err := ctx.NewStaticTunnel("t2", staticCfg)
+				if err != nil {
+					t.Fatalf("NewStaticTunnel(): %v", err)
+				}
+				var closers []func()
+				for i, tunl := range []Tunnel{qt, st} {
+					s, err := tunl.NewSession("s1", &SessionConfig{
+						SessionID:     ControlConnID(i + 1),
+						PeerSessionID: 1,
+						Pseudowire:    PseudowireTypeEth,
+					})
+					if err != nil {
+						t.Fatalf("NewSession(): %v", err)
+					}
+					closers = append(closers, s.Close, tunl.Close)
+				}
+				closers = append(closers, ctx.Close)
+				var wg sync.WaitGroup
+				for i := 0; i < 4; i++ {
+					for _, fn := range closers {
+						wg.Add(1)
+						go func(fn func()) {
+							defer wg.Done()
+							fn()
+						}(fn)
+					}
+				}
+				wg.Wait()
+				_, err = ctx.NewStaticTunnel("t3", staticCfg)
+				if err == nil {
+					t.Errorf("expected tunnel creation to fail once the context is closed")
+				}
+			},
+		},
+		{
+			name: "creation failure",
+			fn: func(t *testing.T, ctx *Context) {
+				_, err := ctx.NewQuiescentTunnel("t1", quiescentCfg)
+				if err != nil {
+					t.Fatalf("NewQuiescentTunnel(): %v", err)
+				}
+				// The tunnel socket address is already in use
+				cfg := *quiescentCfg
+				cfg.TunnelID = 10
+				_, err = ctx.NewQuiescentTunnel("t2", &cfg)
+				if err == nil {
+					t.Fatalf("expected NewQuiescentTunnel() to fail")
+				}
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			goroutines := runtime.NumGoroutine()
+
+			dial, kernels := newFakeNetlinkDialer()
+			ctx, err := newContext(nil, nil, withNetlinkDialer(dial))
+			if err != nil {
+				t.Fatalf("newContext(): %v", err)
+			}
+
+			c.fn(t, ctx)
+			ctx.Close()
+			ctx.Close()
+
+			if nt, ns := kernels[""].counts(); nt != 0 || ns != 0 {
+				t.Errorf("expected an empty kernel, got %v tunnels and %v sessions", nt, ns)
+			}
+			stats := ctx.Stats()
+			if stats.TunnelsCreated != stats.TunnelsClosed {
+				t.Errorf("created %v tunnels but closed %v", stats.TunnelsCreated, stats.TunnelsClosed)
+			}
+			if stats.SessionsCreated != stats.SessionsClosed {
+				t.Errorf("created %v sessions but closed %v", stats.SessionsCreated, stats.SessionsClosed)
+			}
+			err = waitForGoroutines(goroutines)
+			if err != nil {
+				t.Errorf("%v", err)
+			}
+		})
+	}
+}
+
+// TestWedgedNetlink checks that blocking operations return when their
+// context is done, rather than hanging on a netlink socket which has
+// stopped responding.
+func TestWedgedNetlink(t *testing.T) {
+	staticCfg := &TunnelConfig{
+		Local:        "127.0.0.1:6005",
+		Peer:         "127.0.0.1:5005",
+		Version:      ProtocolVersion3,
+		TunnelID:     1,
+		PeerTunnelID: 1001,
+		Encap:        EncapTypeUDP,
+	}
+	quiescentCfg := &TunnelConfig{
+		Local:        "127.0.0.1:6006",
+		Peer:         "127.0.0.1:5006",
+		Version:      ProtocolVersion3,
+		TunnelID:     2,
+		PeerTunnelID: 1002,
+		Encap:        EncapTypeUDP,
+	}
+	sessionCfg := &SessionConfig{
+		SessionID:     1,
+		PeerSessionID: 1,
+		Pseudowire:    PseudowireTypeEth,
+	}
+
+	cases := []struct {
+		name string
+		fn   func(cctx context.Context, ctx *Context, kernel *fakeNetlink) error
+	}{
+		{
+			name: "static tunnel creation",
+			fn: func(cctx context.Context, ctx *Context, kernel *fakeNetlink) error {
+				kernel.setWedged(true)
+				_, err := ctx.NewStaticTunnelContext(cctx, "t1", staticCfg)
+				return err
+			},
+		},
+		{
+			name: "quiescent tunnel creation",
+			fn: func(cctx context.Context, ctx *Context, kernel *fakeNetlink) error {
+				kernel.setWedged(true)
+				_, err := ctx.NewQuiescentTunnelContext(cctx, "t1", quiescentCfg)
+				return err
+			},
+		},
+		{
+			name: "session creation",
+			fn: func(cctx context.Context, ctx *Context, kernel *fakeNetlink) error {
+				tunl, err := ctx.NewStaticTunnel("t1", staticCfg)
+				if err != nil {
+					return fmt.Errorf("NewStaticTunnel(): %v", err)
+				}
+				kernel.setWedged(true)
+				_, err = tunl.NewSessionContext(cctx, "s1", sessionCfg)
+				return err
+			},
+		},
+		{
+			name: "tunnel close",
+			fn: func(cctx context.Context, ctx *Context, kernel *fakeNetlink) error {
+				tunl, err := ctx.NewQuiescentTunnel("t1", quiescentCfg)
+				if err != nil {
+					return fmt.Errorf("NewQuiescentTunnel(): %v", err)
+				}
+				_, err = tunl.NewSession("s1", sessionCfg)
+				if err != nil {
+					return fmt.Errorf("NewSession(): %v", err)
+				}
+				kernel.setWedged(true)
+				return tunl.CloseContext(cctx)
+			},
+		},
+		{
+			name: "session close",
+			fn: func(cctx context.Context, ctx *Context, kernel *fakeNetlink) error {
+				tunl, err := ctx.NewStaticTunnel("t1", staticCfg)
+				if err != nil {
+					return fmt.Errorf("NewStaticTunnel(): %v", err)
+				}
+				s, err := tunl.NewSession("s1", sessionCfg)
+				if err != nil {
+					return fmt.Errorf("NewSession(): %v", err)
+				}
+				kernel.setWedged(true)
+				return s.CloseContext(cctx)
+			},
+		},
+		{
+			name: "context close",
+			fn: func(cctx context.Context, ctx *Context, kernel *fakeNetlink) error {
+				_, err := ctx.NewStaticTunnel("t1", staticCfg)
+				if err != nil {
+					return fmt.Errorf("NewStaticTunnel(): %v", err)
+				}
+				kernel.setWedged(true)
+				return ctx.CloseContext(cctx)
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			goroutines := runtime.NumGoroutine()
+
+			dial, kernels := newFakeNetlinkDialer()
+			ctx, err := newContext(nil, nil, withNetlinkDialer(dial))
+			if err != nil {
+				t.Fatalf("newContext(): %v", err)
+			}
+
+			cctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+
+			err = c.fn(cctx, ctx, kernels[""])
+			if !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+			}
+
+			// Teardown abandoned by the caller completes in the
+			// background once the kernel responds, releasing the
+			// kernel's objects even though cctx is done.
+			kernels[""].setWedged(false)
+			ctx.Close()
+
+			if nt, ns := kernels[""].counts(); nt != 0 || ns != 0 {
+				t.Errorf("expected an empty kernel, got %v tunnels and %v sessions", nt, ns)
+			}
+
+			stats := ctx.Stats()
+			if stats.TunnelsCreated != stats.TunnelsClosed {
+				t.Errorf("created %v tunnels but closed %v", stats.TunnelsCreated, stats.TunnelsClosed)
+			}
+			if stats.SessionsCreated != stats.SessionsClosed {
+				t.Errorf("created %v sessions but closed %v", stats.SessionsCreated, stats.SessionsClosed)
+			}
+			err = waitForGoroutines(goroutines)
+			if err != nil {
+				t.Errorf("%v", err)
+			}
+		})
+	}
+}
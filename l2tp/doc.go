@@ -42,6 +42,19 @@ Usage
 		}
 	}
 
+Control messages
+
+Package l2tp exposes its control message codec for use by tools such as
+test harnesses and traffic analyzers.  ParseMessages decodes a buffer into
+typed messages such as SCCRQ and ICRQ, while MarshalMessage encodes a typed
+message for transmission.  Messages are validated against the AVPs the RFCs
+require and forbid for each message type.  Invalid messages received from a
+peer are rejected using StopCCN, or CDN for session messages, as the RFCs
+require.
+
+Vendor-specific AVPs may be registered using RegisterVendorAVP, and built
+using NewVendorAVP.
+
 Tunnel types
 
 Package l2tp has a concept of "tunnel types" which are used to describe
@@ -59,8 +72,53 @@ of the L2TP control protocol to allow keep-alive (HELLO) messages to be sent and
 acknowledged using the L2TP reliable transport algorithm.  This slight extension
 allows for detection of tunnel failure in an otherwise static setup.
 
-The final tunnel type, which is currently unimplemented(!), is the dynamic
-tunnel.  This runs the full L2TP control protocol.
+The final tunnel type is the dynamic tunnel, which is intended to run the
+full L2TP control protocol.  Currently the dynamic tunnel establishes the
+control connection with the peer, learning the peer's tunnel ID, and then
+behaves as a quiescent tunnel: sessions are still created statically.  If
+both peers start the control connection at the same time, the collision
+is resolved using the Tiebreaker AVP so that just one survives.
+
+Concurrency
+
+A Context, and the Tunnel and Session instances created from it, may be
+used concurrently from multiple goroutines.  The Context owns its tunnels
+and each tunnel owns its sessions: closing a Context closes all its tunnels,
+and closing a tunnel closes all its sessions.  A quiescent tunnel may also
+close itself if its control plane transport fails.  Once a tunnel is closed,
+attempts to create new sessions in it fail.  As each session and tunnel is
+removed, a SessionDownEvent or TunnelDownEvent is passed to any EventHandler
+registered using Context.RegisterEventHandler.
+
+Creating and closing tunnels and sessions requires requests to the Linux
+kernel.  The Context-suffixed variants of these calls, such as
+NewStaticTunnelContext and CloseContext, take a context.Context and return
+early if it is done before the kernel responds.  Teardown abandoned in this
+way continues in the background, giving up if the kernel hasn't responded
+within ten seconds.
+
+By default each quiescent tunnel runs its control plane transport using
+goroutines of its own.  Applications running many thousands of tunnels may
+instead set ContextConfig.ReactorWorkers, in which case the transports of
+the context's quiescent tunnels are run by a shared reactor: a single
+goroutine waits for socket readiness and timer expiry across all the
+tunnels, and hands the resulting events to a fixed pool of worker
+goroutines.  The number of goroutines is then independent of the number
+of tunnels.
+
+Circuit status
+
+Quiescent L2TPv3 tunnels signal the status of the attachment circuits of
+their Ethernet pseudowire sessions, so that the failure of a circuit on the
+customer side of one peer is seen on the customer side of the other.  If a
+session's configuration sets CircuitInterface, the session watches the
+carrier of that network interface and reports changes to the peer using
+SLI messages carrying the Circuit Status AVP, per RFC3931 section 5.4.5.
+SLI and CSUN messages received from the peer are applied to the session's
+network interface, whose operational state is dormant while the peer's
+circuit is down, and a CSURQ from the peer is answered with a CSUN.
+Changes in circuit status are passed to any EventHandler registered using
+Context.RegisterEventHandler as a CircuitStatusEvent.
 
 Configuration
 
@@ -86,21 +144,52 @@ configuration parameters for that instance as key:value pairs.
 	[tunnel.t1]
 
 	# local specifies the local address that the tunnel should
-	# bind its socket to
+	# bind its socket to.
+	# IPv6 link-local addresses must specify the interface zone,
+	# e.g. "[fe80::1%eth0]:5000", and may not be used by static tunnels.
 	local = "127.0.0.1:5000"
 
 	# peer specifies the address of the peer that the tunnel should
-	# connect its socket to
+	# connect its socket to.
+	# The peer address must be of the same address family as the
+	# local address.
 	peer = "127.0.0.1:5001"
 
+	# bind_interface if set binds the tunnel socket to the specified
+	# network interface, which may be useful on multi-homed hosts.
+	# This parameter only applies to quiescent tunnels.
+	# By default the tunnel socket is not bound to an interface.
+	bind_interface = "eth0"
+
+	# netns if set specifies the network namespace in which the tunnel
+	# socket and kernel data plane should be created.  The namespace may
+	# be specified either by name, as created by "ip netns add", or by
+	# the path to a namespace file.
+	# By default the tunnel is created in the current network namespace.
+	netns = "tenant1"
+
+	# vrf if set binds the tunnel socket to the specified VRF master
+	# device.  vrf and bind_interface may not both be set.
+	# This parameter only applies to quiescent tunnels.
+	# By default the tunnel socket is not bound to a VRF.
+	vrf = "vrf-blue"
+
 	# version specifies the version of the L2TP specification the
 	# tunnel should use.
-	# Currently supported values are "l2tpv2" and "l2tpv3"
+	# Currently supported values are "l2tpv2", "l2tpv3" and
+	# "l2tpv3fallback".  The latter is L2TPv3 with RFC3931 fallback
+	# mode, in which the peer may start the control connection
+	# using an SCCRQ with L2TPv2 framing: refer to
+	# ProtocolVersion3Fallback.  Static and quiescent tunnels exchange
+	# no SCCRQ, and so treat "l2tpv3fallback" as "l2tpv3", while
+	# dynamic tunnels send their SCCRQ in fallback mode, and answer a
+	# peer's fallback mode SCCRQ using L2TPv3.  Dynamic "l2tpv3"
+	# tunnels refuse fallback mode SCCRQs.
 	version = "l2tpv3"
 
 	# encap specifies the encapsulation to be used for the tunnel.
 	# Currently supported values are "udp" and "ip".
-	# L2TPv2 tunnels are UDP only.
+	# L2TPv2 and L2TPv3 fallback mode tunnels are UDP only.
 	encap = "udp"
 
 	# tid specifies the local tunnel ID of the tunnel.
@@ -124,6 +213,14 @@ configuration parameters for that instance as key:value pairs.
 	# this from the default value of 4.
 	window_size = 10 # control messages
 
+	# rx_window_size specifies the number of control messages the L2TP
+	# reliable transport will buffer while waiting for a message which
+	# is missing from the sequence.  Messages received beyond the window
+	# are discarded, and must be retransmitted by the peer.  The window
+	# is advertised to the peer when a control connection is established.
+	# By default the window is 4 messages.
+	rx_window_size = 8 # control messages
+
 	# hello_timeout if set enables L2TP keep-alive (HELLO) messages.
 	# A hello message is sent N milliseconds after the last control
 	# message was sent or received.  It allows for early detection of
@@ -133,10 +230,21 @@ configuration parameters for that instance as key:value pairs.
 
 	# retry_timeout if set tweaks the starting retry timeout for the
 	# reliable transport algorithm used for L2TP control messages.
-	# The algorithm uses an exponential backoff when retrying messages.
+	# The algorithm uses an exponential backoff when retrying messages,
+	# up to a maximum interval of 8 seconds.
 	# By default a starting retry timeout of 1000ms is used.
 	retry_timeout = 1500 # milliseconds
 
+	# retry_mode specifies how the starting retry timeout is chosen.
+	# Currently supported values are "fixed" and "adaptive".
+	# In fixed mode retry_timeout is always used.  In adaptive mode the
+	# timeout is derived from the round trip time measured from the
+	# peer's acks, with retry_timeout used until the first measurement
+	# is made.  Adaptive mode suits links whose latency is unknown or
+	# varies between tunnels.
+	# By default fixed mode is used.
+	retry_mode = "adaptive"
+
 	# max_retries sets how many times a given control message may be
 	# retried before the transport considers the message transmission to
 	# have failed.
@@ -146,6 +254,43 @@ configuration parameters for that instance as key:value pairs.
 	# The default is 3 retries.
 	max_retries 5
 
+	# defer_connect if set prevents the tunnel socket from being connected
+	# to the peer until the first control message has been received from
+	# it.  The tunnel socket is then connected to the address and port the
+	# message was sent from.  This allows for RFC2661 peers which reply from
+	# a different port to the one we targeted, and for peers behind NAT.
+	# The tunnel data plane is not created until the socket is connected,
+	# so this is generally used in conjunction with hello_timeout.
+	# This parameter only applies to quiescent tunnels.
+	# By default the socket is connected when the tunnel is created.
+	defer_connect = true
+
+	# nat_traversal if set allows the tunnel to follow the peer to a new
+	# address or port.  If control messages for the tunnel are received
+	# from a different source than the tunnel socket is connected to, the
+	# socket is reconnected to the new source address.  This is useful if
+	# the peer is behind a NAT whose bindings may change over time.
+	# This parameter only applies to quiescent tunnels using UDP
+	# encapsulation.
+	# By default NAT traversal is disabled.
+	nat_traversal = true
+
+	# capture_file if set enables capture of the control messages sent and
+	# received by the tunnel to the specified file.  The capture is written
+	# in pcapng format with synthesized IP and UDP headers, and may be opened
+	# using Wireshark or tcpdump.  Wireshark dissects L2TP on UDP port 1701
+	# by default, so captures of tunnels using other ports may require use
+	# of Wireshark's "Decode As" feature.
+	# This parameter only applies to quiescent tunnels.
+	# By default no capture is written.
+	capture_file = "/var/log/l2tp/t1.pcapng"
+
+	# capture_max_size if set causes the capture file to be rotated when it
+	# reaches the specified size.  The previous capture is renamed to have
+	# the suffix ".1".
+	# By default the capture file is not rotated.
+	capture_max_size = 10485760 # bytes
+
 	# This is a session instance called "s1" within parent tunnel "t1".
 	# Session instances are always created inside a parent tunnel.
 	[tunnel.t1.session.s1]
@@ -203,6 +348,15 @@ configuration parameters for that instance as key:value pairs.
 	# By default no Layer 2 specific sublayer is used.
 	l2spec_type = "default"
 
+	# circuit_interface, if set, specifies the network interface of the
+	# session's attachment circuit, e.g. the customer-facing Ethernet port
+	# bridged with the session interface.  The status of the interface
+	# is signalled to the peer.
+	# Circuit status is only signalled for Ethernet pseudowires in
+	# quiescent L2TPv3 tunnels.
+	# By default circuit status is not signalled.
+	circuit_interface = "eth1"
+
 Logging
 
 Package l2tp uses structured logging.  The logger of choice is the go-kit
@@ -1,8 +1,14 @@
 package l2tp
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/katalix/go-l2tp/internal/nll2tp"
@@ -11,16 +17,106 @@ import (
 
 // Context is a container for a collection of L2TP tunnels and
 // their sessions, and associated configuration.
+//
+// A Context and the tunnels and sessions created from it are safe for
+// concurrent use by multiple goroutines.  The Context owns its tunnels,
+// and each tunnel owns its sessions: closing the Context closes all its
+// tunnels, and closing a tunnel closes all its sessions.
 type Context struct {
-	logger  log.Logger
-	nlconn  *nll2tp.Conn
-	tunnels map[string]Tunnel
+	logger log.Logger
+	dial   func(netns string) (netlinkConn, error)
+	nlconn netlinkConn
+	stats  *ContextStats
+	// dialRoute establishes rtnetlink connections for link monitors
+	dialRoute func(netns string) (routeConn, error)
+	// reactor, if set, runs the transports of quiescent tunnels
+	reactor *reactor
+	// pending tracks tunnels being created, which Close waits for
+	pending sync.WaitGroup
+	// createCctx is cancelled by Close to abandon tunnels being created
+	createCctx   context.Context
+	cancelCreate context.CancelFunc
+	closeOnce    sync.Once
+	// mutex protects the fields below
+	mutex    sync.Mutex
+	closed   bool
+	nlconns  map[string]netlinkConn
+	tunnels  map[string]Tunnel
+	monitors map[string]*linkMonitor
+	handlers []EventHandler
 }
 
 // ContextConfig encodes top-level configuration for an L2TP
 // context.
 type ContextConfig struct {
-	// TODO
+	// ReactorWorkers, if non-zero, runs the control plane transports of
+	// the context's quiescent tunnels on a shared reactor with this many
+	// worker goroutines, rather than each tunnel running goroutines of
+	// its own.  This keeps the per-tunnel cost down for applications
+	// running many thousands of mostly idle tunnels.
+	ReactorWorkers int
+}
+
+// contextOption modifies the behaviour of a Context created by newContext.
+//
+// Options are not exported: the netlink and rtnetlink interfaces they
+// inject are expressed in terms of the internal nll2tp and nlrtnl
+// packages, so they can only be implemented from within this module.
+type contextOption func(ctx *Context)
+
+// withNetlinkDialer replaces the function used to establish netlink
+// connections to the kernel.  dial is passed the network namespace for
+// the connection, the empty string representing the namespace the
+// context was created in.  This allows a fake kernel to be used for testing.
+func withNetlinkDialer(dial func(netns string) (netlinkConn, error)) contextOption {
+	return func(ctx *Context) {
+		ctx.dial = dial
+	}
+}
+
+// withRouteDialer replaces the function used to establish rtnetlink
+// connections to the kernel, in the same way as withNetlinkDialer.
+func withRouteDialer(dial func(netns string) (routeConn, error)) contextOption {
+	return func(ctx *Context) {
+		ctx.dialRoute = dial
+	}
+}
+
+// EventHandler is implemented by applications which wish to be told
+// about events occurring in a Context.
+type EventHandler interface {
+	// HandleEvent is called for each event, e.g. *CircuitStatusEvent.
+	// It's called from goroutines internal to the Context, and so must
+	// not block.  In particular, it must not close tunnels or sessions.
+	HandleEvent(event interface{})
+}
+
+// CircuitStatusEvent reports a change in the status of the attachment
+// circuit of an L2TPv3 Ethernet pseudowire session: either the local
+// circuit, as configured by SessionConfig.CircuitInterface, or the peer's
+// circuit, as signalled by the peer.
+type CircuitStatusEvent struct {
+	TunnelName  string
+	SessionName string
+	// Peer is set if the event reports the status of the peer's circuit
+	Peer bool
+	// Up is set if the circuit is active
+	Up bool
+}
+
+// TunnelDownEvent reports that a tunnel has been removed from its
+// Context, either because it was closed or because its control plane
+// transport failed.  It follows a SessionDownEvent for each of the
+// tunnel's sessions.
+type TunnelDownEvent struct {
+	TunnelName string
+}
+
+// SessionDownEvent reports that a session has been removed from its
+// tunnel.
+type SessionDownEvent struct {
+	TunnelName  string
+	SessionName string
 }
 
 // Tunnel is an interface representing an L2TP tunnel.
@@ -30,21 +126,61 @@ type Tunnel interface {
 	// The name provided must be unique in the parent tunnel.
 	NewSession(name string, cfg *SessionConfig) (Session, error)
 
+	// NewSessionContext is like NewSession, but fails if cctx is done
+	// before the session is created.  The error then wraps the
+	// context's error.
+	NewSessionContext(cctx context.Context, name string, cfg *SessionConfig) (Session, error)
+
 	// Close closes the tunnel, releasing allocated resources.
 	//
 	// Any sessions instantiated inside the tunnel are removed.
+	// Close may be called more than once, including after the
+	// tunnel has closed itself due to transport failure.
 	Close()
 
+	// CloseContext is like Close, but returns the context's error if
+	// cctx is done before the tunnel has been torn down.  Teardown
+	// continues in the background, but kernel resources may not be
+	// released if the kernel doesn't respond within ten seconds.
+	CloseContext(cctx context.Context) error
+
+	// StartCapture starts writing the control messages sent and received
+	// by the tunnel to a pcapng file, which may be opened using Wireshark
+	// or tcpdump.  If maxSize is non-zero, the capture file is rotated when
+	// it reaches maxSize bytes, with the previous file being renamed to have
+	// the suffix ".1".  Any capture already running for the tunnel is stopped.
+	//
+	// Static tunnels have no control plane and so cannot be captured.
+	StartCapture(path string, maxSize uint) error
+
+	// StopCapture stops a capture started by StartCapture or by the
+	// tunnel configuration.
+	StopCapture()
+
+	// Stats returns the state of the tunnel's control plane transport.
+	// It fails if the transport has gone down.
+	Stats() (*TunnelStats, error)
+
 	getCfg() *TunnelConfig
-	getNLConn() *nll2tp.Conn
+	getNLConn() netlinkConn
 	getLogger() log.Logger
-	unlinkSession(name string)
+	unlinkSession(name string, s Session)
 }
 
 // Session is an interface representing an L2TP session.
 type Session interface {
 	// Close closes the session, releasing allocated resources.
+	// Close may be called more than once.
 	Close()
+
+	// CloseContext is like Close, but returns the context's error if
+	// cctx is done before the session has been torn down.  Teardown
+	// continues in the background, as for Tunnel.CloseContext.
+	CloseContext(cctx context.Context) error
+
+	// Stats queries the Linux kernel for the session's data plane
+	// statistics.  It fails if the data plane hasn't been created.
+	Stats() (*SessionStats, error)
 }
 
 // NewContext creates a new L2TP context, which can then be used
@@ -63,6 +199,12 @@ type Session interface {
 // If a nil configuration is passed, default configuration will
 // be used.
 func NewContext(logger log.Logger, cfg *ContextConfig) (*Context, error) {
+	return newContext(logger, cfg)
+}
+
+// newContext is like NewContext, but allows options to be passed to
+// modify the behaviour of the context, e.g. for testing.
+func newContext(logger log.Logger, cfg *ContextConfig, opts ...contextOption) (*Context, error) {
 
 	if logger == nil {
 		logger = log.NewNopLogger()
@@ -74,32 +216,178 @@ func NewContext(logger log.Logger, cfg *ContextConfig) (*Context, error) {
 		// etc, etc.
 	}
 
-	nlconn, err := nll2tp.Dial()
+	ctx := &Context{
+		logger:    logger,
+		dial:      dialNetlink,
+		dialRoute: dialRtnetlink,
+		nlconns:   make(map[string]netlinkConn),
+		tunnels:   make(map[string]Tunnel),
+		monitors:  make(map[string]*linkMonitor),
+		stats:     &ContextStats{},
+	}
+
+	for _, opt := range opts {
+		opt(ctx)
+	}
+
+	ctx.createCctx, ctx.cancelCreate = context.WithCancel(context.Background())
+
+	nlconn, err := ctx.dial("")
 	if err != nil {
+		ctx.cancelCreate()
 		return nil, fmt.Errorf("failed to establish a netlink/L2TP connection: %v", err)
 	}
+	ctx.nlconn = nlconn
+
+	if cfg != nil && cfg.ReactorWorkers > 0 {
+		ctx.reactor, err = newReactor(logger, cfg.ReactorWorkers)
+		if err != nil {
+			ctx.cancelCreate()
+			nlconn.Close()
+			return nil, err
+		}
+	}
 
-	return &Context{
-		logger:  logger,
-		nlconn:  nlconn,
-		tunnels: make(map[string]Tunnel),
-	}, nil
+	return ctx, nil
+}
+
+// dialNetlink establishes a netlink connection to the kernel L2TP
+// subsystem in the specified network namespace.
+func dialNetlink(netns string) (netlinkConn, error) {
+	var nlconn *nll2tp.Conn
+	err := withNetns(netns, func() (err error) {
+		nlconn, err = nll2tp.Dial()
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nlconn, nil
+}
+
+// getNLConn returns the netlink connection for the specified
+// network namespace, establishing a new connection if required.
+// The empty string represents the namespace the context was created in.
+func (ctx *Context) getNLConn(netns string) (nlconn netlinkConn, err error) {
+	if netns == "" {
+		return ctx.nlconn, nil
+	}
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	if nlconn, ok := ctx.nlconns[netns]; ok {
+		return nlconn, nil
+	}
+	nlconn, err = ctx.dial(netns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish a netlink/L2TP connection in network namespace %q: %v", netns, err)
+	}
+	ctx.nlconns[netns] = nlconn
+	return nlconn, nil
+}
+
+// getLinkMonitor returns the link monitor for the specified network
+// namespace, establishing a new rtnetlink connection if required.
+// Since most applications have no need of them, link monitors are
+// only created once they're first used.
+func (ctx *Context) getLinkMonitor(netns string) (*linkMonitor, error) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	if ctx.closed {
+		return nil, fmt.Errorf("context is closed")
+	}
+	if m, ok := ctx.monitors[netns]; ok {
+		return m, nil
+	}
+	conn, err := ctx.dialRoute(netns)
+	if err != nil {
+		return nil, fmt.Errorf("failed to establish an rtnetlink connection in network namespace %q: %v", netns, err)
+	}
+	m := newLinkMonitor(ctx.logger, conn)
+	ctx.monitors[netns] = m
+	return m, nil
+}
+
+// RegisterEventHandler adds an event handler to the context.
+// Each event is passed to all the handlers registered at the time.
+func (ctx *Context) RegisterEventHandler(handler EventHandler) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	ctx.handlers = append(ctx.handlers, handler)
+}
+
+// UnregisterEventHandler removes an event handler added by
+// RegisterEventHandler.
+func (ctx *Context) UnregisterEventHandler(handler EventHandler) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	for i, h := range ctx.handlers {
+		if h == handler {
+			ctx.handlers = append(ctx.handlers[:i:i], ctx.handlers[i+1:]...)
+			return
+		}
+	}
+}
+
+// handleEvent passes an event to the registered event handlers.
+func (ctx *Context) handleEvent(event interface{}) {
+	ctx.mutex.Lock()
+	handlers := ctx.handlers
+	ctx.mutex.Unlock()
+	for _, h := range handlers {
+		h.HandleEvent(event)
+	}
 }
 
 // NewQuiescentTunnel creates a new "quiescent" L2TP tunnel.
 //
 // A quiescent tunnel creates a user space socket for the
 // L2TP control plane, but does not run the control protocol
-// beyond acknowledging messages and optionally sending HELLO
-// messages.
+// beyond acknowledging messages, optionally sending HELLO
+// messages, and signalling the status of the attachment circuits
+// of L2TPv3 Ethernet pseudowires as described by SessionConfig's
+// CircuitInterface.
+//
+// The data plane is established on creation of the tunnel instance,
+// unless the tunnel configuration sets DeferConnect.  In this case the
+// tunnel socket is connected, and the data plane for the tunnel and its
+// sessions established, once the first message is received from the peer.
+// This allows for peers which reply from a different port to the one we
+// targeted, as is common for RFC2661 implementations.
+//
+// If the tunnel configuration sets NATTraversal, the tunnel will follow
+// the peer to a new address or port if it receives control messages for
+// the tunnel from a different source, as happens when a NAT binding in
+// front of the peer changes.  NAT traversal is supported for UDP
+// encapsulation only.
 //
-// The data plane is established on creation of the tunnel instance.
+// If the tunnel configuration sets BindInterface, the tunnel socket
+// is bound to the specified network interface.  This may be useful
+// on multi-homed hosts.
+//
+// If the tunnel configuration sets VRF, the tunnel socket is bound
+// to the specified VRF master device.  VRF and BindInterface may not
+// both be set.
+//
+// If the tunnel configuration sets Netns, the tunnel socket and the
+// kernel data plane are created in the specified network namespace.
+//
+// If the tunnel configuration sets CaptureFile, the control messages sent
+// and received by the tunnel are written to the file as for StartCapture.
 //
 // The name provided must be unique in the Context.
 //
 // The tunnel configuration must include local and peer addresses
-// and local and peer tunnel IDs.
+// and local and peer tunnel IDs.  The local and peer addresses must
+// be of the same address family.  IPv6 link-local addresses must
+// specify a zone, e.g. "[fe80::1%eth0]:1701".
 func (ctx *Context) NewQuiescentTunnel(name string, cfg *TunnelConfig) (tunl Tunnel, err error) {
+	return ctx.NewQuiescentTunnelContext(context.Background(), name, cfg)
+}
+
+// NewQuiescentTunnelContext is like NewQuiescentTunnel, but fails if cctx
+// is done before the tunnel is created.  The error then wraps the
+// context's error.
+func (ctx *Context) NewQuiescentTunnelContext(cctx context.Context, name string, cfg *TunnelConfig) (tunl Tunnel, err error) {
 
 	var sal, sap unix.Sockaddr
 
@@ -109,14 +397,22 @@ func (ctx *Context) NewQuiescentTunnel(name string, cfg *TunnelConfig) (tunl Tun
 	}
 
 	// Must not have name clashes
-	if _, ok := ctx.tunnels[name]; ok {
-		return nil, fmt.Errorf("already have tunnel %q", name)
+	cctx, done, err := ctx.beginCreate(cctx, name)
+	if err != nil {
+		return nil, err
 	}
+	defer done()
 
 	// Sanity check the configuration
 	if cfg.Version != ProtocolVersion3 && cfg.Encap == EncapTypeIP {
 		return nil, fmt.Errorf("IP encapsulation only supported for L2TPv3 tunnels")
 	}
+	if cfg.NATTraversal && cfg.Encap != EncapTypeUDP {
+		return nil, fmt.Errorf("NAT traversal only supported for UDP encapsulation")
+	}
+	if cfg.VRF != "" && cfg.BindInterface != "" {
+		return nil, fmt.Errorf("cannot bind to both a VRF and an interface")
+	}
 	if cfg.Version == ProtocolVersion2 {
 		if cfg.TunnelID == 0 || cfg.TunnelID > 65535 {
 			return nil, fmt.Errorf("L2TPv2 connection ID %v out of range", cfg.TunnelID)
@@ -131,25 +427,115 @@ func (ctx *Context) NewQuiescentTunnel(name string, cfg *TunnelConfig) (tunl Tun
 	}
 
 	// Initialise tunnel address structures
-	switch cfg.Encap {
-	case EncapTypeUDP:
-		sal, sap, err = newUDPAddressPair(cfg.Local, cfg.Peer)
-	case EncapTypeIP:
-		sal, sap, err = newIPAddressPair(cfg.Local, cfg.TunnelID,
-			cfg.Peer, cfg.PeerTunnelID)
-	default:
-		err = fmt.Errorf("unrecognised encapsulation type %v", cfg.Encap)
+	sal, sap, err = newTunnelAddressPair(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialise tunnel addresses: %v", err)
+	}
+
+	nlconn, err := ctx.getNLConn(cfg.Netns)
+	if err != nil {
+		return nil, err
+	}
+
+	tunl, err = newQuiescentTunnel(cctx, name, ctx, nlconn, sal, sap, cfg, false)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctx.linkTunnel(name, tunl)
+	if err != nil {
+		tunl.Close()
+		return nil, err
+	}
+
+	return tunl, nil
+}
+
+// NewDynamicTunnel creates a new dynamic L2TP tunnel.
+//
+// A dynamic tunnel establishes its control connection with the peer
+// using the SCCRQ/SCCRP/SCCCN exchange before instantiating the data
+// plane, learning the peer's tunnel ID in the process.  Once established,
+// the tunnel behaves as a quiescent tunnel: sessions are created
+// statically, and the tunnel closes if the peer sends StopCCN.
+//
+// If both ends of the tunnel start the control connection at the same
+// time, the collision is resolved using the Tiebreaker AVP as per RFC2661
+// section 4.4.3 and RFC3931 section 5.4.3, so that just one control
+// connection survives.  This allows symmetric peers to use dynamic tunnels
+// to connect to each other.
+//
+// NewDynamicTunnel blocks until the control connection is established, or
+// establishment fails.  The transports of dynamic tunnels are never run
+// by the context reactor.
+//
+// The tunnel configuration must include local and peer addresses and
+// the local tunnel ID, and must not set the peer tunnel ID.  Dynamic
+// tunnels support UDP encapsulation only.  Otherwise the configuration is
+// as for NewQuiescentTunnel.
+func (ctx *Context) NewDynamicTunnel(name string, cfg *TunnelConfig) (tunl Tunnel, err error) {
+	return ctx.NewDynamicTunnelContext(context.Background(), name, cfg)
+}
+
+// NewDynamicTunnelContext is like NewDynamicTunnel, but fails if cctx
+// is done before the control connection is established.  The error then
+// wraps the context's error.
+func (ctx *Context) NewDynamicTunnelContext(cctx context.Context, name string, cfg *TunnelConfig) (tunl Tunnel, err error) {
+
+	var sal, sap unix.Sockaddr
+
+	// Must have configuration
+	if cfg == nil {
+		return nil, fmt.Errorf("invalid nil config")
+	}
+
+	// Must not have name clashes
+	cctx, done, err := ctx.beginCreate(cctx, name)
+	if err != nil {
+		return nil, err
 	}
+	defer done()
+
+	// Sanity check the configuration
+	if cfg.Encap != EncapTypeUDP {
+		return nil, fmt.Errorf("dynamic tunnels support UDP encapsulation only")
+	}
+	if cfg.VRF != "" && cfg.BindInterface != "" {
+		return nil, fmt.Errorf("cannot bind to both a VRF and an interface")
+	}
+	if cfg.PeerTunnelID != 0 {
+		return nil, fmt.Errorf("dynamic tunnel peer connection ID is assigned by the peer")
+	}
+	if cfg.TunnelID == 0 {
+		return nil, fmt.Errorf("tunnel connection ID must be > 0")
+	}
+	if cfg.Version == ProtocolVersion2 && cfg.TunnelID > 65535 {
+		return nil, fmt.Errorf("L2TPv2 connection ID %v out of range", cfg.TunnelID)
+	}
+
+	// Initialise tunnel address structures
+	sal, sap, err = newTunnelAddressPair(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialise tunnel addresses: %v", err)
 	}
 
-	tunl, err = newQuiescentTunnel(name, ctx, sal, sap, cfg)
+	nlconn, err := ctx.getNLConn(cfg.Netns)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx.tunnels[name] = tunl
+	// The peer tunnel ID is filled in once the peer assigns it
+	dcfg := *cfg
+	tunl, err = newDynamicTunnel(cctx, name, ctx, nlconn, sal, sap, &dcfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctx.linkTunnel(name, tunl)
+	if err != nil {
+		tunl.Close()
+		return nil, err
+	}
 
 	return tunl, nil
 }
@@ -165,11 +551,23 @@ func (ctx *Context) NewQuiescentTunnel(name string, cfg *TunnelConfig) (tunl Tun
 // so NewStaticTunnel only supports creation of L2TPv3
 // unmanaged tunnel instances.
 //
+// If the tunnel configuration sets Netns, the tunnel is
+// created in the specified network namespace.
+//
 // The name provided must be unique in the Context.
 //
 // The tunnel configuration must include local and peer addresses
-// and local and peer tunnel IDs.
+// and local and peer tunnel IDs.  IPv6 link-local addresses are not
+// supported, since the kernel creates the tunnel socket without a
+// scope ID.
 func (ctx *Context) NewStaticTunnel(name string, cfg *TunnelConfig) (tunl Tunnel, err error) {
+	return ctx.NewStaticTunnelContext(context.Background(), name, cfg)
+}
+
+// NewStaticTunnelContext is like NewStaticTunnel, but fails if cctx
+// is done before the tunnel is created.  The error then wraps the
+// context's error.
+func (ctx *Context) NewStaticTunnelContext(cctx context.Context, name string, cfg *TunnelConfig) (tunl Tunnel, err error) {
 
 	var sal, sap unix.Sockaddr
 
@@ -179,55 +577,278 @@ func (ctx *Context) NewStaticTunnel(name string, cfg *TunnelConfig) (tunl Tunnel
 	}
 
 	// Must not have name clashes
-	if _, ok := ctx.tunnels[name]; ok {
-		return nil, fmt.Errorf("already have tunnel %q", name)
+	cctx, done, err := ctx.beginCreate(cctx, name)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	// Static tunnels exchange no SCCRQ, so fallback mode makes no
+	// difference to them
+	if cfg.Version == ProtocolVersion3Fallback {
+		scfg := *cfg
+		scfg.Version = ProtocolVersion3
+		cfg = &scfg
 	}
 
 	// Sanity check  the configuration
 	if cfg.Version != ProtocolVersion3 {
 		return nil, fmt.Errorf("static tunnels can be L2TPv3 only")
 	}
+	if cfg.DeferConnect {
+		return nil, fmt.Errorf("static tunnels cannot defer connect")
+	}
+	if cfg.NATTraversal {
+		return nil, fmt.Errorf("static tunnels cannot perform NAT traversal")
+	}
+	if cfg.BindInterface != "" {
+		return nil, fmt.Errorf("static tunnels cannot bind to an interface")
+	}
+	if cfg.VRF != "" {
+		return nil, fmt.Errorf("static tunnels cannot bind to a VRF")
+	}
+	if cfg.CaptureFile != "" {
+		return nil, fmt.Errorf("static tunnels cannot capture control messages")
+	}
 	if cfg.TunnelID == 0 || cfg.PeerTunnelID == 0 {
 		return nil, fmt.Errorf("L2TPv3 tunnel IDs %v and %v must both be > 0",
 			cfg.TunnelID, cfg.PeerTunnelID)
 	}
 
 	// Initialise tunnel address structures
-	switch cfg.Encap {
-	case EncapTypeUDP:
-		sal, sap, err = newUDPAddressPair(cfg.Local, cfg.Peer)
-	case EncapTypeIP:
-		sal, sap, err = newIPAddressPair(cfg.Local, cfg.TunnelID,
-			cfg.Peer, cfg.PeerTunnelID)
-	default:
-		err = fmt.Errorf("unrecognised encapsulation type %v", cfg.Encap)
-	}
+	sal, sap, err = newTunnelAddressPair(cfg)
 	if err != nil {
 		return nil, fmt.Errorf("failed to initialise tunnel addresses: %v", err)
 	}
+	// The kernel creates the socket for a static tunnel from the
+	// addresses alone, with no scope ID
+	if isLinkLocal(sal) || isLinkLocal(sap) {
+		return nil, fmt.Errorf("static tunnels cannot use IPv6 link-local addresses")
+	}
 
-	tunl, err = newStaticTunnel(name, ctx, sal, sap, cfg)
+	nlconn, err := ctx.getNLConn(cfg.Netns)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx.tunnels[name] = tunl
+	tunl, err = newStaticTunnel(cctx, name, ctx, nlconn, sal, sap, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ctx.linkTunnel(name, tunl)
+	if err != nil {
+		tunl.Close()
+		return nil, err
+	}
 
 	return tunl, nil
 }
 
 // Close tears down the context, including all the L2TP tunnels and sessions
 // running inside it.
+//
+// Close may be called more than once, and from any goroutine.  Once the
+// context is closed, attempts to create new tunnels fail.
 func (ctx *Context) Close() {
-	for name, tunl := range ctx.tunnels {
-		tunl.Close()
-		ctx.unlinkTunnel(name)
+	_ = ctx.CloseContext(context.Background())
+}
+
+// CloseContext is like Close, but returns the context's error if cctx
+// is done before the context has been torn down.  Teardown continues in
+// the background, but kernel resources may not be released if the kernel
+// doesn't respond within ten seconds.
+func (ctx *Context) CloseContext(cctx context.Context) error {
+	return closeWithContext(cctx, &ctx.closeOnce, ctx.teardown)
+}
+
+func (ctx *Context) teardown(cctx context.Context) {
+	ctx.mutex.Lock()
+	ctx.closed = true
+	ctx.mutex.Unlock()
+
+	// Tunnels being created when we were closed fail rather than
+	// being linked, but must have released their resources before
+	// the netlink connections they use are closed.
+	ctx.cancelCreate()
+	ctx.pending.Wait()
+
+	// Tunnels unlink themselves from the context as they close,
+	// so we mustn't hold the lock while closing them.
+	ctx.mutex.Lock()
+	tunnels := make([]Tunnel, 0, len(ctx.tunnels))
+	for _, tunl := range ctx.tunnels {
+		tunnels = append(tunnels, tunl)
 	}
+	ctx.mutex.Unlock()
+
+	for _, tunl := range tunnels {
+		_ = tunl.CloseContext(cctx)
+	}
+
+	ctx.mutex.Lock()
+	for _, nlconn := range ctx.nlconns {
+		nlconn.Close()
+	}
+	monitors := ctx.monitors
+	ctx.monitors = nil
+	ctx.mutex.Unlock()
 	ctx.nlconn.Close()
+
+	for _, m := range monitors {
+		m.close()
+	}
+
+	if ctx.reactor != nil {
+		ctx.reactor.close()
+	}
+}
+
+// closeTimeout bounds the time teardown waits for the kernel.
+const closeTimeout = 10 * time.Second
+
+// withTeardownContext calls teardown with a context which is independent
+// of the caller's, so that teardown abandoned by the caller still
+// releases kernel resources, but which times out if the kernel doesn't
+// respond.
+func withTeardownContext(teardown func(cctx context.Context)) {
+	tctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+	teardown(tctx)
+}
+
+// closeWithContext calls teardown at most once for the lifetime of once.
+// It returns when teardown has completed, or with the context's error if
+// cctx is done first, in which case teardown continues in the background.
+func closeWithContext(cctx context.Context, once *sync.Once, teardown func(cctx context.Context)) error {
+	done := make(chan struct{})
+	go func() {
+		once.Do(func() { withTeardownContext(teardown) })
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-cctx.Done():
+		return cctx.Err()
+	}
+}
+
+// beginCreate checks whether a tunnel may be created, and if so records
+// the creation as pending.  The returned context is derived from cctx,
+// and is also cancelled if the Context is closed so that Close needn't
+// wait for a slow creation to complete.  The caller must call done once
+// the tunnel is either linked or has failed.
+func (ctx *Context) beginCreate(cctx context.Context, name string) (createCctx context.Context, done func(), err error) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	if ctx.closed {
+		return nil, nil, fmt.Errorf("context is closed")
+	}
+	if _, ok := ctx.tunnels[name]; ok {
+		return nil, nil, fmt.Errorf("already have tunnel %q", name)
+	}
+	ctx.pending.Add(1)
+
+	createCctx, cancel := context.WithCancel(cctx)
+	go func() {
+		select {
+		case <-ctx.createCctx.Done():
+			cancel()
+		case <-createCctx.Done():
+		}
+	}()
+	return createCctx, func() {
+		cancel()
+		ctx.pending.Done()
+	}, nil
+}
+
+// linkTunnel adds a newly created tunnel to the context.  Since tunnels
+// are created without holding the context lock, it fails if another
+// tunnel of the same name was added in the meantime, or if the context
+// was closed.
+func (ctx *Context) linkTunnel(name string, tunl Tunnel) error {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+	if ctx.closed {
+		return fmt.Errorf("context is closed")
+	}
+	if _, ok := ctx.tunnels[name]; ok {
+		return fmt.Errorf("already have tunnel %q", name)
+	}
+	ctx.tunnels[name] = tunl
+	atomic.AddUint64(&ctx.stats.TunnelsCreated, 1)
+	return nil
+}
+
+// unlinkTunnel removes a tunnel from the context.  A tunnel which
+// failed to link, e.g. due to a name clash, must not remove the
+// tunnel holding the name.
+func (ctx *Context) unlinkTunnel(name string, tunl Tunnel) {
+	ctx.mutex.Lock()
+	t, ok := ctx.tunnels[name]
+	unlinked := ok && t == tunl
+	if unlinked {
+		delete(ctx.tunnels, name)
+		atomic.AddUint64(&ctx.stats.TunnelsClosed, 1)
+	}
+	ctx.mutex.Unlock()
+
+	if unlinked {
+		ctx.handleEvent(&TunnelDownEvent{TunnelName: name})
+	}
+}
+
+// newTunnelAddressPair initialises the local and peer addresses for
+// a tunnel.  Addresses are resolved in the tunnel's network namespace
+// so that IPv6 zones refer to interfaces in that namespace.
+func newTunnelAddressPair(cfg *TunnelConfig) (sal, sap unix.Sockaddr, err error) {
+	err = withNetns(cfg.Netns, func() (err error) {
+		switch cfg.Encap {
+		case EncapTypeUDP:
+			sal, sap, err = newUDPAddressPair(cfg.Local, cfg.Peer)
+		case EncapTypeIP:
+			sal, sap, err = newIPAddressPair(cfg.Local, cfg.TunnelID,
+				cfg.Peer, cfg.PeerTunnelID)
+		default:
+			err = fmt.Errorf("unrecognised encapsulation type %v", cfg.Encap)
+		}
+		return
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	// Without a zone the kernel can't tell which link the address is on
+	if isLinkLocal(sal) && sockaddrZone(sal) == 0 {
+		return nil, nil, fmt.Errorf("IPv6 link-local address %v must specify a zone", cfg.Local)
+	}
+	if isLinkLocal(sap) && sockaddrZone(sap) == 0 {
+		return nil, nil, fmt.Errorf("IPv6 link-local address %v must specify a zone", cfg.Peer)
+	}
+	return sal, sap, nil
+}
+
+// isLinkLocal returns true if sa is an IPv6 link-local unicast address.
+func isLinkLocal(sa unix.Sockaddr) bool {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet6:
+		return net.IP(sa.Addr[:]).IsLinkLocalUnicast()
+	case *unix.SockaddrL2TPIP6:
+		return net.IP(sa.Addr[:]).IsLinkLocalUnicast()
+	}
+	return false
 }
 
-func (ctx *Context) unlinkTunnel(name string) {
-	delete(ctx.tunnels, name)
+// sockaddrZone returns the IPv6 scope ID of sa, or 0 if it has none.
+func sockaddrZone(sa unix.Sockaddr) uint32 {
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet6:
+		return sa.ZoneId
+	case *unix.SockaddrL2TPIP6:
+		return sa.ZoneId
+	}
+	return 0
 }
 
 func newUDPTunnelAddress(address string) (unix.Sockaddr, error) {
@@ -243,8 +864,10 @@ func newUDPTunnelAddress(address string) (unix.Sockaddr, error) {
 			Addr: [4]byte{b[0], b[1], b[2], b[3]},
 		}, nil
 	} else if b := u.IP.To16(); b != nil {
-		// TODO: SockaddrInet6 has a uint32 ZoneId, while UDPAddr
-		// has a Zone string.  How to convert between the two?
+		zoneID, err := zoneToIndex(u.Zone)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %v: %v", address, err)
+		}
 		return &unix.SockaddrInet6{
 			Port: u.Port,
 			Addr: [16]byte{
@@ -253,13 +876,39 @@ func newUDPTunnelAddress(address string) (unix.Sockaddr, error) {
 				b[8], b[9], b[10], b[11],
 				b[12], b[13], b[14], b[15],
 			},
-			// ZoneId
+			ZoneId: zoneID,
 		}, nil
 	}
 
 	return nil, fmt.Errorf("unhandled address family")
 }
 
+// zoneToIndex converts an IPv6 zone, which may be either an interface
+// name or a numeric interface index, into an interface index suitable
+// for use as a sockaddr scope ID.
+func zoneToIndex(zone string) (uint32, error) {
+	if zone == "" {
+		return 0, nil
+	}
+	if idx, err := strconv.ParseUint(zone, 10, 32); err == nil {
+		return uint32(idx), nil
+	}
+	ifi, err := net.InterfaceByName(zone)
+	if err != nil {
+		return 0, fmt.Errorf("unrecognised zone %q: %v", zone, err)
+	}
+	return uint32(ifi.Index), nil
+}
+
+// checkAddressFamilies returns an error if the local and peer
+// addresses are not of the same address family.
+func checkAddressFamilies(sal, sap unix.Sockaddr) error {
+	if reflect.TypeOf(sal) != reflect.TypeOf(sap) {
+		return fmt.Errorf("local and peer addresses must be of the same address family")
+	}
+	return nil
+}
+
 func newUDPAddressPair(local, remote string) (sal, sap unix.Sockaddr, err error) {
 	sal, err = newUDPTunnelAddress(local)
 	if err != nil {
@@ -269,6 +918,10 @@ func newUDPAddressPair(local, remote string) (sal, sap unix.Sockaddr, err error)
 	if err != nil {
 		return nil, nil, err
 	}
+	err = checkAddressFamilies(sal, sap)
+	if err != nil {
+		return nil, nil, err
+	}
 	return sal, sap, nil
 }
 
@@ -285,8 +938,10 @@ func newIPTunnelAddress(address string, ccid ControlConnID) (unix.Sockaddr, erro
 			ConnId: uint32(ccid),
 		}, nil
 	} else if b := u.IP.To16(); b != nil {
-		// TODO: SockaddrInet6 has a uint32 ZoneId, while UDPAddr
-		// has a Zone string.  How to convert between the two?
+		zoneID, err := zoneToIndex(u.Zone)
+		if err != nil {
+			return nil, fmt.Errorf("resolve %v: %v", address, err)
+		}
 		return &unix.SockaddrL2TPIP6{
 			Addr: [16]byte{
 				b[0], b[1], b[2], b[3],
@@ -294,7 +949,7 @@ func newIPTunnelAddress(address string, ccid ControlConnID) (unix.Sockaddr, erro
 				b[8], b[9], b[10], b[11],
 				b[12], b[13], b[14], b[15],
 			},
-			// ZoneId
+			ZoneId: zoneID,
 			ConnId: uint32(ccid),
 		}, nil
 	}
@@ -311,5 +966,9 @@ func newIPAddressPair(local string, ccid ControlConnID, remote string, pccid Con
 	if err != nil {
 		return nil, nil, err
 	}
+	err = checkAddressFamilies(sal, sap)
+	if err != nil {
+		return nil, nil, err
+	}
 	return sal, sap, nil
 }
@@ -0,0 +1,452 @@
+package l2tp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+// ctlConnState is the state of control connection establishment.
+type ctlConnState int
+
+const (
+	// ctlConnWaitCtlReply: we've sent SCCRQ and await the peer's SCCRP
+	ctlConnWaitCtlReply ctlConnState = iota
+	// ctlConnWaitCtlConn: we've answered the peer's SCCRQ with SCCRP
+	// and await its SCCCN
+	ctlConnWaitCtlConn
+	// ctlConnEstablished: the control connection is up
+	ctlConnEstablished
+	// ctlConnFailed: establishment failed
+	ctlConnFailed
+)
+
+// ctlConnCollisionTimeout is how long we wait for the peer's SCCRQ once
+// the peer has refused ours due to a collision.
+const ctlConnCollisionTimeout = 10 * time.Second
+
+// ctlConnSetup establishes the control connection of a dynamic tunnel
+// using the SCCRQ/SCCRP/SCCCN exchange of RFC2661 section 5.1 and RFC3931
+// section 3.3.
+//
+// Each dynamic tunnel has a socket of its own connected to the peer, so
+// any SCCRQ the tunnel receives is from the same peer, and crosses the
+// SCCRQ we sent: the collision is resolved using the Tiebreaker AVP.  The
+// peer's SCCRQ starts a control connection with a sequence number space
+// of its own, so checkSCCRQ is called by the transport before the SCCRQ is
+// sequenced.  If we win we answer the peer's SCCRQ with StopCCN as the
+// first message of its connection, and carry on waiting for SCCRP, while
+// if we lose the transport abandons our connection and we answer the
+// peer's SCCRQ with SCCRP in place of our own.  The peer's StopCCN
+// refusing our connection may arrive before its SCCRQ, so it's ignored
+// for as long as it takes the peer to retransmit its SCCRQ.
+//
+// Messages are passed to handle from the transport's receive path, which
+// mustn't block, so messages are sent by a serial queue.
+type ctlConnSetup struct {
+	logger     log.Logger
+	xport      *transport
+	version    ProtocolVersion
+	ccid       ControlConnID
+	hostName   string
+	routerID   uint32
+	tiebreaker uint64
+	doneChan   chan error
+	// sends may block until sendCctx is cancelled
+	sends       serialQueue
+	sendCctx    context.Context
+	cancelSends context.CancelFunc
+	// mutex protects the fields below
+	mutex     sync.Mutex
+	state     ctlConnState
+	peerCCID  ControlConnID
+	responder bool
+}
+
+// newCtlConnSetup creates the control connection setup state.  The
+// transport it's started with must be configured to call checkSCCRQ.
+func newCtlConnSetup(logger log.Logger, version ProtocolVersion,
+	ccid ControlConnID, local unix.Sockaddr) (*ctlConnSetup, error) {
+
+	tiebreaker, err := newTiebreaker()
+	if err != nil {
+		return nil, err
+	}
+
+	hostName, err := os.Hostname()
+	if err != nil || hostName == "" {
+		hostName = "go-l2tp"
+	}
+
+	// The Router ID need only be unique to us: use the local IPv4
+	// address if we have one.
+	routerID := uint32(ccid)
+	if sa, ok := local.(*unix.SockaddrInet4); ok {
+		if id := binary.BigEndian.Uint32(sa.Addr[:]); id != 0 {
+			routerID = id
+		}
+	}
+
+	s := &ctlConnSetup{
+		logger:     logger,
+		version:    version,
+		ccid:       ccid,
+		hostName:   hostName,
+		routerID:   routerID,
+		tiebreaker: tiebreaker,
+		doneChan:   make(chan error, 1),
+	}
+	s.sendCctx, s.cancelSends = context.WithCancel(context.Background())
+	return s, nil
+}
+
+// start sends our SCCRQ using the transport.  It must be called before
+// any message is passed to handle.
+func (s *ctlConnSetup) start(xport *transport) {
+	s.xport = xport
+	msg, err := s.newSCCRQ()
+	if err != nil {
+		s.fail(fmt.Errorf("failed to build SCCRQ: %v", err))
+		return
+	}
+	s.send(msg)
+}
+
+// wait blocks until the control connection has been established, returning
+// the peer's control connection ID, or until establishment fails.
+func (s *ctlConnSetup) wait(cctx context.Context) (ControlConnID, error) {
+	select {
+	case err := <-s.doneChan:
+		if err != nil {
+			return 0, err
+		}
+	case <-cctx.Done():
+		return 0, fmt.Errorf("failed to establish control connection: %w", cctx.Err())
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.peerCCID, nil
+}
+
+// close abandons establishment, and waits for queued messages to be sent.
+// It must be called before the transport is closed.
+func (s *ctlConnSetup) close() {
+	s.fail(errors.New("tunnel closed"))
+	s.cancelSends()
+	s.sends.close()
+}
+
+// handle handles a message received from the peer.  It returns false if
+// the message isn't part of control connection establishment.
+func (s *ctlConnSetup) handle(msg controlMessage) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch s.state {
+	case ctlConnEstablished:
+		return false
+	case ctlConnFailed:
+		return true
+	}
+
+	switch msg.getType() {
+	case avpMsgTypeSccrq:
+		s.handleSCCRQ(msg)
+	case avpMsgTypeSccrp:
+		s.handleSCCRP(msg)
+	case avpMsgTypeScccn:
+		if s.state == ctlConnWaitCtlConn {
+			s.establish()
+		}
+	case avpMsgTypeStopccn:
+		s.handleStopCCN(msg)
+	default:
+		level.Debug(s.logger).Log(
+			"message", "discarding message during control connection setup",
+			"message_type", msg.getType())
+	}
+	return true
+}
+
+// checkSCCRQ is called by the transport for each SCCRQ the peer sends,
+// and resolves the collision between the peer's SCCRQ and ours.
+func (s *ctlConnSetup) checkSCCRQ(msg controlMessage) (sccrqAction, controlMessage) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// Once we've abandoned our connection, the peer's SCCRQ is the first
+	// message of the connection, and retransmissions of it are acked.
+	if s.responder {
+		return sccrqSequence, nil
+	}
+
+	peerCCID, ok := findAssignedConnID(msg)
+	if !ok || peerCCID == 0 {
+		s.failLocked(errors.New("peer SCCRQ has no assigned control connection ID"))
+		return sccrqReply, nil
+	}
+
+	// Having kept our connection, retransmissions of the peer's SCCRQ
+	// are refused as before, in case our StopCCN was lost.
+	keepOurs, keepTheirs := true, false
+	if s.state == ctlConnWaitCtlReply {
+		if err := s.checkVersion(msg); err != nil {
+			s.failLocked(err)
+			return sccrqReply, nil
+		}
+
+		// A peer which doesn't send a tiebreaker doesn't mind there
+		// being more than one control connection between us.  We can
+		// only have one, so ours is retained.
+		if theirs, ok := findTiebreaker(msg); ok {
+			keepOurs, keepTheirs = resolveCollision(s.tiebreaker, theirs)
+		}
+
+		level.Info(s.logger).Log(
+			"message", "control connection collision",
+			"peer_tunnel_id", peerCCID,
+			"keep_ours", keepOurs,
+			"keep_theirs", keepTheirs)
+	}
+
+	if keepTheirs {
+		s.peerCCID = peerCCID
+		s.responder = true
+		s.state = ctlConnWaitCtlConn
+		return sccrqRestart, nil
+	}
+
+	stop, err := newCollisionStopCCNMessage(s.connVersion(), s.ccid, peerCCID)
+	if err != nil {
+		s.failLocked(fmt.Errorf("failed to build StopCCN: %v", err))
+		return sccrqReply, nil
+	}
+	if !keepOurs {
+		s.failLocked(errors.New("control connection collision with equal tiebreakers"))
+	}
+	return sccrqReply, stop
+}
+
+// handleSCCRQ answers the peer's SCCRQ once the transport has abandoned
+// our connection in its favour.  The caller must hold the mutex.
+func (s *ctlConnSetup) handleSCCRQ(msg controlMessage) {
+	if !s.responder || s.state != ctlConnWaitCtlConn {
+		return
+	}
+
+	sccrp, err := s.newSCCRP(s.peerCCID)
+	if err != nil {
+		s.failLocked(fmt.Errorf("failed to build SCCRP: %v", err))
+		return
+	}
+	s.send(sccrp)
+}
+
+// handleSCCRP completes establishment of the control connection we
+// started.  The caller must hold the mutex.
+func (s *ctlConnSetup) handleSCCRP(msg controlMessage) {
+	if s.state != ctlConnWaitCtlReply {
+		return
+	}
+
+	if err := s.checkVersion(msg); err != nil {
+		s.failLocked(err)
+		return
+	}
+
+	peerCCID, ok := findAssignedConnID(msg)
+	if !ok || peerCCID == 0 {
+		s.failLocked(errors.New("peer SCCRP has no assigned control connection ID"))
+		return
+	}
+
+	scccn, err := messageToControlMessage(&SCCCN{
+		MessageHeader: MessageHeader{
+			Version:  s.connVersion(),
+			TunnelID: peerCCID,
+		},
+	})
+	if err != nil {
+		s.failLocked(fmt.Errorf("failed to build SCCCN: %v", err))
+		return
+	}
+	s.peerCCID = peerCCID
+	s.send(scccn)
+	s.establish()
+}
+
+// handleStopCCN handles the peer refusing the control connection.  The
+// caller must hold the mutex.
+func (s *ctlConnSetup) handleStopCCN(msg controlMessage) {
+	var rc resultCode
+	for _, a := range msg.getAvps() {
+		if a.vendorID() == vendorIDIetf && a.getType() == avpTypeResultCode {
+			rc, _ = a.decodeResultCode()
+		}
+	}
+
+	err := fmt.Errorf("peer refused control connection: result code %v, error code %v: %q",
+		rc.result, rc.errCode, rc.errMsg)
+
+	// Having won the tiebreak, the peer refuses the connection we
+	// started.  We may have answered its SCCRQ already, since the StopCCN
+	// can reach us after the transport has abandoned our connection.
+	// Otherwise the peer's SCCRQ is on the way, unless it was lost and
+	// is yet to be retransmitted.
+	if rc.result == avpStopCCNResultCodeChannelExists {
+		level.Debug(s.logger).Log(
+			"message", "peer refused colliding control connection")
+		if s.responder {
+			return
+		}
+		time.AfterFunc(ctlConnCollisionTimeout, func() {
+			s.mutex.Lock()
+			defer s.mutex.Unlock()
+			if !s.responder {
+				s.failLocked(err)
+			}
+		})
+		return
+	}
+
+	s.failLocked(err)
+}
+
+// checkVersion checks that the peer's SCCRQ or SCCRP uses our version of
+// the protocol.  The caller must hold the mutex.
+func (s *ctlConnSetup) checkVersion(msg controlMessage) error {
+	version := messageVersion(msg)
+	if version == ProtocolVersion3Fallback {
+		version = ProtocolVersion3
+	}
+	if version != s.connVersion() {
+		return fmt.Errorf("peer %v uses protocol version %v", msg.getType(), version)
+	}
+	return nil
+}
+
+// connVersion returns the protocol version of the control connection.
+// Fallback mode only affects our SCCRQ.
+func (s *ctlConnSetup) connVersion() ProtocolVersion {
+	if s.version == ProtocolVersion3Fallback {
+		return ProtocolVersion3
+	}
+	return s.version
+}
+
+// establish completes establishment.  The caller must hold the mutex.
+func (s *ctlConnSetup) establish() {
+	s.state = ctlConnEstablished
+	level.Info(s.logger).Log(
+		"message", "control connection established",
+		"peer_tunnel_id", s.peerCCID,
+		"responder", s.responder)
+	s.doneChan <- nil
+}
+
+func (s *ctlConnSetup) fail(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.failLocked(err)
+}
+
+// failLocked fails establishment, unless it has already completed.  The
+// caller must hold the mutex.
+func (s *ctlConnSetup) failLocked(err error) {
+	if s.state == ctlConnEstablished || s.state == ctlConnFailed {
+		return
+	}
+	s.state = ctlConnFailed
+	level.Error(s.logger).Log(
+		"message", "control connection setup failed",
+		"error", err)
+	s.doneChan <- err
+}
+
+// send queues a message for transmission.
+func (s *ctlConnSetup) send(msg controlMessage) {
+	s.sends.run(func() {
+		err := s.xport.sendContext(s.sendCctx, msg)
+		if err != nil && err != errConnAbandoned && s.sendCctx.Err() == nil {
+			s.fail(fmt.Errorf("failed to send %v: %v", msg.getType(), err))
+		}
+	})
+}
+
+func (s *ctlConnSetup) newSCCRQ() (controlMessage, error) {
+	m := &SCCRQ{
+		MessageHeader: MessageHeader{Version: s.version},
+		Tiebreaker:    s.tiebreaker,
+		HostName:      s.hostName,
+	}
+	if s.version != ProtocolVersion3 {
+		m.ProtocolVersion = []byte{1, 0}
+		m.FramingCap = framingCapSync | framingCapAsync
+		m.AssignedTunnelID = uint16(s.ccid)
+	}
+	if s.version != ProtocolVersion2 {
+		m.RouterID = s.routerID
+		m.AssignedConnID = uint32(s.ccid)
+		m.PseudowireCaps = []uint16{uint16(PseudowireTypeEth), uint16(PseudowireTypePPP)}
+	}
+	return messageToControlMessage(m)
+}
+
+func (s *ctlConnSetup) newSCCRP(peerCCID ControlConnID) (controlMessage, error) {
+	m := &SCCRP{
+		MessageHeader: MessageHeader{
+			Version:  s.connVersion(),
+			TunnelID: peerCCID,
+		},
+		HostName: s.hostName,
+	}
+	if s.connVersion() == ProtocolVersion2 {
+		m.ProtocolVersion = []byte{1, 0}
+		m.FramingCap = framingCapSync | framingCapAsync
+		m.AssignedTunnelID = uint16(s.ccid)
+	} else {
+		m.RouterID = s.routerID
+		m.AssignedConnID = uint32(s.ccid)
+		m.PseudowireCaps = []uint16{uint16(PseudowireTypeEth), uint16(PseudowireTypePPP)}
+	}
+	return messageToControlMessage(m)
+}
+
+// Framing Capabilities AVP bits per RFC2661 section 4.4.3.
+const (
+	framingCapSync  = 0x1
+	framingCapAsync = 0x2
+)
+
+// newDynamicTunnel creates a tunnel which establishes its control
+// connection with the peer before instantiating the data plane.
+func newDynamicTunnel(cctx context.Context, name string, parent *Context, nlconn netlinkConn, sal, sap unix.Sockaddr, cfg *TunnelConfig) (qt *quiescentTunnel, err error) {
+	qt, err = newQuiescentTunnel(cctx, name, parent, nlconn, sal, sap, cfg, true)
+	if err != nil {
+		return nil, err
+	}
+
+	peerCCID, err := qt.setup.wait(cctx)
+	if err == nil {
+		qt.mutex.Lock()
+		qt.cfg.PeerTunnelID = peerCCID
+		qt.mutex.Unlock()
+
+		// The socket is connected by now even if connection was
+		// deferred, since we've heard from the peer.
+		err = qt.createDataPlane(cctx, qt.cp)
+	}
+	if err != nil {
+		qt.Close()
+		return nil, err
+	}
+	return qt, nil
+}
@@ -0,0 +1,447 @@
+package l2tp
+
+import (
+	"context"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/katalix/go-l2tp/internal/nll2tp"
+)
+
+// TestDynamicTunnel creates dynamic tunnels at both ends at the same time,
+// so that their SCCRQs cross, and checks that each end instantiates the
+// data plane using the tunnel ID assigned by the other.
+func TestDynamicTunnel(t *testing.T) {
+	cases := []struct {
+		name    string
+		version ProtocolVersion
+	}{
+		{name: "L2TPv2", version: ProtocolVersion2},
+		{name: "L2TPv3", version: ProtocolVersion3},
+		{name: "L2TPv3 fallback", version: ProtocolVersion3Fallback},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			type end struct {
+				local, peer string
+				tid         ControlConnID
+				ctx         *Context
+				kernel      *fakeNetlink
+			}
+			ends := []*end{
+				{local: "127.0.0.1:6200", peer: "127.0.0.1:5200", tid: 1},
+				{local: "127.0.0.1:5200", peer: "127.0.0.1:6200", tid: 2},
+			}
+
+			errChan := make(chan error, len(ends))
+			for _, e := range ends {
+				dial, kernels := newFakeNetlinkDialer()
+				ctx, err := newContext(nil, nil, withNetlinkDialer(dial))
+				if err != nil {
+					t.Fatalf("newContext(): %v", err)
+				}
+				defer ctx.Close()
+				e.ctx = ctx
+				e.kernel = kernels[""]
+			}
+
+			for _, e := range ends {
+				go func(e *end) {
+					_, err := e.ctx.NewDynamicTunnel("t1", &TunnelConfig{
+						Local:    e.local,
+						Peer:     e.peer,
+						Version:  c.version,
+						TunnelID: e.tid,
+						Encap:    EncapTypeUDP,
+					})
+					errChan <- err
+				}(e)
+			}
+			for range ends {
+				if err := <-errChan; err != nil {
+					t.Fatalf("NewDynamicTunnel(): %v", err)
+				}
+			}
+
+			for i, e := range ends {
+				peer := ends[1-i]
+				tcfg, err := e.kernel.GetTunnel(context.Background(),
+					&nll2tp.TunnelConfig{Tid: nll2tp.L2tpTunnelID(e.tid)})
+				if err != nil {
+					t.Fatalf("GetTunnel(): %v", err)
+				}
+				if tcfg.Ptid != nll2tp.L2tpTunnelID(peer.tid) {
+					t.Errorf("expected peer tunnel ID %v, got %v", peer.tid, tcfg.Ptid)
+				}
+				expectVersion := nll2tp.L2tpProtocolVersion(nll2tp.ProtocolVersion3)
+				if c.version == ProtocolVersion2 {
+					expectVersion = nll2tp.ProtocolVersion2
+				}
+				if tcfg.Version != expectVersion {
+					t.Errorf("expected kernel tunnel version %v, got %v", expectVersion, tcfg.Version)
+				}
+			}
+		})
+	}
+}
+
+// TestCloseDuringDynamicCreate closes the context while a dynamic tunnel
+// is waiting for a peer which never answers, and checks that Close doesn't
+// wait for the SCCRQ retries to run out.
+func TestCloseDuringDynamicCreate(t *testing.T) {
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 5210})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer peer.Close()
+
+	dial, _ := newFakeNetlinkDialer()
+	ctx, err := newContext(nil, nil, withNetlinkDialer(dial))
+	if err != nil {
+		t.Fatalf("newContext(): %v", err)
+	}
+	defer ctx.Close()
+
+	errChan := make(chan error, 1)
+	go func() {
+		_, err := ctx.NewDynamicTunnel("t1", &TunnelConfig{
+			Local:    "127.0.0.1:6210",
+			Peer:     "127.0.0.1:5210",
+			Version:  ProtocolVersion3,
+			TunnelID: 1,
+			Encap:    EncapTypeUDP,
+		})
+		errChan <- err
+	}()
+
+	// Wait for the SCCRQ so that we know the creation is in progress
+	_, _, err = peer.ReadFrom(make([]byte, 4096))
+	if err != nil {
+		t.Fatalf("failed to receive SCCRQ: %v", err)
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		ctx.Close()
+		ctx.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Close() blocked by dynamic tunnel creation")
+	}
+	if err := <-errChan; err == nil {
+		t.Errorf("expected NewDynamicTunnel() to fail once the context closed")
+	}
+	if n := len(ctx.tunnels); n != 0 {
+		t.Errorf("expected no tunnels after close, got %d", n)
+	}
+}
+
+// TestFallbackResponder has a peer start the control connection using
+// an RFC3931 fallback mode SCCRQ, and checks that it's answered using
+// L2TPv3 if fallback mode is enabled, and refused otherwise.
+func TestFallbackResponder(t *testing.T) {
+	cases := []struct {
+		name    string
+		version ProtocolVersion
+		accept  bool
+	}{
+		{name: "fallback", version: ProtocolVersion3Fallback, accept: true},
+		{name: "l2tpv3", version: ProtocolVersion3, accept: false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sa, sb := testMemAddressPair(t)
+			cp, peer := newMemControlPlanePair(sa, sb, memLinkConfig{}, memLinkConfig{})
+			defer peer.close()
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+
+			// The peer's tiebreaker is lower, so its connection wins
+			s := testCtlConnSetup(t, logger, cp, c.version, 11, 0xffffffffffffffff)
+			defer s.xport.close()
+			defer s.close()
+
+			msg, err := testMemPeerRecv(peer)
+			if err != nil {
+				t.Fatalf("failed to receive SCCRQ: %v", err)
+			}
+			if msg.getType() != avpMsgTypeSccrq {
+				t.Fatalf("expected SCCRQ, got %v", msg.getType())
+			}
+
+			sccrq, err := messageToControlMessage(&SCCRQ{
+				MessageHeader:    MessageHeader{Version: ProtocolVersion3Fallback},
+				ProtocolVersion:  []byte{0x01, 0x00},
+				FramingCap:       0x3,
+				HostName:         "lcce",
+				AssignedTunnelID: 22,
+				Tiebreaker:       1,
+				RouterID:         1,
+				AssignedConnID:   22,
+				PseudowireCaps:   []uint16{uint16(PseudowireTypeEth)},
+			})
+			if err != nil {
+				t.Fatalf("failed to build SCCRQ: %v", err)
+			}
+			err = testMemPeerSend(peer, sccrq, 0, 0)
+			if err != nil {
+				t.Fatalf("failed to send SCCRQ: %v", err)
+			}
+
+			msg, err = testMemPeerRecv(peer)
+			if err != nil {
+				t.Fatalf("failed to receive response: %v", err)
+			}
+			if msg.ns() != 0 || msg.nr() != 1 {
+				t.Errorf("expected response with ns 0 nr 1, got ns %v nr %v", msg.ns(), msg.nr())
+			}
+			if !c.accept {
+				if msg.getType() != avpMsgTypeStopccn {
+					t.Errorf("expected StopCCN, got %v", msg.getType())
+				}
+				return
+			}
+
+			// The SCCRP uses L2TPv3 framing and AVPs only
+			m, err := messageFromControlMessage(msg)
+			if err != nil {
+				t.Fatalf("messageFromControlMessage(): %v", err)
+			}
+			sccrp, ok := m.(*SCCRP)
+			if !ok {
+				t.Fatalf("expected SCCRP, got %v", msg.getType())
+			}
+			if sccrp.Version != ProtocolVersion3 || sccrp.TunnelID != 22 {
+				t.Errorf("expected an L2TPv3 SCCRP for connection 22, got version %v connection %v",
+					sccrp.Version, sccrp.TunnelID)
+			}
+			if sccrp.AssignedConnID != 11 || sccrp.AssignedTunnelID != 0 || sccrp.ProtocolVersion != nil {
+				t.Errorf("expected L2TPv3 AVPs assigning connection 11, got %+v", sccrp)
+			}
+
+			scccn, err := messageToControlMessage(&SCCCN{
+				MessageHeader: MessageHeader{Version: ProtocolVersion3, TunnelID: 11},
+			})
+			if err != nil {
+				t.Fatalf("failed to build SCCCN: %v", err)
+			}
+			err = testMemPeerSend(peer, scccn, 1, 1)
+			if err != nil {
+				t.Fatalf("failed to send SCCCN: %v", err)
+			}
+
+			cctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			peerCCID, err := s.wait(cctx)
+			if err != nil {
+				t.Fatalf("wait(): %v", err)
+			}
+			if peerCCID != 22 || !s.responder {
+				t.Errorf("expected to respond to connection 22, got %v, responder %v", peerCCID, s.responder)
+			}
+		})
+	}
+}
+
+// TestCtlConnCollisionRFCPeer crosses SCCRQs with a peer which keeps a
+// sequence number space for each control connection, as the RFCs require,
+// and checks that the reply to the peer's SCCRQ is the first message of
+// the peer's connection, whichever connection wins.
+func TestCtlConnCollisionRFCPeer(t *testing.T) {
+	cases := []struct {
+		name     string
+		version  ProtocolVersion
+		peerWins bool
+	}{
+		{name: "L2TPv2 peer wins", version: ProtocolVersion2, peerWins: true},
+		{name: "L2TPv3 peer wins", version: ProtocolVersion3, peerWins: true},
+		{name: "L2TPv2 we win", version: ProtocolVersion2},
+		{name: "L2TPv3 we win", version: ProtocolVersion3},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sa, sb := testMemAddressPair(t)
+			cp, peer := newMemControlPlanePair(sa, sb, memLinkConfig{}, memLinkConfig{})
+			defer peer.close()
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+
+			ours, theirs := uint64(1), uint64(2)
+			if c.peerWins {
+				ours, theirs = theirs, ours
+			}
+			s := testCtlConnSetup(t, logger, cp, c.version, 11, ours)
+			defer s.xport.close()
+			defer s.close()
+
+			// Our SCCRQ starts connection A, and the peer's SCCRQ
+			// connection B
+			msg, err := testMemPeerRecv(peer)
+			if err != nil {
+				t.Fatalf("failed to receive SCCRQ: %v", err)
+			}
+			if msg.getType() != avpMsgTypeSccrq || msg.ns() != 0 || msg.nr() != 0 {
+				t.Fatalf("expected SCCRQ with ns 0 nr 0, got %v ns %v nr %v",
+					msg.getType(), msg.ns(), msg.nr())
+			}
+			sccrq := &SCCRQ{
+				MessageHeader: MessageHeader{Version: c.version},
+				HostName:      "lcce",
+				Tiebreaker:    theirs,
+			}
+			if c.version == ProtocolVersion2 {
+				sccrq.ProtocolVersion = []byte{0x01, 0x00}
+				sccrq.FramingCap = 0x3
+				sccrq.AssignedTunnelID = 22
+			} else {
+				sccrq.RouterID = 1
+				sccrq.AssignedConnID = 22
+				sccrq.PseudowireCaps = []uint16{uint16(PseudowireTypeEth)}
+			}
+			peerSCCRQ, err := messageToControlMessage(sccrq)
+			if err != nil {
+				t.Fatalf("failed to build SCCRQ: %v", err)
+			}
+
+			expect := func(msgType avpMsgType, ns, nr uint16) {
+				t.Helper()
+				msg, err := testMemPeerRecv(peer)
+				if err != nil {
+					t.Fatalf("failed to receive %v: %v", msgType, err)
+				}
+				m, err := messageFromControlMessage(msg)
+				if err != nil {
+					t.Fatalf("messageFromControlMessage(): %v", err)
+				}
+				h := m.Header()
+				if msg.getType() != msgType || h.TunnelID != 22 || h.Ns != ns || h.Nr != nr {
+					t.Fatalf("expected %v to 22 with ns %v nr %v, got %v to %v with ns %v nr %v",
+						msgType, ns, nr, msg.getType(), h.TunnelID, h.Ns, h.Nr)
+				}
+			}
+
+			if c.peerWins {
+				// The peer refuses connection A, and we answer its SCCRQ
+				// with SCCRP instead
+				stop, err := newCollisionStopCCNMessage(c.version, 22, 11)
+				if err != nil {
+					t.Fatalf("failed to build StopCCN: %v", err)
+				}
+				if err = testMemPeerSend(peer, peerSCCRQ, 0, 0); err != nil {
+					t.Fatalf("failed to send SCCRQ: %v", err)
+				}
+				if err = testMemPeerSend(peer, stop, 0, 1); err != nil {
+					t.Fatalf("failed to send StopCCN: %v", err)
+				}
+				expect(avpMsgTypeSccrp, 0, 1)
+
+				scccn, err := messageToControlMessage(&SCCCN{
+					MessageHeader: MessageHeader{Version: c.version, TunnelID: 11},
+				})
+				if err != nil {
+					t.Fatalf("failed to build SCCCN: %v", err)
+				}
+				if err = testMemPeerSend(peer, scccn, 1, 1); err != nil {
+					t.Fatalf("failed to send SCCCN: %v", err)
+				}
+			} else {
+				// We refuse connection B, including the peer's
+				// retransmission of its SCCRQ, and the peer answers
+				// our SCCRQ with SCCRP instead
+				for i := 0; i < 2; i++ {
+					if err = testMemPeerSend(peer, peerSCCRQ, 0, 0); err != nil {
+						t.Fatalf("failed to send SCCRQ: %v", err)
+					}
+					expect(avpMsgTypeStopccn, 0, 1)
+				}
+
+				sccrp := &SCCRP{
+					MessageHeader: MessageHeader{Version: c.version, TunnelID: 11},
+					HostName:      "lcce",
+				}
+				if c.version == ProtocolVersion2 {
+					sccrp.ProtocolVersion = []byte{0x01, 0x00}
+					sccrp.FramingCap = 0x3
+					sccrp.AssignedTunnelID = 22
+				} else {
+					sccrp.RouterID = 1
+					sccrp.AssignedConnID = 22
+					sccrp.PseudowireCaps = []uint16{uint16(PseudowireTypeEth)}
+				}
+				msg, err := messageToControlMessage(sccrp)
+				if err != nil {
+					t.Fatalf("failed to build SCCRP: %v", err)
+				}
+				if err = testMemPeerSend(peer, msg, 0, 1); err != nil {
+					t.Fatalf("failed to send SCCRP: %v", err)
+				}
+				expect(avpMsgTypeScccn, 1, 1)
+			}
+
+			cctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			peerCCID, err := s.wait(cctx)
+			if err != nil {
+				t.Fatalf("wait(): %v", err)
+			}
+			if peerCCID != 22 || s.responder != c.peerWins {
+				t.Errorf("expected connection to 22 with responder %v, got %v, responder %v",
+					c.peerWins, peerCCID, s.responder)
+			}
+
+			if !c.peerWins {
+				return
+			}
+
+			// Having lost, our SCCRQ mustn't be retransmitted
+			time.Sleep(3 * testCtlConnRetryTimeout)
+			stats, err := s.xport.getStats()
+			if err != nil {
+				t.Fatalf("getStats(): %v", err)
+			}
+			if stats.Retransmits != 0 || stats.AckQueueLen != 0 || stats.TxQueueLen != 0 {
+				t.Errorf("expected no messages outstanding, got %+v", stats)
+			}
+		})
+	}
+}
+
+const testCtlConnRetryTimeout = 50 * time.Millisecond
+
+// testCtlConnSetup creates control connection setup state with a
+// transport of its own, and passes it the messages the transport receives.
+func testCtlConnSetup(t *testing.T, logger log.Logger, cp controlPlaneConn,
+	version ProtocolVersion, ccid ControlConnID, tiebreaker uint64) *ctlConnSetup {
+
+	s, err := newCtlConnSetup(logger, version, ccid, cp.localAddr())
+	if err != nil {
+		t.Fatalf("newCtlConnSetup(): %v", err)
+	}
+	s.tiebreaker = tiebreaker
+	xport, err := newTransport(logger, cp, transportConfig{
+		Version:       version,
+		ControlConnID: ccid,
+		RetryTimeout:  testCtlConnRetryTimeout,
+		AckTimeout:    5 * time.Millisecond,
+		CheckSCCRQ:    s.checkSCCRQ,
+	})
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+	s.start(xport)
+	go func() {
+		for {
+			msg, err := xport.recv()
+			if err != nil {
+				return
+			}
+			s.handle(msg)
+		}
+	}()
+	return s
+}
@@ -1,13 +1,14 @@
 package l2tp
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	"github.com/katalix/go-l2tp/internal/nll2tp"
 	"golang.org/x/sys/unix"
 )
 
@@ -15,157 +16,558 @@ type quiescentTunnel struct {
 	logger    log.Logger
 	name      string
 	parent    *Context
+	nlconn    netlinkConn
 	cfg       *TunnelConfig
 	cp        *controlPlane
 	xport     *transport
-	dp        dataPlane
-	closeChan chan bool
+	closeChan chan struct{}
+	closeOnce sync.Once
+	downOnce  sync.Once
 	wg        sync.WaitGroup
-	sessions  map[string]Session
+	// signals runs circuit status signalling, which may block until
+	// signalCctx is cancelled
+	signals       serialQueue
+	signalCctx    context.Context
+	cancelSignals context.CancelFunc
+	// setup establishes the control connection of a dynamic tunnel,
+	// and is nil for a quiescent tunnel
+	setup *ctlConnSetup
+	// mutex protects the fields below
+	mutex    sync.Mutex
+	closed   bool
+	dp       dataPlane
+	sessions map[string]Session
 }
 
 func (qt *quiescentTunnel) NewSession(name string, cfg *SessionConfig) (Session, error) {
+	return qt.NewSessionContext(context.Background(), name, cfg)
+}
+
+func (qt *quiescentTunnel) NewSessionContext(cctx context.Context, name string, cfg *SessionConfig) (Session, error) {
+
+	qt.mutex.Lock()
+	defer qt.mutex.Unlock()
+
+	if qt.closed {
+		return nil, fmt.Errorf("tunnel is closed")
+	}
 
 	if _, ok := qt.sessions[name]; ok {
 		return nil, fmt.Errorf("already have session %q", name)
 	}
 
-	s, err := newStaticSession(name, qt, cfg)
+	var monitor *linkMonitor
+	if cfg.CircuitInterface != "" {
+		if qt.cfg.Version == ProtocolVersion2 {
+			return nil, fmt.Errorf("L2TPv2 tunnels cannot signal circuit status")
+		}
+		if cfg.Pseudowire != PseudowireTypeEth {
+			return nil, fmt.Errorf("circuit status may only be signalled for Ethernet pseudowires")
+		}
+		var err error
+		monitor, err = qt.parent.getLinkMonitor(qt.cfg.Netns)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// If the tunnel data plane is yet to be created the session data
+	// plane must wait for it: see onConnect.
+	var s *staticSession
+	var err error
+	if qt.dp == nil {
+		s, err = newDeferredSession(name, qt, cfg)
+	} else {
+		s, err = newStaticSession(cctx, name, qt, cfg)
+	}
 	if err != nil {
 		return nil, err
 	}
 
+	if monitor != nil {
+		s.circuit = monitor.watch(cctx, cfg.CircuitInterface, func(up, isNew bool) {
+			qt.onCircuitChange(s, up, isNew)
+		})
+	}
+
 	qt.sessions[name] = s
+	atomic.AddUint64(&qt.parent.stats.SessionsCreated, 1)
 
 	return s, nil
 }
 
+// Close may be called any number of times, from any goroutine, and
+// before or after the tunnel has closed itself due to transport failure.
+// It returns once the tunnel has been torn down.
 func (qt *quiescentTunnel) Close() {
 	if qt != nil {
-		qt.closeChan <- true
+		_ = qt.CloseContext(context.Background())
+	}
+}
+
+func (qt *quiescentTunnel) CloseContext(cctx context.Context) error {
+	// Stop the transport reader, which may already have exited
+	// due to transport failure, before tearing down.
+	qt.closeOnce.Do(func() { close(qt.closeChan) })
+	stopped := make(chan struct{})
+	go func() {
 		qt.wg.Wait()
-		qt.close()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		return closeWithContext(cctx, &qt.downOnce, qt.teardown)
+	case <-cctx.Done():
+		go func() {
+			<-stopped
+			qt.close()
+		}()
+		return cctx.Err()
 	}
 }
 
+// close tears down the tunnel.  It's called by both CloseContext and the
+// transport reader, and only the first call has any effect: concurrent
+// callers block until teardown is complete.
 func (qt *quiescentTunnel) close() {
-	if qt != nil {
-		for name, session := range qt.sessions {
-			session.Close()
-			qt.unlinkSession(name)
-		}
+	qt.downOnce.Do(func() { withTeardownContext(qt.teardown) })
+}
 
-		if qt.xport != nil {
-			qt.xport.close()
-		}
-		if qt.cp != nil {
-			qt.cp.close()
-		}
-		if qt.dp != nil {
-			qt.dp.close(qt.getNLConn())
-		}
+func (qt *quiescentTunnel) teardown(cctx context.Context) {
+	// Sessions unlink themselves from the tunnel as they close,
+	// so we mustn't hold the lock while closing them.
+	for _, session := range qt.closeSessions() {
+		_ = session.CloseContext(cctx)
+	}
 
-		qt.parent.unlinkTunnel(qt.name)
+	// Signalling must be complete before the transport is closed
+	qt.cancelSignals()
+	qt.signals.close()
+	if qt.setup != nil {
+		qt.setup.close()
+	}
 
-		level.Info(qt.logger).Log("message", "close")
+	if qt.xport != nil {
+		qt.xport.close()
+	}
+	if qt.cp != nil {
+		qt.cp.close()
 	}
+
+	qt.mutex.Lock()
+	dp := qt.dp
+	qt.dp = nil
+	qt.mutex.Unlock()
+
+	if dp != nil {
+		dp.close(cctx, qt.getNLConn())
+	}
+
+	qt.parent.unlinkTunnel(qt.name, qt)
+
+	level.Info(qt.logger).Log("message", "close")
+}
+
+func (qt *quiescentTunnel) StartCapture(path string, maxSize uint) error {
+	return qt.xport.startCapture(path, int64(maxSize))
+}
+
+func (qt *quiescentTunnel) StopCapture() {
+	qt.xport.stopCapture()
+}
+
+func (qt *quiescentTunnel) Stats() (*TunnelStats, error) {
+	xs, err := qt.xport.getStats()
+	if err != nil {
+		return nil, err
+	}
+	return &TunnelStats{Transport: xs}, nil
 }
 
 func (qt *quiescentTunnel) getCfg() *TunnelConfig {
 	return qt.cfg
 }
 
-func (qt *quiescentTunnel) getNLConn() *nll2tp.Conn {
-	return qt.parent.nlconn
+func (qt *quiescentTunnel) getNLConn() netlinkConn {
+	return qt.nlconn
 }
 
 func (qt *quiescentTunnel) getLogger() log.Logger {
 	return qt.logger
 }
 
-func (qt *quiescentTunnel) unlinkSession(name string) {
-	delete(qt.sessions, name)
+// closeSessions marks the tunnel closed, preventing further sessions
+// being created, and returns the sessions to be closed.
+func (qt *quiescentTunnel) closeSessions() []Session {
+	qt.mutex.Lock()
+	defer qt.mutex.Unlock()
+	qt.closed = true
+	return sessionList(qt.sessions)
+}
+
+func (qt *quiescentTunnel) unlinkSession(name string, s Session) {
+	qt.mutex.Lock()
+	ss, ok := qt.sessions[name]
+	unlinked := ok && ss == s
+	if unlinked {
+		delete(qt.sessions, name)
+		atomic.AddUint64(&qt.parent.stats.SessionsClosed, 1)
+	}
+	qt.mutex.Unlock()
+
+	if unlinked {
+		qt.parent.handleEvent(&SessionDownEvent{TunnelName: qt.name, SessionName: name})
+	}
+}
+
+// onConnect is called by the control plane once the socket has been
+// connected to the peer after the tunnel has been created, either
+// because connection was deferred or because the peer's port floated.
+func (qt *quiescentTunnel) onConnect(cp *controlPlane) error {
+	return qt.createDataPlane(context.Background(), cp)
+}
+
+// createDataPlane instantiates the data plane for the tunnel, and any
+// sessions which were created before we were connected.
+func (qt *quiescentTunnel) createDataPlane(cctx context.Context, cp *controlPlane) (err error) {
+	qt.mutex.Lock()
+	defer qt.mutex.Unlock()
+
+	if qt.closed {
+		return fmt.Errorf("tunnel is closed")
+	}
+	if qt.dp != nil {
+		return nil
+	}
+
+	// A dynamic tunnel's data plane waits for the peer to assign its
+	// tunnel ID during control connection setup.
+	if qt.cfg.PeerTunnelID == 0 {
+		return nil
+	}
+
+	qt.dp, err = newManagedTunnelDataPlane(cctx, qt.nlconn, cp.fd, qt.cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range qt.sessions {
+		if ss, ok := s.(*staticSession); ok {
+			err = ss.createDataPlane(cctx)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
 }
 
 func (qt *quiescentTunnel) xportReader() {
 	// Although we're not running the control protocol we do need
 	// to drain messages from the transport to avoid the receive
-	// path blocking.
+	// path blocking.  Circuit status messages are handled, while
+	// anything else is discarded.
 	defer qt.wg.Done()
 	for {
 		select {
 		case <-qt.closeChan:
 			return
-		case _, ok := <-qt.xport.recvChan:
+		case msg, ok := <-qt.xport.recvChan:
 			if !ok {
+				atomic.AddUint64(&qt.parent.stats.TransportFailures, 1)
 				qt.close()
 				return
 			}
+			qt.handleMessage(msg)
 		}
 	}
 }
 
-func newQuiescentTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig) (qt *quiescentTunnel, err error) {
+// handleMessage handles a message received from the peer.  It's called
+// from the transport's receive path, which mustn't block, so circuit
+// status messages are queued for handling by the signalling queue.
+// Other messages are discarded, other than by a dynamic tunnel, which
+// closes on receipt of StopCCN once its control connection is up.
+func (qt *quiescentTunnel) handleMessage(msg controlMessage) {
+	msgType := msg.getType()
+	if qt.setup != nil {
+		if qt.setup.handle(msg) {
+			return
+		}
+		if msgType == avpMsgTypeStopccn {
+			level.Info(qt.logger).Log("message", "peer closed control connection")
+			go qt.close()
+			return
+		}
+	}
+	switch msgType {
+	case avpMsgTypeSli, avpMsgTypeCsun, avpMsgTypeCsurq:
+	default:
+		return
+	}
+	if msg.protocolVersion() != ProtocolVersion3 {
+		return
+	}
+	sid, _ := messageSessionIDs(msg)
+	status, hasStatus := findCircuitStatus(msg)
+	qt.signals.run(func() {
+		qt.handleCircuitMessage(msgType, sid, status, hasStatus)
+	})
+}
+
+// handleCircuitMessage handles a circuit status message from the peer.
+// An SLI or CSUN reporting the status of the peer's circuit is applied
+// to the operational state of the session interface, while a CSURQ is
+// answered with a CSUN reporting the status of our circuit.
+func (qt *quiescentTunnel) handleCircuitMessage(msgType avpMsgType, sid ControlConnID, status circuitStatus, hasStatus bool) {
+	ss := qt.findSession(sid)
+	if ss == nil || ss.cfg.Pseudowire != PseudowireTypeEth {
+		level.Debug(qt.logger).Log(
+			"message", "discarding circuit status message",
+			"message_type", msgType,
+			"session_id", sid)
+		return
+	}
+
+	if msgType == avpMsgTypeCsurq {
+		qt.sendCircuitStatus(avpMsgTypeCsun, ss, newCircuitStatus(ss.circuitUp(), false))
+		return
+	}
+
+	// SLI is used for more than circuit status
+	if !hasStatus {
+		return
+	}
+
+	up := status&circuitStatusActive != 0
+	level.Info(ss.logger).Log(
+		"message", "peer circuit status",
+		"up", up)
+	qt.parent.handleEvent(&CircuitStatusEvent{
+		TunnelName:  qt.name,
+		SessionName: ss.name,
+		Peer:        true,
+		Up:          up,
+	})
+
+	err := qt.applyPeerCircuitStatus(ss, up)
+	if err != nil {
+		level.Error(ss.logger).Log(
+			"message", "failed to apply peer circuit status",
+			"error", err)
+	}
+}
+
+// applyPeerCircuitStatus sets the operational state of the session
+// interface to reflect the status of the peer's circuit.  The interface
+// is dormant while the peer's circuit is down.
+func (qt *quiescentTunnel) applyPeerCircuitStatus(ss *staticSession, up bool) error {
+	cctx := context.Background()
+	ifname, err := ss.interfaceName(cctx)
+	if err != nil {
+		return err
+	}
+	monitor, err := qt.parent.getLinkMonitor(qt.cfg.Netns)
+	if err != nil {
+		return err
+	}
+	return monitor.setOperState(cctx, ifname, up)
+}
+
+// onCircuitChange is called by the link monitor when the status of a
+// session's attachment circuit changes.  It's called with the monitor
+// lock held, so the peer is signalled by the signalling queue.
+func (qt *quiescentTunnel) onCircuitChange(ss *staticSession, up, isNew bool) {
+	qt.signals.run(func() {
+		level.Info(ss.logger).Log(
+			"message", "circuit status",
+			"up", up)
+		qt.parent.handleEvent(&CircuitStatusEvent{
+			TunnelName:  qt.name,
+			SessionName: ss.name,
+			Up:          up,
+		})
+		qt.sendCircuitStatus(avpMsgTypeSli, ss, newCircuitStatus(up, isNew))
+	})
+}
+
+// sendCircuitStatus reports the status of a session's attachment circuit
+// to the peer.  It blocks until the peer acks the message, or the tunnel
+// is torn down.
+func (qt *quiescentTunnel) sendCircuitStatus(msgType avpMsgType, ss *staticSession, status circuitStatus) {
+	if ss.isClosed() {
+		return
+	}
+	msg, err := newCircuitStatusMessage(msgType,
+		qt.cfg.PeerTunnelID, ss.cfg.SessionID, ss.cfg.PeerSessionID,
+		status)
+	if err == nil {
+		err = qt.xport.sendContext(qt.signalCctx, msg)
+	}
+	if err != nil && qt.signalCctx.Err() == nil {
+		level.Error(ss.logger).Log(
+			"message", "failed to signal circuit status",
+			"message_type", msgType,
+			"error", err)
+	}
+}
+
+// findSession returns the session with our session ID sid, if any.
+func (qt *quiescentTunnel) findSession(sid ControlConnID) *staticSession {
+	qt.mutex.Lock()
+	defer qt.mutex.Unlock()
+	for _, s := range qt.sessions {
+		if ss, ok := s.(*staticSession); ok && ss.cfg.SessionID == sid {
+			return ss
+		}
+	}
+	return nil
+}
+
+// onTransportDown is called by a transport run by the context reactor
+// when it fails.  It's called from a reactor worker, which mustn't block
+// waiting for the tunnel to be torn down.
+func (qt *quiescentTunnel) onTransportDown(err error) {
+	atomic.AddUint64(&qt.parent.stats.TransportFailures, 1)
+	go qt.close()
+}
+
+// newQuiescentTunnel creates a quiescent tunnel, or if dynamic is set, a
+// dynamic tunnel whose control connection is yet to be established.
+func newQuiescentTunnel(cctx context.Context, name string, parent *Context, nlconn netlinkConn, sal, sap unix.Sockaddr, cfg *TunnelConfig, dynamic bool) (qt *quiescentTunnel, err error) {
 	qt = &quiescentTunnel{
 		logger:    log.With(parent.logger, "tunnel_name", name),
 		name:      name,
 		parent:    parent,
+		nlconn:    nlconn,
 		cfg:       cfg,
-		closeChan: make(chan bool),
+		closeChan: make(chan struct{}),
 		sessions:  make(map[string]Session),
 	}
+	qt.signalCctx, qt.cancelSignals = context.WithCancel(context.Background())
 
 	// Initialise the control plane.
-	// We bind/connect immediately since we're not runnning most of the control protocol.
-	qt.cp, err = newL2tpControlPlane(sal, sap)
-	if err != nil {
-		qt.Close()
-		return nil, err
-	}
+	// We bind/connect immediately since we're not runnning most of the control protocol,
+	// unless we've been asked to wait for the peer to reply before connecting.
+	// The control plane sockets are created in the tunnel's network
+	// namespace, and remain there once created.
+	err = withNetns(cfg.Netns, func() (err error) {
+		qt.cp, err = newL2tpControlPlane(sal, sap)
+		if err != nil {
+			return err
+		}
 
-	err = qt.cp.bind()
-	if err != nil {
-		qt.Close()
-		return nil, err
-	}
+		if cfg.NATTraversal {
+			err = qt.cp.enableNATTraversal()
+			if err != nil {
+				return err
+			}
+		}
+
+		// A VRF is bound to in the same way as any other network device.
+		if cfg.BindInterface != "" {
+			err = qt.cp.bindToDevice(cfg.BindInterface)
+		} else if cfg.VRF != "" {
+			err = qt.cp.bindToDevice(cfg.VRF)
+		}
+		if err != nil {
+			return err
+		}
 
-	err = qt.cp.connect()
+		return qt.cp.bind()
+	})
 	if err != nil {
 		qt.Close()
 		return nil, err
 	}
 
-	qt.dp, err = newManagedTunnelDataPlane(parent.nlconn, qt.cp.fd, cfg)
-	if err != nil {
-		qt.Close()
-		return nil, err
+	if !cfg.DeferConnect {
+		err = qt.cp.connect()
+		if err == nil {
+			err = qt.createDataPlane(cctx, qt.cp)
+		}
+		if err != nil {
+			qt.Close()
+			return nil, err
+		}
 	}
 
-	qt.xport, err = newTransport(qt.logger, qt.cp, transportConfig{
+	qt.cp.onConnect = qt.onConnect
+
+	xcfg := transportConfig{
 		HelloTimeout:      cfg.HelloTimeout,
 		TxWindowSize:      cfg.WindowSize,
+		RxWindowSize:      cfg.RxWindowSize,
 		MaxRetries:        cfg.MaxRetries,
 		RetryTimeout:      cfg.RetryTimeout,
+		RetryMode:         cfg.RetryMode,
 		AckTimeout:        time.Millisecond * 100,
 		Version:           cfg.Version,
 		PeerControlConnID: cfg.PeerTunnelID,
-	})
+		ControlConnID:     cfg.TunnelID,
+	}
+
+	// A dynamic tunnel decides which control connection an SCCRQ from
+	// the peer belongs to.
+	var setup *ctlConnSetup
+	if dynamic {
+		setup, err = newCtlConnSetup(qt.logger, cfg.Version, cfg.TunnelID, sal)
+		if err != nil {
+			qt.Close()
+			return nil, err
+		}
+		xcfg.CheckSCCRQ = setup.checkSCCRQ
+	}
+
+	// A transport run by the context reactor needs no reader: messages
+	// are handled as they're received.  Dynamic tunnels always run a
+	// reader so that control connection setup begins once the tunnel
+	// is fully initialised.
+	useReactor := parent.reactor != nil && !dynamic
+	if useReactor {
+		qt.xport, err = newReactorTransport(qt.logger, qt.cp, xcfg, parent.reactor,
+			qt.handleMessage,
+			qt.onTransportDown)
+	} else {
+		qt.xport, err = newTransport(qt.logger, qt.cp, xcfg)
+	}
 	if err != nil {
 		qt.Close()
 		return nil, err
 	}
 
-	qt.wg.Add(1)
-	go qt.xportReader()
+	if dynamic {
+		qt.setup = setup
+		qt.setup.start(qt.xport)
+	}
+
+	if !useReactor {
+		qt.wg.Add(1)
+		go qt.xportReader()
+	}
+
+	if cfg.CaptureFile != "" {
+		err = qt.xport.startCapture(cfg.CaptureFile, int64(cfg.CaptureMaxSize))
+		if err != nil {
+			qt.Close()
+			return nil, err
+		}
+	}
 
+	kind := "quiescent"
+	if dynamic {
+		kind = "dynamic"
+	}
 	level.Info(qt.logger).Log(
-		"message", "new quiescent tunnel",
+		"message", "new "+kind+" tunnel",
 		"version", cfg.Version,
 		"encap", cfg.Encap,
 		"local", cfg.Local,
 		"peer", cfg.Peer,
 		"tunnel_id", cfg.TunnelID,
-		"peer_tunnel_id", cfg.PeerTunnelID)
+		"peer_tunnel_id", cfg.PeerTunnelID,
+		"defer_connect", cfg.DeferConnect,
+		"nat_traversal", cfg.NATTraversal)
 
 	return
 }
@@ -1,92 +1,177 @@
 package l2tp
 
 import (
+	"context"
 	"fmt"
+	"sync"
+	"sync/atomic"
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	"github.com/katalix/go-l2tp/internal/nll2tp"
 	"golang.org/x/sys/unix"
 )
 
 type staticTunnel struct {
-	logger   log.Logger
-	name     string
-	parent   *Context
-	cfg      *TunnelConfig
+	logger    log.Logger
+	name      string
+	parent    *Context
+	nlconn    netlinkConn
+	cfg       *TunnelConfig
+	closeOnce sync.Once
+	// mutex protects the fields below
+	mutex    sync.Mutex
+	closed   bool
 	dp       dataPlane
 	sessions map[string]Session
 }
 
 type staticSession struct {
-	logger log.Logger
-	name   string
-	parent Tunnel
-	cfg    *SessionConfig
+	logger    log.Logger
+	name      string
+	parent    Tunnel
+	cfg       *SessionConfig
+	closeOnce sync.Once
+	// circuit, if set, watches the session's attachment circuit
+	circuit *linkWatch
+	// mutex protects the fields below
+	mutex  sync.Mutex
+	closed bool
 	dp     dataPlane
 }
 
 func (st *staticTunnel) NewSession(name string, cfg *SessionConfig) (Session, error) {
+	return st.NewSessionContext(context.Background(), name, cfg)
+}
+
+func (st *staticTunnel) NewSessionContext(cctx context.Context, name string, cfg *SessionConfig) (Session, error) {
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.closed {
+		return nil, fmt.Errorf("tunnel is closed")
+	}
 
 	if _, ok := st.sessions[name]; ok {
 		return nil, fmt.Errorf("already have session %q", name)
 	}
 
-	s, err := newStaticSession(name, st, cfg)
+	if cfg.CircuitInterface != "" {
+		return nil, fmt.Errorf("static tunnels cannot signal circuit status")
+	}
+
+	s, err := newStaticSession(cctx, name, st, cfg)
 
 	if err != nil {
 		return nil, err
 	}
 
 	st.sessions[name] = s
+	atomic.AddUint64(&st.parent.stats.SessionsCreated, 1)
 
 	return s, nil
 }
 
+// Close may be called any number of times, from any goroutine.
+// It returns once the tunnel has been torn down.
 func (st *staticTunnel) Close() {
 	if st != nil {
+		_ = st.CloseContext(context.Background())
+	}
+}
 
-		for name, session := range st.sessions {
-			session.Close()
-			st.unlinkSession(name)
-		}
+func (st *staticTunnel) CloseContext(cctx context.Context) error {
+	return closeWithContext(cctx, &st.closeOnce, st.teardown)
+}
 
-		if st.dp != nil {
-			st.dp.close(st.getNLConn())
-		}
+func (st *staticTunnel) teardown(cctx context.Context) {
+	// Sessions unlink themselves from the tunnel as they close,
+	// so we mustn't hold the lock while closing them.
+	for _, session := range st.closeSessions() {
+		_ = session.CloseContext(cctx)
+	}
 
-		st.parent.unlinkTunnel(st.name)
+	st.mutex.Lock()
+	dp := st.dp
+	st.dp = nil
+	st.mutex.Unlock()
 
-		level.Info(st.logger).Log("message", "close")
+	if dp != nil {
+		dp.close(cctx, st.getNLConn())
 	}
+
+	st.parent.unlinkTunnel(st.name, st)
+
+	level.Info(st.logger).Log("message", "close")
+}
+
+func (st *staticTunnel) StartCapture(path string, maxSize uint) error {
+	return fmt.Errorf("static tunnels cannot capture control messages")
+}
+
+func (st *staticTunnel) StopCapture() {
+}
+
+func (st *staticTunnel) Stats() (*TunnelStats, error) {
+	return &TunnelStats{}, nil
 }
 
 func (st *staticTunnel) getCfg() *TunnelConfig {
 	return st.cfg
 }
 
-func (st *staticTunnel) getNLConn() *nll2tp.Conn {
-	return st.parent.nlconn
+func (st *staticTunnel) getNLConn() netlinkConn {
+	return st.nlconn
 }
 
 func (st *staticTunnel) getLogger() log.Logger {
 	return st.logger
 }
 
-func (st *staticTunnel) unlinkSession(name string) {
-	delete(st.sessions, name)
+// closeSessions marks the tunnel closed, preventing further sessions
+// being created, and returns the sessions to be closed.
+func (st *staticTunnel) closeSessions() []Session {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	st.closed = true
+	return sessionList(st.sessions)
+}
+
+func (st *staticTunnel) unlinkSession(name string, s Session) {
+	st.mutex.Lock()
+	ss, ok := st.sessions[name]
+	unlinked := ok && ss == s
+	if unlinked {
+		delete(st.sessions, name)
+		atomic.AddUint64(&st.parent.stats.SessionsClosed, 1)
+	}
+	st.mutex.Unlock()
+
+	if unlinked {
+		st.parent.handleEvent(&SessionDownEvent{TunnelName: st.name, SessionName: name})
+	}
+}
+
+// sessionList returns the sessions in a tunnel's session map.
+func sessionList(sessions map[string]Session) []Session {
+	list := make([]Session, 0, len(sessions))
+	for _, s := range sessions {
+		list = append(list, s)
+	}
+	return list
 }
 
-func newStaticTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *TunnelConfig) (st *staticTunnel, err error) {
+func newStaticTunnel(cctx context.Context, name string, parent *Context, nlconn netlinkConn, sal, sap unix.Sockaddr, cfg *TunnelConfig) (st *staticTunnel, err error) {
 	st = &staticTunnel{
 		logger:   log.With(parent.logger, "tunnel_name", name),
 		name:     name,
 		parent:   parent,
+		nlconn:   nlconn,
 		cfg:      cfg,
 		sessions: make(map[string]Session),
 	}
 
-	st.dp, err = newStaticTunnelDataPlane(parent.nlconn, sal, sap, cfg)
+	st.dp, err = newStaticTunnelDataPlane(cctx, st.nlconn, sal, sap, cfg)
 	if err != nil {
 		st.Close()
 		return nil, err
@@ -104,24 +189,42 @@ func newStaticTunnel(name string, parent *Context, sal, sap unix.Sockaddr, cfg *
 	return
 }
 
-func newStaticSession(name string, parent Tunnel, cfg *SessionConfig) (ss *staticSession, err error) {
+func newStaticSession(cctx context.Context, name string, parent Tunnel, cfg *SessionConfig) (ss *staticSession, err error) {
+	ss = &staticSession{
+		logger: log.With(parent.getLogger(), "session_name", name),
+		name:   name,
+		parent: parent,
+		cfg:    cfg,
+	}
+
 	// Since we're static we instantiate the session in the
 	// dataplane at the point of creation.
-	dp, err := newSessionDataPlane(parent.getNLConn(), parent.getCfg().TunnelID, parent.getCfg().PeerTunnelID, cfg)
+	err = ss.createDataPlane(cctx)
 	if err != nil {
-		return
+		return nil, err
 	}
 
+	level.Info(ss.logger).Log(
+		"message", "new static session",
+		"session_id", cfg.SessionID,
+		"peer_session_id", cfg.PeerSessionID,
+		"pseudowire", cfg.Pseudowire)
+
+	return
+}
+
+// newDeferredSession creates a static session whose data plane
+// is instantiated later, once the parent tunnel data plane is up.
+func newDeferredSession(name string, parent Tunnel, cfg *SessionConfig) (ss *staticSession, err error) {
 	ss = &staticSession{
 		logger: log.With(parent.getLogger(), "session_name", name),
 		name:   name,
 		parent: parent,
 		cfg:    cfg,
-		dp:     dp,
 	}
 
 	level.Info(ss.logger).Log(
-		"message", "new static session",
+		"message", "new deferred session",
 		"session_id", cfg.SessionID,
 		"peer_session_id", cfg.PeerSessionID,
 		"pseudowire", cfg.Pseudowire)
@@ -129,8 +232,88 @@ func newStaticSession(name string, parent Tunnel, cfg *SessionConfig) (ss *stati
 	return
 }
 
+// createDataPlane instantiates the session data plane, unless it
+// already exists or the session has been closed.
+func (ss *staticSession) createDataPlane(cctx context.Context) (err error) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if ss.closed || ss.dp != nil {
+		return nil
+	}
+	ss.dp, err = newSessionDataPlane(cctx, ss.parent.getNLConn(),
+		ss.parent.getCfg().TunnelID, ss.parent.getCfg().PeerTunnelID, ss.cfg)
+	return
+}
+
+func (ss *staticSession) Stats() (*SessionStats, error) {
+	ss.mutex.Lock()
+	sdp, ok := ss.dp.(*sessionDataPlane)
+	ss.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("session data plane not yet created")
+	}
+	return sdp.stats(context.Background(), ss.parent.getNLConn())
+}
+
+// isClosed returns true once the session has been closed.
+func (ss *staticSession) isClosed() bool {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	return ss.closed
+}
+
+// circuitUp returns true if the session's attachment circuit is active.
+// Sessions which don't watch their circuit consider it to be active.
+func (ss *staticSession) circuitUp() bool {
+	if ss.circuit == nil {
+		return true
+	}
+	return ss.circuit.isRunning()
+}
+
+// interfaceName returns the name of the session's network interface,
+// which is chosen by the kernel unless it's configured.
+func (ss *staticSession) interfaceName(cctx context.Context) (string, error) {
+	if ss.cfg.InterfaceName != "" {
+		return ss.cfg.InterfaceName, nil
+	}
+	ss.mutex.Lock()
+	sdp, ok := ss.dp.(*sessionDataPlane)
+	ss.mutex.Unlock()
+	if !ok {
+		return "", fmt.Errorf("session data plane not yet created")
+	}
+	nlcfg, err := ss.parent.getNLConn().GetSession(cctx, sdp.cfg)
+	if err != nil {
+		return "", fmt.Errorf("failed to get session via. netlink: %w", err)
+	}
+	return nlcfg.IfName, nil
+}
+
+// Close may be called any number of times, from any goroutine.
+// It returns once the session has been torn down.
 func (ss *staticSession) Close() {
-	ss.dp.close(ss.parent.getNLConn())
-	ss.parent.unlinkSession(ss.name)
+	_ = ss.CloseContext(context.Background())
+}
+
+func (ss *staticSession) CloseContext(cctx context.Context) error {
+	return closeWithContext(cctx, &ss.closeOnce, ss.teardown)
+}
+
+func (ss *staticSession) teardown(cctx context.Context) {
+	if ss.circuit != nil {
+		ss.circuit.stop()
+	}
+
+	ss.mutex.Lock()
+	dp := ss.dp
+	ss.dp = nil
+	ss.closed = true
+	ss.mutex.Unlock()
+
+	if dp != nil {
+		dp.close(cctx, ss.parent.getNLConn())
+	}
+	ss.parent.unlinkSession(ss.name, ss)
 	level.Info(ss.logger).Log("message", "close")
 }
@@ -11,6 +11,7 @@ import (
 
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
 )
 
 // Must be called with root permissions
@@ -355,6 +356,112 @@ func testStaticSessions(t *testing.T) {
 	}
 }
 
+func TestAddressPairs(t *testing.T) {
+	cases := []struct {
+		name       string
+		encap      EncapType
+		local      string
+		peer       string
+		zoneID     uint32
+		expectFail bool
+	}{
+		{
+			name:  "UDP IPv4",
+			encap: EncapTypeUDP,
+			local: "127.0.0.1:6000",
+			peer:  "127.0.0.1:5000",
+		},
+		{
+			name:   "UDP IPv6 link-local with named zone",
+			encap:  EncapTypeUDP,
+			local:  "[fe80::1%lo]:6000",
+			peer:   "[fe80::2%lo]:5000",
+			zoneID: 1,
+		},
+		{
+			name:   "UDP IPv6 link-local with numeric zone",
+			encap:  EncapTypeUDP,
+			local:  "[fe80::1%1]:6000",
+			peer:   "[fe80::2%1]:5000",
+			zoneID: 1,
+		},
+		{
+			name:   "IP IPv6 link-local with named zone",
+			encap:  EncapTypeIP,
+			local:  "[fe80::1%lo]:6000",
+			peer:   "[fe80::2%lo]:5000",
+			zoneID: 1,
+		},
+		{
+			name:       "reject unknown zone",
+			encap:      EncapTypeUDP,
+			local:      "[fe80::1%nosuchif0]:6000",
+			peer:       "[fe80::2%nosuchif0]:5000",
+			expectFail: true,
+		},
+		{
+			name:       "reject UDP IPv6 link-local with no zone",
+			encap:      EncapTypeUDP,
+			local:      "[fe80::1%lo]:6000",
+			peer:       "[fe80::2]:5000",
+			expectFail: true,
+		},
+		{
+			name:       "reject IP IPv6 link-local with no zone",
+			encap:      EncapTypeIP,
+			local:      "[fe80::1]:6000",
+			peer:       "[fe80::2%lo]:5000",
+			expectFail: true,
+		},
+		{
+			name:       "reject UDP family mismatch",
+			encap:      EncapTypeUDP,
+			local:      "127.0.0.1:6000",
+			peer:       "[::1]:5000",
+			expectFail: true,
+		},
+		{
+			name:       "reject IP family mismatch",
+			encap:      EncapTypeIP,
+			local:      "[::1]:6000",
+			peer:       "127.0.0.1:5000",
+			expectFail: true,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sal, sap, err := newTunnelAddressPair(&TunnelConfig{
+				Local:        c.local,
+				Peer:         c.peer,
+				Encap:        c.encap,
+				TunnelID:     1,
+				PeerTunnelID: 2,
+			})
+			if c.expectFail {
+				if err == nil {
+					t.Fatalf("expected address pair %v/%v to be rejected", c.local, c.peer)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("address pair %v/%v: %v", c.local, c.peer, err)
+			}
+			for _, sa := range []unix.Sockaddr{sal, sap} {
+				var zoneID uint32
+				switch sa := sa.(type) {
+				case *unix.SockaddrInet6:
+					zoneID = sa.ZoneId
+				case *unix.SockaddrL2TPIP6:
+					zoneID = sa.ZoneId
+				}
+				if zoneID != c.zoneID {
+					t.Errorf("expected zone ID %v, got %v", c.zoneID, zoneID)
+				}
+			}
+		})
+	}
+}
+
 func TestRequiresRoot(t *testing.T) {
 
 	// These tests need root permissions, so verify we have those first of all
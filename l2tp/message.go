@@ -0,0 +1,868 @@
+package l2tp
+
+import (
+	"fmt"
+
+	"github.com/katalix/go-l2tp/internal/nll2tp"
+)
+
+// MessageType identifies an L2TP control message.
+type MessageType uint16
+
+// Control message types as per RFC2661 and RFC3931.
+const (
+	MessageTypeSCCRQ   = MessageType(avpMsgTypeSccrq)
+	MessageTypeSCCRP   = MessageType(avpMsgTypeSccrp)
+	MessageTypeSCCCN   = MessageType(avpMsgTypeScccn)
+	MessageTypeStopCCN = MessageType(avpMsgTypeStopccn)
+	MessageTypeHello   = MessageType(avpMsgTypeHello)
+	MessageTypeICRQ    = MessageType(avpMsgTypeIcrq)
+	MessageTypeICRP    = MessageType(avpMsgTypeIcrp)
+	MessageTypeICCN    = MessageType(avpMsgTypeIccn)
+	MessageTypeCDN     = MessageType(avpMsgTypeCdn)
+	MessageTypeWEN     = MessageType(avpMsgTypeWen)
+	MessageTypeSLI     = MessageType(avpMsgTypeSli)
+	MessageTypeAck     = MessageType(avpMsgTypeAck)
+	MessageTypeCSUN    = MessageType(avpMsgTypeCsun)
+)
+
+var _ fmt.Stringer = (*MessageType)(nil)
+
+// String represents the message type as a human-readable string.
+func (t MessageType) String() string {
+	return avpMsgType(t).String()
+}
+
+// ResultCode represents the value of an RFC2661/RFC3931 Result Code AVP,
+// as carried by StopCCN and CDN messages.
+type ResultCode struct {
+	Result       uint16
+	ErrorCode    uint16
+	ErrorMessage string
+}
+
+// CallErrors represents the value of an RFC2661 Call Errors AVP,
+// as carried by WEN messages.
+type CallErrors struct {
+	CRCErrors        uint32
+	FramingErrors    uint32
+	HardwareOverruns uint32
+	BufferOverruns   uint32
+	TimeoutErrors    uint32
+	AlignmentErrors  uint32
+}
+
+// ACCM represents the value of an RFC2661 ACCM AVP, as carried by
+// L2TPv2 SLI messages.
+type ACCM struct {
+	SendACCM uint32
+	RecvACCM uint32
+}
+
+// MessageHeader holds the fields common to all control messages.
+type MessageHeader struct {
+	// Version is the protocol version of the message
+	Version ProtocolVersion
+	// TunnelID is the L2TPv2 tunnel ID or L2TPv3 control connection ID
+	// of the recipient
+	TunnelID ControlConnID
+	// SessionID is the L2TPv2 session ID of the recipient, and is
+	// unused for L2TPv3
+	SessionID ControlConnID
+	// Ns and Nr are the transport sequence numbers.  These are
+	// managed by the transport for messages sent on a tunnel.
+	Ns, Nr uint16
+	// ExtraAVPs holds AVPs which are not represented by message fields,
+	// for example vendor-specific AVPs.  These are appended to the
+	// message when it is built.
+	ExtraAVPs []AVP
+}
+
+// Message is the interface implemented by the typed control messages.
+//
+// Each message field is carried in the AVP of the same name.  When
+// building a message, fields whose AVP the message requires are always
+// included, while other fields are included only if they are not the
+// zero value.
+type Message interface {
+	// Type returns the message type.
+	Type() MessageType
+	// Header returns the message header.
+	Header() *MessageHeader
+}
+
+// Header returns the message header.
+func (h *MessageHeader) Header() *MessageHeader {
+	return h
+}
+
+// SCCRQ is the Start-Control-Connection-Request message.
+type SCCRQ struct {
+	MessageHeader
+	ProtocolVersion  []byte
+	FramingCap       uint32
+	BearerCap        uint32
+	Tiebreaker       uint64
+	FirmwareRevision uint16
+	HostName         string
+	VendorName       string
+	AssignedTunnelID uint16
+	RxWindowSize     uint16
+	Challenge        []byte
+	RouterID         uint32
+	AssignedConnID   uint32
+	PseudowireCaps   []uint16
+}
+
+// SCCRP is the Start-Control-Connection-Reply message.
+type SCCRP struct {
+	MessageHeader
+	ProtocolVersion   []byte
+	FramingCap        uint32
+	BearerCap         uint32
+	FirmwareRevision  uint16
+	HostName          string
+	VendorName        string
+	AssignedTunnelID  uint16
+	RxWindowSize      uint16
+	Challenge         []byte
+	ChallengeResponse []byte
+	RouterID          uint32
+	AssignedConnID    uint32
+	PseudowireCaps    []uint16
+}
+
+// SCCCN is the Start-Control-Connection-Connected message.
+type SCCCN struct {
+	MessageHeader
+	ChallengeResponse []byte
+}
+
+// StopCCN is the Stop-Control-Connection-Notification message.
+type StopCCN struct {
+	MessageHeader
+	ResultCode       ResultCode
+	AssignedTunnelID uint16
+	AssignedConnID   uint32
+}
+
+// Hello is the Hello keepalive message.
+type Hello struct {
+	MessageHeader
+}
+
+// ICRQ is the Incoming-Call-Request message.
+type ICRQ struct {
+	MessageHeader
+	AssignedSessionID uint16
+	CallSerialNumber  uint32
+	BearerType        uint32
+	CalledNumber      string
+	CallingNumber     string
+	SubAddress        string
+	PhysicalChannelID uint32
+	LocalSessionID    uint32
+	RemoteSessionID   uint32
+	AssignedCookie    []byte
+	PseudowireType    uint16
+	L2SpecSublayer    uint16
+	DataSequencing    uint16
+	CircuitStatus     uint16
+}
+
+// ICRP is the Incoming-Call-Reply message.
+type ICRP struct {
+	MessageHeader
+	AssignedSessionID uint16
+	LocalSessionID    uint32
+	RemoteSessionID   uint32
+	AssignedCookie    []byte
+	PseudowireType    uint16
+	L2SpecSublayer    uint16
+	DataSequencing    uint16
+	CircuitStatus     uint16
+}
+
+// ICCN is the Incoming-Call-Connected message.
+type ICCN struct {
+	MessageHeader
+	FramingType        uint32
+	ConnectSpeed       uint32
+	RxConnectSpeed     uint32
+	SequencingRequired bool
+	LocalSessionID     uint32
+	RemoteSessionID    uint32
+	DataSequencing     uint16
+	CircuitStatus      uint16
+	TxConnectSpeedBps  uint64
+	RxConnectSpeedBps  uint64
+}
+
+// CDN is the Call-Disconnect-Notify message.
+type CDN struct {
+	MessageHeader
+	ResultCode        ResultCode
+	AssignedSessionID uint16
+	LocalSessionID    uint32
+	RemoteSessionID   uint32
+}
+
+// WEN is the WAN-Error-Notify message.
+type WEN struct {
+	MessageHeader
+	CallErrors CallErrors
+}
+
+// SLI is the Set-Link-Info message.
+type SLI struct {
+	MessageHeader
+	ACCM            ACCM
+	LocalSessionID  uint32
+	RemoteSessionID uint32
+	CircuitStatus   uint16
+}
+
+// GenericMessage represents control messages which don't have a typed
+// representation, including L2TPv2 ZLB and L2TPv3 ACK messages.
+// All AVPs other than the Message Type AVP are held in ExtraAVPs.
+type GenericMessage struct {
+	MessageHeader
+	MsgType MessageType
+}
+
+// Type returns the message type.
+func (m *SCCRQ) Type() MessageType { return MessageTypeSCCRQ }
+
+// Type returns the message type.
+func (m *SCCRP) Type() MessageType { return MessageTypeSCCRP }
+
+// Type returns the message type.
+func (m *SCCCN) Type() MessageType { return MessageTypeSCCCN }
+
+// Type returns the message type.
+func (m *StopCCN) Type() MessageType { return MessageTypeStopCCN }
+
+// Type returns the message type.
+func (m *Hello) Type() MessageType { return MessageTypeHello }
+
+// Type returns the message type.
+func (m *ICRQ) Type() MessageType { return MessageTypeICRQ }
+
+// Type returns the message type.
+func (m *ICRP) Type() MessageType { return MessageTypeICRP }
+
+// Type returns the message type.
+func (m *ICCN) Type() MessageType { return MessageTypeICCN }
+
+// Type returns the message type.
+func (m *CDN) Type() MessageType { return MessageTypeCDN }
+
+// Type returns the message type.
+func (m *WEN) Type() MessageType { return MessageTypeWEN }
+
+// Type returns the message type.
+func (m *SLI) Type() MessageType { return MessageTypeSLI }
+
+// Type returns the message type.
+func (m *GenericMessage) Type() MessageType { return m.MsgType }
+
+func newTypedMessage(t avpMsgType) Message {
+	switch t {
+	case avpMsgTypeSccrq:
+		return &SCCRQ{}
+	case avpMsgTypeSccrp:
+		return &SCCRP{}
+	case avpMsgTypeScccn:
+		return &SCCCN{}
+	case avpMsgTypeStopccn:
+		return &StopCCN{}
+	case avpMsgTypeHello:
+		return &Hello{}
+	case avpMsgTypeIcrq:
+		return &ICRQ{}
+	case avpMsgTypeIcrp:
+		return &ICRP{}
+	case avpMsgTypeIccn:
+		return &ICCN{}
+	case avpMsgTypeCdn:
+		return &CDN{}
+	case avpMsgTypeWen:
+		return &WEN{}
+	case avpMsgTypeSli:
+		return &SLI{}
+	}
+	return &GenericMessage{MsgType: MessageType(t)}
+}
+
+// ParseMessages parses a buffer containing one or more control messages.
+//
+// Messages are validated against the AVPs required and forbidden for
+// their type.  Unrecognised AVPs without the mandatory bit set are
+// retained in the ExtraAVPs field of the message header.
+func ParseMessages(b []byte) ([]Message, error) {
+	cms, err := parseMessageBuffer(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []Message
+	for _, cm := range cms {
+		m, err := messageFromControlMessage(cm)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// MarshalMessage builds the wire representation of a control message.
+//
+// The message is validated against the AVPs required and forbidden
+// for its type prior to being encoded.
+func MarshalMessage(m Message) ([]byte, error) {
+	cm, err := messageToControlMessage(m)
+	if err != nil {
+		return nil, err
+	}
+	return cm.toBytes()
+}
+
+func messageFromControlMessage(cm controlMessage) (Message, error) {
+	err := validateMessage(cm)
+	if err != nil {
+		return nil, err
+	}
+
+	m := newTypedMessage(cm.getType())
+
+	h := m.Header()
+	h.Version = messageVersion(cm)
+	h.Ns = cm.ns()
+	h.Nr = cm.nr()
+	switch msg := cm.(type) {
+	case *v2ControlMessage:
+		h.TunnelID = ControlConnID(msg.Tid())
+		h.SessionID = ControlConnID(msg.Sid())
+	case *v3ControlMessage:
+		h.TunnelID = ControlConnID(msg.ControlConnectionID())
+	}
+
+	codec, _ := m.(messageCodec)
+	for i, a := range cm.getAvps() {
+		if i == 0 && a.getType() == avpTypeMessage {
+			continue
+		}
+		if codec != nil && a.vendorID() == vendorIDIetf {
+			ok, err := codec.decodeAVP(&a)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode %v: %v", a.getType(), err)
+			}
+			if ok {
+				continue
+			}
+		}
+		h.ExtraAVPs = append(h.ExtraAVPs, AVP{avp: a})
+	}
+
+	return m, nil
+}
+
+func messageToControlMessage(m Message) (cm controlMessage, err error) {
+	var avps []avp
+
+	h := m.Header()
+	version := nll2tp.L2tpProtocolVersion(h.Version)
+
+	// Only the SCCRQ starting a control connection uses fallback mode
+	if h.Version == ProtocolVersion3Fallback && m.Type() != MessageTypeSCCRQ {
+		return nil, fmt.Errorf("fallback mode is not supported for %v messages", m.Type())
+	}
+
+	// ZLB messages have no AVPs at all
+	if !(version == ProtocolVersion2 && m.Type() == MessageTypeAck) {
+		a, err := newAvp(vendorIDIetf, avpTypeMessage, avpMsgType(m.Type()))
+		if err != nil {
+			return nil, err
+		}
+		avps = append(avps, *a)
+	}
+
+	if codec, ok := m.(messageCodec); ok {
+		schema, _ := getMsgSchema(version, avpMsgType(m.Type()))
+		e := messageEncoder{
+			schema:   schema,
+			fallback: h.Version == ProtocolVersion3Fallback,
+			avps:     avps,
+		}
+		codec.encodeAVPs(&e)
+		if e.err != nil {
+			return nil, e.err
+		}
+		avps = e.avps
+	}
+
+	for _, a := range h.ExtraAVPs {
+		avps = append(avps, a.avp)
+	}
+
+	switch version {
+	case ProtocolVersion2, ProtocolVersion3Fallback:
+		cm, err = newV2ControlMessage(h.TunnelID, h.SessionID, avps)
+	case ProtocolVersion3:
+		cm, err = newV3ControlMessage(h.TunnelID, avps)
+	default:
+		return nil, fmt.Errorf("unsupported protocol version %v", h.Version)
+	}
+	if err != nil {
+		return nil, err
+	}
+	cm.setTransportSeqNum(h.Ns, h.Nr)
+
+	err = validateMessage(cm)
+	if err != nil {
+		return nil, err
+	}
+
+	return cm, nil
+}
+
+// messageCodec is implemented by typed messages which carry fields in
+// AVPs.  decodeAVP returns false for AVPs the message has no field for.
+type messageCodec interface {
+	decodeAVP(a *avp) (ok bool, err error)
+	encodeAVPs(e *messageEncoder)
+}
+
+// messageEncoder builds the AVPs for the fields of a typed message.
+// Fields are omitted if they are the zero value, unless the message
+// schema requires them.  The first encoding error is retained in err.
+type messageEncoder struct {
+	schema   *msgSchema
+	fallback bool
+	avps     []avp
+	err      error
+}
+
+func (e *messageEncoder) add(t avpType, value interface{}, isZero bool) {
+	if e.err != nil || (isZero && !e.schema.isRequiredAvp(t)) {
+		return
+	}
+	a, err := newAvp(vendorIDIetf, t, value)
+	if err != nil {
+		e.err = fmt.Errorf("failed to encode %v: %v", t, err)
+		return
+	}
+	// A peer supporting only L2TPv2 must be able to ignore the
+	// L2TPv3 AVPs of a fallback mode SCCRQ.
+	if e.fallback && isV3OnlyAvp(t) {
+		a.setMandatory(false)
+	}
+	e.avps = append(e.avps, *a)
+}
+
+func (e *messageEncoder) bool(t avpType, v bool) {
+	// Boolean AVPs carry no data, their presence signals true
+	e.add(t, nil, !v)
+}
+
+func (e *messageEncoder) uint16(t avpType, v uint16) {
+	e.add(t, v, v == 0)
+}
+
+func (e *messageEncoder) uint32(t avpType, v uint32) {
+	e.add(t, v, v == 0)
+}
+
+func (e *messageEncoder) uint64(t avpType, v uint64) {
+	e.add(t, v, v == 0)
+}
+
+func (e *messageEncoder) string(t avpType, v string) {
+	e.add(t, v, v == "")
+}
+
+func (e *messageEncoder) bytes(t avpType, v []byte) {
+	e.add(t, v, v == nil)
+}
+
+func (e *messageEncoder) uint16Array(t avpType, v []uint16) {
+	e.add(t, v, v == nil)
+}
+
+func (e *messageEncoder) resultCode(t avpType, v ResultCode) {
+	e.add(t, resultCode{
+		result:  avpResultCode(v.Result),
+		errCode: avpErrorCode(v.ErrorCode),
+		errMsg:  v.ErrorMessage,
+	}, v == ResultCode{})
+}
+
+func (e *messageEncoder) callErrors(t avpType, v CallErrors) {
+	e.add(t, callErrors{
+		crcErrors:        v.CRCErrors,
+		framingErrors:    v.FramingErrors,
+		hardwareOverruns: v.HardwareOverruns,
+		bufferOverruns:   v.BufferOverruns,
+		timeoutErrors:    v.TimeoutErrors,
+		alignmentErrors:  v.AlignmentErrors,
+	}, v == CallErrors{})
+}
+
+func (e *messageEncoder) accm(t avpType, v ACCM) {
+	e.add(t, accm{sendACCM: v.SendACCM, recvACCM: v.RecvACCM}, v == ACCM{})
+}
+
+func decodeBytes(a *avp) []byte {
+	_, b := a.rawData()
+	return append([]byte(nil), b...)
+}
+
+func decodeResultCode(a *avp) (ResultCode, error) {
+	v, err := a.decodeResultCode()
+	return ResultCode{
+		Result:       uint16(v.result),
+		ErrorCode:    uint16(v.errCode),
+		ErrorMessage: v.errMsg,
+	}, err
+}
+
+func decodeCallErrors(a *avp) (CallErrors, error) {
+	v, err := a.decodeCallErrors()
+	return CallErrors{
+		CRCErrors:        v.crcErrors,
+		FramingErrors:    v.framingErrors,
+		HardwareOverruns: v.hardwareOverruns,
+		BufferOverruns:   v.bufferOverruns,
+		TimeoutErrors:    v.timeoutErrors,
+		AlignmentErrors:  v.alignmentErrors,
+	}, err
+}
+
+func decodeACCM(a *avp) (ACCM, error) {
+	v, err := a.decodeACCM()
+	return ACCM{SendACCM: v.sendACCM, RecvACCM: v.recvACCM}, err
+}
+
+func (m *SCCRQ) decodeAVP(a *avp) (ok bool, err error) {
+	switch a.getType() {
+	case avpTypeProtocolVersion:
+		m.ProtocolVersion = decodeBytes(a)
+	case avpTypeFramingCap:
+		m.FramingCap, err = a.decodeUint32Data()
+	case avpTypeBearerCap:
+		m.BearerCap, err = a.decodeUint32Data()
+	case avpTypeTiebreaker:
+		m.Tiebreaker, err = a.decodeUint64Data()
+	case avpTypeFirmwareRevision:
+		m.FirmwareRevision, err = a.decodeUint16Data()
+	case avpTypeHostName:
+		m.HostName, err = a.decodeStringData()
+	case avpTypeVendorName:
+		m.VendorName, err = a.decodeStringData()
+	case avpTypeTunnelID:
+		m.AssignedTunnelID, err = a.decodeUint16Data()
+	case avpTypeRxWindowSize:
+		m.RxWindowSize, err = a.decodeUint16Data()
+	case avpTypeChallenge:
+		m.Challenge = decodeBytes(a)
+	case avpTypeRouterID:
+		m.RouterID, err = a.decodeUint32Data()
+	case avpTypeAssignedConnID:
+		m.AssignedConnID, err = a.decodeUint32Data()
+	case avpTypePseudowireCaps:
+		m.PseudowireCaps, err = a.decodeUint16ArrayData()
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func (m *SCCRQ) encodeAVPs(e *messageEncoder) {
+	e.bytes(avpTypeProtocolVersion, m.ProtocolVersion)
+	e.uint32(avpTypeFramingCap, m.FramingCap)
+	e.uint32(avpTypeBearerCap, m.BearerCap)
+	e.uint64(avpTypeTiebreaker, m.Tiebreaker)
+	e.uint16(avpTypeFirmwareRevision, m.FirmwareRevision)
+	e.string(avpTypeHostName, m.HostName)
+	e.string(avpTypeVendorName, m.VendorName)
+	e.uint16(avpTypeTunnelID, m.AssignedTunnelID)
+	e.uint16(avpTypeRxWindowSize, m.RxWindowSize)
+	e.bytes(avpTypeChallenge, m.Challenge)
+	e.uint32(avpTypeRouterID, m.RouterID)
+	e.uint32(avpTypeAssignedConnID, m.AssignedConnID)
+	e.uint16Array(avpTypePseudowireCaps, m.PseudowireCaps)
+}
+
+func (m *SCCRP) decodeAVP(a *avp) (ok bool, err error) {
+	switch a.getType() {
+	case avpTypeProtocolVersion:
+		m.ProtocolVersion = decodeBytes(a)
+	case avpTypeFramingCap:
+		m.FramingCap, err = a.decodeUint32Data()
+	case avpTypeBearerCap:
+		m.BearerCap, err = a.decodeUint32Data()
+	case avpTypeFirmwareRevision:
+		m.FirmwareRevision, err = a.decodeUint16Data()
+	case avpTypeHostName:
+		m.HostName, err = a.decodeStringData()
+	case avpTypeVendorName:
+		m.VendorName, err = a.decodeStringData()
+	case avpTypeTunnelID:
+		m.AssignedTunnelID, err = a.decodeUint16Data()
+	case avpTypeRxWindowSize:
+		m.RxWindowSize, err = a.decodeUint16Data()
+	case avpTypeChallenge:
+		m.Challenge = decodeBytes(a)
+	case avpTypeChallengeResponse:
+		m.ChallengeResponse = decodeBytes(a)
+	case avpTypeRouterID:
+		m.RouterID, err = a.decodeUint32Data()
+	case avpTypeAssignedConnID:
+		m.AssignedConnID, err = a.decodeUint32Data()
+	case avpTypePseudowireCaps:
+		m.PseudowireCaps, err = a.decodeUint16ArrayData()
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func (m *SCCRP) encodeAVPs(e *messageEncoder) {
+	e.bytes(avpTypeProtocolVersion, m.ProtocolVersion)
+	e.uint32(avpTypeFramingCap, m.FramingCap)
+	e.uint32(avpTypeBearerCap, m.BearerCap)
+	e.uint16(avpTypeFirmwareRevision, m.FirmwareRevision)
+	e.string(avpTypeHostName, m.HostName)
+	e.string(avpTypeVendorName, m.VendorName)
+	e.uint16(avpTypeTunnelID, m.AssignedTunnelID)
+	e.uint16(avpTypeRxWindowSize, m.RxWindowSize)
+	e.bytes(avpTypeChallenge, m.Challenge)
+	e.bytes(avpTypeChallengeResponse, m.ChallengeResponse)
+	e.uint32(avpTypeRouterID, m.RouterID)
+	e.uint32(avpTypeAssignedConnID, m.AssignedConnID)
+	e.uint16Array(avpTypePseudowireCaps, m.PseudowireCaps)
+}
+
+func (m *SCCCN) decodeAVP(a *avp) (ok bool, err error) {
+	switch a.getType() {
+	case avpTypeChallengeResponse:
+		m.ChallengeResponse = decodeBytes(a)
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+func (m *SCCCN) encodeAVPs(e *messageEncoder) {
+	e.bytes(avpTypeChallengeResponse, m.ChallengeResponse)
+}
+
+func (m *StopCCN) decodeAVP(a *avp) (ok bool, err error) {
+	switch a.getType() {
+	case avpTypeResultCode:
+		m.ResultCode, err = decodeResultCode(a)
+	case avpTypeTunnelID:
+		m.AssignedTunnelID, err = a.decodeUint16Data()
+	case avpTypeAssignedConnID:
+		m.AssignedConnID, err = a.decodeUint32Data()
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func (m *StopCCN) encodeAVPs(e *messageEncoder) {
+	e.resultCode(avpTypeResultCode, m.ResultCode)
+	e.uint16(avpTypeTunnelID, m.AssignedTunnelID)
+	e.uint32(avpTypeAssignedConnID, m.AssignedConnID)
+}
+
+func (m *ICRQ) decodeAVP(a *avp) (ok bool, err error) {
+	switch a.getType() {
+	case avpTypeSessionID:
+		m.AssignedSessionID, err = a.decodeUint16Data()
+	case avpTypeCallSerialNumber:
+		m.CallSerialNumber, err = a.decodeUint32Data()
+	case avpTypeBearerType:
+		m.BearerType, err = a.decodeUint32Data()
+	case avpTypeCalledNumber:
+		m.CalledNumber, err = a.decodeStringData()
+	case avpTypeCallingNumber:
+		m.CallingNumber, err = a.decodeStringData()
+	case avpTypeSubAddress:
+		m.SubAddress, err = a.decodeStringData()
+	case avpTypePhysicalChannelID:
+		m.PhysicalChannelID, err = a.decodeUint32Data()
+	case avpTypeLocalSessionID:
+		m.LocalSessionID, err = a.decodeUint32Data()
+	case avpTypeRemoteSessionID:
+		m.RemoteSessionID, err = a.decodeUint32Data()
+	case avpTypeAssignedCookie:
+		m.AssignedCookie = decodeBytes(a)
+	case avpTypePseudowireType:
+		m.PseudowireType, err = a.decodeUint16Data()
+	case avpTypeL2specificSublayer:
+		m.L2SpecSublayer, err = a.decodeUint16Data()
+	case avpTypeDataSequencing:
+		m.DataSequencing, err = a.decodeUint16Data()
+	case avpTypeCircuitStatus:
+		m.CircuitStatus, err = a.decodeUint16Data()
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func (m *ICRQ) encodeAVPs(e *messageEncoder) {
+	e.uint16(avpTypeSessionID, m.AssignedSessionID)
+	e.uint32(avpTypeCallSerialNumber, m.CallSerialNumber)
+	e.uint32(avpTypeBearerType, m.BearerType)
+	e.string(avpTypeCalledNumber, m.CalledNumber)
+	e.string(avpTypeCallingNumber, m.CallingNumber)
+	e.string(avpTypeSubAddress, m.SubAddress)
+	e.uint32(avpTypePhysicalChannelID, m.PhysicalChannelID)
+	e.uint32(avpTypeLocalSessionID, m.LocalSessionID)
+	e.uint32(avpTypeRemoteSessionID, m.RemoteSessionID)
+	e.bytes(avpTypeAssignedCookie, m.AssignedCookie)
+	e.uint16(avpTypePseudowireType, m.PseudowireType)
+	e.uint16(avpTypeL2specificSublayer, m.L2SpecSublayer)
+	e.uint16(avpTypeDataSequencing, m.DataSequencing)
+	e.uint16(avpTypeCircuitStatus, m.CircuitStatus)
+}
+
+func (m *ICRP) decodeAVP(a *avp) (ok bool, err error) {
+	switch a.getType() {
+	case avpTypeSessionID:
+		m.AssignedSessionID, err = a.decodeUint16Data()
+	case avpTypeLocalSessionID:
+		m.LocalSessionID, err = a.decodeUint32Data()
+	case avpTypeRemoteSessionID:
+		m.RemoteSessionID, err = a.decodeUint32Data()
+	case avpTypeAssignedCookie:
+		m.AssignedCookie = decodeBytes(a)
+	case avpTypePseudowireType:
+		m.PseudowireType, err = a.decodeUint16Data()
+	case avpTypeL2specificSublayer:
+		m.L2SpecSublayer, err = a.decodeUint16Data()
+	case avpTypeDataSequencing:
+		m.DataSequencing, err = a.decodeUint16Data()
+	case avpTypeCircuitStatus:
+		m.CircuitStatus, err = a.decodeUint16Data()
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func (m *ICRP) encodeAVPs(e *messageEncoder) {
+	e.uint16(avpTypeSessionID, m.AssignedSessionID)
+	e.uint32(avpTypeLocalSessionID, m.LocalSessionID)
+	e.uint32(avpTypeRemoteSessionID, m.RemoteSessionID)
+	e.bytes(avpTypeAssignedCookie, m.AssignedCookie)
+	e.uint16(avpTypePseudowireType, m.PseudowireType)
+	e.uint16(avpTypeL2specificSublayer, m.L2SpecSublayer)
+	e.uint16(avpTypeDataSequencing, m.DataSequencing)
+	e.uint16(avpTypeCircuitStatus, m.CircuitStatus)
+}
+
+func (m *ICCN) decodeAVP(a *avp) (ok bool, err error) {
+	switch a.getType() {
+	case avpTypeFramingType:
+		m.FramingType, err = a.decodeUint32Data()
+	case avpTypeConnectSpeed:
+		m.ConnectSpeed, err = a.decodeUint32Data()
+	case avpTypeRxConnectSpeed:
+		m.RxConnectSpeed, err = a.decodeUint32Data()
+	case avpTypeSequencingRequired:
+		m.SequencingRequired = true
+	case avpTypeLocalSessionID:
+		m.LocalSessionID, err = a.decodeUint32Data()
+	case avpTypeRemoteSessionID:
+		m.RemoteSessionID, err = a.decodeUint32Data()
+	case avpTypeDataSequencing:
+		m.DataSequencing, err = a.decodeUint16Data()
+	case avpTypeCircuitStatus:
+		m.CircuitStatus, err = a.decodeUint16Data()
+	case avpTypeTxConnectSpeedBps:
+		m.TxConnectSpeedBps, err = a.decodeUint64Data()
+	case avpTypeRxConnectSpeedBps:
+		m.RxConnectSpeedBps, err = a.decodeUint64Data()
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func (m *ICCN) encodeAVPs(e *messageEncoder) {
+	e.uint32(avpTypeFramingType, m.FramingType)
+	e.uint32(avpTypeConnectSpeed, m.ConnectSpeed)
+	e.uint32(avpTypeRxConnectSpeed, m.RxConnectSpeed)
+	e.bool(avpTypeSequencingRequired, m.SequencingRequired)
+	e.uint32(avpTypeLocalSessionID, m.LocalSessionID)
+	e.uint32(avpTypeRemoteSessionID, m.RemoteSessionID)
+	e.uint16(avpTypeDataSequencing, m.DataSequencing)
+	e.uint16(avpTypeCircuitStatus, m.CircuitStatus)
+	e.uint64(avpTypeTxConnectSpeedBps, m.TxConnectSpeedBps)
+	e.uint64(avpTypeRxConnectSpeedBps, m.RxConnectSpeedBps)
+}
+
+func (m *CDN) decodeAVP(a *avp) (ok bool, err error) {
+	switch a.getType() {
+	case avpTypeResultCode:
+		m.ResultCode, err = decodeResultCode(a)
+	case avpTypeSessionID:
+		m.AssignedSessionID, err = a.decodeUint16Data()
+	case avpTypeLocalSessionID:
+		m.LocalSessionID, err = a.decodeUint32Data()
+	case avpTypeRemoteSessionID:
+		m.RemoteSessionID, err = a.decodeUint32Data()
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func (m *CDN) encodeAVPs(e *messageEncoder) {
+	e.resultCode(avpTypeResultCode, m.ResultCode)
+	e.uint16(avpTypeSessionID, m.AssignedSessionID)
+	e.uint32(avpTypeLocalSessionID, m.LocalSessionID)
+	e.uint32(avpTypeRemoteSessionID, m.RemoteSessionID)
+}
+
+func (m *WEN) decodeAVP(a *avp) (ok bool, err error) {
+	switch a.getType() {
+	case avpTypeCallErrors:
+		m.CallErrors, err = decodeCallErrors(a)
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func (m *WEN) encodeAVPs(e *messageEncoder) {
+	e.callErrors(avpTypeCallErrors, m.CallErrors)
+}
+
+func (m *SLI) decodeAVP(a *avp) (ok bool, err error) {
+	switch a.getType() {
+	case avpTypeAccm:
+		m.ACCM, err = decodeACCM(a)
+	case avpTypeLocalSessionID:
+		m.LocalSessionID, err = a.decodeUint32Data()
+	case avpTypeRemoteSessionID:
+		m.RemoteSessionID, err = a.decodeUint32Data()
+	case avpTypeCircuitStatus:
+		m.CircuitStatus, err = a.decodeUint16Data()
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func (m *SLI) encodeAVPs(e *messageEncoder) {
+	e.accm(avpTypeAccm, m.ACCM)
+	e.uint32(avpTypeLocalSessionID, m.LocalSessionID)
+	e.uint32(avpTypeRemoteSessionID, m.RemoteSessionID)
+	e.uint16(avpTypeCircuitStatus, m.CircuitStatus)
+}
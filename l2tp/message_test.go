@@ -0,0 +1,436 @@
+package l2tp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMessageMarshalParse(t *testing.T) {
+	cases := []struct {
+		name string
+		in   Message
+	}{
+		{
+			name: "L2TPv2 SCCRQ",
+			in: &SCCRQ{
+				MessageHeader: MessageHeader{
+					Version: ProtocolVersion2,
+					Ns:      1,
+				},
+				ProtocolVersion:  []byte{0x01, 0x00},
+				FramingCap:       0x3,
+				HostName:         "lac.example.com",
+				AssignedTunnelID: 42,
+				Tiebreaker:       0x1122334455667788,
+			},
+		},
+		{
+			name: "L2TPv3 SCCRQ",
+			in: &SCCRQ{
+				MessageHeader: MessageHeader{
+					Version: ProtocolVersion3,
+				},
+				HostName:       "lcce.example.com",
+				RouterID:       0x0a000001,
+				AssignedConnID: 90210,
+				PseudowireCaps: []uint16{0x0005, 0x0007},
+			},
+		},
+		{
+			name: "L2TPv3 fallback SCCRQ",
+			in: &SCCRQ{
+				MessageHeader: MessageHeader{
+					Version: ProtocolVersion3Fallback,
+				},
+				ProtocolVersion:  []byte{0x01, 0x00},
+				FramingCap:       0x3,
+				HostName:         "lcce.example.com",
+				AssignedTunnelID: 42,
+				RouterID:         0x0a000001,
+				AssignedConnID:   90210,
+				PseudowireCaps:   []uint16{0x0005},
+			},
+		},
+		{
+			name: "L2TPv3 ICRQ",
+			in: &ICRQ{
+				MessageHeader: MessageHeader{
+					Version:  ProtocolVersion3,
+					TunnelID: 1234,
+					Ns:       2,
+					Nr:       1,
+				},
+				LocalSessionID:   5678,
+				CallSerialNumber: 1,
+				PseudowireType:   0x0005,
+			},
+		},
+		{
+			name: "L2TPv2 StopCCN",
+			in: &StopCCN{
+				MessageHeader: MessageHeader{
+					Version:  ProtocolVersion2,
+					TunnelID: 12,
+				},
+				AssignedTunnelID: 42,
+				ResultCode: ResultCode{
+					Result:       2,
+					ErrorCode:    3,
+					ErrorMessage: "bad value",
+				},
+			},
+		},
+		{
+			name: "L2TPv2 ICCN",
+			in: &ICCN{
+				MessageHeader: MessageHeader{
+					Version:   ProtocolVersion2,
+					TunnelID:  12,
+					SessionID: 13,
+				},
+				FramingType:        0x1,
+				ConnectSpeed:       100000000,
+				SequencingRequired: true,
+			},
+		},
+		{
+			name: "L2TPv2 WEN",
+			in: &WEN{
+				MessageHeader: MessageHeader{
+					Version:   ProtocolVersion2,
+					TunnelID:  12,
+					SessionID: 13,
+				},
+				CallErrors: CallErrors{
+					CRCErrors:       1,
+					FramingErrors:   2,
+					AlignmentErrors: 6,
+				},
+			},
+		},
+		{
+			name: "L2TPv2 SLI",
+			in: &SLI{
+				MessageHeader: MessageHeader{
+					Version:   ProtocolVersion2,
+					TunnelID:  12,
+					SessionID: 13,
+				},
+				ACCM: ACCM{
+					SendACCM: 0xffffffff,
+					RecvACCM: 0x000a0000,
+				},
+			},
+		},
+		{
+			name: "L2TPv3 SLI",
+			in: &SLI{
+				MessageHeader: MessageHeader{
+					Version:  ProtocolVersion3,
+					TunnelID: 1234,
+				},
+				LocalSessionID:  5678,
+				RemoteSessionID: 8765,
+				CircuitStatus:   0x1,
+			},
+		},
+		{
+			name: "L2TPv3 Hello",
+			in: &Hello{
+				MessageHeader: MessageHeader{
+					Version:  ProtocolVersion3,
+					TunnelID: 1234,
+				},
+			},
+		},
+		{
+			name: "L2TPv2 ZLB",
+			in: &GenericMessage{
+				MessageHeader: MessageHeader{
+					Version:  ProtocolVersion2,
+					TunnelID: 12,
+					Ns:       3,
+					Nr:       4,
+				},
+				MsgType: MessageTypeAck,
+			},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			b, err := MarshalMessage(c.in)
+			if err != nil {
+				t.Fatalf("MarshalMessage(%v): %v", c.in, err)
+			}
+			got, err := ParseMessages(b)
+			if err != nil {
+				t.Fatalf("ParseMessages(%v): %v", b, err)
+			}
+			if len(got) != 1 {
+				t.Fatalf("ParseMessages(%v): expected 1 message, got %d", b, len(got))
+			}
+			if !reflect.DeepEqual(got[0], c.in) {
+				t.Fatalf("ParseMessages(%v): got %+v, want %+v", b, got[0], c.in)
+			}
+		})
+	}
+}
+
+func TestMessageFallbackSCCRQ(t *testing.T) {
+	b, err := MarshalMessage(&SCCRQ{
+		MessageHeader:    MessageHeader{Version: ProtocolVersion3Fallback},
+		ProtocolVersion:  []byte{0x01, 0x00},
+		FramingCap:       0x3,
+		HostName:         "lcce.example.com",
+		AssignedTunnelID: 42,
+		RouterID:         0x0a000001,
+		AssignedConnID:   90210,
+		PseudowireCaps:   []uint16{0x0005},
+	})
+	if err != nil {
+		t.Fatalf("MarshalMessage(): %v", err)
+	}
+
+	msgs, err := parseMessageBuffer(b)
+	if err != nil {
+		t.Fatalf("parseMessageBuffer(): %v", err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+
+	// The message uses L2TPv2 framing, and an L2TPv2 peer must be
+	// able to ignore the L2TPv3 AVPs
+	if v := msgs[0].protocolVersion(); v != ProtocolVersion2 {
+		t.Errorf("expected L2TPv2 framing, got version %v", v)
+	}
+	for _, a := range msgs[0].getAvps() {
+		if isV3OnlyAvp(a.getType()) && a.isMandatory() {
+			t.Errorf("L2TPv3 AVP %v has the mandatory bit set", a.getType())
+		}
+	}
+
+	// Without the L2TPv3 AVPs it's an ordinary L2TPv2 SCCRQ
+	b, err = MarshalMessage(&SCCRQ{
+		MessageHeader:    MessageHeader{Version: ProtocolVersion2},
+		ProtocolVersion:  []byte{0x01, 0x00},
+		FramingCap:       0x3,
+		HostName:         "lac.example.com",
+		AssignedTunnelID: 42,
+	})
+	if err != nil {
+		t.Fatalf("MarshalMessage(): %v", err)
+	}
+	parsed, err := ParseMessages(b)
+	if err != nil {
+		t.Fatalf("ParseMessages(): %v", err)
+	}
+	if v := parsed[0].Header().Version; v != ProtocolVersion2 {
+		t.Errorf("expected an L2TPv2 SCCRQ, got version %v", v)
+	}
+}
+
+func TestMessageVendorAVP(t *testing.T) {
+	defer resetVendorAVPRegistry()
+
+	err := RegisterVendorAVP(VendorAVPInfo{VendorID: 9, Type: 1, DataType: AVPDataTypeString})
+	if err != nil {
+		t.Fatalf("RegisterVendorAVP(): %v", err)
+	}
+	a, err := NewVendorAVP(9, 1, "vendor data")
+	if err != nil {
+		t.Fatalf("NewVendorAVP(): %v", err)
+	}
+
+	b, err := MarshalMessage(&Hello{
+		MessageHeader: MessageHeader{
+			Version:   ProtocolVersion3,
+			TunnelID:  1,
+			ExtraAVPs: []AVP{*a},
+		},
+	})
+	if err != nil {
+		t.Fatalf("MarshalMessage(): %v", err)
+	}
+
+	msgs, err := ParseMessages(b)
+	if err != nil {
+		t.Fatalf("ParseMessages(): %v", err)
+	}
+	extra := msgs[0].Header().ExtraAVPs
+	if len(extra) != 1 {
+		t.Fatalf("expected 1 extra AVP, got %v", extra)
+	}
+	s, err := extra[0].DecodeString()
+	if err != nil || s != "vendor data" {
+		t.Fatalf("DecodeString(): got %q, %v", s, err)
+	}
+}
+
+func TestMessageParseCapture(t *testing.T) {
+	// L2TPv3 SCCRQ from msg_test.go
+	in := []byte{
+		0xc8, 0x03, 0x00, 0x7c, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x80, 0x08, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x01, 0x80, 0x0c, 0x00, 0x00,
+		0x00, 0x07, 0x6f, 0x70, 0x65, 0x6e, 0x76, 0x33,
+		0x00, 0x34, 0x00, 0x00, 0x00, 0x08, 0x70, 0x72,
+		0x6f, 0x6c, 0x32, 0x74, 0x70, 0x20, 0x31, 0x2e,
+		0x37, 0x2e, 0x33, 0x20, 0x4c, 0x69, 0x6e, 0x75,
+		0x78, 0x2d, 0x33, 0x2e, 0x31, 0x33, 0x2e, 0x30,
+		0x2d, 0x33, 0x30, 0x2d, 0x67, 0x65, 0x6e, 0x65,
+		0x72, 0x69, 0x63, 0x20, 0x28, 0x78, 0x38, 0x36,
+		0x5f, 0x36, 0x34, 0x29, 0x80, 0x08, 0x00, 0x00,
+		0x00, 0x0a, 0x00, 0x0a, 0x00, 0x0a, 0x00, 0x00,
+		0x00, 0x3c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0a,
+		0x00, 0x00, 0x00, 0x3d, 0x28, 0x46, 0xf1, 0x81,
+		0x00, 0x0c, 0x00, 0x00, 0x00, 0x3e, 0x00, 0x07,
+		0x00, 0x05, 0x00, 0x04,
+	}
+	msgs, err := ParseMessages(in)
+	if err != nil {
+		t.Fatalf("ParseMessages(): %v", err)
+	}
+	sccrq, ok := msgs[0].(*SCCRQ)
+	if !ok {
+		t.Fatalf("expected SCCRQ, got %v", msgs[0].Type())
+	}
+	if sccrq.HostName != "openv3" {
+		t.Errorf("HostName: got %q, want %q", sccrq.HostName, "openv3")
+	}
+	if sccrq.AssignedConnID != 0x2846f181 {
+		t.Errorf("AssignedConnID: got %#x, want %#x", sccrq.AssignedConnID, 0x2846f181)
+	}
+	if !reflect.DeepEqual(sccrq.PseudowireCaps, []uint16{7, 5, 4}) {
+		t.Errorf("PseudowireCaps: got %v", sccrq.PseudowireCaps)
+	}
+}
+
+func TestMessageParseInvalid(t *testing.T) {
+	cases := []struct {
+		name string
+		in   []byte
+		estr string
+	}{
+		{
+			name: "missing required AVP",
+			// L2TPv3 StopCCN with no Result Code AVP
+			in: []byte{
+				0xc8, 0x03, 0x00, 0x14, 0x00, 0x00, 0x00, 0x01,
+				0x00, 0x00, 0x00, 0x00, 0x80, 0x08, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x04,
+			},
+			estr: "missing required AVP avpTypeResultCode",
+		},
+		{
+			name: "missing circuit status",
+			// L2TPv3 CSUN with no Circuit Status AVP
+			in: []byte{
+				0xc8, 0x03, 0x00, 0x28, 0x00, 0x00, 0x00, 0x01,
+				0x00, 0x00, 0x00, 0x00, 0x80, 0x08, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x1c, 0x00, 0x0a, 0x00, 0x00,
+				0x00, 0x3f, 0x00, 0x00, 0x00, 0x14, 0x00, 0x0a,
+				0x00, 0x00, 0x00, 0x40, 0x00, 0x00, 0x00, 0x0a,
+			},
+			estr: "missing required AVP avpTypeCircuitStatus",
+		},
+		{
+			name: "duplicate AVP",
+			// L2TPv2 ICRP with two Assigned Session ID AVPs
+			in: []byte{
+				0xc8, 0x02, 0x00, 0x24, 0x00, 0x01, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x80, 0x08, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x0b, 0x80, 0x08, 0x00, 0x00,
+				0x00, 0x0e, 0x00, 0x01, 0x80, 0x08, 0x00, 0x00,
+				0x00, 0x0e, 0x00, 0x02,
+			},
+			estr: "duplicate AVP avpTypeSessionID",
+		},
+		{
+			name: "truncated message type",
+			// L2TPv2 message with a one octet Message Type AVP
+			in: []byte{
+				0xc8, 0x02, 0x00, 0x13, 0x00, 0x01, 0x00, 0x00,
+				0x00, 0x00, 0x00, 0x00, 0x80, 0x07, 0x00, 0x00,
+				0x00, 0x00, 0x06,
+			},
+			estr: "invalid L2TPv2 message",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := ParseMessages(c.in)
+			if err == nil {
+				t.Fatalf("ParseMessages(%v) succeeded when we expected an error", c.in)
+			}
+			if !strings.Contains(err.Error(), c.estr) {
+				t.Fatalf("ParseMessages(%v): error %q doesn't contain %q", c.in, err, c.estr)
+			}
+		})
+	}
+}
+
+func TestMessageValidation(t *testing.T) {
+	cases := []struct {
+		name string
+		in   Message
+		estr string
+	}{
+		{
+			name: "forbidden AVP",
+			in: &StopCCN{
+				MessageHeader:    MessageHeader{Version: ProtocolVersion3},
+				AssignedTunnelID: 42,
+			},
+			estr: "forbidden AVP avpTypeTunnelID",
+		},
+		{
+			name: "fallback mode for a message other than SCCRQ",
+			in: &Hello{
+				MessageHeader: MessageHeader{Version: ProtocolVersion3Fallback},
+			},
+			estr: "fallback mode is not supported",
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := MarshalMessage(c.in)
+			if err == nil {
+				t.Fatalf("MarshalMessage(%v) succeeded when we expected an error", c.in)
+			}
+			if !strings.Contains(err.Error(), c.estr) {
+				t.Fatalf("MarshalMessage(%v): error %q doesn't contain %q", c.in, err, c.estr)
+			}
+		})
+	}
+}
+
+func TestDecodeRawMessages(t *testing.T) {
+	// L2TPv3 StopCCN with no Result Code AVP, which ParseMessages rejects
+	in := []byte{
+		0xc8, 0x03, 0x00, 0x14, 0x00, 0x00, 0x00, 0x01,
+		0x00, 0x02, 0x00, 0x03, 0x80, 0x08, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x04,
+	}
+	msgs, err := DecodeRawMessages(in)
+	if err != nil {
+		t.Fatalf("DecodeRawMessages(): %v", err)
+	}
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %v", len(msgs))
+	}
+	m := msgs[0]
+	if m.Version != ProtocolVersion3 || m.Type != MessageTypeStopCCN ||
+		m.TunnelID != 1 || m.Ns != 2 || m.Nr != 3 || m.Length != len(in) {
+		t.Errorf("unexpected header: %v", m)
+	}
+	if len(m.AVPs) != 1 || m.AVPs[0].TypeName() != "avpTypeMessage" ||
+		!m.AVPs[0].IsMandatory() || m.AVPs[0].Value() != "avpMsgTypeStopccn" {
+		t.Errorf("unexpected AVPs: %v", m.AVPs)
+	}
+	err = m.Validate()
+	if err == nil || !strings.Contains(err.Error(), "missing required AVP avpTypeResultCode") {
+		t.Errorf("Validate(): expected missing result code, got %v", err)
+	}
+}
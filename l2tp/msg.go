@@ -76,58 +76,101 @@ func newL2tpV3MessageHeader(ccid uint32, ns, nr uint16, payloadBytes int) *l2tpV
 	}
 }
 
-func bytesToV2CtlMsg(b []byte) (msg *v2ControlMessage, err error) {
+// decodeCommonHeader decodes the header fields common to L2TPv2 and
+// L2TPv3 from the start of b.
+func decodeCommonHeader(b []byte) (h l2tpCommonHeader, err error) {
+	if len(b) < commonHeaderLen {
+		return h, io.ErrUnexpectedEOF
+	}
+	h.FlagsVer = binary.BigEndian.Uint16(b[0:])
+	h.Len = binary.BigEndian.Uint16(b[2:])
+	return h, nil
+}
+
+// The message headers are decoded directly from the frame rather than
+// using binary.Read, which allocates on each call.  Similarly the AVPs
+// refer to the frame rather than holding copies of their payloads.
+
+// decodeV2CtlMsg decodes an L2TPv2 message from b into msg, appending
+// its AVPs to avps.
+func decodeV2CtlMsg(msg *v2ControlMessage, avps []avp, b []byte) ([]avp, error) {
 	var hdr l2tpV2Header
-	var avps []avp
+	var err error
 
-	r := bytes.NewReader(b)
-	if err = binary.Read(r, binary.BigEndian, &hdr); err != nil {
-		return nil, err
+	if len(b) < v2HeaderLen {
+		return avps, io.ErrUnexpectedEOF
+	}
+	if hdr.Common, err = decodeCommonHeader(b); err != nil {
+		return avps, err
 	}
+	hdr.Tid = binary.BigEndian.Uint16(b[4:])
+	hdr.Sid = binary.BigEndian.Uint16(b[6:])
+	hdr.Ns = binary.BigEndian.Uint16(b[8:])
+	hdr.Nr = binary.BigEndian.Uint16(b[10:])
 
 	// Messages with no AVP payload are treated as ZLB (zero-length-body) ack messages,
 	// so they're valid L2TPv2 messages.  Don't try to parse the AVP payload in this case.
+	var msgAvps []avp
 	if hdr.Common.Len > v2HeaderLen {
-		if avps, err = parseAVPBuffer(b[v2HeaderLen:hdr.Common.Len]); err != nil {
-			return nil, err
+		start := len(avps)
+		if avps, err = appendAVPs(avps, b[v2HeaderLen:hdr.Common.Len]); err != nil {
+			return avps, err
 		}
+		msgAvps = avps[start:len(avps):len(avps)]
 		// RFC2661 says the first AVP in the message MUST be the Message Type AVP,
 		// so let's validate that now
 		// TODO: we need to do real actual validation
-		if avps[0].getType() != avpTypeMessage {
-			return nil, errors.New("invalid L2TPv2 message: first AVP is not Message Type AVP")
+		if msgAvps[0].getType() != avpTypeMessage {
+			return avps, errors.New("invalid L2TPv2 message: first AVP is not Message Type AVP")
+		}
+		if _, err = msgAvps[0].decodeMsgType(); err != nil {
+			return avps, fmt.Errorf("invalid L2TPv2 message: %v", err)
 		}
 	}
 
-	return &v2ControlMessage{
+	*msg = v2ControlMessage{
 		header: hdr,
-		avps:   avps,
-	}, nil
+		avps:   msgAvps,
+	}
+	return avps, nil
 }
 
-func bytesToV3CtlMsg(b []byte) (msg *v3ControlMessage, err error) {
+// decodeV3CtlMsg decodes an L2TPv3 message from b into msg, appending
+// its AVPs to avps.
+func decodeV3CtlMsg(msg *v3ControlMessage, avps []avp, b []byte) ([]avp, error) {
 	var hdr l2tpV3Header
-	var avps []avp
+	var err error
 
-	r := bytes.NewReader(b)
-	if err = binary.Read(r, binary.BigEndian, &hdr); err != nil {
-		return nil, err
+	if len(b) < v3HeaderLen {
+		return avps, io.ErrUnexpectedEOF
+	}
+	if hdr.Common, err = decodeCommonHeader(b); err != nil {
+		return avps, err
 	}
+	hdr.Ccid = binary.BigEndian.Uint32(b[4:])
+	hdr.Ns = binary.BigEndian.Uint16(b[8:])
+	hdr.Nr = binary.BigEndian.Uint16(b[10:])
 
-	if avps, err = parseAVPBuffer(b[v3HeaderLen:hdr.Common.Len]); err != nil {
-		return nil, err
+	start := len(avps)
+	if avps, err = appendAVPs(avps, b[v3HeaderLen:hdr.Common.Len]); err != nil {
+		return avps, err
 	}
+	msgAvps := avps[start:len(avps):len(avps)]
 
 	// RFC3931 says the first AVP in the message MUST be the Message Type AVP,
 	// so let's validate that now
-	if avps[0].getType() != avpTypeMessage {
-		return nil, errors.New("invalid L2TPv3 message: first AVP is not Message Type AVP")
+	if msgAvps[0].getType() != avpTypeMessage {
+		return avps, errors.New("invalid L2TPv3 message: first AVP is not Message Type AVP")
+	}
+	if _, err = msgAvps[0].decodeMsgType(); err != nil {
+		return avps, fmt.Errorf("invalid L2TPv3 message: %v", err)
 	}
 
-	return &v3ControlMessage{
+	*msg = v3ControlMessage{
 		header: hdr,
-		avps:   avps,
-	}, nil
+		avps:   msgAvps,
+	}
+	return avps, nil
 }
 
 // controlMessage is an interface representing a generic L2TP
@@ -343,55 +386,120 @@ func (m *v3ControlMessage) toBytes() ([]byte, error) {
 
 // parseMessageBuffer takes a byte slice of L2TP control message data and
 // parses it into an array of controlMessage instances.
+//
+// The messages refer to b rather than copying it, so b must not be
+// modified while they are in use: c.f. retainMessage.
 func parseMessageBuffer(b []byte) (messages []controlMessage, err error) {
-	r := bytes.NewReader(b)
-	for r.Len() >= controlMessageMinLen {
+	var p messageParser
+	return p.parse(b)
+}
+
+// messageParser parses control messages into storage which is reused
+// from one call of parse to the next, so that once the storage has grown
+// to fit the frames received, parsing doesn't allocate.  The messages
+// parse returns are only valid until parse is next called, and refer to
+// the parsed buffer: c.f. retainMessage.
+type messageParser struct {
+	messages []controlMessage
+	v2       []v2ControlMessage
+	v3       []v3ControlMessage
+	avps     []avp
+}
+
+// parse is like parseMessageBuffer, but the messages are only valid
+// until parse is next called.
+func (p *messageParser) parse(b []byte) (messages []controlMessage, err error) {
+	p.messages = p.messages[:0]
+	p.v2 = p.v2[:0]
+	p.v3 = p.v3[:0]
+	p.avps = p.avps[:0]
+
+	for cursor := 0; len(b)-cursor >= controlMessageMinLen; {
 		var ver nll2tp.L2tpProtocolVersion
-		var h l2tpCommonHeader
-		var cursor int64
-
-		if cursor, err = r.Seek(0, io.SeekCurrent); err != nil {
-			return nil, errors.New("malformed message buffer: unable to determine current offset")
-		}
 
 		// Read the common part of the header: this will tell us the
 		// protocol version and the length of the complete frame
-		if err := binary.Read(r, binary.BigEndian, &h); err != nil {
+		h, err := decodeCommonHeader(b[cursor:])
+		if err != nil {
 			return nil, err
 		}
 
 		// Throw out malformed packets
-		if int(h.Len-commonHeaderLen) > r.Len() {
-			return nil, fmt.Errorf("malformed header: length %d exceeds buffer bounds of %d", h.Len, r.Len())
+		remaining := len(b) - cursor - commonHeaderLen
+		if int(h.Len) < commonHeaderLen || int(h.Len-commonHeaderLen) > remaining {
+			return nil, fmt.Errorf("malformed header: length %d exceeds buffer bounds of %d", h.Len, remaining)
 		}
 
-		// Figure out the protocol version, and read the message
+		// Figure out the protocol version, and read the message.
+		// Growing the message arrays leaves the messages already parsed
+		// in the old arrays, which is fine since they aren't reused
+		// until parse is next called.
 		if ver, err = h.protocolVersion(); err != nil {
 			return nil, err
 		}
 
+		frame := b[cursor : cursor+int(h.Len)]
 		if ver == nll2tp.ProtocolVersion2 {
-			var msg *v2ControlMessage
-			if msg, err = bytesToV2CtlMsg(b[cursor : cursor+int64(h.Len)]); err != nil {
+			p.v2 = append(p.v2, v2ControlMessage{})
+			msg := &p.v2[len(p.v2)-1]
+			if p.avps, err = decodeV2CtlMsg(msg, p.avps, frame); err != nil {
 				return nil, err
 			}
-			messages = append(messages, msg)
+			p.messages = append(p.messages, msg)
 		} else if ver == nll2tp.ProtocolVersion3 {
-			var msg *v3ControlMessage
-			if msg, err = bytesToV3CtlMsg(b[cursor : cursor+int64(+h.Len)]); err != nil {
+			p.v3 = append(p.v3, v3ControlMessage{})
+			msg := &p.v3[len(p.v3)-1]
+			if p.avps, err = decodeV3CtlMsg(msg, p.avps, frame); err != nil {
 				return nil, err
 			}
-			messages = append(messages, msg)
+			p.messages = append(p.messages, msg)
 		} else {
 			panic("Unhandled protocol version")
 		}
 
 		// Step on to the next message in the buffer, if any
-		if _, err := r.Seek(int64(h.Len), io.SeekCurrent); err != nil {
-			return nil, errors.New("malformed message buffer: invalid length for current message")
-		}
+		cursor += int(h.Len)
 	}
-	return messages, nil
+	return p.messages, nil
+}
+
+// retainMessage copies a message parsed by parseMessageBuffer or a
+// messageParser, so that the copy remains valid once the parsed buffer
+// and the parser's storage are reused.  The AVP payloads of the copy
+// are held in a single allocation.
+func retainMessage(msg controlMessage) controlMessage {
+	avps := msg.getAvps()
+	n := 0
+	for i := range avps {
+		n += len(avps[i].payload.data)
+	}
+	buf := make([]byte, n)
+	retained := make([]avp, len(avps))
+	for i := range avps {
+		retained[i] = avps[i]
+		l := copy(buf, avps[i].payload.data)
+		retained[i].payload.data = buf[:l:l]
+		buf = buf[l:]
+	}
+
+	switch m := msg.(type) {
+	case *v2ControlMessage:
+		return &v2ControlMessage{header: m.header, avps: retained}
+	case *v3ControlMessage:
+		return &v3ControlMessage{header: m.header, avps: retained}
+	}
+	panic("Unhandled control message type")
+}
+
+// checkMessageTypeAvp checks that the Message Type AVP leads the AVPs
+// for a new message.  The AVPs for a given message type are checked
+// against the message schema by validateMessage once the message has
+// been fully built.
+func checkMessageTypeAvp(avps []avp) error {
+	if len(avps) > 0 && (avps[0].vendorID() != vendorIDIetf || avps[0].getType() != avpTypeMessage) {
+		return errors.New("first AVP is not Message Type AVP")
+	}
+	return nil
 }
 
 // newV2ControlMessage builds a new control message
@@ -402,7 +510,9 @@ func newV2ControlMessage(tid ControlConnID, sid ControlConnID, avps []avp) (msg
 	if sid > v2TidSidMax {
 		return nil, fmt.Errorf("v2 session ID %v out of range", sid)
 	}
-	// TODO: validate AVPs
+	if err = checkMessageTypeAvp(avps); err != nil {
+		return nil, err
+	}
 	return &v2ControlMessage{
 		header: *newL2tpV2MessageHeader(uint16(tid), uint16(sid), 0, 0, avpsLengthBytes(avps)),
 		avps:   avps,
@@ -411,9 +521,123 @@ func newV2ControlMessage(tid ControlConnID, sid ControlConnID, avps []avp) (msg
 
 // newV3ControlMessage builds a new control message
 func newV3ControlMessage(ccid ControlConnID, avps []avp) (msg *v3ControlMessage, err error) {
-	// TODO: validate AVPs
+	if err = checkMessageTypeAvp(avps); err != nil {
+		return nil, err
+	}
 	return &v3ControlMessage{
 		header: *newL2tpV3MessageHeader(uint32(ccid), 0, 0, avpsLengthBytes(avps)),
 		avps:   avps,
 	}, nil
 }
+
+// newStopCCNMessage builds a StopCCN message for sending to the peer.
+// The local control connection ID is reported to the peer using the
+// Assigned Tunnel ID or Assigned Control Connection ID AVPs, and may be
+// zero if the peer has yet to be told it.
+func newStopCCNMessage(version ProtocolVersion,
+	localCCID, peerCCID ControlConnID,
+	rc resultCode) (msg controlMessage, err error) {
+
+	var idAvp *avp
+
+	msgAvp, err := newAvp(vendorIDIetf, avpTypeMessage, avpMsgTypeStopccn)
+	if err != nil {
+		return nil, err
+	}
+	rcAvp, err := newAvp(vendorIDIetf, avpTypeResultCode, rc)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == ProtocolVersion2 {
+		idAvp, err = newAvp(vendorIDIetf, avpTypeTunnelID, uint16(localCCID))
+		if err != nil {
+			return nil, err
+		}
+		msg, err = newV2ControlMessage(peerCCID, 0, []avp{*msgAvp, *idAvp, *rcAvp})
+	} else {
+		idAvp, err = newAvp(vendorIDIetf, avpTypeAssignedConnID, uint32(localCCID))
+		if err != nil {
+			return nil, err
+		}
+		msg, err = newV3ControlMessage(peerCCID, []avp{*msgAvp, *idAvp, *rcAvp})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// newCDNMessage builds a CDN message for sending to the peer.
+// The session IDs are reported to the peer using the Assigned Session ID
+// AVP and header session ID for L2TPv2, or the Local and Remote Session ID
+// AVPs for L2TPv3.
+func newCDNMessage(version ProtocolVersion,
+	peerCCID, localSID, peerSID ControlConnID,
+	rc resultCode) (msg controlMessage, err error) {
+
+	msgAvp, err := newAvp(vendorIDIetf, avpTypeMessage, avpMsgTypeCdn)
+	if err != nil {
+		return nil, err
+	}
+	rcAvp, err := newAvp(vendorIDIetf, avpTypeResultCode, rc)
+	if err != nil {
+		return nil, err
+	}
+
+	if version == ProtocolVersion2 {
+		sidAvp, err := newAvp(vendorIDIetf, avpTypeSessionID, uint16(localSID))
+		if err != nil {
+			return nil, err
+		}
+		msg, err = newV2ControlMessage(peerCCID, peerSID, []avp{*msgAvp, *rcAvp, *sidAvp})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		lsidAvp, err := newAvp(vendorIDIetf, avpTypeLocalSessionID, uint32(localSID))
+		if err != nil {
+			return nil, err
+		}
+		rsidAvp, err := newAvp(vendorIDIetf, avpTypeRemoteSessionID, uint32(peerSID))
+		if err != nil {
+			return nil, err
+		}
+		msg, err = newV3ControlMessage(peerCCID, []avp{*msgAvp, *rcAvp, *lsidAvp, *rsidAvp})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return msg, nil
+}
+
+// newCircuitStatusMessage builds an SLI or CSUN message reporting the
+// status of a session's attachment circuit to the peer.  The session IDs
+// are reported using the Local and Remote Session ID AVPs, so circuit
+// status messages are L2TPv3 only.
+func newCircuitStatusMessage(msgType avpMsgType,
+	peerCCID, localSID, peerSID ControlConnID,
+	status circuitStatus) (msg controlMessage, err error) {
+
+	msgAvp, err := newAvp(vendorIDIetf, avpTypeMessage, msgType)
+	if err != nil {
+		return nil, err
+	}
+	lsidAvp, err := newAvp(vendorIDIetf, avpTypeLocalSessionID, uint32(localSID))
+	if err != nil {
+		return nil, err
+	}
+	rsidAvp, err := newAvp(vendorIDIetf, avpTypeRemoteSessionID, uint32(peerSID))
+	if err != nil {
+		return nil, err
+	}
+	csAvp, err := newAvp(vendorIDIetf, avpTypeCircuitStatus, uint16(status))
+	if err != nil {
+		return nil, err
+	}
+	msg, err = newV3ControlMessage(peerCCID, []avp{*msgAvp, *lsidAvp, *rsidAvp, *csAvp})
+	if err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
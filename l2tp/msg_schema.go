@@ -0,0 +1,337 @@
+package l2tp
+
+import (
+	"fmt"
+
+	"github.com/katalix/go-l2tp/internal/nll2tp"
+)
+
+// msgSchema describes the AVPs which must and must not be present
+// in a given control message.  Any AVP not listed as required or
+// forbidden is optional.
+type msgSchema struct {
+	required  []avpType
+	forbidden []avpType
+}
+
+type msgSchemaKey struct {
+	version nll2tp.L2tpProtocolVersion
+	msgType avpMsgType
+}
+
+// AVPs which are specific to one protocol version.
+var (
+	v2OnlyAvps = []avpType{
+		avpTypeProtocolVersion,
+		avpTypeTunnelID,
+		avpTypeSessionID,
+	}
+	v3OnlyAvps = []avpType{
+		avpTypeRouterID,
+		avpTypeAssignedConnID,
+		avpTypePseudowireCaps,
+		avpTypeLocalSessionID,
+		avpTypeRemoteSessionID,
+		avpTypeAssignedCookie,
+		avpTypeRemoteEndID,
+		avpTypePseudowireType,
+		avpTypeL2specificSublayer,
+		avpTypeDataSequencing,
+	}
+	// Session AVPs are forbidden in control connection messages
+	v2SessionAvps = []avpType{
+		avpTypeSessionID,
+		avpTypeCallSerialNumber,
+	}
+	v3SessionAvps = []avpType{
+		avpTypeLocalSessionID,
+		avpTypeRemoteSessionID,
+		avpTypeCallSerialNumber,
+	}
+)
+
+func avpTypes(lists ...[]avpType) (out []avpType) {
+	for _, l := range lists {
+		out = append(out, l...)
+	}
+	return
+}
+
+// msgSchemaTable describes the control messages per RFC2661 section 6
+// and RFC3931 section 6.
+var msgSchemaTable = map[msgSchemaKey]msgSchema{
+	// RFC2661 control connection management
+	{nll2tp.ProtocolVersion2, avpMsgTypeSccrq}: {
+		required: []avpType{avpTypeProtocolVersion, avpTypeHostName,
+			avpTypeFramingCap, avpTypeTunnelID},
+		forbidden: avpTypes(v3OnlyAvps, v2SessionAvps),
+	},
+	{nll2tp.ProtocolVersion2, avpMsgTypeSccrp}: {
+		required: []avpType{avpTypeProtocolVersion, avpTypeHostName,
+			avpTypeFramingCap, avpTypeTunnelID},
+		forbidden: avpTypes(v3OnlyAvps, v2SessionAvps),
+	},
+	{nll2tp.ProtocolVersion2, avpMsgTypeScccn}: {
+		forbidden: avpTypes(v3OnlyAvps, v2SessionAvps),
+	},
+	{nll2tp.ProtocolVersion2, avpMsgTypeStopccn}: {
+		required:  []avpType{avpTypeTunnelID, avpTypeResultCode},
+		forbidden: avpTypes(v3OnlyAvps, v2SessionAvps),
+	},
+	{nll2tp.ProtocolVersion2, avpMsgTypeHello}: {
+		forbidden: avpTypes(v3OnlyAvps, v2SessionAvps),
+	},
+	// RFC2661 call management
+	{nll2tp.ProtocolVersion2, avpMsgTypeIcrq}: {
+		required:  []avpType{avpTypeSessionID, avpTypeCallSerialNumber},
+		forbidden: avpTypes(v3OnlyAvps, []avpType{avpTypeTunnelID}),
+	},
+	{nll2tp.ProtocolVersion2, avpMsgTypeIcrp}: {
+		required:  []avpType{avpTypeSessionID},
+		forbidden: avpTypes(v3OnlyAvps, []avpType{avpTypeTunnelID}),
+	},
+	{nll2tp.ProtocolVersion2, avpMsgTypeIccn}: {
+		required:  []avpType{avpTypeConnectSpeed, avpTypeFramingType},
+		forbidden: avpTypes(v3OnlyAvps, []avpType{avpTypeTunnelID}),
+	},
+	{nll2tp.ProtocolVersion2, avpMsgTypeCdn}: {
+		required:  []avpType{avpTypeResultCode, avpTypeSessionID},
+		forbidden: avpTypes(v3OnlyAvps, []avpType{avpTypeTunnelID}),
+	},
+	{nll2tp.ProtocolVersion2, avpMsgTypeWen}: {
+		required:  []avpType{avpTypeCallErrors},
+		forbidden: avpTypes(v3OnlyAvps, []avpType{avpTypeTunnelID}),
+	},
+	{nll2tp.ProtocolVersion2, avpMsgTypeSli}: {
+		required:  []avpType{avpTypeAccm},
+		forbidden: avpTypes(v3OnlyAvps, []avpType{avpTypeTunnelID}),
+	},
+	// RFC3931 control connection management
+	{nll2tp.ProtocolVersion3, avpMsgTypeSccrq}: {
+		required:  []avpType{avpTypeHostName, avpTypeRouterID, avpTypeAssignedConnID, avpTypePseudowireCaps},
+		forbidden: avpTypes(v2OnlyAvps, v3SessionAvps),
+	},
+	{nll2tp.ProtocolVersion3, avpMsgTypeSccrp}: {
+		required:  []avpType{avpTypeHostName, avpTypeRouterID, avpTypeAssignedConnID, avpTypePseudowireCaps},
+		forbidden: avpTypes(v2OnlyAvps, v3SessionAvps),
+	},
+	{nll2tp.ProtocolVersion3, avpMsgTypeScccn}: {
+		forbidden: avpTypes(v2OnlyAvps, v3SessionAvps),
+	},
+	{nll2tp.ProtocolVersion3, avpMsgTypeStopccn}: {
+		required:  []avpType{avpTypeResultCode},
+		forbidden: avpTypes(v2OnlyAvps, v3SessionAvps),
+	},
+	{nll2tp.ProtocolVersion3, avpMsgTypeHello}: {
+		forbidden: avpTypes(v2OnlyAvps, v3SessionAvps),
+	},
+	// RFC3931 fallback mode: an SCCRQ using L2TPv2 framing carries the
+	// AVPs of both an L2TPv2 and an L2TPv3 SCCRQ
+	{ProtocolVersion3Fallback, avpMsgTypeSccrq}: {
+		required: []avpType{avpTypeProtocolVersion, avpTypeHostName,
+			avpTypeFramingCap, avpTypeTunnelID,
+			avpTypeRouterID, avpTypeAssignedConnID, avpTypePseudowireCaps},
+		forbidden: avpTypes(v2SessionAvps, v3SessionAvps),
+	},
+	// RFC3931 session management
+	{nll2tp.ProtocolVersion3, avpMsgTypeIcrq}: {
+		required: []avpType{avpTypeLocalSessionID, avpTypeRemoteSessionID,
+			avpTypeCallSerialNumber, avpTypePseudowireType},
+		forbidden: avpTypes(v2OnlyAvps, []avpType{avpTypeAssignedConnID}),
+	},
+	{nll2tp.ProtocolVersion3, avpMsgTypeIcrp}: {
+		required:  []avpType{avpTypeLocalSessionID, avpTypeRemoteSessionID, avpTypePseudowireType},
+		forbidden: avpTypes(v2OnlyAvps, []avpType{avpTypeAssignedConnID}),
+	},
+	{nll2tp.ProtocolVersion3, avpMsgTypeIccn}: {
+		required:  []avpType{avpTypeLocalSessionID, avpTypeRemoteSessionID},
+		forbidden: avpTypes(v2OnlyAvps, []avpType{avpTypeAssignedConnID}),
+	},
+	{nll2tp.ProtocolVersion3, avpMsgTypeCdn}: {
+		required:  []avpType{avpTypeResultCode, avpTypeLocalSessionID, avpTypeRemoteSessionID},
+		forbidden: avpTypes(v2OnlyAvps, []avpType{avpTypeAssignedConnID}),
+	},
+	{nll2tp.ProtocolVersion3, avpMsgTypeSli}: {
+		required:  []avpType{avpTypeLocalSessionID, avpTypeRemoteSessionID},
+		forbidden: avpTypes(v2OnlyAvps, []avpType{avpTypeAssignedConnID}),
+	},
+	// Circuit status messages carry the session IDs in the same way
+	// as RFC3931 session management messages
+	{nll2tp.ProtocolVersion3, avpMsgTypeCsun}: {
+		required: []avpType{avpTypeLocalSessionID, avpTypeRemoteSessionID,
+			avpTypeCircuitStatus},
+		forbidden: avpTypes(v2OnlyAvps, []avpType{avpTypeAssignedConnID}),
+	},
+	{nll2tp.ProtocolVersion3, avpMsgTypeCsurq}: {
+		required:  []avpType{avpTypeLocalSessionID, avpTypeRemoteSessionID},
+		forbidden: avpTypes(v2OnlyAvps, []avpType{avpTypeAssignedConnID}),
+	},
+}
+
+// schemaError describes a control message which fails validation against
+// the message schema.
+type schemaError struct {
+	msgType avpMsgType
+	avpType avpType
+	// missing is set if a required AVP is absent, otherwise a forbidden,
+	// duplicated or malformed AVP is present
+	missing bool
+	detail  string
+}
+
+func (e *schemaError) Error() string {
+	if e.missing {
+		return fmt.Sprintf("%v message is missing required AVP %v", e.msgType, e.avpType)
+	}
+	return fmt.Sprintf("%v message has %s AVP %v", e.msgType, e.detail, e.avpType)
+}
+
+// errorCode returns the error code to report to the peer in the Result
+// Code AVP of the StopCCN or CDN message rejecting the invalid message.
+func (e *schemaError) errorCode() avpErrorCode {
+	if e.missing || e.detail == "malformed" {
+		return avpErrorCodeBadLength
+	}
+	return avpErrorCodeBadValue
+}
+
+// getMsgSchema looks up the schema for a control message.
+func getMsgSchema(version nll2tp.L2tpProtocolVersion, msgType avpMsgType) (*msgSchema, bool) {
+	schema, ok := msgSchemaTable[msgSchemaKey{version: version, msgType: msgType}]
+	return &schema, ok
+}
+
+// isV3OnlyAvp returns true if the AVP type is specific to L2TPv3.
+func isV3OnlyAvp(t avpType) bool {
+	for _, v3 := range v3OnlyAvps {
+		if t == v3 {
+			return true
+		}
+	}
+	return false
+}
+
+// messageVersion returns the protocol version of a control message.  An
+// SCCRQ using L2TPv2 framing which carries the L2TPv3 Assigned Control
+// Connection ID AVP is an RFC3931 fallback mode SCCRQ.
+func messageVersion(msg controlMessage) ProtocolVersion {
+	version := ProtocolVersion(msg.protocolVersion())
+	if version != ProtocolVersion2 || msg.getType() != avpMsgTypeSccrq {
+		return version
+	}
+	for _, a := range msg.getAvps() {
+		if a.vendorID() == vendorIDIetf && a.getType() == avpTypeAssignedConnID {
+			return ProtocolVersion3Fallback
+		}
+	}
+	return version
+}
+
+// validateMessage checks a control message against the message schema.
+// Messages for which no schema is defined are considered valid.
+//
+// Messages carrying an unrecognised AVP with the mandatory bit set are
+// invalid whatever the message type.
+func validateMessage(msg controlMessage) error {
+	for _, a := range msg.getAvps() {
+		if !a.isMandatory() {
+			continue
+		}
+		if _, err := getAVPInfo(a.getType(), a.vendorID()); err != nil {
+			return &unknownMandatoryAVPError{vendorID: a.vendorID(), avpType: a.getType()}
+		}
+	}
+
+	msgType := msg.getType()
+	schema, ok := getMsgSchema(nll2tp.L2tpProtocolVersion(messageVersion(msg)), msgType)
+	if !ok {
+		return nil
+	}
+
+	seen := make(map[avpType]bool)
+	for i, a := range msg.getAvps() {
+		if a.vendorID() != vendorIDIetf {
+			continue
+		}
+		t := a.getType()
+		if t == avpTypeMessage && i != 0 {
+			return &schemaError{msgType: msgType, avpType: t, detail: "misplaced"}
+		}
+		if seen[t] {
+			return &schemaError{msgType: msgType, avpType: t, detail: "duplicate"}
+		}
+		seen[t] = true
+		for _, f := range schema.forbidden {
+			if t == f {
+				return &schemaError{msgType: msgType, avpType: t, detail: "forbidden"}
+			}
+		}
+		if !avpIsWellFormed(&a) {
+			return &schemaError{msgType: msgType, avpType: t, detail: "malformed"}
+		}
+	}
+
+	for _, r := range schema.required {
+		if !seen[r] {
+			return &schemaError{msgType: msgType, avpType: r, missing: true}
+		}
+	}
+
+	return nil
+}
+
+// isRequiredAvp returns true if the schema requires the AVP type.
+func (s *msgSchema) isRequiredAvp(t avpType) bool {
+	for _, r := range s.required {
+		if r == t {
+			return true
+		}
+	}
+	return false
+}
+
+// avpIsWellFormed checks that the length of the data carried by an AVP
+// is consistent with its data type.  The data carried by hidden AVPs is
+// obscured and so can't be checked.
+func avpIsWellFormed(a *avp) bool {
+	if a.isHidden() {
+		return true
+	}
+	dt, b := a.rawData()
+	switch dt {
+	case avpDataTypeEmpty:
+		return len(b) == 0
+	case avpDataTypeUint8:
+		return len(b) == 1
+	case avpDataTypeUint16, avpDataTypeMsgID:
+		return len(b) == 2
+	case avpDataTypeUint32:
+		return len(b) == 4
+	case avpDataTypeUint64:
+		return len(b) == 8
+	case avpDataTypeResultCode:
+		return len(b) == 2 || len(b) >= 4
+	case avpDataTypeUint16Array:
+		return len(b)%2 == 0
+	case avpDataTypeQ931CauseCode:
+		return len(b) >= 3
+	case avpDataTypeCallErrors:
+		return len(b) == 26
+	case avpDataTypeACCM:
+		return len(b) == 10
+	}
+	return true
+}
+
+// isSessionMessage returns true if the message type relates to a
+// session rather than the control connection.
+func isSessionMessage(t avpMsgType) bool {
+	switch t {
+	case avpMsgTypeOcrq, avpMsgTypeOcrp, avpMsgTypeOccn,
+		avpMsgTypeIcrq, avpMsgTypeIcrp, avpMsgTypeIccn,
+		avpMsgTypeCdn, avpMsgTypeWen, avpMsgTypeSli,
+		avpMsgTypeCsun, avpMsgTypeCsurq:
+		return true
+	}
+	return false
+}
@@ -15,6 +15,26 @@ type msgInfo struct {
 	msgType          avpMsgType
 }
 
+// testSccrqBytes is an L2TPv3 SCCRQ message carrying 7 AVPs
+var testSccrqBytes = []byte{
+	0xc8, 0x03, 0x00, 0x7c, 0x00, 0x00, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x00, 0x80, 0x08, 0x00, 0x00,
+	0x00, 0x00, 0x00, 0x01, 0x80, 0x0c, 0x00, 0x00,
+	0x00, 0x07, 0x6f, 0x70, 0x65, 0x6e, 0x76, 0x33,
+	0x00, 0x34, 0x00, 0x00, 0x00, 0x08, 0x70, 0x72,
+	0x6f, 0x6c, 0x32, 0x74, 0x70, 0x20, 0x31, 0x2e,
+	0x37, 0x2e, 0x33, 0x20, 0x4c, 0x69, 0x6e, 0x75,
+	0x78, 0x2d, 0x33, 0x2e, 0x31, 0x33, 0x2e, 0x30,
+	0x2d, 0x33, 0x30, 0x2d, 0x67, 0x65, 0x6e, 0x65,
+	0x72, 0x69, 0x63, 0x20, 0x28, 0x78, 0x38, 0x36,
+	0x5f, 0x36, 0x34, 0x29, 0x80, 0x08, 0x00, 0x00,
+	0x00, 0x0a, 0x00, 0x0a, 0x00, 0x0a, 0x00, 0x00,
+	0x00, 0x3c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0a,
+	0x00, 0x00, 0x00, 0x3d, 0x28, 0x46, 0xf1, 0x81,
+	0x00, 0x0c, 0x00, 0x00, 0x00, 0x3e, 0x00, 0x07,
+	0x00, 0x05, 0x00, 0x04,
+}
+
 func TestParseMessageBuffer(t *testing.T) {
 	cases := []struct {
 		in   []byte
@@ -40,24 +60,7 @@ func TestParseMessageBuffer(t *testing.T) {
 			},
 		},
 		{
-			in: []byte{
-				0xc8, 0x03, 0x00, 0x7c, 0x00, 0x00, 0x00, 0x00,
-				0x00, 0x00, 0x00, 0x00, 0x80, 0x08, 0x00, 0x00,
-				0x00, 0x00, 0x00, 0x01, 0x80, 0x0c, 0x00, 0x00,
-				0x00, 0x07, 0x6f, 0x70, 0x65, 0x6e, 0x76, 0x33,
-				0x00, 0x34, 0x00, 0x00, 0x00, 0x08, 0x70, 0x72,
-				0x6f, 0x6c, 0x32, 0x74, 0x70, 0x20, 0x31, 0x2e,
-				0x37, 0x2e, 0x33, 0x20, 0x4c, 0x69, 0x6e, 0x75,
-				0x78, 0x2d, 0x33, 0x2e, 0x31, 0x33, 0x2e, 0x30,
-				0x2d, 0x33, 0x30, 0x2d, 0x67, 0x65, 0x6e, 0x65,
-				0x72, 0x69, 0x63, 0x20, 0x28, 0x78, 0x38, 0x36,
-				0x5f, 0x36, 0x34, 0x29, 0x80, 0x08, 0x00, 0x00,
-				0x00, 0x0a, 0x00, 0x0a, 0x00, 0x0a, 0x00, 0x00,
-				0x00, 0x3c, 0x00, 0x00, 0x00, 0x00, 0x00, 0x0a,
-				0x00, 0x00, 0x00, 0x3d, 0x28, 0x46, 0xf1, 0x81,
-				0x00, 0x0c, 0x00, 0x00, 0x00, 0x3e, 0x00, 0x07,
-				0x00, 0x05, 0x00, 0x04,
-			},
+			in: testSccrqBytes,
 			want: []msgInfo{
 				{version: nll2tp.ProtocolVersion3, ns: 0, nr: 0, ccid: 0, navps: 7, msgType: avpMsgTypeSccrq},
 			},
@@ -218,3 +221,132 @@ func TestParseEncode(t *testing.T) {
 		}
 	}
 }
+
+func TestParseMessageBufferAllocs(t *testing.T) {
+	// parseMessageBuffer has no storage to reuse, so it allocates the
+	// message array, the message and its AVP array, however many AVPs
+	// there are.  AVP payloads aren't copied until the message is
+	// retained.  c.f. TestMessageParserAllocs.
+	cases := []struct {
+		name   string
+		in     []byte
+		allocs float64
+	}{
+		{
+			name: "ZLB",
+			in: []byte{
+				0xc8, 0x02, 0x00, 0x0c, 0x00, 0x01, 0x00, 0x00,
+				0x00, 0x01, 0x00, 0x01,
+			},
+			allocs: 2,
+		},
+		{
+			name:   "SCCRQ",
+			in:     testSccrqBytes,
+			allocs: 3,
+		},
+	}
+	for _, c := range cases {
+		allocs := testing.AllocsPerRun(100, func() {
+			if _, err := parseMessageBuffer(c.in); err != nil {
+				t.Fatalf("parseMessageBuffer(): %v", err)
+			}
+		})
+		if allocs > c.allocs {
+			t.Errorf("%v: expected at most %v allocations, got %v", c.name, c.allocs, allocs)
+		}
+	}
+}
+
+func TestMessageParserAllocs(t *testing.T) {
+	// Once the parser's storage has grown to fit, parsing doesn't
+	// allocate, however many messages and AVPs there are
+	frame := append(append([]byte(nil), testSccrqBytes...), testSccrqBytes...)
+	var p messageParser
+	allocs := testing.AllocsPerRun(100, func() {
+		msgs, err := p.parse(frame)
+		if err != nil || len(msgs) != 2 {
+			t.Fatalf("parse(): %v, %v messages", err, len(msgs))
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("expected no allocations, got %v", allocs)
+	}
+}
+
+func TestRetainMessageAllocs(t *testing.T) {
+	// Retaining a message copies the message, its AVP array and its
+	// AVP payloads, however many AVPs there are.
+	msgs, err := parseMessageBuffer(testSccrqBytes)
+	if err != nil {
+		t.Fatalf("parseMessageBuffer(): %v", err)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		retainMessage(msgs[0])
+	})
+	if allocs != 3 {
+		t.Errorf("expected 3 allocations, got %v", allocs)
+	}
+}
+
+func TestRetainMessage(t *testing.T) {
+	b := append([]byte(nil), testSccrqBytes...)
+	var p messageParser
+	msgs, err := p.parse(b)
+	if err != nil {
+		t.Fatalf("parse(): %v", err)
+	}
+	want, err := msgs[0].toBytes()
+	if err != nil {
+		t.Fatalf("toBytes(): %v", err)
+	}
+
+	retained := retainMessage(msgs[0])
+
+	// Reuse both the buffer and the parser's storage
+	for i := range b {
+		b[i] = 0xff
+	}
+	hello := []byte{
+		0xc8, 0x03, 0x00, 0x14, 0x00, 0x00, 0x00, 0x01,
+		0x00, 0x01, 0x00, 0x01, 0x80, 0x08, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x06,
+	}
+	if _, err = p.parse(hello); err != nil {
+		t.Fatalf("parse(): %v", err)
+	}
+
+	got, err := retained.toBytes()
+	if err != nil {
+		t.Fatalf("toBytes(): %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("message changed with parsed buffer: wanted %v, got %v", want, got)
+	}
+}
+
+// BenchmarkParseMessageBuffer reports the allocations made by parsing
+// using a parser whose storage is reused, as the transport does.
+func BenchmarkParseMessageBuffer(b *testing.B) {
+	var p messageParser
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := p.parse(testSccrqBytes); err != nil {
+			b.Fatalf("parse(): %v", err)
+		}
+	}
+}
+
+// BenchmarkParseRetainMessage reports the cost of parsing a message
+// and retaining it, as the transport does for each message it queues.
+func BenchmarkParseRetainMessage(b *testing.B) {
+	var p messageParser
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		msgs, err := p.parse(testSccrqBytes)
+		if err != nil {
+			b.Fatalf("parse(): %v", err)
+		}
+		retainMessage(msgs[0])
+	}
+}
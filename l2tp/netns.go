@@ -0,0 +1,69 @@
+package l2tp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// netnsPath returns the filesystem path for a network namespace.
+// Names which don't include a path separator are assumed to be
+// named namespaces as created by "ip netns add".
+func netnsPath(netns string) string {
+	if strings.Contains(netns, "/") {
+		return netns
+	}
+	return filepath.Join("/var/run/netns", netns)
+}
+
+// withNetns calls fn from within the specified network namespace.
+//
+// Sockets created by fn remain in the namespace once withNetns returns,
+// so withNetns may be used to instantiate sockets in a namespace while
+// the remainder of the program runs in the original namespace.
+//
+// If netns is the empty string fn is called in the current namespace.
+func withNetns(netns string, fn func() error) error {
+	if netns == "" {
+		return fn()
+	}
+
+	// Namespaces are a per-thread property, so we must prevent the
+	// Go runtime from moving us between threads while we're switched.
+	runtime.LockOSThread()
+
+	origin, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open current network namespace: %v", err)
+	}
+	defer origin.Close()
+
+	target, err := os.Open(netnsPath(netns))
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to open network namespace %q: %v", netns, err)
+	}
+	defer target.Close()
+
+	err = unix.Setns(int(target.Fd()), unix.CLONE_NEWNET)
+	if err != nil {
+		runtime.UnlockOSThread()
+		return fmt.Errorf("failed to enter network namespace %q: %v", netns, err)
+	}
+
+	defer func() {
+		// If we can't restore the original namespace we leave the
+		// thread locked, which causes the runtime to terminate it
+		// when the goroutine exits rather than reuse it.
+		if unix.Setns(int(origin.Fd()), unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+	}()
+
+	return fn()
+}
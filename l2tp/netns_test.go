@@ -0,0 +1,55 @@
+package l2tp
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"testing"
+)
+
+func TestWithNetns(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("skipping test because we don't have root permissions")
+	}
+
+	netns := fmt.Sprintf("go-l2tp-test-%d", os.Getpid())
+	err := exec.Command("ip", "netns", "add", netns).Run()
+	if err != nil {
+		t.Skipf("skipping test because we couldn't create a network namespace: %v", err)
+	}
+	defer exec.Command("ip", "netns", "del", netns).Run()
+
+	outside, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("net.Interfaces(): %v", err)
+	}
+
+	var inside []net.Interface
+	err = withNetns(netns, func() (err error) {
+		inside, err = net.Interfaces()
+		return
+	})
+	if err != nil {
+		t.Fatalf("withNetns(%v): %v", netns, err)
+	}
+
+	// A freshly created namespace contains only a loopback device
+	if len(inside) != 1 || inside[0].Name != "lo" {
+		t.Errorf("expected only loopback in namespace %v, got %v", netns, inside)
+	}
+
+	// We should be back in the original namespace afterwards
+	after, err := net.Interfaces()
+	if err != nil {
+		t.Fatalf("net.Interfaces(): %v", err)
+	}
+	if len(after) != len(outside) {
+		t.Errorf("failed to restore namespace: got %v, want %v", after, outside)
+	}
+
+	err = withNetns("go-l2tp-no-such-netns", func() error { return nil })
+	if err == nil {
+		t.Errorf("expected withNetns to fail for a nonexistent namespace")
+	}
+}
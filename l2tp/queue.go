@@ -0,0 +1,297 @@
+package l2tp
+
+import (
+	"time"
+)
+
+// msgRing is a FIFO queue of control messages pending transmission or
+// acknowledgement, implemented as a ring buffer which grows as needed.
+//
+// Messages are sent in order and acks are cumulative, so the messages
+// awaiting an ack are always ordered by sequence number: the oldest
+// unacked message is at the head of the ring.
+type msgRing struct {
+	buf        []*ctlMsg
+	head, size int
+}
+
+func (r *msgRing) len() int {
+	return r.size
+}
+
+func (r *msgRing) push(m *ctlMsg) {
+	if r.size == len(r.buf) {
+		r.grow()
+	}
+	r.buf[(r.head+r.size)&(len(r.buf)-1)] = m
+	r.size++
+}
+
+// peek returns the message at the head of the ring, or nil if the
+// ring is empty.
+func (r *msgRing) peek() *ctlMsg {
+	if r.size == 0 {
+		return nil
+	}
+	return r.buf[r.head]
+}
+
+// pop removes and returns the message at the head of the ring, or nil
+// if the ring is empty.
+func (r *msgRing) pop() *ctlMsg {
+	if r.size == 0 {
+		return nil
+	}
+	m := r.buf[r.head]
+	r.buf[r.head] = nil
+	r.head = (r.head + 1) & (len(r.buf) - 1)
+	r.size--
+	return m
+}
+
+// remove removes a message from anywhere in the ring, preserving the
+// order of the remaining messages.  It returns false if the message
+// wasn't found.
+func (r *msgRing) remove(m *ctlMsg) bool {
+	mask := len(r.buf) - 1
+	for i := 0; i < r.size; i++ {
+		if r.buf[(r.head+i)&mask] != m {
+			continue
+		}
+		for ; i < r.size-1; i++ {
+			r.buf[(r.head+i)&mask] = r.buf[(r.head+i+1)&mask]
+		}
+		r.buf[(r.head+r.size-1)&mask] = nil
+		r.size--
+		return true
+	}
+	return false
+}
+
+func (r *msgRing) grow() {
+	n := 2 * len(r.buf)
+	if n == 0 {
+		n = 8
+	}
+	buf := make([]*ctlMsg, n)
+	for i := 0; i < r.size; i++ {
+		buf[i] = r.buf[(r.head+i)&(len(r.buf)-1)]
+	}
+	r.buf = buf
+	r.head = 0
+}
+
+// rxRing holds messages received ahead of sequence, indexed by their
+// sequence number.  Its capacity is our receive window, so inserting,
+// detecting duplicates and dequeuing the next message in sequence are
+// all constant time.
+type rxRing struct {
+	buf  []controlMessage
+	size int
+}
+
+func newRxRing(window uint16) rxRing {
+	n := 1
+	for n < int(window) {
+		n *= 2
+	}
+	return rxRing{buf: make([]controlMessage, n)}
+}
+
+func (r *rxRing) len() int {
+	return r.size
+}
+
+// insert adds a message to the ring.  The caller must ensure the
+// message lies within the receive window.  It returns false if a message
+// with the same sequence number is already queued.
+func (r *rxRing) insert(msg controlMessage) bool {
+	i := int(msg.ns()) & (len(r.buf) - 1)
+	if r.buf[i] != nil {
+		return false
+	}
+	r.buf[i] = msg
+	r.size++
+	return true
+}
+
+// has returns true if a message with sequence number ns is queued.
+func (r *rxRing) has(ns uint16) bool {
+	msg := r.buf[int(ns)&(len(r.buf)-1)]
+	return msg != nil && msg.ns() == ns
+}
+
+// take removes and returns the message with sequence number ns, or nil
+// if it hasn't been received.
+func (r *rxRing) take(ns uint16) controlMessage {
+	i := int(ns) & (len(r.buf) - 1)
+	msg := r.buf[i]
+	if msg == nil || msg.ns() != ns {
+		return nil
+	}
+	r.buf[i] = nil
+	r.size--
+	return msg
+}
+
+func (r *rxRing) clear() {
+	for i := range r.buf {
+		r.buf[i] = nil
+	}
+	r.size = 0
+}
+
+// wheelTimer holds the deadline of an entry on a timerWheel, and its
+// position on the wheel.
+type wheelTimer struct {
+	when            time.Time
+	onWheel         bool
+	slot, slotIndex int
+}
+
+// wheelEntry is implemented by the values scheduled on a timerWheel.
+type wheelEntry interface {
+	wheelTimer() *wheelTimer
+}
+
+// timerWheel is a hashed timer wheel.  The transport uses one for the
+// retransmit deadlines of the messages awaiting an ack, running a single
+// timer for the earliest deadline rather than one timer per message,
+// and the reactor uses one for the timers of the transports it runs.
+//
+// Entries are hashed into slots by deadline, so scheduling and
+// cancelling are constant time, while finding expired entries only
+// visits the slots which have come due.  The slots are allocated when
+// the first entry is scheduled, since a transport may never have more
+// than a HELLO in flight.
+type timerWheel struct {
+	slots [][]wheelEntry
+	tick  time.Duration
+	// cursor is the tick up to which expired entries have been removed
+	cursor int64
+	size   int
+}
+
+const (
+	timerWheelSlots = 1024
+	timerWheelTick  = 10 * time.Millisecond
+)
+
+func newTimerWheel(now time.Time) timerWheel {
+	w := timerWheel{
+		tick: timerWheelTick,
+	}
+	w.cursor = w.tickOf(now)
+	return w
+}
+
+func (w *timerWheel) tickOf(t time.Time) int64 {
+	return t.UnixNano() / int64(w.tick)
+}
+
+func (w *timerWheel) len() int {
+	return w.size
+}
+
+// schedule adds an entry to the wheel, to expire at its wheelTimer's
+// deadline.  The entry must not already be scheduled.
+func (w *timerWheel) schedule(e wheelEntry) {
+	t := e.wheelTimer()
+	tick := w.tickOf(t.when)
+	if tick < w.cursor {
+		tick = w.cursor
+	}
+	if w.slots == nil {
+		w.slots = make([][]wheelEntry, timerWheelSlots)
+	}
+	slot := int(tick % int64(len(w.slots)))
+	t.onWheel = true
+	t.slot = slot
+	t.slotIndex = len(w.slots[slot])
+	w.slots[slot] = append(w.slots[slot], e)
+	w.size++
+}
+
+// cancel removes an entry from the wheel, if it is scheduled.
+func (w *timerWheel) cancel(e wheelEntry) {
+	t := e.wheelTimer()
+	if !t.onWheel {
+		return
+	}
+	slot := w.slots[t.slot]
+	last := len(slot) - 1
+	slot[t.slotIndex] = slot[last]
+	slot[t.slotIndex].wheelTimer().slotIndex = t.slotIndex
+	slot[last] = nil
+	w.slots[t.slot] = slot[:last]
+	t.onWheel = false
+	w.size--
+}
+
+// expire removes and returns the entries whose deadline is at or
+// before now.
+func (w *timerWheel) expire(now time.Time) (expired []wheelEntry) {
+	if w.size == 0 {
+		w.cursor = w.tickOf(now)
+		return nil
+	}
+	end := w.tickOf(now)
+	if end-w.cursor >= int64(len(w.slots)) {
+		// We've been through a full rotation, so every slot may hold
+		// expired entries.
+		w.cursor = end - int64(len(w.slots)) + 1
+	}
+	for tick := w.cursor; tick <= end; tick++ {
+		slot := int(tick % int64(len(w.slots)))
+		for i := 0; i < len(w.slots[slot]); {
+			e := w.slots[slot][i]
+			if e.wheelTimer().when.After(now) {
+				i++
+				continue
+			}
+			w.cancel(e)
+			expired = append(expired, e)
+		}
+	}
+	w.cursor = end
+	return expired
+}
+
+// next returns the earliest deadline of the entries on the wheel.
+func (w *timerWheel) next() (deadline time.Time, ok bool) {
+	if w.size == 0 {
+		return time.Time{}, false
+	}
+	// The first occupied slot within a rotation of the cursor holds the
+	// earliest deadline, unless all the deadlines are further away.
+	for tick := w.cursor; tick < w.cursor+int64(len(w.slots)); tick++ {
+		for _, e := range w.slots[int(tick%int64(len(w.slots)))] {
+			when := e.wheelTimer().when
+			if w.tickOf(when) <= tick && (!ok || when.Before(deadline)) {
+				deadline, ok = when, true
+			}
+		}
+		if ok {
+			return deadline, true
+		}
+	}
+	for _, slot := range w.slots {
+		for _, e := range slot {
+			when := e.wheelTimer().when
+			if !ok || when.Before(deadline) {
+				deadline, ok = when, true
+			}
+		}
+	}
+	return deadline, ok
+}
+
+func (w *timerWheel) clear() {
+	for i, slot := range w.slots {
+		for _, e := range slot {
+			e.wheelTimer().onWheel = false
+		}
+		w.slots[i] = nil
+	}
+	w.size = 0
+}
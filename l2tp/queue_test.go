@@ -0,0 +1,370 @@
+package l2tp
+
+import (
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+func testNewQueueMsgs(n int) []*ctlMsg {
+	msgs := make([]*ctlMsg, n)
+	for i := range msgs {
+		msgs[i] = &ctlMsg{nretries: uint(i)}
+	}
+	return msgs
+}
+
+func TestMsgRing(t *testing.T) {
+	var r msgRing
+	msgs := testNewQueueMsgs(20)
+
+	if r.peek() != nil || r.pop() != nil {
+		t.Fatalf("expected empty ring")
+	}
+
+	// Wrap the ring before growing it, to check order is preserved
+	for _, m := range msgs[:6] {
+		r.push(m)
+	}
+	for _, m := range msgs[:4] {
+		if got := r.pop(); got != m {
+			t.Fatalf("pop(): expected message %v, got %v", m.nretries, got.nretries)
+		}
+	}
+	for _, m := range msgs[6:] {
+		r.push(m)
+	}
+	if r.len() != 16 {
+		t.Fatalf("expected 16 messages, got %v", r.len())
+	}
+
+	if r.remove(msgs[0]) {
+		t.Errorf("remove(): removed message which isn't queued")
+	}
+	if !r.remove(msgs[10]) {
+		t.Errorf("remove(): failed to remove queued message")
+	}
+
+	for _, m := range msgs[4:] {
+		if m == msgs[10] {
+			continue
+		}
+		if got := r.peek(); got != m {
+			t.Fatalf("peek(): expected message %v, got %v", m.nretries, got.nretries)
+		}
+		if got := r.pop(); got != m {
+			t.Fatalf("pop(): expected message %v, got %v", m.nretries, got.nretries)
+		}
+	}
+	if r.len() != 0 {
+		t.Errorf("expected empty ring, got %v messages", r.len())
+	}
+}
+
+func TestRxRing(t *testing.T) {
+	cases := []struct {
+		window uint16
+		nr     uint16
+	}{
+		{window: 4, nr: 0},
+		{window: 5, nr: 100},
+		{window: 16, nr: 0xfffe},
+	}
+	for _, c := range cases {
+		r := newRxRing(c.window)
+		// Queue the window in reverse order, with a duplicate
+		ns := c.nr + c.window - 1
+		for i := uint16(0); i < c.window; i++ {
+			msg, err := newV3ControlMessage(1, []avp{})
+			if err != nil {
+				t.Fatalf("newV3ControlMessage(): %v", err)
+			}
+			msg.setTransportSeqNum(ns-i, 0)
+			if !r.insert(msg) {
+				t.Fatalf("window %v: insert(%v) failed", c.window, ns-i)
+			}
+			if i == 0 && r.insert(msg) {
+				t.Fatalf("window %v: insert(%v) accepted duplicate", c.window, ns-i)
+			}
+		}
+		if r.len() != int(c.window) {
+			t.Fatalf("window %v: expected %v messages, got %v", c.window, c.window, r.len())
+		}
+		if msg := r.take(c.nr + c.window); msg != nil {
+			t.Errorf("window %v: took message %v which wasn't queued", c.window, msg.ns())
+		}
+		for i := uint16(0); i < c.window; i++ {
+			msg := r.take(c.nr + i)
+			if msg == nil || msg.ns() != c.nr+i {
+				t.Fatalf("window %v: take(%v) failed", c.window, c.nr+i)
+			}
+		}
+		if r.len() != 0 {
+			t.Errorf("window %v: expected empty ring, got %v messages", c.window, r.len())
+		}
+	}
+}
+
+func TestTimerWheel(t *testing.T) {
+	now := time.Unix(1000000, 0)
+	w := newTimerWheel(now)
+
+	// Deadlines spanning more than one rotation of the wheel
+	msgs := testNewQueueMsgs(5)
+	offsets := []time.Duration{
+		time.Second,
+		50 * time.Millisecond,
+		20 * time.Second,
+		time.Second,
+		5 * time.Millisecond,
+	}
+	for i, m := range msgs {
+		m.retry.when = now.Add(offsets[i])
+		w.schedule(m)
+	}
+	w.cancel(msgs[3])
+	w.cancel(msgs[3])
+	if w.len() != 4 {
+		t.Fatalf("expected 4 messages, got %v", w.len())
+	}
+
+	expect := []struct {
+		at      time.Duration
+		expired []*ctlMsg
+		next    time.Duration
+	}{
+		{at: 0, next: 5 * time.Millisecond},
+		{at: 5 * time.Millisecond, expired: msgs[4:5], next: 50 * time.Millisecond},
+		{at: 2 * time.Second, expired: []*ctlMsg{msgs[1], msgs[0]}, next: 20 * time.Second},
+		{at: 15 * time.Second, next: 20 * time.Second},
+		{at: 25 * time.Second, expired: msgs[2:3]},
+	}
+	for _, e := range expect {
+		expired := w.expire(now.Add(e.at))
+		if len(expired) != len(e.expired) {
+			t.Fatalf("at %v: expected %v expired, got %v", e.at, len(e.expired), len(expired))
+		}
+		for i := range expired {
+			if expired[i] != e.expired[i] || e.expired[i].retry.onWheel {
+				t.Errorf("at %v: expected expired message %v, got %v", e.at, e.expired[i].nretries, expired[i].(*ctlMsg).nretries)
+			}
+		}
+		deadline, ok := w.next()
+		if e.next == 0 {
+			if ok {
+				t.Errorf("at %v: unexpected next deadline %v", e.at, deadline.Sub(now))
+			}
+		} else if !ok || !deadline.Equal(now.Add(e.next)) {
+			t.Errorf("at %v: expected next deadline %v, got %v", e.at, e.next, deadline.Sub(now))
+		}
+	}
+	if w.len() != 0 {
+		t.Errorf("expected empty wheel, got %v messages", w.len())
+	}
+}
+
+func TestTransportMultiAck(t *testing.T) {
+	sa, sb := testMemAddressPair(t)
+	cpa, peer := newMemControlPlanePair(sa, sb, memLinkConfig{}, memLinkConfig{})
+	defer peer.close()
+
+	xport, err := newTransport(
+		level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo()),
+		cpa, transportConfig{
+			Version:           ProtocolVersion3,
+			TxWindowSize:      8,
+			PeerControlConnID: 1,
+		})
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+	defer xport.close()
+
+	cfg := xport.getConfig()
+	ackAvp, err := newAvp(vendorIDIetf, avpTypeMessage, avpMsgTypeAck)
+	if err != nil {
+		t.Fatalf("newAvp(): %v", err)
+	}
+
+	// Each round sends the messages concurrently, and the peer acks
+	// them all with a single ack.  Slow start opens the window by one
+	// message per ack, so each round has one more message in flight.
+	var nr uint16
+	for round := 1; round <= 4; round++ {
+		var wg sync.WaitGroup
+		errChan := make(chan error, round)
+		for i := 0; i < round; i++ {
+			msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+			if err != nil {
+				t.Fatalf("failed to build Hello message: %v", err)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				errChan <- xport.send(msg)
+			}()
+		}
+
+		for i := 0; i < round; i++ {
+			msg, err := testMemPeerRecv(peer)
+			if err != nil {
+				t.Fatalf("round %v: %v", round, err)
+			}
+			if msg.ns() != nr {
+				t.Fatalf("round %v: expected ns %v, got %v", round, nr, msg.ns())
+			}
+			nr = seqIncrement(nr)
+		}
+
+		stats, err := xport.getStats()
+		if err != nil {
+			t.Fatalf("getStats(): %v", err)
+		}
+		if stats.AckQueueLen != round {
+			t.Errorf("round %v: expected %v messages awaiting ack, got %v", round, round, stats.AckQueueLen)
+		}
+
+		ack, err := newV3ControlMessage(1, []avp{*ackAvp})
+		if err != nil {
+			t.Fatalf("newV3ControlMessage(): %v", err)
+		}
+		err = testMemPeerSend(peer, ack, 0, nr)
+		if err != nil {
+			t.Fatalf("round %v: failed to ack: %v", round, err)
+		}
+		wg.Wait()
+		close(errChan)
+		for err := range errChan {
+			if err != nil {
+				t.Errorf("round %v: send(): %v", round, err)
+			}
+		}
+
+		stats, err = xport.getStats()
+		if err != nil {
+			t.Fatalf("getStats(): %v", err)
+		}
+		if stats.AckQueueLen != 0 || stats.InFlight != 0 || stats.Retransmits != 0 {
+			t.Errorf("round %v: unexpected stats after ack: %+v", round, stats)
+		}
+	}
+}
+
+// benchNewAckTransport returns a transport which isn't running, for
+// driving the queues directly.
+func benchNewAckTransport(window uint16) *transport {
+	clk := realClock{}
+	xport := &transport{
+		logger:     log.NewNopLogger(),
+		config:     transportConfig{Clock: clk, RetryTimeout: time.Second},
+		txWindow:   window,
+		retryTimer: newTimer(clk, 0),
+		retries:    newTimerWheel(clk.Now()),
+	}
+	xport.slowStart.reset(window)
+	return xport
+}
+
+// BenchmarkAckQueue measures a window of messages in flight being
+// scheduled for retransmit and then completed by a single ack.
+func BenchmarkAckQueue(b *testing.B) {
+	const inFlight = 4096
+	xport := benchNewAckTransport(inFlight)
+	helloAvp, err := newAvp(vendorIDIetf, avpTypeMessage, avpMsgTypeHello)
+	if err != nil {
+		b.Fatalf("newAvp(): %v", err)
+	}
+	msgs := make([]*ctlMsg, inFlight)
+	for i := range msgs {
+		msg, err := newV3ControlMessage(1, []avp{*helloAvp})
+		if err != nil {
+			b.Fatalf("newV3ControlMessage(): %v", err)
+		}
+		msgs[i] = &ctlMsg{xport: xport, msg: msg, onComplete: func(m *ctlMsg, err error) {}}
+	}
+	ack, err := newV3ControlMessage(1, []avp{*helloAvp})
+	if err != nil {
+		b.Fatalf("newV3ControlMessage(): %v", err)
+	}
+
+	b.ResetTimer()
+	var ns uint16
+	for i := 0; i < b.N; i++ {
+		xport.slowStart.cwnd = inFlight
+		for _, m := range msgs {
+			m.isComplete = false
+			m.msg.setTransportSeqNum(ns, 0)
+			m.sentAt = xport.config.Clock.Now()
+			xport.scheduleRetry(m)
+			xport.ackQueue.push(m)
+			xport.slowStart.onSend()
+			ns = seqIncrement(ns)
+		}
+		ack.setTransportSeqNum(0, ns)
+		if !xport.processAckQueue(ack) || xport.ackQueue.len() != 0 || xport.retries.len() != 0 {
+			b.Fatalf("failed to ack messages in flight")
+		}
+	}
+	b.ReportMetric(inFlight, "msgs/op")
+}
+
+// BenchmarkTransportThroughput measures messages sent by concurrent
+// callers with a large transmit window, the peer acking every message.
+func BenchmarkTransportThroughput(b *testing.B) {
+	sa, sb, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+	if err != nil {
+		b.Fatalf("newUDPAddressPair(): %v", err)
+	}
+	cpa, peer := newMemControlPlanePair(sa, sb, memLinkConfig{}, memLinkConfig{})
+	defer peer.close()
+
+	xport, err := newTransport(log.NewNopLogger(), cpa, transportConfig{
+		Version:           ProtocolVersion3,
+		TxWindowSize:      512,
+		PeerControlConnID: 1,
+	})
+	if err != nil {
+		b.Fatalf("newTransport(): %v", err)
+	}
+	defer xport.close()
+
+	go func() {
+		ackAvp, _ := newAvp(vendorIDIetf, avpTypeMessage, avpMsgTypeAck)
+		for {
+			msg, err := testMemPeerRecv(peer)
+			if err != nil {
+				return
+			}
+			ack, _ := newV3ControlMessage(1, []avp{*ackAvp})
+			if testMemPeerSend(peer, ack, 0, seqIncrement(msg.ns())) != nil {
+				return
+			}
+		}
+	}()
+
+	cfg := xport.getConfig()
+	msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+	if err != nil {
+		b.Fatalf("failed to build Hello message: %v", err)
+	}
+	b.SetParallelism(64)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			msg, err := newV3ControlMessage(1, msg.getAvps())
+			if err != nil {
+				b.Errorf("newV3ControlMessage(): %v", err)
+				return
+			}
+			err = xport.send(msg)
+			if err != nil {
+				b.Errorf("send(): %v", err)
+				return
+			}
+		}
+	})
+}
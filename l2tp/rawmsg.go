@@ -0,0 +1,84 @@
+package l2tp
+
+import (
+	"fmt"
+)
+
+// RawMessage is a control message decoded without being validated
+// against the AVPs the RFCs require and forbid for its type.
+//
+// RawMessage is intended for diagnostic tools which need to display
+// messages exactly as they were received, including messages which
+// ParseMessages would reject.
+type RawMessage struct {
+	// Version is the protocol version of the message
+	Version ProtocolVersion
+	// Length is the length of the message in octets, including the header
+	Length int
+	// TunnelID is the L2TPv2 tunnel ID or L2TPv3 control connection ID
+	// of the recipient
+	TunnelID ControlConnID
+	// SessionID is the L2TPv2 session ID of the recipient, and is
+	// unused for L2TPv3
+	SessionID ControlConnID
+	// Ns and Nr are the transport sequence numbers
+	Ns, Nr uint16
+	// Type is the message type.  L2TPv2 ZLB messages are represented
+	// using MessageTypeAck.
+	Type MessageType
+	// AVPs holds all the AVPs carried by the message, including the
+	// Message Type AVP
+	AVPs []AVP
+	cm   controlMessage
+}
+
+// DecodeRawMessages decodes a buffer containing one or more control
+// messages without validating them against the message schema.
+func DecodeRawMessages(b []byte) ([]*RawMessage, error) {
+	cms, err := parseMessageBuffer(b)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*RawMessage
+	for _, cm := range cms {
+		m := &RawMessage{
+			Version: ProtocolVersion(cm.protocolVersion()),
+			Length:  cm.getLen(),
+			Ns:      cm.ns(),
+			Nr:      cm.nr(),
+			Type:    MessageType(cm.getType()),
+			cm:      cm,
+		}
+		switch msg := cm.(type) {
+		case *v2ControlMessage:
+			m.TunnelID = ControlConnID(msg.Tid())
+			m.SessionID = ControlConnID(msg.Sid())
+		case *v3ControlMessage:
+			m.TunnelID = ControlConnID(msg.ControlConnectionID())
+		}
+		for _, a := range cm.getAvps() {
+			m.AVPs = append(m.AVPs, AVP{avp: a})
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// Validate checks the message against the AVPs the RFCs require and
+// forbid for its type.
+func (m *RawMessage) Validate() error {
+	return validateMessage(m.cm)
+}
+
+var _ fmt.Stringer = (*RawMessage)(nil)
+
+// String represents the message header as a human-readable string.
+func (m *RawMessage) String() string {
+	if m.Version == ProtocolVersion2 {
+		return fmt.Sprintf("L2TPv2 %v tid %d sid %d ns %d nr %d len %d",
+			m.Type, m.TunnelID, m.SessionID, m.Ns, m.Nr, m.Length)
+	}
+	return fmt.Sprintf("L2TPv3 %v ccid %d ns %d nr %d len %d",
+		m.Type, m.TunnelID, m.Ns, m.Nr, m.Length)
+}
@@ -0,0 +1,585 @@
+package l2tp
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/sys/unix"
+)
+
+// reactorMaxEvents is the maximum number of events the reactor collects
+// from a single epoll_wait call.
+const reactorMaxEvents = 256
+
+// reactorReadBatches limits the number of batches of frames a worker
+// reads from a socket before rearming it, so that one busy tunnel can't
+// starve the others.
+const reactorReadBatches = 4
+
+// reactor runs the transports of many tunnels on a small, fixed pool of
+// goroutines.  A single poller goroutine waits for socket readiness using
+// epoll and for transport timers using a timer wheel, and hands the
+// resulting events to the worker goroutines.
+//
+// Sockets are registered with EPOLLONESHOT, and are rearmed once the
+// worker has finished reading from them, so only one worker handles a
+// given socket at a time.  The transport loop mutex serialises socket
+// events with timer events and calls from user code.
+type reactor struct {
+	logger log.Logger
+	epfd   int
+	wakefd int
+	events chan reactorEvent
+	wg     sync.WaitGroup
+	// mutex protects the fields below
+	mutex    sync.Mutex
+	closed   bool
+	fds      map[int]*reactorFd
+	timers   timerWheel
+	deadline time.Time
+}
+
+// reactorHandle is a transport's registration with the reactor.
+type reactorHandle struct {
+	r     *reactor
+	xport *transport
+	fds   []*reactorFd
+	timer wheelTimer
+}
+
+// reactorFd is a socket polled by the reactor on behalf of a transport.
+type reactorFd struct {
+	h            *reactorHandle
+	conn         pollableConn
+	fromListener bool
+}
+
+// reactorEvent is passed from the poller to the workers.  If fd is nil,
+// the event is the expiry of the transport's timer.
+type reactorEvent struct {
+	h  *reactorHandle
+	fd *reactorFd
+}
+
+func (h *reactorHandle) wheelTimer() *wheelTimer {
+	return &h.timer
+}
+
+// newReactor creates a reactor with the specified number of worker
+// goroutines.
+func newReactor(logger log.Logger, workers int) (r *reactor, err error) {
+	if workers <= 0 {
+		return nil, fmt.Errorf("invalid reactor worker count %d", workers)
+	}
+
+	epfd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create epoll instance: %v", err)
+	}
+
+	wakefd, err := unix.Eventfd(0, unix.EFD_NONBLOCK|unix.EFD_CLOEXEC)
+	if err != nil {
+		unix.Close(epfd)
+		return nil, fmt.Errorf("failed to create eventfd: %v", err)
+	}
+
+	err = unix.EpollCtl(epfd, unix.EPOLL_CTL_ADD, wakefd, &unix.EpollEvent{
+		Events: unix.EPOLLIN,
+		Fd:     int32(wakefd),
+	})
+	if err != nil {
+		unix.Close(wakefd)
+		unix.Close(epfd)
+		return nil, fmt.Errorf("failed to poll eventfd: %v", err)
+	}
+
+	r = &reactor{
+		logger: log.With(logger, "function", "reactor"),
+		epfd:   epfd,
+		wakefd: wakefd,
+		events: make(chan reactorEvent, reactorMaxEvents),
+		fds:    make(map[int]*reactorFd),
+		timers: newTimerWheel(time.Now()),
+	}
+
+	r.wg.Add(1 + workers)
+	go r.poll()
+	for i := 0; i < workers; i++ {
+		go r.work()
+	}
+
+	return r, nil
+}
+
+// register adds a transport's control plane, and its NAT traversal
+// listener if there is one, to the reactor.  The sockets are polled
+// once registration is complete.
+func (r *reactor) register(xport *transport, cp pollableConn, listener pollableConn) (h *reactorHandle, err error) {
+	h = &reactorHandle{
+		r:     r,
+		xport: xport,
+		fds:   []*reactorFd{{conn: cp}},
+	}
+	if listener != nil {
+		h.fds = append(h.fds, &reactorFd{conn: listener, fromListener: true})
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.closed {
+		return nil, errors.New("reactor is closed")
+	}
+
+	for i, rfd := range h.fds {
+		rfd.h = h
+		fd := rfd.conn.pollFd()
+		err = unix.EpollCtl(r.epfd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{
+			Events: unix.EPOLLIN | unix.EPOLLONESHOT,
+			Fd:     int32(fd),
+		})
+		if err != nil {
+			for _, added := range h.fds[:i] {
+				r.unpoll(added)
+			}
+			return nil, fmt.Errorf("failed to poll control plane socket: %v", err)
+		}
+		r.fds[fd] = rfd
+	}
+
+	return h, nil
+}
+
+// rearm resumes polling a socket after a worker has read from it.
+func (h *reactorHandle) rearm(rfd *reactorFd) error {
+	fd := rfd.conn.pollFd()
+	err := unix.EpollCtl(h.r.epfd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{
+		Events: unix.EPOLLIN | unix.EPOLLONESHOT,
+		Fd:     int32(fd),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rearm control plane socket: %v", err)
+	}
+	return nil
+}
+
+// removeFd stops polling one of the transport's sockets.
+func (h *reactorHandle) removeFd(rfd *reactorFd) {
+	r := h.r
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for i, f := range h.fds {
+		if f == rfd {
+			h.fds = append(h.fds[:i], h.fds[i+1:]...)
+			r.unpoll(rfd)
+			return
+		}
+	}
+}
+
+// setTimer arranges for the transport to receive a timer event at
+// the specified time, replacing any previous deadline.  A zero time
+// cancels the timer.
+func (h *reactorHandle) setTimer(when time.Time) {
+	r := h.r
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if h.timer.onWheel {
+		if h.timer.when.Equal(when) {
+			return
+		}
+		r.timers.cancel(h)
+	}
+	if when.IsZero() || r.closed {
+		return
+	}
+
+	h.timer.when = when
+	r.timers.schedule(h)
+
+	// If the poller is sleeping beyond the new deadline, wake it
+	// so it can recompute its timeout.
+	if r.deadline.IsZero() || when.Before(r.deadline) {
+		r.wake()
+	}
+}
+
+// remove unregisters the transport from the reactor.  It must be called
+// before the transport's sockets are closed.  Events already passed to
+// the workers may still be delivered.
+func (h *reactorHandle) remove() {
+	r := h.r
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for _, rfd := range h.fds {
+		r.unpoll(rfd)
+	}
+	h.fds = nil
+	if h.timer.onWheel {
+		r.timers.cancel(h)
+	}
+}
+
+// unpoll removes a socket from the epoll set.  It must be called with
+// the mutex held.  Once the reactor is closed the epoll descriptor may
+// have been reused, so there is nothing to do.
+func (r *reactor) unpoll(rfd *reactorFd) {
+	if r.closed {
+		return
+	}
+	fd := rfd.conn.pollFd()
+	_ = unix.EpollCtl(r.epfd, unix.EPOLL_CTL_DEL, fd, nil)
+	delete(r.fds, fd)
+}
+
+// wake interrupts the poller's epoll_wait call.
+func (r *reactor) wake() {
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], 1)
+	_, _ = unix.Write(r.wakefd, b[:])
+}
+
+// pollTimeout returns the epoll_wait timeout in milliseconds for the
+// next timer deadline, or -1 if there are no timers.  It must be called
+// with the mutex held.
+func (r *reactor) pollTimeout(now time.Time) int {
+	deadline, ok := r.timers.next()
+	r.deadline = deadline
+	if !ok {
+		return -1
+	}
+	d := r.deadline.Sub(now)
+	if d <= 0 {
+		return 0
+	}
+	// Round up so we don't wake before the deadline
+	return int((d + time.Millisecond - 1) / time.Millisecond)
+}
+
+// poll is the poller goroutine.  It collects socket readiness and timer
+// expiry events and passes them to the workers.
+func (r *reactor) poll() {
+	defer r.wg.Done()
+	defer close(r.events)
+
+	events := make([]unix.EpollEvent, reactorMaxEvents)
+	var ready []reactorEvent
+
+	for {
+		r.mutex.Lock()
+		if r.closed {
+			r.mutex.Unlock()
+			return
+		}
+		timeout := r.pollTimeout(time.Now())
+		r.mutex.Unlock()
+
+		n, err := unix.EpollWait(r.epfd, events, timeout)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			level.Error(r.logger).Log(
+				"message", "epoll_wait failed",
+				"error", err)
+			return
+		}
+
+		ready = ready[:0]
+
+		r.mutex.Lock()
+		for _, ev := range events[:n] {
+			fd := int(ev.Fd)
+			if fd == r.wakefd {
+				var b [8]byte
+				_, _ = unix.Read(r.wakefd, b[:])
+				continue
+			}
+			if rfd, ok := r.fds[fd]; ok {
+				ready = append(ready, reactorEvent{h: rfd.h, fd: rfd})
+			}
+		}
+		for _, e := range r.timers.expire(time.Now()) {
+			ready = append(ready, reactorEvent{h: e.(*reactorHandle)})
+		}
+		r.mutex.Unlock()
+
+		// Dispatch outside the lock since the workers take it to
+		// rearm sockets and set timers.
+		for _, ev := range ready {
+			r.events <- ev
+		}
+	}
+}
+
+// work is a worker goroutine, running transport event handlers.
+func (r *reactor) work() {
+	defer r.wg.Done()
+	msgs := make([]*rawMsg, rawMsgBatchLen)
+	for ev := range r.events {
+		ev.h.xport.runReactorEvent(ev.fd, msgs)
+	}
+}
+
+// close stops the reactor.  Transports using the reactor should be
+// closed first.
+func (r *reactor) close() {
+	r.mutex.Lock()
+	if r.closed {
+		r.mutex.Unlock()
+		return
+	}
+	r.closed = true
+	r.wake()
+	r.mutex.Unlock()
+
+	r.wg.Wait()
+
+	unix.Close(r.wakefd)
+	unix.Close(r.epfd)
+}
+
+// deadlineTimer is a clockTimer for transports run by a reactor.  It has
+// no channel: instead the transport checks for expired timers when the
+// reactor delivers a timer event.
+type deadlineTimer struct {
+	clk   clock
+	armed bool
+	when  time.Time
+}
+
+func (t *deadlineTimer) C() <-chan time.Time {
+	return nil
+}
+
+func (t *deadlineTimer) Stop() bool {
+	wasArmed := t.armed
+	t.armed = false
+	return wasArmed
+}
+
+func (t *deadlineTimer) Reset(d time.Duration) bool {
+	wasArmed := t.armed
+	t.armed = true
+	t.when = t.clk.Now().Add(d)
+	return wasArmed
+}
+
+// expired returns true, disarming the timer, if its deadline has passed.
+func (t *deadlineTimer) expired(now time.Time) bool {
+	if !t.armed || t.when.After(now) {
+		return false
+	}
+	t.armed = false
+	return true
+}
+
+// newReactorTransport creates a transport which is run by a reactor
+// rather than by goroutines of its own.  Messages received from the peer
+// are passed to onRecv rather than being returned by recv, and onDown is
+// called if the transport fails.  onRecv is called with the transport
+// locked and so must not call back into the transport.
+//
+// The reactor uses the system clock, so cfg.Clock must not be set.
+func newReactorTransport(logger log.Logger, cp controlPlaneConn, cfg transportConfig, r *reactor,
+	onRecv func(msg controlMessage), onDown func(err error)) (xport *transport, err error) {
+
+	if cfg.Clock != nil {
+		return nil, errors.New("reactor transports must use the system clock")
+	}
+
+	pcp, ok := cp.(pollableConn)
+	if !ok {
+		return nil, errors.New("control plane cannot be polled by a reactor")
+	}
+	var listener pollableConn
+	if l := cp.natListener(); l != nil {
+		if listener, ok = l.(pollableConn); !ok {
+			return nil, errors.New("NAT traversal listener cannot be polled by a reactor")
+		}
+	}
+
+	xport, err = initTransport(logger, cp, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	xport.helloTimer = &deadlineTimer{clk: xport.config.Clock}
+	xport.ackTimer = &deadlineTimer{clk: xport.config.Clock}
+	xport.retryTimer = &deadlineTimer{clk: xport.config.Clock}
+	xport.onRecv = onRecv
+	xport.onDown = onDown
+
+	// The reactor may deliver events as soon as we're registered
+	xport.loopMutex.Lock()
+	defer xport.loopMutex.Unlock()
+
+	xport.reactor, err = r.register(xport, pcp, listener)
+	if err != nil {
+		return nil, err
+	}
+
+	xport.resetHelloTimer()
+	xport.armReactorTimer()
+
+	return xport, nil
+}
+
+// runReactorEvent is called by a reactor worker to handle one of the
+// transport's sockets becoming readable, or if rfd is nil, the expiry
+// of the transport's timer.  msgs is scratch space owned by the worker.
+func (xport *transport) runReactorEvent(rfd *reactorFd, msgs []*rawMsg) {
+	if rfd != nil {
+		_ = xport.runEvent(func() error {
+			return xport.handleReadable(rfd, msgs)
+		})
+	} else {
+		_ = xport.runEvent(xport.handleTimers)
+	}
+}
+
+// runEvent runs an event handler for a transport run by a reactor,
+// playing the part of an iteration of runTransport's loop.  If the
+// handler fails, or a StopCCN sent by the transport has completed, the
+// transport is brought down.  runEvent fails only if the transport was
+// already down, in which case the handler isn't run.
+func (xport *transport) runEvent(handler func() error) error {
+	xport.loopMutex.Lock()
+
+	if xport.isDown {
+		xport.loopMutex.Unlock()
+		return errors.New("transport is down")
+	}
+
+	err := handler()
+	if err == nil {
+		select {
+		case err = <-xport.stopChan:
+		default:
+		}
+	}
+
+	if err != nil {
+		xport.reactorDown(err)
+		xport.loopMutex.Unlock()
+		if xport.onDown != nil {
+			xport.onDown(err)
+		}
+		return nil
+	}
+
+	xport.armReactorTimer()
+	xport.loopMutex.Unlock()
+	return nil
+}
+
+// reactorDown brings down a transport run by a reactor.  It must be
+// called with the loop mutex held.
+func (xport *transport) reactorDown(err error) {
+	xport.isDown = true
+	xport.down(err)
+	close(xport.doneChan)
+}
+
+// armReactorTimer sets the reactor timer for the earliest deadline of
+// the transport's timers.
+func (xport *transport) armReactorTimer() {
+	var when time.Time
+	for _, t := range [...]clockTimer{xport.retryTimer, xport.helloTimer, xport.ackTimer} {
+		dt := t.(*deadlineTimer)
+		if dt.armed && (when.IsZero() || dt.when.Before(when)) {
+			when = dt.when
+		}
+	}
+	xport.reactor.setTimer(when)
+}
+
+// handleTimers runs the handlers of the transport timers which have
+// expired.
+func (xport *transport) handleTimers() error {
+	now := xport.config.Clock.Now()
+	if xport.retryTimer.(*deadlineTimer).expired(now) {
+		if err := xport.processRetries(); err != nil {
+			return err
+		}
+	}
+	if xport.helloTimer.(*deadlineTimer).expired(now) {
+		if err := xport.handleHelloTimer(); err != nil {
+			return err
+		}
+	}
+	if xport.ackTimer.(*deadlineTimer).expired(now) {
+		return xport.handleAckTimer()
+	}
+	return nil
+}
+
+// handleReadable reads the frames waiting on one of the transport's
+// sockets, and rearms the socket once it has been drained or the batch
+// limit has been reached.
+func (xport *transport) handleReadable(rfd *reactorFd, msgs []*rawMsg) error {
+	for i := 0; i < reactorReadBatches; i++ {
+		n, err := rfd.conn.tryRecvBatch(msgs)
+		if err == unix.EAGAIN || err == unix.EWOULDBLOCK {
+			break
+		}
+		if err != nil {
+			level.Error(xport.logger).Log(
+				"message", "socket read failed",
+				"error", err)
+			if rfd.fromListener {
+				// We can carry on without the listener, we just won't be
+				// able to follow the peer if its address changes.
+				xport.reactor.removeFd(rfd)
+				return nil
+			}
+			return errors.New("control plane socket read error")
+		}
+		for j, msg := range msgs[:n] {
+			msgs[j] = nil
+			xport.captureFrame(msg.b, msg.sa, rfd.conn.localAddr(), false)
+			err = xport.recvRawMsg(msg, rfd.fromListener)
+			msg.free()
+			if err != nil {
+				for k, m := range msgs[j+1 : n] {
+					m.free()
+					msgs[j+1+k] = nil
+				}
+				return err
+			}
+		}
+	}
+	return xport.reactor.rearm(rfd)
+}
+
+// reactorSend is sendContext for a transport run by a reactor.
+func (xport *transport) reactorSend(cctx context.Context, cm *ctlMsg) error {
+	if err := cctx.Err(); err != nil {
+		return err
+	}
+	err := xport.runEvent(func() error {
+		return xport.handleSend(cm)
+	})
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-cm.completeChan:
+		return err
+	case <-cctx.Done():
+		_ = xport.runEvent(func() error {
+			xport.cancelMessage(cm)
+			return nil
+		})
+		return cctx.Err()
+	}
+}
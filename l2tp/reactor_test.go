@@ -0,0 +1,215 @@
+package l2tp
+
+import (
+	"fmt"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+)
+
+func testNewReactor(t *testing.T, workers int) *reactor {
+	r, err := newReactor(log.NewNopLogger(), workers)
+	if err != nil {
+		t.Fatalf("newReactor(): %v", err)
+	}
+	return r
+}
+
+func TestReactorTransport(t *testing.T) {
+	r := testNewReactor(t, 2)
+	defer r.close()
+
+	cpa, cpb := testNewUDPControlPlanePair(t, "127.0.0.1:9200", "127.0.0.1:9201")
+	cfg := transportConfig{
+		Version:           ProtocolVersion3,
+		PeerControlConnID: 42,
+		HelloTimeout:      50 * time.Millisecond,
+	}
+
+	recvd := make(chan controlMessage, 64)
+	a, err := newReactorTransport(log.NewNopLogger(), cpa, cfg, r,
+		func(msg controlMessage) {
+			select {
+			case recvd <- msg:
+			default:
+			}
+		},
+		func(err error) { t.Errorf("unexpected transport failure: %v", err) })
+	if err != nil {
+		t.Fatalf("newReactorTransport(): %v", err)
+	}
+	b, err := newTransport(log.NewNopLogger(), cpb, cfg)
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+	defer b.close()
+
+	// The transports exchange HELLOs as well as the messages we send,
+	// so drain the peer's receive path.
+	peerRecvd := make(chan controlMessage, 64)
+	go func() {
+		for {
+			msg, err := b.recv()
+			if err != nil {
+				return
+			}
+			select {
+			case peerRecvd <- msg:
+			default:
+			}
+		}
+	}()
+	peerRecv := func() {
+		select {
+		case <-peerRecvd:
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for the peer to receive a message")
+		}
+	}
+
+	// Messages from the peer are passed to onRecv
+	for i := 0; i < 3*int(defaulttransportConfig().TxWindowSize); i++ {
+		msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+		if err != nil {
+			t.Fatalf("failed to build message: %v", err)
+		}
+		if err = b.send(msg); err != nil {
+			t.Fatalf("send(): %v", err)
+		}
+		select {
+		case msg = <-recvd:
+			if msg.getType() != avpMsgTypeHello {
+				t.Errorf("expected HELLO, got %v", msg.getType())
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for message %d", i)
+		}
+	}
+
+	// Messages sent using the reactor transport reach the peer
+	msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+	if err != nil {
+		t.Fatalf("failed to build message: %v", err)
+	}
+	if err = a.send(msg); err != nil {
+		t.Fatalf("send(): %v", err)
+	}
+	peerRecv()
+
+	// The hello timer is run by the reactor: once the peer goes
+	// quiet we send a HELLO of our own
+	stats, err := a.getStats()
+	if err != nil {
+		t.Fatalf("getStats(): %v", err)
+	}
+	sent := stats.MessagesSent
+	_, err = testWaitForStats(a, func(s *TransportStats) bool {
+		return s.MessagesSent > sent && s.AckQueueLen == 0
+	})
+	if err != nil {
+		t.Fatalf("no HELLO sent: %v", err)
+	}
+	peerRecv()
+
+	a.close()
+	if _, err = a.getStats(); err == nil {
+		t.Errorf("expected getStats() to fail once the transport is closed")
+	}
+	if err = a.send(msg); err == nil {
+		t.Errorf("expected send() to fail once the transport is closed")
+	}
+}
+
+func TestReactorTransportDown(t *testing.T) {
+	r := testNewReactor(t, 1)
+	defer r.close()
+
+	// Nothing runs a transport on the peer control plane, so
+	// nothing we send is acked
+	cpa, cpb := testNewUDPControlPlanePair(t, "127.0.0.1:9202", "127.0.0.1:9203")
+	defer cpb.close()
+
+	cfg := transportConfig{
+		Version:           ProtocolVersion3,
+		PeerControlConnID: 42,
+		MaxRetries:        2,
+		RetryTimeout:      10 * time.Millisecond,
+	}
+
+	downChan := make(chan error, 1)
+	a, err := newReactorTransport(log.NewNopLogger(), cpa, cfg, r,
+		func(msg controlMessage) {},
+		func(err error) { downChan <- err })
+	if err != nil {
+		t.Fatalf("newReactorTransport(): %v", err)
+	}
+	defer a.close()
+
+	msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+	if err != nil {
+		t.Fatalf("failed to build message: %v", err)
+	}
+	if err = a.send(msg); err == nil {
+		t.Fatalf("expected send() to fail")
+	}
+
+	select {
+	case err = <-downChan:
+		if err == nil {
+			t.Errorf("expected onDown to be passed an error")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("onDown not called")
+	}
+
+	if _, err = a.getStats(); err == nil {
+		t.Errorf("expected getStats() to fail once the transport is down")
+	}
+}
+
+func TestReactorGoroutines(t *testing.T) {
+	r := testNewReactor(t, 4)
+	defer r.close()
+
+	cfg := transportConfig{
+		Version:           ProtocolVersion3,
+		PeerControlConnID: 42,
+		HelloTimeout:      time.Hour,
+	}
+
+	before := runtime.NumGoroutine()
+
+	var xports []*transport
+	var peers []*controlPlane
+	defer func() {
+		for _, xport := range xports {
+			xport.close()
+		}
+		for _, cp := range peers {
+			cp.close()
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		cpa, cpb := testNewUDPControlPlanePair(t,
+			fmt.Sprintf("127.0.0.1:%d", 9300+2*i),
+			fmt.Sprintf("127.0.0.1:%d", 9301+2*i))
+		peers = append(peers, cpb)
+		xport, err := newReactorTransport(log.NewNopLogger(), cpa, cfg, r,
+			func(msg controlMessage) {},
+			func(err error) { t.Errorf("unexpected transport failure: %v", err) })
+		if err != nil {
+			cpa.close()
+			t.Fatalf("newReactorTransport(): %v", err)
+		}
+		xports = append(xports, xport)
+	}
+
+	// Idle transports run by the reactor cost no goroutines
+	if after := runtime.NumGoroutine(); after > before+2 {
+		t.Errorf("goroutine count grew from %d to %d for %d transports",
+			before, after, len(xports))
+	}
+}
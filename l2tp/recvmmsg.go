@@ -0,0 +1,145 @@
+package l2tp
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// mmsghdr is struct mmsghdr from recvmmsg(2), which x/sys/unix doesn't
+// provide.  Go pads the struct to the alignment of Msghdr just as C does.
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// mmsgBatch holds the structures passed to recvmmsg to read a batch
+// of frames.  Batches are pooled rather than owned by a control plane
+// since there may be tens of thousands of control planes, most of
+// which are idle most of the time.
+type mmsgBatch struct {
+	hdrs  [rawMsgBatchLen]mmsghdr
+	iovs  [rawMsgBatchLen]unix.Iovec
+	names [rawMsgBatchLen]unix.RawSockaddrAny
+}
+
+var mmsgBatchPool = sync.Pool{
+	New: func() interface{} {
+		return new(mmsgBatch)
+	},
+}
+
+// recv reads up to len(msgs) frames from the socket with a single
+// recvmmsg call, setting the frame of each message read.  The sender
+// address of msgs[i] is left in names[i].  Messages which aren't
+// needed are returned to the pool.
+func (mb *mmsgBatch) recv(fd uintptr, msgs []*rawMsg) (n int, err error) {
+	if len(msgs) > len(mb.hdrs) {
+		msgs = msgs[:len(mb.hdrs)]
+	}
+
+	for i := range msgs {
+		msgs[i] = newRawMsg()
+		mb.iovs[i].Base = &msgs[i].buf[0]
+		mb.iovs[i].SetLen(len(msgs[i].buf))
+		mb.names[i] = unix.RawSockaddrAny{}
+		mb.hdrs[i] = mmsghdr{}
+		mb.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&mb.names[i]))
+		mb.hdrs[i].hdr.Namelen = unix.SizeofSockaddrAny
+		mb.hdrs[i].hdr.Iov = &mb.iovs[i]
+		mb.hdrs[i].hdr.SetIovlen(1)
+	}
+
+	r, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, fd,
+		uintptr(unsafe.Pointer(&mb.hdrs[0])), uintptr(len(msgs)),
+		0, 0, 0)
+	if errno != 0 {
+		err = errno
+	} else {
+		n = int(r)
+	}
+
+	for i := range msgs {
+		// Don't let the pooled batch keep the buffers alive
+		mb.iovs[i].Base = nil
+		if i < n {
+			msgs[i].b = msgs[i].buf[:mb.hdrs[i].len]
+		} else {
+			msgs[i].free()
+			msgs[i] = nil
+		}
+	}
+	return n, err
+}
+
+// rawSockaddrCache converts raw socket addresses to unix.Sockaddr,
+// reusing the previous conversion if the address hasn't changed.
+// Frames on a connected socket are all from the same peer, so this
+// saves allocating a Sockaddr for every frame.
+type rawSockaddrCache struct {
+	raw unix.RawSockaddrAny
+	sa  unix.Sockaddr
+}
+
+// sockaddr converts raw to a unix.Sockaddr of the same type as local.
+// The returned Sockaddr is shared, and must not be modified.
+func (c *rawSockaddrCache) sockaddr(raw *unix.RawSockaddrAny, local unix.Sockaddr) (unix.Sockaddr, error) {
+	if c.sa != nil && *raw == c.raw {
+		return c.sa, nil
+	}
+	sa, err := rawToSockaddr(raw, local)
+	if err != nil {
+		return nil, err
+	}
+	c.raw = *raw
+	c.sa = sa
+	return sa, nil
+}
+
+// rawToSockaddr converts raw to a unix.Sockaddr of the same type as
+// local.  Unlike the conversion used by unix.Recvfrom we know the
+// socket protocol from the local address, and so don't need to query
+// the socket for it.
+func rawToSockaddr(raw *unix.RawSockaddrAny, local unix.Sockaddr) (unix.Sockaddr, error) {
+	switch local.(type) {
+	case *unix.SockaddrInet4:
+		if raw.Addr.Family == unix.AF_INET {
+			pp := (*unix.RawSockaddrInet4)(unsafe.Pointer(raw))
+			p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+			return &unix.SockaddrInet4{
+				Port: int(p[0])<<8 + int(p[1]),
+				Addr: pp.Addr,
+			}, nil
+		}
+	case *unix.SockaddrInet6:
+		if raw.Addr.Family == unix.AF_INET6 {
+			pp := (*unix.RawSockaddrInet6)(unsafe.Pointer(raw))
+			p := (*[2]byte)(unsafe.Pointer(&pp.Port))
+			return &unix.SockaddrInet6{
+				Port:   int(p[0])<<8 + int(p[1]),
+				ZoneId: pp.Scope_id,
+				Addr:   pp.Addr,
+			}, nil
+		}
+	case *unix.SockaddrL2TPIP:
+		if raw.Addr.Family == unix.AF_INET {
+			pp := (*unix.RawSockaddrL2TPIP)(unsafe.Pointer(raw))
+			return &unix.SockaddrL2TPIP{
+				ConnId: pp.Conn_id,
+				Addr:   pp.Addr,
+			}, nil
+		}
+	case *unix.SockaddrL2TPIP6:
+		if raw.Addr.Family == unix.AF_INET6 {
+			pp := (*unix.RawSockaddrL2TPIP6)(unsafe.Pointer(raw))
+			return &unix.SockaddrL2TPIP6{
+				ConnId: pp.Conn_id,
+				ZoneId: pp.Scope_id,
+				Addr:   pp.Addr,
+			}, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected address family %v for %T socket", raw.Addr.Family, local)
+}
@@ -0,0 +1,92 @@
+package l2tp
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ContextStats counts tunnel and session lifecycle events for a Context.
+type ContextStats struct {
+	// TunnelsCreated and TunnelsClosed count tunnel instances created
+	// and closed, including tunnels closed due to transport failure
+	TunnelsCreated, TunnelsClosed uint64
+	// SessionsCreated and SessionsClosed count session instances
+	// created and closed, including sessions closed with their tunnel
+	SessionsCreated, SessionsClosed uint64
+	// TransportFailures counts tunnels torn down because the reliable
+	// transport failed, e.g. because HELLO messages were not acked
+	TransportFailures uint64
+}
+
+// TunnelStats represents the state of a tunnel instance.
+type TunnelStats struct {
+	// Transport holds the state of the reliable transport.  Static
+	// tunnels don't run the transport, so for these it is nil.
+	Transport *TransportStats
+}
+
+// TransportStats is a snapshot of the state of the reliable transport
+// a tunnel uses to send and receive control messages.
+type TransportStats struct {
+	// Ns and Nr are the transport sequence numbers
+	Ns, Nr uint16
+	// Cwnd and Thresh are the congestion window and slow start
+	// threshold, as per RFC2661 Appendix A
+	Cwnd, Thresh uint16
+	// TxWindow is the maximum congestion window, which is limited by
+	// the peer's receive window if it advertises one
+	TxWindow uint16
+	// InFlight is the number of messages sent but not yet acked
+	InFlight uint16
+	// TxQueueLen is the number of messages waiting for the transmit
+	// window to open, and AckQueueLen the number of messages sent and
+	// waiting for an ack
+	TxQueueLen, AckQueueLen int
+	// RxQueueLen is the number of messages received out of sequence
+	RxQueueLen int
+	// MessagesSent counts messages written to the tunnel socket,
+	// including retransmits and explicit acks
+	MessagesSent uint64
+	// MessagesReceived counts messages received in sequence, excluding
+	// explicit acks
+	MessagesReceived uint64
+	// Retransmits counts messages retransmitted because the peer
+	// didn't ack them in time
+	Retransmits uint64
+	// RxWindowDrops counts messages discarded because they were
+	// received beyond our receive window
+	RxWindowDrops uint64
+	// SRTT and RTTVar are the smoothed round trip time and round trip
+	// time variation measured using acks from the peer, and RTO is the
+	// retry timeout derived from them.  They are zero until the first
+	// measurement is made.
+	SRTT, RTTVar, RTO time.Duration
+	// HelloRTT is the round trip time measured for the most recently
+	// acked HELLO message, or zero if no HELLO has been acked
+	HelloRTT time.Duration
+}
+
+// SessionStats represents the data plane statistics the Linux kernel
+// maintains for a session instance.
+type SessionStats struct {
+	TxPackets     uint64
+	TxBytes       uint64
+	TxErrors      uint64
+	RxPackets     uint64
+	RxBytes       uint64
+	RxSeqDiscards uint64
+	RxOOSPackets  uint64
+	RxErrors      uint64
+}
+
+// Stats returns the tunnel and session lifecycle event counts for
+// the context.
+func (ctx *Context) Stats() ContextStats {
+	return ContextStats{
+		TunnelsCreated:    atomic.LoadUint64(&ctx.stats.TunnelsCreated),
+		TunnelsClosed:     atomic.LoadUint64(&ctx.stats.TunnelsClosed),
+		SessionsCreated:   atomic.LoadUint64(&ctx.stats.SessionsCreated),
+		SessionsClosed:    atomic.LoadUint64(&ctx.stats.SessionsClosed),
+		TransportFailures: atomic.LoadUint64(&ctx.stats.TransportFailures),
+	}
+}
@@ -0,0 +1,58 @@
+package l2tp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// Control connection collision resolution per RFC2661 section 4.4.3 and
+// RFC3931 section 5.4.3.
+//
+// If both peers initiate a control connection to each other at the same
+// time, each sends an SCCRQ carrying a random Tiebreaker AVP.  On receipt
+// of an SCCRQ from a peer for which we have an SCCRQ outstanding, the
+// connection with the lower tiebreaker value is retained, while the other
+// is torn down using StopCCN with result code 3 (channel exists).  If the
+// values are equal both connections are torn down.
+//
+// Dynamic tunnels send SCCRQ, and resolve collisions as described by
+// ctlConnSetup.
+
+// newTiebreaker generates a random tiebreaker value.
+func newTiebreaker() (uint64, error) {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return 0, fmt.Errorf("failed to generate tiebreaker: %v", err)
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
+// findTiebreaker returns the tiebreaker value carried by a message,
+// if present.
+func findTiebreaker(msg controlMessage) (value uint64, ok bool) {
+	for _, a := range msg.getAvps() {
+		if a.vendorID() == vendorIDIetf && a.getType() == avpTypeTiebreaker {
+			value, err := a.decodeUint64Data()
+			return value, err == nil
+		}
+	}
+	return 0, false
+}
+
+// resolveCollision compares the tiebreaker we sent with the one sent by
+// the peer in a crossing SCCRQ, and determines which of the connections
+// should be retained.
+func resolveCollision(ours, theirs uint64) (keepOurs, keepTheirs bool) {
+	return ours < theirs, theirs < ours
+}
+
+// newCollisionStopCCNMessage builds the StopCCN message used to tear
+// down the losing connection following a tiebreak.
+func newCollisionStopCCNMessage(version ProtocolVersion,
+	localCCID, peerCCID ControlConnID) (msg controlMessage, err error) {
+	return newStopCCNMessage(version, localCCID, peerCCID, resultCode{
+		result: avpStopCCNResultCodeChannelExists,
+	})
+}
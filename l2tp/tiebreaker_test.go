@@ -0,0 +1,184 @@
+package l2tp
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+)
+
+func TestResolveCollision(t *testing.T) {
+	cases := []struct {
+		name                 string
+		ours, theirs         uint64
+		keepOurs, keepTheirs bool
+	}{
+		{name: "ours lower", ours: 10, theirs: 20, keepOurs: true},
+		{name: "theirs lower", ours: 20, theirs: 10, keepTheirs: true},
+		{name: "equal", ours: 42, theirs: 42},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			keepOurs, keepTheirs := resolveCollision(c.ours, c.theirs)
+			if keepOurs != c.keepOurs || keepTheirs != c.keepTheirs {
+				t.Errorf("resolveCollision(%v, %v): got %v/%v, want %v/%v",
+					c.ours, c.theirs, keepOurs, keepTheirs, c.keepOurs, c.keepTheirs)
+			}
+		})
+	}
+}
+
+func TestTiebreakerAVP(t *testing.T) {
+	tb, err := newTiebreaker()
+	if err != nil {
+		t.Fatalf("newTiebreaker(): %v", err)
+	}
+
+	msg, err := newV3ControlMessage(0, []avp{})
+	if err != nil {
+		t.Fatalf("newV3ControlMessage(): %v", err)
+	}
+	for _, v := range []struct {
+		typ   avpType
+		value interface{}
+	}{
+		{avpTypeMessage, avpMsgTypeSccrq},
+		{avpTypeTiebreaker, tb},
+	} {
+		a, err := newAvp(vendorIDIetf, v.typ, v.value)
+		if err != nil {
+			t.Fatalf("newAvp(%v, %v): %v", v.typ, v.value, err)
+		}
+		msg.appendAvp(a)
+	}
+
+	got, ok := findTiebreaker(msg)
+	if !ok || got != tb {
+		t.Errorf("findTiebreaker(): got %v/%v, want %v", got, ok, tb)
+	}
+}
+
+func TestCollisionStopCCN(t *testing.T) {
+	cases := []struct {
+		version ProtocolVersion
+	}{
+		{ProtocolVersion2},
+		{ProtocolVersion3},
+	}
+	for _, c := range cases {
+		msg, err := newCollisionStopCCNMessage(c.version, 42, 90)
+		if err != nil {
+			t.Fatalf("newCollisionStopCCNMessage(%v): %v", c.version, err)
+		}
+		if msg.getType() != avpMsgTypeStopccn {
+			t.Errorf("expected %v, got %v", avpMsgTypeStopccn, msg.getType())
+		}
+		var found bool
+		for _, a := range msg.getAvps() {
+			if a.getType() == avpTypeResultCode {
+				rc, err := a.decodeResultCode()
+				if err != nil {
+					t.Fatalf("decodeResultCode(): %v", err)
+				}
+				if rc.result != avpStopCCNResultCodeChannelExists {
+					t.Errorf("expected result %v, got %v", avpStopCCNResultCodeChannelExists, rc.result)
+				}
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("StopCCN has no result code AVP")
+		}
+	}
+}
+
+// TestCtlConnCollision checks that when both peers send SCCRQ at the same
+// time, the SCCRQs cross and just one control connection is established.
+func TestCtlConnCollision(t *testing.T) {
+	cases := []struct {
+		name         string
+		version      ProtocolVersion
+		tbA, tbB     uint64
+		expectFailed bool
+	}{
+		{name: "L2TPv2 a wins", version: ProtocolVersion2, tbA: 1, tbB: 2},
+		{name: "L2TPv3 b wins", version: ProtocolVersion3, tbA: 2, tbB: 1},
+		{name: "fallback a wins", version: ProtocolVersion3Fallback, tbA: 10, tbB: 20},
+		{name: "equal tiebreakers", version: ProtocolVersion3, tbA: 7, tbB: 7, expectFailed: true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sa, sb := testMemAddressPair(t)
+			cpa, cpb := newMemControlPlanePair(sa, sb, memLinkConfig{}, memLinkConfig{})
+			logger := level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo())
+
+			newEnd := func(cp *memControlPlane, ccid ControlConnID, tb uint64) *ctlConnSetup {
+				s, err := newCtlConnSetup(logger, c.version, ccid, cp.localAddr())
+				if err != nil {
+					t.Fatalf("newCtlConnSetup(): %v", err)
+				}
+				s.tiebreaker = tb
+				s.xport, err = newTransport(logger, cp, transportConfig{
+					Version:       c.version,
+					ControlConnID: ccid,
+					RetryTimeout:  50 * time.Millisecond,
+					AckTimeout:    5 * time.Millisecond,
+					CheckSCCRQ:    s.checkSCCRQ,
+				})
+				if err != nil {
+					t.Fatalf("newTransport(): %v", err)
+				}
+				return s
+			}
+			a := newEnd(cpa, 11, c.tbA)
+			defer a.xport.close()
+			defer a.close()
+			b := newEnd(cpb, 22, c.tbB)
+			defer b.xport.close()
+			defer b.close()
+
+			// Both SCCRQs are sent before either end handles a message
+			a.start(a.xport)
+			b.start(b.xport)
+			for _, s := range []*ctlConnSetup{a, b} {
+				go func(s *ctlConnSetup) {
+					for {
+						msg, err := s.xport.recv()
+						if err != nil {
+							return
+						}
+						s.handle(msg)
+					}
+				}(s)
+			}
+
+			cctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			peerA, errA := a.wait(cctx)
+			peerB, errB := b.wait(cctx)
+
+			if c.expectFailed {
+				if errA == nil || errB == nil {
+					t.Fatalf("expected both ends to fail, got %v, %v", errA, errB)
+				}
+				return
+			}
+			if errA != nil || errB != nil {
+				t.Fatalf("wait(): %v, %v", errA, errB)
+			}
+			if peerA != 22 || peerB != 11 {
+				t.Errorf("expected peer IDs 22 and 11, got %v and %v", peerA, peerB)
+			}
+
+			// The end with the lower tiebreaker keeps the connection it
+			// started, while the other answers it
+			if a.responder == (c.tbA < c.tbB) || b.responder == (c.tbB < c.tbA) {
+				t.Errorf("unexpected responders a %v, b %v", a.responder, b.responder)
+			}
+		})
+	}
+}
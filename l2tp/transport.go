@@ -1,6 +1,7 @@
 package l2tp
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
@@ -34,15 +35,48 @@ type ctlMsg struct {
 	completeChan chan error
 	// Completion state flag used internally by the transport.
 	isComplete bool
-	// Timer for retransmission if the peer doesn't ack the message.
-	retryTimer *time.Timer
+	// Time of the first transmission of the message.
+	sentAt time.Time
+	// Time at which the message is retransmitted if the peer hasn't
+	// acked it, and its position on the transport's retry wheel.
+	retry      wheelTimer
 	onComplete func(m *ctlMsg, err error)
 }
 
+func (m *ctlMsg) wheelTimer() *wheelTimer {
+	return &m.retry
+}
+
 // rawMsg represents a raw frame read from the transport socket.
+// The frame is read into a buffer from rawMsgPool, which is returned
+// to the pool by free once the transport has handled the frame.
 type rawMsg struct {
-	b  []byte
-	sa unix.Sockaddr
+	buf []byte
+	b   []byte
+	sa  unix.Sockaddr
+}
+
+const (
+	// rawMsgBufLen is the size of the buffer for each frame read
+	rawMsgBufLen = 4096
+	// rawMsgBatchLen is the maximum number of frames read in one go
+	rawMsgBatchLen = 16
+)
+
+var rawMsgPool = sync.Pool{
+	New: func() interface{} {
+		return &rawMsg{buf: make([]byte, rawMsgBufLen)}
+	},
+}
+
+func newRawMsg() *rawMsg {
+	return rawMsgPool.Get().(*rawMsg)
+}
+
+func (m *rawMsg) free() {
+	m.b = nil
+	m.sa = nil
+	rawMsgPool.Put(m)
 }
 
 // transportConfig represents the tunable parameters governing
@@ -53,15 +87,27 @@ type transportConfig struct {
 	// are transmitted.
 	HelloTimeout time.Duration
 	// Maximum number of messages we will send to the peer without having
-	// received an acknowledgement.
+	// received an acknowledgement.  If the peer advertises a smaller
+	// receive window during control connection setup, the peer's window
+	// is used instead.
 	TxWindowSize uint16
+	// Maximum number of messages we will buffer pending in-sequence
+	// delivery.  Messages received beyond the window are discarded.  The
+	// window is advertised to the peer using the Receive Window Size AVP
+	// in SCCRQ and SCCRP messages.
+	RxWindowSize uint16
 	// Maximum number of retransmits of an unacknowledged control packet.
 	MaxRetries uint
 	// Duration to wait before first packet retransmit.
 	// Subsequent retransmits up to the limit set by maxRetries occur at
-	// exponentially increasing intervals as per RFC3931.  If set to 0,
-	// a default value of 1 second is used.
+	// exponentially increasing intervals as per RFC3931, up to a maximum
+	// interval of 8 seconds.  If set to 0, a default value of 1 second is
+	// used.
 	RetryTimeout time.Duration
+	// How the timeout before the first retransmit is determined.  In
+	// adaptive mode RetryTimeout is used only until the round trip time
+	// to the peer has been measured.
+	RetryMode RetryMode
 	// Duration to wait before explicitly acking a control message.
 	// Most control messages will be implicitly acked by control protocol
 	// responses.
@@ -70,24 +116,86 @@ type transportConfig struct {
 	Version ProtocolVersion
 	// Peer control connection ID to use for transport-generated messages
 	PeerControlConnID ControlConnID
+	// Local control connection ID.  If set, this is used to validate
+	// messages received from a new peer address when NAT traversal is
+	// enabled on the control plane.
+	ControlConnID ControlConnID
+	// Clock used for the transport timers.  If nil, the system clock
+	// is used.  Tests may supply a fake clock to control time.
+	Clock clock
+	// If set, CheckSCCRQ is called by the transport goroutine for each
+	// SCCRQ received, before its sequence numbers are checked.  Since an
+	// SCCRQ starts a control connection of its own, one which crosses
+	// an SCCRQ we've sent has a sequence number space of its own too:
+	// CheckSCCRQ decides which connection it belongs to.  The message
+	// must not be retained.
+	CheckSCCRQ func(msg controlMessage) (action sccrqAction, reply controlMessage)
 }
 
+// sccrqAction says how the transport handles an SCCRQ from the peer.
+type sccrqAction int
+
+const (
+	// sccrqSequence: the SCCRQ is part of our control connection
+	sccrqSequence sccrqAction = iota
+	// sccrqReply: the SCCRQ starts a connection other than ours, and
+	// is discarded after sending the reply, if any, as the first message
+	// of that connection
+	sccrqReply
+	// sccrqRestart: our control connection is abandoned in favour of the
+	// one the SCCRQ starts, and the SCCRQ is handled as its first message
+	sccrqRestart
+)
+
+// errConnAbandoned completes the messages of a control connection
+// abandoned in favour of one started by the peer.
+var errConnAbandoned = errors.New("control connection abandoned")
+
 // transport represents the RFC2661/RFC3931
 // reliable transport algorithm state.
 type transport struct {
 	logger               log.Logger
 	slowStart            slowStartState
 	config               transportConfig
-	cp                   *controlPlane
-	helloTimer, ackTimer *time.Timer
+	cp                   controlPlaneConn
+	helloTimer, ackTimer clockTimer
 	helloInFlight        bool
+	abandoned            bool
+	ackPending           bool
+	retryTimer           clockTimer
+	retryArmed           bool
+	retryDeadline        time.Time
+	retries              timerWheel
+	txWindow             uint16
+	rxWindowDrops        uint64
+	helloRTT             time.Duration
+	rtt                  rttEstimator
+	retransmits          uint64
+	msgsSent, msgsRecvd  uint64
 	sendChan             chan *ctlMsg
-	retryChan            chan *ctlMsg
+	cancelChan           chan *ctlMsg
 	recvChan             chan controlMessage
-	cpChan               chan *rawMsg
-	rxQueue              []controlMessage
-	txQueue, ackQueue    []*ctlMsg
-	wg                   sync.WaitGroup
+	cpChan, natChan      chan *rawMsg
+	stopChan             chan error
+	stopErr              error
+	statsChan            chan chan TransportStats
+	doneChan             chan struct{}
+	// reactor is set if the transport is run by a reactor rather than
+	// by goroutines of its own.  loopMutex then serialises the event
+	// handlers, and received messages are passed to onRecv.
+	reactor           *reactorHandle
+	loopMutex         sync.Mutex
+	isDown            bool
+	onRecv            func(msg controlMessage)
+	onDown            func(err error)
+	parser            messageParser
+	rxQueue           rxRing
+	txQueue, ackQueue msgRing
+	wg                sync.WaitGroup
+	// capture is accessed by both the transport and socket read
+	// goroutines, and so is protected by captureMutex.
+	captureMutex sync.Mutex
+	capture      *capture
 }
 
 // Increment transport sequence number by one avoiding overflow
@@ -174,6 +282,43 @@ func (s *slowStartState) msgIsStale(msg controlMessage) bool {
 	return seqCompare(msg.ns(), s.nr) == -1
 }
 
+// rttEstimator tracks the smoothed round trip time to the peer and its
+// variation, and derives the retry timeout from them as per RFC6298.
+type rttEstimator struct {
+	measured          bool
+	srtt, rttvar, rto time.Duration
+}
+
+const (
+	// The maximum interval between retransmits recommended by
+	// RFC2661 section 5.8 and RFC3931 section 4.2.
+	maxRetryTimeout = 8 * time.Second
+	// The minimum adaptive retry timeout, which allows for scheduling
+	// delays on links with very low latency.
+	minRetryTimeout = 10 * time.Millisecond
+)
+
+func (r *rttEstimator) update(sample time.Duration) {
+	if !r.measured {
+		r.measured = true
+		r.srtt = sample
+		r.rttvar = sample / 2
+	} else {
+		delta := r.srtt - sample
+		if delta < 0 {
+			delta = -delta
+		}
+		r.rttvar = (3*r.rttvar + delta) / 4
+		r.srtt = (7*r.srtt + sample) / 8
+	}
+	r.rto = r.srtt + 4*r.rttvar
+	if r.rto < minRetryTimeout {
+		r.rto = minRetryTimeout
+	} else if r.rto > maxRetryTimeout {
+		r.rto = maxRetryTimeout
+	}
+}
+
 func (m *ctlMsg) txComplete(err error) {
 	if !m.isComplete {
 
@@ -183,18 +328,16 @@ func (m *ctlMsg) txComplete(err error) {
 			"error", err)
 
 		m.isComplete = true
-		if m.retryTimer != nil {
-			m.retryTimer.Stop()
-		}
+		m.xport.retries.cancel(m)
 		m.onComplete(m, err)
 	}
 }
 
-func newTimer(duration time.Duration) *time.Timer {
+func newTimer(clk clock, duration time.Duration) clockTimer {
 	if duration == 0 {
 		duration = 1 * time.Hour
 	}
-	t := time.NewTimer(duration)
+	t := clk.NewTimer(duration)
 	t.Stop()
 	return t
 }
@@ -203,6 +346,13 @@ func sanitiseConfig(cfg *transportConfig) {
 	if cfg.TxWindowSize == 0 || cfg.TxWindowSize > 65535 {
 		cfg.TxWindowSize = defaulttransportConfig().TxWindowSize
 	}
+	if cfg.RxWindowSize == 0 {
+		cfg.RxWindowSize = defaulttransportConfig().RxWindowSize
+	} else if cfg.RxWindowSize > 0x8000 {
+		// Sequence numbers are compared modulo 2^16, so a larger
+		// window would make messages ahead of us look stale.
+		cfg.RxWindowSize = 0x8000
+	}
 	if cfg.RetryTimeout == 0 {
 		cfg.RetryTimeout = defaulttransportConfig().RetryTimeout
 	}
@@ -212,27 +362,46 @@ func sanitiseConfig(cfg *transportConfig) {
 	if cfg.MaxRetries == 0 {
 		cfg.MaxRetries = defaulttransportConfig().MaxRetries
 	}
+	if cfg.Clock == nil {
+		cfg.Clock = realClock{}
+	}
 }
 
-func cpRead(xport *transport, wg *sync.WaitGroup) {
+// cpRead reads frames from the control plane in batches, passing them
+// to the transport goroutine.  cpChan is buffered to hold a batch, so
+// the transport can work through one batch while the next is read.
+func cpRead(xport *transport, cp controlPlaneConn, cpChan chan *rawMsg, wg *sync.WaitGroup) {
 	defer wg.Done()
+	batch := make([]*rawMsg, rawMsgBatchLen)
 	for {
-		b := make([]byte, 4096)
-		n, sa, err := xport.cp.recvFrom(b)
+		n, err := cp.recvBatch(batch)
 		if err != nil {
-			close(xport.cpChan)
+			close(cpChan)
 			level.Error(xport.logger).Log(
 				"message", "socket read failed",
 				"error", err)
 			return
 		}
-		xport.cpChan <- &rawMsg{b: b[:n], sa: sa}
+		for i, msg := range batch[:n] {
+			batch[i] = nil
+			xport.captureFrame(msg.b, msg.sa, cp.localAddr(), false)
+			// The transport goroutine may have exited before the control
+			// plane was closed, in which case nothing will read cpChan.
+			select {
+			case cpChan <- msg:
+			case <-xport.doneChan:
+				return
+			}
+		}
 	}
 }
 
 func runTransport(xport *transport, wg *sync.WaitGroup) {
 	defer wg.Done()
+	defer close(xport.doneChan)
 	for {
+		var err error
+
 		select {
 		// Transmission request from user code
 		case ctlMsg, ok := <-xport.sendChan:
@@ -240,108 +409,289 @@ func runTransport(xport *transport, wg *sync.WaitGroup) {
 				xport.down(errors.New("transport shut down by user"))
 				return
 			}
+			err = xport.handleSend(ctlMsg)
 
-			level.Debug(xport.logger).Log(
-				"message", "send",
-				"message_type", ctlMsg.msg.getType())
-
-			xport.txQueue = append(xport.txQueue, ctlMsg)
-			err := xport.processTxQueue()
-			if err != nil {
-				xport.down(err)
-				return
-			}
+		// Cancellation of a transmission request by user code
+		case ctlMsg := <-xport.cancelChan:
+			xport.cancelMessage(ctlMsg)
 
 		// Socket receive from the transport socket
 		case rawMsg, ok := <-xport.cpChan:
+			if !ok {
+				err = errors.New("control plane socket read error")
+				break
+			}
+			err = xport.recvRawMsg(rawMsg, false)
+			rawMsg.free()
 
+		// Socket receive from the NAT traversal listener socket
+		case rawMsg, ok := <-xport.natChan:
 			if !ok {
-				xport.down(errors.New("control plane socket read error"))
-				return
+				// We can carry on without the listener, we just won't be
+				// able to follow the peer if its address changes.
+				xport.natChan = nil
+				break
 			}
+			err = xport.recvRawMsg(rawMsg, true)
+			rawMsg.free()
 
+		// Timer fired for retransmitting messages the peer hasn't acked
+		case <-xport.retryTimer.C():
+			err = xport.processRetries()
+
+		// Timer fired for sending a hello message
+		case <-xport.helloTimer.C():
+			err = xport.handleHelloTimer()
+
+		// Timer fired for sending an explicit ack
+		case <-xport.ackTimer.C():
+			err = xport.handleAckTimer()
+
+		// StopCCN sent by the transport has completed
+		case err = <-xport.stopChan:
+
+		// Request for a snapshot of the transport state
+		case c := <-xport.statsChan:
+			c <- xport.stats()
+		}
+
+		if err != nil {
+			xport.down(err)
+			return
+		}
+	}
+}
+
+// handleSend queues a message from user code for transmission.
+func (xport *transport) handleSend(ctlMsg *ctlMsg) error {
+
+	level.Debug(xport.logger).Log(
+		"message", "send",
+		"message_type", ctlMsg.msg.getType())
+
+	// Our SCCRQ may be sent after we've already abandoned the control
+	// connection it would have started.
+	if xport.abandoned && ctlMsg.msg.getType() == avpMsgTypeSccrq {
+		ctlMsg.txComplete(errConnAbandoned)
+		return nil
+	}
+
+	xport.advertiseRxWindow(ctlMsg.msg)
+	xport.txQueue.push(ctlMsg)
+	return xport.processTxQueue()
+}
+
+func (xport *transport) handleHelloTimer() error {
+	if xport.helloInFlight {
+		return nil
+	}
+	err := xport.sendHelloMessage()
+	if err == nil {
+		xport.helloInFlight = true
+	}
+	return err
+}
+
+func (xport *transport) handleAckTimer() error {
+	xport.ackPending = false
+	return xport.sendExplicitAck()
+}
+
+// recvRawMsg handles a frame read from the control plane.  If fromListener
+// is set, the frame was received by the NAT traversal listener socket.
+// Failure indicates that the transport should be brought down.
+func (xport *transport) recvRawMsg(rawMsg *rawMsg, fromListener bool) error {
+
+	level.Debug(xport.logger).Log(
+		"message", "socket recv",
+		"length", len(rawMsg.b))
+
+	// Until the socket is connected we may receive frames from any
+	// host, so discard anything which isn't from our peer.
+	if !xport.cp.isConnected() && !xport.cp.isPeer(rawMsg.sa) {
+		level.Debug(xport.logger).Log(
+			"message", "discarding frame from unexpected host",
+			"address", sockaddrString(rawMsg.sa))
+		return nil
+	}
+
+	messages, err := xport.recvFrame(rawMsg)
+	if err != nil {
+		// Early packet handling can fail if we fail to parse a message or
+		// the parsed message sequence number checks fail.  We ignore these
+		// errors, but log them for analysis.
+		level.Error(xport.logger).Log(
+			"message", "frame receive failed",
+			"error", err)
+		return nil
+	}
+
+	// The kernel delivers frames from the connected peer address to the
+	// control plane socket.  If the listener has received a frame for our
+	// control connection after we've connected, the peer's address has changed.
+	if xport.cp.isConnected() && fromListener {
+		if !xport.isOurControlConnection(messages) || !xport.isInSequence(messages) {
 			level.Debug(xport.logger).Log(
-				"message", "socket recv",
-				"length", len(rawMsg.b))
+				"message", "discarding frame from unexpected host",
+				"address", sockaddrString(rawMsg.sa))
+			return nil
+		}
+
+		oldAddr := xport.cp.remoteAddr()
 
-			messages, err := xport.recvFrame(rawMsg)
+		// The kernel data plane transmits to the address the tunnel socket
+		// is connected to, so reconnecting updates the data plane as well.
+		err = xport.cp.connectTo(rawMsg.sa)
+		if err != nil {
+			return fmt.Errorf("failed to connect to new peer address: %v", err)
+		}
+
+		level.Info(xport.logger).Log(
+			"message", "peer address changed",
+			"old_address", sockaddrString(oldAddr),
+			"new_address", sockaddrString(rawMsg.sa))
+	}
+
+	for _, msg := range messages {
+		if msg.getType() == avpMsgTypeSccrq && xport.config.CheckSCCRQ != nil {
+			handled, err := xport.checkSCCRQ(msg)
 			if err != nil {
-				// Early packet handling can fail if we fail to parse a message or
-				// the parsed message sequence number checks fail.  We ignore these
-				// errors, but log them for analysis.
-				level.Error(xport.logger).Log(
-					"message", "frame receive failed",
-					"error", err)
-				break
+				return err
+			}
+			if handled {
+				continue
 			}
+		}
 
-			for _, msg := range messages {
-				xport.rxQueue = append(xport.rxQueue, msg)
-
-				// Process the ack queue using sequence numbers from the newly received
-				// message.  If we manage to dequeue a message it may result in opening
-				// the window for further transmits.
-				if xport.processAckQueue(msg) {
-					err = xport.processTxQueue()
-					if err != nil {
-						xport.down(err)
-						return
-					}
-				}
+		xport.queueRxMessage(msg)
+
+		// Process the ack queue using sequence numbers from the newly received
+		// message.  If we manage to dequeue a message it may result in opening
+		// the window for further transmits.
+		if xport.processAckQueue(msg) {
+			err = xport.processTxQueue()
+			if err != nil {
+				return err
 			}
+		}
+	}
 
-			// TODO: connect socket here if required
+	// If connect has been deferred, we now know the real address of
+	// the peer: connect the socket to complete the tunnel setup.
+	if !xport.cp.isConnected() {
+		err = xport.cp.connectTo(rawMsg.sa)
+		if err != nil {
+			return fmt.Errorf("failed to connect to peer: %v", err)
+		}
 
-			// Having added messages to the receive queue, process the queue
-			// to attempt to handle any messages that are in sequence.
-			xport.processRxQueue()
+		level.Info(xport.logger).Log(
+			"message", "connected to peer",
+			"address", sockaddrString(rawMsg.sa))
+	}
 
-		// Message retry request due to timeout waiting for an ack
-		case ctlMsg, ok := <-xport.retryChan:
-			if !ok {
-				return
-			}
+	// Having added messages to the receive queue, process the queue
+	// to attempt to handle any messages that are in sequence.
+	xport.processRxQueue()
 
-			level.Info(xport.logger).Log(
-				"message", "retransmit",
-				"message_type", ctlMsg.msg.getType())
-
-			// It's possible that a message ack could race with the retry timer.
-			// Hence we track completion state in the message struct to avoid
-			// a bogus retransmit.
-			if !ctlMsg.isComplete {
-				err := xport.retransmitMessage(ctlMsg)
-				if err != nil {
-					ctlMsg.txComplete(err)
-					xport.down(err)
-					return
-				}
-			}
+	// Rejection of invalid messages may have queued messages for
+	// transmission.
+	return xport.processTxQueue()
+}
 
-		// Timer fired for sending a hello message
-		case <-xport.helloTimer.C:
-			if !xport.helloInFlight {
-				err := xport.sendHelloMessage()
-				if err != nil {
-					xport.down(err)
-					return
-				}
-				xport.helloInFlight = true
-			}
+// checkSCCRQ asks the CheckSCCRQ callback which control connection an
+// SCCRQ belongs to.  It returns true if the SCCRQ has been dealt with,
+// and so mustn't be handled as part of our control connection.
+func (xport *transport) checkSCCRQ(msg controlMessage) (handled bool, err error) {
+	action, reply := xport.config.CheckSCCRQ(msg)
+	switch action {
+	case sccrqReply:
+		if reply != nil {
+			// The peer retransmits its SCCRQ until it's acked, and each
+			// retransmission is answered in turn, so the reply needn't
+			// be retransmitted or acked.
+			reply.setTransportSeqNum(0, seqIncrement(msg.ns()))
+			err = xport.writeMessage(reply)
+		}
+		return true, err
+	case sccrqRestart:
+		xport.restart(msg)
+	}
+	return false, nil
+}
 
-		// Timer fired for sending an explicit ack
-		case <-xport.ackTimer.C:
-			err := xport.sendExplicitAck()
-			if err != nil {
-				xport.down(err)
-				return
-			}
+// restart abandons our control connection in favour of the one the peer
+// starts with an SCCRQ.  The messages we've sent or queued are completed
+// with errConnAbandoned, and the sequence numbers are reset so that the
+// SCCRQ is the next message in sequence, and our reply is sent with Ns 0.
+func (xport *transport) restart(sccrq controlMessage) {
+
+	level.Info(xport.logger).Log(
+		"message", "abandoning control connection",
+		"ns", xport.slowStart.ns,
+		"nr", xport.slowStart.nr)
+
+	xport.abandoned = true
+
+	xport.rxQueue.clear()
+	for msg := xport.txQueue.pop(); msg != nil; msg = xport.txQueue.pop() {
+		msg.txComplete(errConnAbandoned)
+	}
+	for msg := xport.ackQueue.pop(); msg != nil; msg = xport.ackQueue.pop() {
+		msg.txComplete(errConnAbandoned)
+	}
+	xport.retries.clear()
+	xport.retryArmed = false
+	_ = xport.retryTimer.Stop()
+
+	xport.slowStart = slowStartState{nr: sccrq.ns()}
+	xport.slowStart.reset(xport.config.TxWindowSize)
+	xport.txWindow = xport.config.TxWindowSize
+
+	if ccid, ok := findAssignedConnID(sccrq); ok {
+		xport.config.PeerControlConnID = ccid
+	}
+}
+
+// isOurControlConnection returns true if all the messages are
+// addressed to our local control connection ID.
+func (xport *transport) isOurControlConnection(messages []controlMessage) bool {
+	if xport.config.ControlConnID == 0 {
+		return false
+	}
+	for _, msg := range messages {
+		var ccid ControlConnID
+		switch m := msg.(type) {
+		case *v2ControlMessage:
+			ccid = ControlConnID(m.Tid())
+		case *v3ControlMessage:
+			ccid = ControlConnID(m.ControlConnectionID())
+		}
+		if ccid != xport.config.ControlConnID {
+			return false
 		}
 	}
+	return true
+}
+
+// isInSequence returns true if the messages continue the peer's
+// conversation with us: either the first message carries the next sequence
+// number we expect from the peer, or it acks a message we've sent which is
+// still awaiting an ack.  Knowing the control connection ID isn't enough to
+// move the control connection to a new address, since it's easily guessed.
+func (xport *transport) isInSequence(messages []controlMessage) bool {
+	if len(messages) == 0 {
+		return false
+	}
+	msg := messages[0]
+	if msg.ns() == xport.slowStart.nr {
+		return true
+	}
+	oldest := xport.ackQueue.peek()
+	return oldest != nil && seqCompare(msg.nr(), oldest.msg.ns()) > 0
 }
 
 func (xport *transport) recvFrame(rawMsg *rawMsg) (messages []controlMessage, err error) {
-	messages, err = parseMessageBuffer(rawMsg.b)
+	messages, err = xport.parser.parse(rawMsg.b)
 	if err != nil {
 		return nil, err
 	}
@@ -357,47 +707,308 @@ func (xport *transport) recvFrame(rawMsg *rawMsg) (messages []controlMessage, er
 	return messages, nil
 }
 
+// recvMessage handles the next message in sequence from the peer.
 func (xport *transport) recvMessage(msg controlMessage) {
-	if xport.slowStart.msgIsInSequence(msg) {
 
-		level.Debug(xport.logger).Log(
-			"message", "recv",
-			"message_type", msg.getType())
+	level.Debug(xport.logger).Log(
+		"message", "recv",
+		"message_type", msg.getType())
 
-		xport.toggleAckTimer(true)
-		xport.resetHelloTimer()
-		xport.slowStart.incrementNr()
-		xport.recvChan <- msg
-	} else if xport.slowStart.msgIsStale(msg) {
+	xport.toggleAckTimer(true)
+	xport.resetHelloTimer()
+	xport.slowStart.incrementNr()
+	xport.msgsRecvd++
+
+	// Once we've sent StopCCN the control connection is going
+	// away, so there's no point passing further messages up.
+	if xport.stopErr != nil {
+		return
+	}
+
+	// Don't allow messages which don't conform to the RFCs to
+	// reach the protocol state machines.
+	if err := validateMessage(msg); err != nil {
+		xport.rejectMessage(msg, err)
+		return
+	}
+
+	// An L2TPv2 peer ignores the L2TPv3 AVPs of a fallback mode SCCRQ,
+	// but an L2TPv3 peer only accepts it if fallback mode is enabled.
+	if xport.config.Version == ProtocolVersion3 && messageVersion(msg) == ProtocolVersion3Fallback {
+		xport.rejectMessage(msg, errors.New("RFC3931 fallback mode is not enabled"))
+		return
+	}
+
+	if t := msg.getType(); t == avpMsgTypeSccrq || t == avpMsgTypeSccrp {
+		xport.setPeerRxWindow(msg)
+		xport.setPeerControlConnID(msg)
+	}
+
+	if xport.onRecv != nil {
+		xport.onRecv(msg)
+		return
+	}
+	xport.recvChan <- msg
+}
+
+// queueRxMessage adds a message to the receive queue pending in-sequence
+// delivery.  So that a misbehaving peer can't have us buffer without
+// limit, messages beyond our receive window and duplicates of messages
+// already queued are discarded: the peer will retransmit them.  Acks
+// aren't queued since processAckQueue has already dealt with them, while
+// messages we've already received are acked again in case our previous
+// ack was lost.
+func (xport *transport) queueRxMessage(msg controlMessage) {
+	if msg.getType() == avpMsgTypeAck {
+		return
+	}
+
+	if xport.slowStart.msgIsStale(msg) {
 		_ = xport.sendExplicitAck()
+		return
+	}
+
+	if seqCompare(msg.ns(), xport.slowStart.nr+xport.config.RxWindowSize) >= 0 {
+		level.Debug(xport.logger).Log(
+			"message", "discarding message beyond receive window",
+			"message_type", msg.getType(),
+			"ns", msg.ns(),
+			"nr", xport.slowStart.nr)
+		xport.rxWindowDrops++
+		return
+	}
+
+	if xport.rxQueue.has(msg.ns()) {
+		level.Debug(xport.logger).Log(
+			"message", "discarding duplicate message",
+			"message_type", msg.getType(),
+			"ns", msg.ns())
+		return
 	}
+
+	// Queued messages outlive the frame they were parsed from, so
+	// every message we queue is copied.  Acks, stale messages and
+	// messages we discard aren't copied.
+	xport.rxQueue.insert(retainMessage(msg))
 }
 
-func (xport *transport) dequeueRxMessage() bool {
-	for i, msg := range xport.rxQueue {
-		if xport.slowStart.msgIsInSequence(msg) || xport.slowStart.msgIsStale(msg) {
-			// Remove the message from the rx queue, and bubble it up for
-			// processing.
-			// In general we don't need to do anything more with an ack message
-			// since they're just for the transport's purposes, so just drop them
-			xport.rxQueue = append(xport.rxQueue[:i], xport.rxQueue[i+1:]...)
-			if msg.getType() != avpMsgTypeAck {
-				xport.recvMessage(msg)
+// rejectMessage responds to an invalid message received from the peer.
+// Invalid session messages are rejected using CDN, while any other invalid
+// message causes the control connection to be shut down using StopCCN.
+func (xport *transport) rejectMessage(msg controlMessage, reason error) {
+
+	level.Error(xport.logger).Log(
+		"message", "rejecting invalid message",
+		"message_type", msg.getType(),
+		"error", reason)
+
+	errCode := avpErrorCodeBadValue
+	switch e := reason.(type) {
+	case *schemaError:
+		errCode = e.errorCode()
+	case *unknownMandatoryAVPError:
+		errCode = avpErrorCodeMBitShutdown
+	}
+
+	if !isSessionMessage(msg.getType()) {
+		xport.shutdown(errCode, reason)
+		return
+	}
+
+	// A CDN indicates the peer has torn the session down already
+	if msg.getType() == avpMsgTypeCdn {
+		return
+	}
+
+	localSID, peerSID := messageSessionIDs(msg)
+	cdn, err := newCDNMessage(xport.config.Version,
+		xport.config.PeerControlConnID,
+		localSID, peerSID,
+		resultCode{
+			result:  avpCDNResultCodeGeneralError,
+			errCode: errCode,
+			errMsg:  reason.Error(),
+		})
+	if err != nil {
+		level.Error(xport.logger).Log(
+			"message", "failed to build CDN message",
+			"error", err)
+		return
+	}
+
+	xport.txQueue.push(&ctlMsg{
+		xport:      xport,
+		msg:        cdn,
+		onComplete: func(m *ctlMsg, err error) {},
+	})
+}
+
+// messageSessionIDs extracts our session ID and the peer's session ID
+// from a session message received from the peer.  IDs not carried by
+// the message are returned as zero.
+func messageSessionIDs(msg controlMessage) (localSID, peerSID ControlConnID) {
+	for _, a := range msg.getAvps() {
+		if a.vendorID() != vendorIDIetf {
+			continue
+		}
+		switch a.getType() {
+		case avpTypeSessionID:
+			if v, err := a.decodeUint16Data(); err == nil {
+				peerSID = ControlConnID(v)
+			}
+		case avpTypeLocalSessionID:
+			if v, err := a.decodeUint32Data(); err == nil {
+				peerSID = ControlConnID(v)
+			}
+		case avpTypeRemoteSessionID:
+			if v, err := a.decodeUint32Data(); err == nil {
+				localSID = ControlConnID(v)
+			}
+		}
+	}
+	if v2msg, ok := msg.(*v2ControlMessage); ok {
+		localSID = ControlConnID(v2msg.Sid())
+	}
+	return
+}
+
+// shutdown sends StopCCN to the peer with a General Error result code.
+// The transport is brought down once the StopCCN has been acked, or
+// its transmission has failed.
+func (xport *transport) shutdown(errCode avpErrorCode, reason error) {
+	if xport.stopErr != nil {
+		return
+	}
+	xport.stopErr = reason
+
+	msg, err := newStopCCNMessage(xport.config.Version,
+		xport.config.ControlConnID,
+		xport.config.PeerControlConnID,
+		resultCode{
+			result:  avpStopCCNResultCodeGeneralError,
+			errCode: errCode,
+			errMsg:  reason.Error(),
+		})
+	if err != nil {
+		level.Error(xport.logger).Log(
+			"message", "failed to build StopCCN message",
+			"error", err)
+		xport.stopChan <- reason
+		return
+	}
+
+	xport.txQueue.push(&ctlMsg{
+		xport: xport,
+		msg:   msg,
+		onComplete: func(m *ctlMsg, err error) {
+			m.xport.stopChan <- m.xport.stopErr
+		},
+	})
+}
+
+// advertiseRxWindow adds our Receive Window Size AVP to SCCRQ and SCCRP
+// messages.  Messages already carrying the AVP are left unchanged.
+func (xport *transport) advertiseRxWindow(msg controlMessage) {
+	if t := msg.getType(); t != avpMsgTypeSccrq && t != avpMsgTypeSccrp {
+		return
+	}
+	if _, ok := findRxWindowSize(msg); ok {
+		return
+	}
+	a, err := newAvp(vendorIDIetf, avpTypeRxWindowSize, xport.config.RxWindowSize)
+	if err != nil {
+		level.Error(xport.logger).Log(
+			"message", "failed to build Receive Window Size AVP",
+			"error", err)
+		return
+	}
+	msg.appendAvp(a)
+}
+
+// setPeerRxWindow limits the transmit window to the receive window the
+// peer advertised in its SCCRQ or SCCRP.  A peer which doesn't send the
+// Receive Window Size AVP has a window of 4 messages, as per RFC2661
+// section 4.4.3 and RFC3931 section 5.4.3.
+func (xport *transport) setPeerRxWindow(msg controlMessage) {
+	rws, ok := findRxWindowSize(msg)
+	if !ok || rws == 0 {
+		rws = 4
+	}
+
+	xport.txWindow = xport.config.TxWindowSize
+	if rws < xport.txWindow {
+		xport.txWindow = rws
+	}
+	if xport.slowStart.cwnd > xport.txWindow {
+		xport.slowStart.cwnd = xport.txWindow
+	}
+	if xport.slowStart.thresh > xport.txWindow {
+		xport.slowStart.thresh = xport.txWindow
+	}
+
+	level.Debug(xport.logger).Log(
+		"message", "peer receive window",
+		"rx_window_size", rws,
+		"tx_window_size", xport.txWindow)
+}
+
+// setPeerControlConnID records the control connection ID the peer
+// assigned in its SCCRQ or SCCRP, for use in transport-generated messages.
+// A dynamic tunnel doesn't know the peer's ID until the peer assigns it,
+// while the ID of any other tunnel is configured and left unchanged.
+func (xport *transport) setPeerControlConnID(msg controlMessage) {
+	if xport.config.PeerControlConnID != 0 {
+		return
+	}
+	if ccid, ok := findAssignedConnID(msg); ok {
+		xport.config.PeerControlConnID = ccid
+	}
+}
+
+// findAssignedConnID returns the control connection ID assigned by the
+// sender of a message, if present.  The L2TPv3 Assigned Control Connection
+// ID AVP is preferred to the L2TPv2 Assigned Tunnel ID AVP since both are
+// carried by a fallback mode SCCRQ.
+func findAssignedConnID(msg controlMessage) (ccid ControlConnID, ok bool) {
+	for _, a := range msg.getAvps() {
+		if a.vendorID() != vendorIDIetf {
+			continue
+		}
+		switch a.getType() {
+		case avpTypeAssignedConnID:
+			if v, err := a.decodeUint32Data(); err == nil {
+				return ControlConnID(v), true
+			}
+		case avpTypeTunnelID:
+			if v, err := a.decodeUint16Data(); err == nil {
+				ccid, ok = ControlConnID(v), true
 			}
-			return true
 		}
 	}
-	return false
+	return
+}
+
+// findRxWindowSize returns the receive window size carried by a
+// message, if present.
+func findRxWindowSize(msg controlMessage) (value uint16, ok bool) {
+	for _, a := range msg.getAvps() {
+		if a.vendorID() == vendorIDIetf && a.getType() == avpTypeRxWindowSize {
+			value, err := a.decodeUint16Data()
+			return value, err == nil
+		}
+	}
+	return 0, false
 }
 
 func (xport *transport) processRxQueue() {
-	// Loop the receive queue looking for messages in sequence.
-	// We give up once we've been through the queue without finding
-	// an in-sequence message.
+	// Deliver queued messages for as long as we have the next
+	// message in sequence.
 	for {
-		if !xport.dequeueRxMessage() {
+		msg := xport.rxQueue.take(xport.slowStart.nr)
+		if msg == nil {
 			return
 		}
+		xport.recvMessage(msg)
 	}
 }
 
@@ -417,17 +1028,42 @@ func (xport *transport) sendMessage1(msg controlMessage, isRetransmit bool) erro
 		"nr", msg.nr(),
 		"isRetransmit", isRetransmit)
 
-	// Render as a byte slice and send.
+	return xport.writeMessage(msg)
+}
+
+// writeMessage renders a message whose sequence numbers have been set
+// as a byte slice and sends it.
+func (xport *transport) writeMessage(msg controlMessage) error {
 	b, err := msg.toBytes()
 	if err == nil {
 		_, err = xport.cp.write(b)
+		if err == nil {
+			xport.msgsSent++
+			xport.captureFrame(b, xport.cp.localAddr(), xport.cp.remoteAddr(), true)
+		}
 	}
 	return err
 }
 
-// Exponential retry timeout scaling as per RFC2661/RFC3931
+// Exponential retry timeout scaling as per RFC2661/RFC3931.  The interval
+// is capped at the RFC-recommended maximum, unless the configured retry
+// timeout is larger still.
 func (xport *transport) scaleRetryTimeout(msg *ctlMsg) time.Duration {
-	return xport.config.RetryTimeout * (1 << msg.nretries)
+	timeout := xport.config.RetryTimeout
+	limit := maxRetryTimeout
+	if xport.config.RetryMode == RetryModeAdaptive && xport.rtt.measured {
+		timeout = xport.rtt.rto
+	}
+	if timeout > limit {
+		limit = timeout
+	}
+	for i := uint(0); i < msg.nretries && timeout < limit; i++ {
+		timeout *= 2
+	}
+	if timeout > limit {
+		timeout = limit
+	}
+	return timeout
 }
 
 func (xport *transport) sendMessage(msg *ctlMsg) error {
@@ -438,14 +1074,54 @@ func (xport *transport) sendMessage(msg *ctlMsg) error {
 		xport.resetHelloTimer()
 		if msg.msg.getType() != avpMsgTypeAck && msg.nretries == 0 {
 			xport.slowStart.incrementNs()
+			msg.sentAt = xport.config.Clock.Now()
 		}
-		msg.retryTimer = time.AfterFunc(xport.scaleRetryTimeout(msg), func() {
-			xport.retryChan <- msg
-		})
+		xport.scheduleRetry(msg)
 	}
 	return err
 }
 
+// scheduleRetry adds a message to the retry wheel, bringing the retry
+// timer forward if the message is due before any other.
+func (xport *transport) scheduleRetry(msg *ctlMsg) {
+	msg.retry.when = xport.config.Clock.Now().Add(xport.scaleRetryTimeout(msg))
+	xport.retries.schedule(msg)
+	if !xport.retryArmed || msg.retry.when.Before(xport.retryDeadline) {
+		xport.setRetryTimer(msg.retry.when)
+	}
+}
+
+// processRetries retransmits the messages whose retry timeout has
+// expired, and rearms the retry timer for the next message due.
+// Messages which are acked are removed from the retry wheel, so the
+// timer may fire with nothing to do.
+func (xport *transport) processRetries() error {
+	xport.retryArmed = false
+	for _, e := range xport.retries.expire(xport.config.Clock.Now()) {
+		msg := e.(*ctlMsg)
+
+		level.Info(xport.logger).Log(
+			"message", "retransmit",
+			"message_type", msg.msg.getType())
+
+		err := xport.retransmitMessage(msg)
+		if err != nil {
+			msg.txComplete(err)
+			return err
+		}
+	}
+	if deadline, ok := xport.retries.next(); ok {
+		xport.setRetryTimer(deadline)
+	}
+	return nil
+}
+
+func (xport *transport) setRetryTimer(deadline time.Time) {
+	xport.retryArmed = true
+	xport.retryDeadline = deadline
+	xport.retryTimer.Reset(deadline.Sub(xport.config.Clock.Now()))
+}
+
 func (xport *transport) retransmitMessage(msg *ctlMsg) error {
 	msg.nretries++
 	if msg.nretries >= xport.config.MaxRetries {
@@ -455,43 +1131,65 @@ func (xport *transport) retransmitMessage(msg *ctlMsg) error {
 	err := xport.sendMessage(msg)
 	if err == nil {
 		xport.slowStart.onRetransmit()
+		xport.retransmits++
 	}
 	return err
 }
 
 func (xport *transport) processTxQueue() error {
-	// Loop the transmit queue sending messages in order while
-	// the transmit window is open.
-	for i, msg := range xport.txQueue {
-		if !xport.slowStart.canSend() {
-			// We've sent all we can for the time being.  This is not
-			// an error condition, so return successfully.
-			return nil
-		}
-
+	// Send messages in order while the transmit window is open.  Once
+	// we've sent all we can for the time being any remaining messages
+	// wait for acks to open the window: this is not an error condition.
+	for xport.txQueue.len() > 0 && xport.slowStart.canSend() {
 		// Remove from the tx queue, send, add to the ack queue
-		xport.txQueue = append(xport.txQueue[:i], xport.txQueue[i+1:]...)
+		msg := xport.txQueue.pop()
 		err := xport.sendMessage(msg)
-		if err == nil {
-			xport.ackQueue = append(xport.ackQueue, msg)
-			xport.slowStart.onSend()
-		} else {
+		if err != nil {
 			msg.txComplete(err)
 			return err
 		}
+		xport.ackQueue.push(msg)
+		xport.slowStart.onSend()
 	}
 	return nil
 }
 
+// cancelMessage withdraws a message from the transmit queue.  Messages
+// which have already been sent must be retransmitted until acked in order
+// to keep the sequence numbers in step with the peer, so they complete as
+// normal.
+func (xport *transport) cancelMessage(msg *ctlMsg) {
+	if xport.txQueue.remove(msg) {
+		msg.txComplete(errors.New("send cancelled"))
+	}
+}
+
+// processAckQueue completes the messages acked by a message received
+// from the peer.  Acks are cumulative and the ack queue is ordered by
+// sequence number, so the acked messages are at the head of the queue.
 func (xport *transport) processAckQueue(recvd controlMessage) bool {
 	found := false
-	for i, msg := range xport.ackQueue {
-		if seqCompare(recvd.nr(), msg.msg.ns()) > 0 {
-			xport.slowStart.onAck(xport.config.TxWindowSize)
-			xport.ackQueue = append(xport.ackQueue[:i], xport.ackQueue[i+1:]...)
-			msg.txComplete(nil)
-			found = true
+	for msg := xport.ackQueue.peek(); msg != nil; msg = xport.ackQueue.peek() {
+		if seqCompare(recvd.nr(), msg.msg.ns()) <= 0 {
+			break
 		}
+		xport.ackQueue.pop()
+		xport.slowStart.onAck(xport.txWindow)
+		// Ignore retransmitted messages when measuring round trip
+		// time, since we can't tell which transmission the peer acked.
+		if msg.nretries == 0 {
+			xport.rtt.update(xport.config.Clock.Now().Sub(msg.sentAt))
+		}
+		msg.txComplete(nil)
+		found = true
+	}
+	// Acked messages are removed from the retry wheel, which may leave
+	// the retry timer set for a message which no longer needs it.  Firing
+	// early is harmless, but once nothing is awaiting an ack the timer
+	// should stop.
+	if found && xport.retries.len() == 0 && xport.retryArmed {
+		xport.retryArmed = false
+		_ = xport.retryTimer.Stop()
 	}
 	return found
 }
@@ -499,27 +1197,24 @@ func (xport *transport) processAckQueue(recvd controlMessage) bool {
 func (xport *transport) down(err error) {
 
 	// Flush rx queue
-	for i := range xport.rxQueue {
-		xport.rxQueue = append(xport.rxQueue[:i], xport.rxQueue[i+1:]...)
-	}
+	xport.rxQueue.clear()
 
 	// Flush tx and ack queues: complete these messages to unblock
 	// callers pending on their completion.
-	for i, msg := range xport.txQueue {
-		xport.txQueue = append(xport.txQueue[:i], xport.txQueue[i+1:]...)
+	for msg := xport.txQueue.pop(); msg != nil; msg = xport.txQueue.pop() {
 		msg.txComplete(err)
 	}
-
-	for i, msg := range xport.ackQueue {
-		xport.ackQueue = append(xport.ackQueue[:i], xport.ackQueue[i+1:]...)
+	for msg := xport.ackQueue.pop(); msg != nil; msg = xport.ackQueue.pop() {
 		msg.txComplete(err)
 	}
+	xport.retries.clear()
 
 	// Stop timers: we don't care about the return value since
 	// the transport goroutine will return after calling this function
 	// and hence won't be able to process racing timer messages
 	xport.toggleAckTimer(false)
 	_ = xport.helloTimer.Stop()
+	_ = xport.retryTimer.Stop()
 
 	level.Error(xport.logger).Log(
 		"message", "transport down",
@@ -528,15 +1223,25 @@ func (xport *transport) down(err error) {
 	// Unblock recv path
 	close(xport.recvChan)
 
-	// Unblock control plane read goroutine
+	// Unblock control plane read goroutine.  A reactor must stop
+	// polling the sockets before they're closed.
+	if xport.reactor != nil {
+		xport.reactor.remove()
+	}
 	xport.cp.close()
 }
 
 func (xport *transport) toggleAckTimer(enable bool) {
+	// The ack is delayed from the first message we haven't acked,
+	// so that a steady stream of messages from the peer doesn't
+	// hold it back indefinitely.
 	if enable {
-		xport.ackTimer.Reset(xport.config.AckTimeout)
+		if !xport.ackPending {
+			xport.ackPending = true
+			xport.ackTimer.Reset(xport.config.AckTimeout)
+		}
 	} else {
-		// TODO: is this bad?
+		xport.ackPending = false
 		_ = xport.ackTimer.Stop()
 	}
 }
@@ -565,15 +1270,23 @@ func (xport *transport) sendHelloMessage() error {
 		return fmt.Errorf("failed to build hello message: %v", err)
 	}
 
-	return xport.sendMessage(&ctlMsg{
+	// HELLO is subject to the transmit window and acked like any other
+	// message.
+	xport.txQueue.push(&ctlMsg{
 		xport:      xport,
 		msg:        msg,
 		onComplete: helloSendComplete,
 	})
+	return xport.processTxQueue()
 }
 
 func helloSendComplete(m *ctlMsg, err error) {
 	m.xport.helloInFlight = false
+	// Ignore retransmitted messages when measuring round trip time, since
+	// we can't tell which transmission the peer acked.
+	if err == nil && m.nretries == 0 {
+		m.xport.helloRTT = m.xport.config.Clock.Now().Sub(m.sentAt)
+	}
 }
 
 func (xport *transport) sendExplicitAck() (err error) {
@@ -602,6 +1315,7 @@ func defaulttransportConfig() transportConfig {
 	return transportConfig{
 		HelloTimeout: 0 * time.Second,
 		TxWindowSize: 4,
+		RxWindowSize: 4,
 		MaxRetries:   3,
 		RetryTimeout: 1 * time.Second,
 		AckTimeout:   100 * time.Millisecond,
@@ -612,7 +1326,36 @@ func defaulttransportConfig() transportConfig {
 // newTransport creates a new RFC2661/RFC3931 reliable transport.
 // The control plane passed in is owned by the transport and will
 // be closed by the transport when the transport is closed.
-func newTransport(logger log.Logger, cp *controlPlane, cfg transportConfig) (xport *transport, err error) {
+func newTransport(logger log.Logger, cp controlPlaneConn, cfg transportConfig) (xport *transport, err error) {
+
+	xport, err = initTransport(logger, cp, cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// We always create timer instances even if they're not going to be used.
+	// This makes the logic for the transport go routine select easier to manage.
+	xport.helloTimer = newTimer(xport.config.Clock, xport.config.HelloTimeout)
+	xport.ackTimer = newTimer(xport.config.Clock, xport.config.AckTimeout)
+	xport.retryTimer = newTimer(xport.config.Clock, 0)
+
+	xport.wg.Add(2)
+	xport.resetHelloTimer()
+	go runTransport(xport, &xport.wg)
+	go cpRead(xport, cp, xport.cpChan, &xport.wg)
+
+	if listener := cp.natListener(); listener != nil {
+		xport.wg.Add(1)
+		go cpRead(xport, listener, xport.natChan, &xport.wg)
+	}
+
+	return xport, nil
+}
+
+// initTransport creates the transport state common to transports run by
+// goroutines of their own and those run by a reactor.  The timers are
+// left for the caller to create.
+func initTransport(logger log.Logger, cp controlPlaneConn, cfg transportConfig) (xport *transport, err error) {
 
 	if cp == nil {
 		return nil, errors.New("illegal nil control plane argument")
@@ -624,32 +1367,24 @@ func newTransport(logger log.Logger, cp *controlPlane, cfg transportConfig) (xpo
 	slowStart := slowStartState{}
 	slowStart.reset(cfg.TxWindowSize)
 
-	// We always create timer instances even if they're not going to be used.
-	// This makes the logic for the transport go routine select easier to manage.
-	helloTimer := newTimer(cfg.HelloTimeout)
-	ackTimer := newTimer(cfg.AckTimeout)
-
 	xport = &transport{
 		logger:     log.With(logger, "function", "transport"),
 		slowStart:  slowStart,
 		config:     cfg,
+		txWindow:   cfg.TxWindowSize,
 		cp:         cp,
-		helloTimer: helloTimer,
-		ackTimer:   ackTimer,
+		retries:    newTimerWheel(cfg.Clock.Now()),
 		sendChan:   make(chan *ctlMsg),
-		retryChan:  make(chan *ctlMsg),
+		cancelChan: make(chan *ctlMsg),
 		recvChan:   make(chan controlMessage),
-		cpChan:     make(chan *rawMsg),
-		rxQueue:    []controlMessage{},
-		txQueue:    []*ctlMsg{},
-		ackQueue:   []*ctlMsg{},
+		cpChan:     make(chan *rawMsg, rawMsgBatchLen),
+		natChan:    make(chan *rawMsg, rawMsgBatchLen),
+		stopChan:   make(chan error, 1),
+		statsChan:  make(chan chan TransportStats),
+		doneChan:   make(chan struct{}),
+		rxQueue:    newRxRing(cfg.RxWindowSize),
 	}
 
-	xport.wg.Add(2)
-	xport.resetHelloTimer()
-	go runTransport(xport, &xport.wg)
-	go cpRead(xport, &xport.wg)
-
 	return xport, nil
 }
 
@@ -663,15 +1398,42 @@ func (xport *transport) getConfig() transportConfig {
 // Failure indicates that the transport has failed and the parent tunnel
 // should be torn down.
 func (xport *transport) send(msg controlMessage) error {
+	return xport.sendContext(context.Background(), msg)
+}
+
+// sendContext is like send, but returns the context's error if cctx is
+// done before the message has been acked.  A message which is still
+// queued is withdrawn, but once it has been transmitted the transport
+// continues to retransmit it until it is acked or the retries run out.
+func (xport *transport) sendContext(cctx context.Context, msg controlMessage) error {
 	cm := ctlMsg{
-		xport:        xport,
-		msg:          msg,
-		completeChan: make(chan error),
+		xport: xport,
+		msg:   msg,
+		// Buffered so the transport never blocks completing a
+		// message the sender has given up on.
+		completeChan: make(chan error, 1),
 		onComplete:   sendComplete,
 	}
-	xport.sendChan <- &cm
-	err := <-cm.completeChan
-	return err
+	if xport.reactor != nil {
+		return xport.reactorSend(cctx, &cm)
+	}
+	select {
+	case xport.sendChan <- &cm:
+	case <-xport.doneChan:
+		return errors.New("transport is down")
+	case <-cctx.Done():
+		return cctx.Err()
+	}
+	select {
+	case err := <-cm.completeChan:
+		return err
+	case <-cctx.Done():
+		select {
+		case xport.cancelChan <- &cm:
+		case <-xport.doneChan:
+		}
+		return cctx.Err()
+	}
 }
 
 func sendComplete(m *ctlMsg, err error) {
@@ -690,8 +1452,121 @@ func (xport *transport) recv() (msg controlMessage, err error) {
 	return msg, nil
 }
 
+// stats returns a snapshot of the transport state.  It must only be
+// called from the transport goroutine, or from a reactor event handler.
+func (xport *transport) stats() TransportStats {
+	return TransportStats{
+		Ns:               xport.slowStart.ns,
+		Nr:               xport.slowStart.nr,
+		Cwnd:             xport.slowStart.cwnd,
+		Thresh:           xport.slowStart.thresh,
+		TxWindow:         xport.txWindow,
+		InFlight:         xport.slowStart.ntx,
+		TxQueueLen:       xport.txQueue.len(),
+		AckQueueLen:      xport.ackQueue.len(),
+		RxQueueLen:       xport.rxQueue.len(),
+		MessagesSent:     xport.msgsSent,
+		MessagesReceived: xport.msgsRecvd,
+		Retransmits:      xport.retransmits,
+		RxWindowDrops:    xport.rxWindowDrops,
+		SRTT:             xport.rtt.srtt,
+		RTTVar:           xport.rtt.rttvar,
+		RTO:              xport.rtt.rto,
+		HelloRTT:         xport.helloRTT,
+	}
+}
+
+// getStats queries the transport state.  The state is owned by the
+// transport goroutine, so this fails once the transport is down.
+func (xport *transport) getStats() (*TransportStats, error) {
+	if xport.reactor != nil {
+		var stats TransportStats
+		err := xport.runEvent(func() error {
+			stats = xport.stats()
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		return &stats, nil
+	}
+	c := make(chan TransportStats, 1)
+	select {
+	case xport.statsChan <- c:
+		stats := <-c
+		return &stats, nil
+	case <-xport.doneChan:
+		return nil, errors.New("transport is down")
+	}
+}
+
 // close closes the transport.
 func (xport *transport) close() {
-	close(xport.sendChan)
-	xport.wg.Wait()
+	if xport.reactor != nil {
+		xport.loopMutex.Lock()
+		if !xport.isDown {
+			xport.reactorDown(errors.New("transport shut down by user"))
+		}
+		xport.loopMutex.Unlock()
+	} else {
+		close(xport.sendChan)
+		xport.wg.Wait()
+	}
+	xport.stopCapture()
+}
+
+// startCapture starts writing the control frames sent and received by
+// the transport to a pcapng file.  If maxSize is non-zero the file is
+// rotated when it reaches maxSize bytes.  Any capture already running
+// is stopped.
+func (xport *transport) startCapture(path string, maxSize int64) error {
+	c, err := newCapture(path, maxSize)
+	if err != nil {
+		return err
+	}
+
+	xport.captureMutex.Lock()
+	defer xport.captureMutex.Unlock()
+
+	if xport.capture != nil {
+		_ = xport.capture.close()
+	}
+	xport.capture = c
+
+	level.Info(xport.logger).Log(
+		"message", "capture started",
+		"file", path)
+
+	return nil
+}
+
+// stopCapture stops writing control frames to the capture file.
+func (xport *transport) stopCapture() {
+	xport.captureMutex.Lock()
+	defer xport.captureMutex.Unlock()
+
+	if xport.capture != nil {
+		_ = xport.capture.close()
+		xport.capture = nil
+	}
+}
+
+// captureFrame writes a control frame to the capture file, if enabled.
+// If the frame can't be written the capture is stopped.
+func (xport *transport) captureFrame(b []byte, src, dst unix.Sockaddr, outbound bool) {
+	xport.captureMutex.Lock()
+	defer xport.captureMutex.Unlock()
+
+	if xport.capture == nil {
+		return
+	}
+
+	err := xport.capture.writeFrame(b, src, dst, outbound, xport.config.Clock.Now())
+	if err != nil {
+		level.Error(xport.logger).Log(
+			"message", "capture failed",
+			"error", err)
+		_ = xport.capture.close()
+		xport.capture = nil
+	}
 }
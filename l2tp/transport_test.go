@@ -2,6 +2,7 @@ package l2tp
 
 import (
 	"fmt"
+	"net"
 	"os"
 	"testing"
 	"time"
@@ -387,3 +388,1229 @@ func TestBasicSendReceive(t *testing.T) {
 			})
 	}
 }
+
+func TestDeferredConnect(t *testing.T) {
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+
+	cp, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(): %v", err)
+	}
+
+	err = cp.bind()
+	if err != nil {
+		t.Fatalf("cp.bind(): %v", err)
+	}
+
+	connected := make(chan unix.Sockaddr, 1)
+	cp.onConnect = func(cp *controlPlane) error {
+		connected <- cp.remote
+		return nil
+	}
+
+	// The peer receives on the port we target, but replies from another
+	peerRx, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9001})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer peerRx.Close()
+
+	peerTx, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9002})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer peerTx.Close()
+
+	cfg := transportConfig{
+		Version:           ProtocolVersion2,
+		AckTimeout:        5 * time.Millisecond,
+		PeerControlConnID: 90,
+	}
+
+	xport, err := newTransport(
+		level.NewFilter(log.NewLogfmtLogger(os.Stderr),
+			level.AllowDebug(), level.AllowInfo()),
+		cp, cfg)
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+	defer xport.close()
+
+	msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+	if err != nil {
+		t.Fatalf("failed to build Hello message: %v", err)
+	}
+
+	sendCompletion := make(chan error)
+	go func() {
+		sendCompletion <- xport.send(msg)
+	}()
+
+	b := make([]byte, 4096)
+	_, _, err = peerRx.ReadFromUDP(b)
+	if err != nil {
+		t.Fatalf("ReadFromUDP(): %v", err)
+	}
+
+	ack, err := newV2ControlMessage(42, 0, []avp{})
+	if err != nil {
+		t.Fatalf("newV2ControlMessage(): %v", err)
+	}
+	ack.setTransportSeqNum(0, 1)
+	b, err = ack.toBytes()
+	if err != nil {
+		t.Fatalf("toBytes(): %v", err)
+	}
+
+	_, err = peerTx.WriteToUDP(b, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000})
+	if err != nil {
+		t.Fatalf("WriteToUDP(): %v", err)
+	}
+
+	err = <-sendCompletion
+	if err != nil {
+		t.Fatalf("send(): %v", err)
+	}
+
+	remote := <-connected
+	_, port, err := sockaddrAddrPort(remote)
+	if err != nil {
+		t.Fatalf("sockaddrAddrPort(): %v", err)
+	}
+	if port != 9002 {
+		t.Errorf("expected control plane to connect to peer port 9002, got %v", port)
+	}
+}
+
+func TestNATTraversal(t *testing.T) {
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+
+	cp, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(): %v", err)
+	}
+
+	err = cp.enableNATTraversal()
+	if err != nil {
+		t.Fatalf("cp.enableNATTraversal(): %v", err)
+	}
+
+	err = cp.bind()
+	if err != nil {
+		t.Fatalf("cp.bind(): %v", err)
+	}
+
+	err = cp.connect()
+	if err != nil {
+		t.Fatalf("cp.connect(): %v", err)
+	}
+
+	// The peer's original address
+	peerOld, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9001})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer peerOld.Close()
+
+	// The peer's address after its NAT binding has changed
+	peerNew, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9003})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer peerNew.Close()
+
+	cfg := transportConfig{
+		Version:           ProtocolVersion2,
+		AckTimeout:        5 * time.Millisecond,
+		PeerControlConnID: 90,
+		ControlConnID:     42,
+	}
+
+	xport, err := newTransport(
+		level.NewFilter(log.NewLogfmtLogger(os.Stderr),
+			level.AllowDebug(), level.AllowInfo()),
+		cp, cfg)
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+	defer xport.close()
+
+	hello, err := newV2ControlMessage(42, 0, []avp{})
+	if err != nil {
+		t.Fatalf("newV2ControlMessage(): %v", err)
+	}
+	a, err := newAvp(vendorIDIetf, avpTypeMessage, avpMsgTypeHello)
+	if err != nil {
+		t.Fatalf("newAvp(): %v", err)
+	}
+	hello.appendAvp(a)
+	b, err := hello.toBytes()
+	if err != nil {
+		t.Fatalf("toBytes(): %v", err)
+	}
+
+	_, err = peerNew.WriteToUDP(b, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000})
+	if err != nil {
+		t.Fatalf("WriteToUDP(): %v", err)
+	}
+
+	msg, err := xport.recv()
+	if err != nil {
+		t.Fatalf("recv(): %v", err)
+	}
+	if msg.getType() != avpMsgTypeHello {
+		t.Fatalf("expected message %v, got %v", avpMsgTypeHello, msg.getType())
+	}
+
+	// The transport should now ack the HELLO to the peer's new address
+	err = peerNew.SetReadDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("SetReadDeadline(): %v", err)
+	}
+	b = make([]byte, 4096)
+	n, _, err := peerNew.ReadFromUDP(b)
+	if err != nil {
+		t.Fatalf("expected ack at peer's new address: %v", err)
+	}
+
+	messages, err := parseMessageBuffer(b[:n])
+	if err != nil {
+		t.Fatalf("parseMessageBuffer(): %v", err)
+	}
+	if len(messages) != 1 || messages[0].getType() != avpMsgTypeAck || messages[0].nr() != 1 {
+		t.Fatalf("expected ack with nr 1, got %v", messages)
+	}
+}
+
+func TestNATTraversalSpoofedPeer(t *testing.T) {
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+
+	cp, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(): %v", err)
+	}
+
+	err = cp.enableNATTraversal()
+	if err != nil {
+		t.Fatalf("cp.enableNATTraversal(): %v", err)
+	}
+
+	err = cp.bind()
+	if err != nil {
+		t.Fatalf("cp.bind(): %v", err)
+	}
+
+	err = cp.connect()
+	if err != nil {
+		t.Fatalf("cp.connect(): %v", err)
+	}
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9001})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer peer.Close()
+
+	// A host which has guessed our control connection ID
+	spoofer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9003})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer spoofer.Close()
+
+	cfg := transportConfig{
+		Version:           ProtocolVersion2,
+		AckTimeout:        5 * time.Millisecond,
+		PeerControlConnID: 90,
+		ControlConnID:     42,
+	}
+
+	xport, err := newTransport(
+		level.NewFilter(log.NewLogfmtLogger(os.Stderr),
+			level.AllowDebug(), level.AllowInfo()),
+		cp, cfg)
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+	defer xport.close()
+
+	spoofed, err := newV2ControlMessage(42, 0, []avp{})
+	if err != nil {
+		t.Fatalf("newV2ControlMessage(): %v", err)
+	}
+	a, err := newAvp(vendorIDIetf, avpTypeMessage, avpMsgTypeHello)
+	if err != nil {
+		t.Fatalf("newAvp(): %v", err)
+	}
+	spoofed.appendAvp(a)
+	// The spoofed frame has the right control connection ID, but its
+	// sequence numbers don't follow on from anything the peer has sent.
+	spoofed.setTransportSeqNum(5, 0)
+	b, err := spoofed.toBytes()
+	if err != nil {
+		t.Fatalf("toBytes(): %v", err)
+	}
+
+	_, err = spoofer.WriteToUDP(b, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000})
+	if err != nil {
+		t.Fatalf("WriteToUDP(): %v", err)
+	}
+
+	// Give the transport a chance to handle the spoofed frame
+	time.Sleep(50 * time.Millisecond)
+
+	msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+	if err != nil {
+		t.Fatalf("failed to build Hello message: %v", err)
+	}
+
+	sendCompletion := make(chan error)
+	go func() {
+		sendCompletion <- xport.send(msg)
+	}()
+
+	// The transport should still be sending to the peer, not the spoofer
+	err = peer.SetReadDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatalf("SetReadDeadline(): %v", err)
+	}
+	b = make([]byte, 4096)
+	n, _, err := peer.ReadFromUDP(b)
+	if err != nil {
+		t.Fatalf("expected HELLO at peer's address: %v", err)
+	}
+
+	messages, err := parseMessageBuffer(b[:n])
+	if err != nil {
+		t.Fatalf("parseMessageBuffer(): %v", err)
+	}
+	if len(messages) != 1 || messages[0].getType() != avpMsgTypeHello {
+		t.Fatalf("expected HELLO, got %v", messages)
+	}
+
+	err = spoofer.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if err != nil {
+		t.Fatalf("SetReadDeadline(): %v", err)
+	}
+	_, _, err = spoofer.ReadFromUDP(b)
+	if err == nil {
+		t.Errorf("expected spoofed peer address to be ignored")
+	}
+
+	ack, err := newV2ControlMessage(42, 0, []avp{})
+	if err != nil {
+		t.Fatalf("newV2ControlMessage(): %v", err)
+	}
+	ack.setTransportSeqNum(0, 1)
+	b, err = ack.toBytes()
+	if err != nil {
+		t.Fatalf("toBytes(): %v", err)
+	}
+
+	_, err = peer.WriteToUDP(b, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000})
+	if err != nil {
+		t.Fatalf("WriteToUDP(): %v", err)
+	}
+
+	err = <-sendCompletion
+	if err != nil {
+		t.Fatalf("send(): %v", err)
+	}
+}
+
+func TestUnknownMandatoryAVP(t *testing.T) {
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+
+	cp, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(): %v", err)
+	}
+
+	err = cp.bind()
+	if err != nil {
+		t.Fatalf("cp.bind(): %v", err)
+	}
+
+	err = cp.connect()
+	if err != nil {
+		t.Fatalf("cp.connect(): %v", err)
+	}
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9001})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer peer.Close()
+
+	xport, err := newTransport(
+		level.NewFilter(log.NewLogfmtLogger(os.Stderr),
+			level.AllowDebug(), level.AllowInfo()),
+		cp, transportConfig{
+			Version:           ProtocolVersion2,
+			PeerControlConnID: 90,
+			ControlConnID:     42,
+		})
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+	defer xport.close()
+
+	// HELLO carrying an unregistered vendor AVP with the mandatory bit set
+	b := []byte{
+		0xc8, 0x02, 0x00, 0x1a, 0x00, 0x2a, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x80, 0x08, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x06, 0x80, 0x06, 0x01, 0xef,
+		0x00, 0x01,
+	}
+	_, err = peer.WriteToUDP(b, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000})
+	if err != nil {
+		t.Fatalf("WriteToUDP(): %v", err)
+	}
+
+	// The transport should send StopCCN before going down
+	stopccn, err := testPeerRecvMessage(peer)
+	if err != nil {
+		t.Fatalf("expected StopCCN: %v", err)
+	}
+	err = testCheckResultCode(stopccn, avpMsgTypeStopccn,
+		avpStopCCNResultCodeGeneralError, avpErrorCodeMBitShutdown)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	err = testPeerSendAck(peer, stopccn, 0)
+	if err != nil {
+		t.Fatalf("failed to ack StopCCN: %v", err)
+	}
+
+	_, err = xport.recv()
+	if err == nil {
+		t.Fatalf("expected transport to go down on receipt of unknown mandatory AVP")
+	}
+}
+
+// testPeerRecvMessage reads a single control message from the peer socket.
+func testPeerRecvMessage(peer *net.UDPConn) (controlMessage, error) {
+	err := peer.SetReadDeadline(time.Now().Add(time.Second))
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, 4096)
+	n, _, err := peer.ReadFromUDP(b)
+	if err != nil {
+		return nil, err
+	}
+	messages, err := parseMessageBuffer(b[:n])
+	if err != nil {
+		return nil, err
+	}
+	if len(messages) != 1 {
+		return nil, fmt.Errorf("expected 1 message, got %d", len(messages))
+	}
+	return messages[0], nil
+}
+
+// testPeerSendAck acks a message received by the peer socket.
+func testPeerSendAck(peer *net.UDPConn, msg controlMessage, ns uint16) error {
+	ack, err := newV2ControlMessage(42, 0, []avp{})
+	if err != nil {
+		return err
+	}
+	ack.setTransportSeqNum(ns, seqIncrement(msg.ns()))
+	b, err := ack.toBytes()
+	if err != nil {
+		return err
+	}
+	_, err = peer.WriteToUDP(b, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000})
+	return err
+}
+
+// testCheckResultCode checks the type and result code of a message.
+func testCheckResultCode(msg controlMessage, msgType avpMsgType, result avpResultCode, errCode avpErrorCode) error {
+	if msg.getType() != msgType {
+		return fmt.Errorf("expected message %v, got %v", msgType, msg.getType())
+	}
+	for _, a := range msg.getAvps() {
+		if a.getType() == avpTypeResultCode {
+			rc, err := a.decodeResultCode()
+			if err != nil {
+				return err
+			}
+			if rc.result != result || rc.errCode != errCode || rc.errMsg == "" {
+				return fmt.Errorf("expected result %v error %v with message, got %v", result, errCode, rc)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("%v message has no result code", msgType)
+}
+
+func TestInvalidMessageRejected(t *testing.T) {
+	cases := []struct {
+		name string
+		// v2 message from the peer, with ns 0, lacking the Message Type AVP
+		avps []struct {
+			typ   avpType
+			value interface{}
+		}
+		msgType avpMsgType
+		sid     uint16
+		// if set, the message is the first the transport receives,
+		// before its socket is connected to the peer
+		deferConnect bool
+		// expected response
+		respType avpMsgType
+		result   avpResultCode
+		errCode  avpErrorCode
+	}{
+		{
+			name:    "hello with session AVP",
+			msgType: avpMsgTypeHello,
+			avps: []struct {
+				typ   avpType
+				value interface{}
+			}{
+				{avpTypeSessionID, uint16(12)},
+			},
+			respType: avpMsgTypeStopccn,
+			result:   avpStopCCNResultCodeGeneralError,
+			errCode:  avpErrorCodeBadValue,
+		},
+		{
+			name:    "stopccn missing result code",
+			msgType: avpMsgTypeStopccn,
+			avps: []struct {
+				typ   avpType
+				value interface{}
+			}{
+				{avpTypeTunnelID, uint16(90)},
+			},
+			respType: avpMsgTypeStopccn,
+			result:   avpStopCCNResultCodeGeneralError,
+			errCode:  avpErrorCodeBadLength,
+		},
+		{
+			name:    "icrq missing call serial number",
+			msgType: avpMsgTypeIcrq,
+			avps: []struct {
+				typ   avpType
+				value interface{}
+			}{
+				{avpTypeSessionID, uint16(12)},
+			},
+			respType: avpMsgTypeCdn,
+			result:   avpCDNResultCodeGeneralError,
+			errCode:  avpErrorCodeBadLength,
+		},
+		{
+			name:    "iccn with malformed connect speed",
+			msgType: avpMsgTypeIccn,
+			sid:     7,
+			avps: []struct {
+				typ   avpType
+				value interface{}
+			}{
+				// Connect Speed should be a uint32
+				{avpTypeConnectSpeed, avp{
+					header:  *newAvpHeader(true, false, 2, vendorIDIetf, avpTypeConnectSpeed),
+					payload: avpPayload{dataType: avpDataTypeUint32, data: []byte{0x25, 0x80}},
+				}},
+				{avpTypeFramingType, uint32(1)},
+			},
+			respType: avpMsgTypeCdn,
+			result:   avpCDNResultCodeGeneralError,
+			errCode:  avpErrorCodeBadLength,
+		},
+		{
+			name:    "iccn with unknown mandatory AVP",
+			msgType: avpMsgTypeIccn,
+			sid:     7,
+			avps: []struct {
+				typ   avpType
+				value interface{}
+			}{
+				{avpTypeConnectSpeed, uint32(9600)},
+				{avpTypeFramingType, uint32(1)},
+				{0, avp{
+					header:  *newAvpHeader(true, false, 2, 0x1ef, 0),
+					payload: avpPayload{dataType: avpDataTypeBytes, data: []byte{0x00, 0x01}},
+				}},
+			},
+			respType: avpMsgTypeCdn,
+			result:   avpCDNResultCodeGeneralError,
+			errCode:  avpErrorCodeMBitShutdown,
+		},
+		{
+			name:         "sccrq with unknown mandatory AVP before connect",
+			msgType:      avpMsgTypeSccrq,
+			deferConnect: true,
+			avps: []struct {
+				typ   avpType
+				value interface{}
+			}{
+				{avpTypeTunnelID, uint16(90)},
+				{0, avp{
+					header:  *newAvpHeader(true, false, 2, 0x1ef, 0),
+					payload: avpPayload{dataType: avpDataTypeBytes, data: []byte{0x00, 0x01}},
+				}},
+			},
+			respType: avpMsgTypeStopccn,
+			result:   avpStopCCNResultCodeGeneralError,
+			errCode:  avpErrorCodeMBitShutdown,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sal, sap, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+			if err != nil {
+				t.Fatalf("newUDPAddressPair(): %v", err)
+			}
+
+			cp, err := newL2tpControlPlane(sal, sap)
+			if err != nil {
+				t.Fatalf("newL2tpControlPlane(): %v", err)
+			}
+
+			err = cp.bind()
+			if err != nil {
+				t.Fatalf("cp.bind(): %v", err)
+			}
+
+			if !c.deferConnect {
+				err = cp.connect()
+				if err != nil {
+					t.Fatalf("cp.connect(): %v", err)
+				}
+			}
+
+			peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9001})
+			if err != nil {
+				t.Fatalf("ListenUDP(): %v", err)
+			}
+			defer peer.Close()
+
+			xport, err := newTransport(
+				level.NewFilter(log.NewLogfmtLogger(os.Stderr),
+					level.AllowDebug(), level.AllowInfo()),
+				cp, transportConfig{
+					Version:           ProtocolVersion2,
+					PeerControlConnID: 90,
+					ControlConnID:     42,
+				})
+			if err != nil {
+				t.Fatalf("newTransport(): %v", err)
+			}
+			defer xport.close()
+
+			a, err := newAvp(vendorIDIetf, avpTypeMessage, c.msgType)
+			if err != nil {
+				t.Fatalf("newAvp(): %v", err)
+			}
+			avps := []avp{*a}
+			for _, v := range c.avps {
+				if raw, ok := v.value.(avp); ok {
+					avps = append(avps, raw)
+					continue
+				}
+				a, err = newAvp(vendorIDIetf, v.typ, v.value)
+				if err != nil {
+					t.Fatalf("newAvp(): %v", err)
+				}
+				avps = append(avps, *a)
+			}
+			msg, err := newV2ControlMessage(42, ControlConnID(c.sid), avps)
+			if err != nil {
+				t.Fatalf("newV2ControlMessage(): %v", err)
+			}
+			b, err := msg.toBytes()
+			if err != nil {
+				t.Fatalf("toBytes(): %v", err)
+			}
+			_, err = peer.WriteToUDP(b, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000})
+			if err != nil {
+				t.Fatalf("WriteToUDP(): %v", err)
+			}
+
+			resp, err := testPeerRecvMessage(peer)
+			if err != nil {
+				t.Fatalf("expected %v: %v", c.respType, err)
+			}
+			err = testCheckResultCode(resp, c.respType, c.result, c.errCode)
+			if err != nil {
+				t.Fatalf("%v", err)
+			}
+			if resp.nr() != 1 {
+				t.Errorf("expected response to ack invalid message, got nr %v", resp.nr())
+			}
+			err = testPeerSendAck(peer, resp, 1)
+			if err != nil {
+				t.Fatalf("failed to ack %v: %v", c.respType, err)
+			}
+
+			if c.respType == avpMsgTypeStopccn {
+				_, err = xport.recv()
+				if err == nil {
+					t.Fatalf("expected transport to go down following StopCCN")
+				}
+				return
+			}
+
+			// The CDN should be addressed to the peer's session
+			v2resp := resp.(*v2ControlMessage)
+			localSID, peerSID := messageSessionIDs(msg)
+			if v2resp.Sid() != uint16(peerSID) {
+				t.Errorf("expected CDN for peer session %v, got %v", peerSID, v2resp.Sid())
+			}
+			if _, respPeerSID := messageSessionIDs(resp); respPeerSID != localSID {
+				t.Errorf("expected CDN to assign session %v, got %v", localSID, respPeerSID)
+			}
+
+			// Rejecting a session message should leave the transport up
+			hello, err := testBasicSendRecvSenderNewHelloMsg(&transportConfig{
+				Version:           ProtocolVersion2,
+				PeerControlConnID: 42,
+			})
+			if err != nil {
+				t.Fatalf("failed to build Hello message: %v", err)
+			}
+			hello.setTransportSeqNum(1, 1)
+			b, err = hello.toBytes()
+			if err != nil {
+				t.Fatalf("toBytes(): %v", err)
+			}
+			_, err = peer.WriteToUDP(b, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9000})
+			if err != nil {
+				t.Fatalf("WriteToUDP(): %v", err)
+			}
+			rcvd, err := xport.recv()
+			if err != nil {
+				t.Fatalf("recv(): %v", err)
+			}
+			if rcvd.getType() != avpMsgTypeHello {
+				t.Fatalf("expected message %v, got %v", avpMsgTypeHello, rcvd.getType())
+			}
+		})
+	}
+}
+
+func TestTransportStats(t *testing.T) {
+	sal, sap, err := newUDPAddressPair("127.0.0.1:9000", "127.0.0.1:9001")
+	if err != nil {
+		t.Fatalf("newUDPAddressPair(): %v", err)
+	}
+
+	cp, err := newL2tpControlPlane(sal, sap)
+	if err != nil {
+		t.Fatalf("newL2tpControlPlane(): %v", err)
+	}
+
+	err = cp.bind()
+	if err != nil {
+		t.Fatalf("cp.bind(): %v", err)
+	}
+
+	err = cp.connect()
+	if err != nil {
+		t.Fatalf("cp.connect(): %v", err)
+	}
+
+	peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9001})
+	if err != nil {
+		t.Fatalf("ListenUDP(): %v", err)
+	}
+	defer peer.Close()
+
+	xport, err := newTransport(
+		level.NewFilter(log.NewLogfmtLogger(os.Stderr),
+			level.AllowDebug(), level.AllowInfo()),
+		cp, transportConfig{
+			Version:           ProtocolVersion2,
+			HelloTimeout:      50 * time.Millisecond,
+			PeerControlConnID: 90,
+			ControlConnID:     42,
+		})
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+
+	hello, err := testPeerRecvMessage(peer)
+	if err != nil {
+		t.Fatalf("expected HELLO: %v", err)
+	}
+	if hello.getType() != avpMsgTypeHello {
+		t.Fatalf("expected message %v, got %v", avpMsgTypeHello, hello.getType())
+	}
+
+	// Until the HELLO is acked it should be in flight
+	stats, err := xport.getStats()
+	if err != nil {
+		t.Fatalf("getStats(): %v", err)
+	}
+	if stats.InFlight != 1 || stats.AckQueueLen != 1 || stats.MessagesSent != 1 || stats.HelloRTT != 0 {
+		t.Errorf("unexpected stats before ack: %+v", stats)
+	}
+
+	err = testPeerSendAck(peer, hello, 0)
+	if err != nil {
+		t.Fatalf("failed to ack HELLO: %v", err)
+	}
+
+	// The ack is processed asynchronously
+	for i := 0; i < 100; i++ {
+		stats, err = xport.getStats()
+		if err != nil {
+			t.Fatalf("getStats(): %v", err)
+		}
+		if stats.HelloRTT != 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if stats.HelloRTT == 0 || stats.Ns == 0 || stats.Retransmits != 0 {
+		t.Errorf("unexpected stats after ack: %+v", stats)
+	}
+
+	xport.close()
+
+	_, err = xport.getStats()
+	if err == nil {
+		t.Errorf("expected getStats() to fail once the transport is closed")
+	}
+}
+
+// testMemPeerSend writes a message to the transport from the peer end
+// of an in-memory control plane pair.
+func testMemPeerSend(peer *memControlPlane, msg controlMessage, ns, nr uint16) error {
+	msg.setTransportSeqNum(ns, nr)
+	b, err := msg.toBytes()
+	if err != nil {
+		return err
+	}
+	_, err = peer.write(b)
+	return err
+}
+
+// testMemPeerRecv reads messages sent by the transport to the peer end
+// of an in-memory control plane pair, skipping acks.
+func testMemPeerRecv(peer *memControlPlane) (controlMessage, error) {
+	b := make([]byte, 4096)
+	for {
+		n, _, err := peer.recvFrom(b)
+		if err != nil {
+			return nil, err
+		}
+		messages, err := parseMessageBuffer(b[:n])
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) != 1 {
+			return nil, fmt.Errorf("expected 1 message, got %d", len(messages))
+		}
+		if messages[0].getType() != avpMsgTypeAck {
+			return messages[0], nil
+		}
+	}
+}
+
+// testWaitForStats polls the transport state until cond is satisfied.
+func testWaitForStats(xport *transport, cond func(s *TransportStats) bool) (*TransportStats, error) {
+	for i := 0; i < 500; i++ {
+		stats, err := xport.getStats()
+		if err != nil {
+			return nil, err
+		}
+		if cond(stats) {
+			return stats, nil
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return nil, fmt.Errorf("timed out waiting for transport state")
+}
+
+func TestReceiveWindow(t *testing.T) {
+	sa, sb := testMemAddressPair(t)
+	cpa, peer := newMemControlPlanePair(sa, sb, memLinkConfig{}, memLinkConfig{})
+	defer peer.close()
+
+	xport, err := newTransport(
+		level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo()),
+		cpa, transportConfig{
+			Version:           ProtocolVersion3,
+			RxWindowSize:      2,
+			PeerControlConnID: 1,
+		})
+	if err != nil {
+		t.Fatalf("newTransport(): %v", err)
+	}
+	defer xport.close()
+
+	// With Nr 0 and a window of 2, ns 0 and 1 may be buffered.
+	// Messages 2 and 3 are beyond the window, while the second
+	// message 1 is a duplicate.
+	cfg := xport.getConfig()
+	for _, ns := range []uint16{1, 2, 3, 1} {
+		msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+		if err != nil {
+			t.Fatalf("failed to build Hello message: %v", err)
+		}
+		err = testMemPeerSend(peer, msg, ns, 0)
+		if err != nil {
+			t.Fatalf("failed to send Hello message: %v", err)
+		}
+	}
+	stats, err := testWaitForStats(xport, func(s *TransportStats) bool {
+		return s.RxWindowDrops == 2
+	})
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	if stats.RxQueueLen != 1 {
+		t.Errorf("expected 1 message queued, got %v", stats.RxQueueLen)
+	}
+
+	// Filling the gap releases the buffered message
+	msg, err := testBasicSendRecvSenderNewHelloMsg(&cfg)
+	if err != nil {
+		t.Fatalf("failed to build Hello message: %v", err)
+	}
+	err = testMemPeerSend(peer, msg, 0, 0)
+	if err != nil {
+		t.Fatalf("failed to send Hello message: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		msg, err := xport.recv()
+		if err != nil {
+			t.Fatalf("recv(): %v", err)
+		}
+		if msg.ns() != uint16(i) {
+			t.Errorf("expected ns %v, got %v", i, msg.ns())
+		}
+	}
+	stats, err = xport.getStats()
+	if err != nil {
+		t.Fatalf("getStats(): %v", err)
+	}
+	if stats.Nr != 2 || stats.RxQueueLen != 0 || stats.MessagesReceived != 2 {
+		t.Errorf("unexpected stats after filling the gap: %+v", stats)
+	}
+}
+
+func TestReceiveWindowSizeAVP(t *testing.T) {
+	cases := []struct {
+		name               string
+		txWindow, rxWindow uint16
+		peerRxWindow       uint16
+		expectTxWindow     uint16
+		expectAdvertised   uint16
+	}{
+		{
+			name:             "peer window smaller",
+			txWindow:         10,
+			rxWindow:         8,
+			peerRxWindow:     2,
+			expectTxWindow:   2,
+			expectAdvertised: 8,
+		},
+		{
+			name:             "peer window larger",
+			txWindow:         3,
+			peerRxWindow:     16,
+			expectTxWindow:   3,
+			expectAdvertised: 4,
+		},
+		{
+			name:             "peer window absent",
+			txWindow:         10,
+			rxWindow:         32,
+			expectTxWindow:   4,
+			expectAdvertised: 32,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sa, sb := testMemAddressPair(t)
+			cpa, peer := newMemControlPlanePair(sa, sb, memLinkConfig{}, memLinkConfig{})
+			defer peer.close()
+
+			xport, err := newTransport(
+				level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo()),
+				cpa, transportConfig{
+					Version:           ProtocolVersion3,
+					TxWindowSize:      c.txWindow,
+					RxWindowSize:      c.rxWindow,
+					PeerControlConnID: 1,
+				})
+			if err != nil {
+				t.Fatalf("newTransport(): %v", err)
+			}
+			defer xport.close()
+
+			sccrq, err := messageToControlMessage(&SCCRQ{
+				MessageHeader:  MessageHeader{Version: ProtocolVersion3, TunnelID: 1},
+				HostName:       "lac",
+				RouterID:       1,
+				AssignedConnID: 2,
+				PseudowireCaps: []uint16{uint16(PseudowireTypeEth)},
+			})
+			if err != nil {
+				t.Fatalf("failed to build SCCRQ: %v", err)
+			}
+			errChan := make(chan error, 1)
+			go func() {
+				errChan <- xport.send(sccrq)
+			}()
+
+			// Our SCCRQ should advertise our receive window
+			msg, err := testMemPeerRecv(peer)
+			if err != nil {
+				t.Fatalf("failed to receive SCCRQ: %v", err)
+			}
+			rws, ok := findRxWindowSize(msg)
+			if !ok || rws != c.expectAdvertised {
+				t.Errorf("expected Receive Window Size AVP %v, got %v (present: %v)",
+					c.expectAdvertised, rws, ok)
+			}
+
+			sccrp, err := messageToControlMessage(&SCCRP{
+				MessageHeader:  MessageHeader{Version: ProtocolVersion3, TunnelID: 2},
+				HostName:       "lns",
+				RouterID:       2,
+				AssignedConnID: 1,
+				RxWindowSize:   c.peerRxWindow,
+				PseudowireCaps: []uint16{uint16(PseudowireTypeEth)},
+			})
+			if err != nil {
+				t.Fatalf("failed to build SCCRP: %v", err)
+			}
+			err = testMemPeerSend(peer, sccrp, 0, 1)
+			if err != nil {
+				t.Fatalf("failed to send SCCRP: %v", err)
+			}
+			err = <-errChan
+			if err != nil {
+				t.Fatalf("send(): %v", err)
+			}
+			_, err = xport.recv()
+			if err != nil {
+				t.Fatalf("recv(): %v", err)
+			}
+
+			stats, err := xport.getStats()
+			if err != nil {
+				t.Fatalf("getStats(): %v", err)
+			}
+			if stats.TxWindow != c.expectTxWindow || stats.Thresh > c.expectTxWindow {
+				t.Errorf("expected tx window %v, got %+v", c.expectTxWindow, stats)
+			}
+		})
+	}
+}
+
+func TestFallbackSCCRQ(t *testing.T) {
+	cases := []struct {
+		name    string
+		version ProtocolVersion
+		accept  bool
+	}{
+		{name: "fallback", version: ProtocolVersion3Fallback, accept: true},
+		{name: "l2tpv2", version: ProtocolVersion2, accept: true},
+		{name: "l2tpv3", version: ProtocolVersion3, accept: false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sa, sb := testMemAddressPair(t)
+			cpa, peer := newMemControlPlanePair(sa, sb, memLinkConfig{}, memLinkConfig{})
+			defer peer.close()
+
+			xport, err := newTransport(
+				level.NewFilter(log.NewLogfmtLogger(os.Stderr), level.AllowInfo()),
+				cpa, transportConfig{
+					Version:           c.version,
+					PeerControlConnID: 2,
+				})
+			if err != nil {
+				t.Fatalf("newTransport(): %v", err)
+			}
+			defer xport.close()
+
+			sccrq, err := messageToControlMessage(&SCCRQ{
+				MessageHeader:    MessageHeader{Version: ProtocolVersion3Fallback},
+				ProtocolVersion:  []byte{0x01, 0x00},
+				FramingCap:       0x3,
+				HostName:         "lcce",
+				AssignedTunnelID: 2,
+				RouterID:         1,
+				AssignedConnID:   2,
+				PseudowireCaps:   []uint16{uint16(PseudowireTypeEth)},
+			})
+			if err != nil {
+				t.Fatalf("failed to build SCCRQ: %v", err)
+			}
+			err = testMemPeerSend(peer, sccrq, 0, 0)
+			if err != nil {
+				t.Fatalf("failed to send SCCRQ: %v", err)
+			}
+
+			if !c.accept {
+				msg, err := testMemPeerRecv(peer)
+				if err != nil {
+					t.Fatalf("failed to receive response: %v", err)
+				}
+				if msg.getType() != avpMsgTypeStopccn {
+					t.Errorf("expected StopCCN, got %v", msg.getType())
+				}
+				return
+			}
+
+			msg, err := xport.recv()
+			if err != nil {
+				t.Fatalf("recv(): %v", err)
+			}
+			if v := messageVersion(msg); v != ProtocolVersion3Fallback {
+				t.Errorf("expected a fallback mode SCCRQ, got version %v", v)
+			}
+		})
+	}
+}
+
+func TestRTTEstimator(t *testing.T) {
+	cases := []struct {
+		name                  string
+		samples               []time.Duration
+		srtt, rttvar, timeout time.Duration
+	}{
+		{
+			name:    "first sample",
+			samples: []time.Duration{100 * time.Millisecond},
+			srtt:    100 * time.Millisecond,
+			rttvar:  50 * time.Millisecond,
+			timeout: 300 * time.Millisecond,
+		},
+		{
+			name:    "steady",
+			samples: []time.Duration{100 * time.Millisecond, 100 * time.Millisecond},
+			srtt:    100 * time.Millisecond,
+			rttvar:  37500 * time.Microsecond,
+			timeout: 250 * time.Millisecond,
+		},
+		{
+			name:    "increasing",
+			samples: []time.Duration{100 * time.Millisecond, 900 * time.Millisecond},
+			srtt:    200 * time.Millisecond,
+			rttvar:  237500 * time.Microsecond,
+			timeout: 1150 * time.Millisecond,
+		},
+		{
+			name:    "lan",
+			samples: []time.Duration{time.Millisecond},
+			srtt:    time.Millisecond,
+			rttvar:  500 * time.Microsecond,
+			timeout: minRetryTimeout,
+		},
+		{
+			name:    "satellite",
+			samples: []time.Duration{600 * time.Millisecond},
+			srtt:    600 * time.Millisecond,
+			rttvar:  300 * time.Millisecond,
+			timeout: 1800 * time.Millisecond,
+		},
+		{
+			name:    "congested",
+			samples: []time.Duration{5 * time.Second},
+			srtt:    5 * time.Second,
+			rttvar:  2500 * time.Millisecond,
+			timeout: maxRetryTimeout,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var r rttEstimator
+			for _, s := range c.samples {
+				r.update(s)
+			}
+			if r.srtt != c.srtt || r.rttvar != c.rttvar || r.rto != c.timeout {
+				t.Errorf("expected srtt %v rttvar %v rto %v, got %v %v %v",
+					c.srtt, c.rttvar, c.timeout, r.srtt, r.rttvar, r.rto)
+			}
+		})
+	}
+}
+
+func TestScaleRetryTimeout(t *testing.T) {
+	cases := []struct {
+		name     string
+		cfg      transportConfig
+		rtt      time.Duration
+		nretries uint
+		expect   time.Duration
+	}{
+		{
+			name:     "fixed",
+			cfg:      transportConfig{RetryTimeout: time.Second},
+			nretries: 2,
+			expect:   4 * time.Second,
+		},
+		{
+			name:     "fixed capped",
+			cfg:      transportConfig{RetryTimeout: time.Second},
+			nretries: 40,
+			expect:   maxRetryTimeout,
+		},
+		{
+			name:     "fixed beyond cap",
+			cfg:      transportConfig{RetryTimeout: 10 * time.Second},
+			nretries: 3,
+			expect:   10 * time.Second,
+		},
+		{
+			name:     "fixed ignores rtt",
+			cfg:      transportConfig{RetryTimeout: time.Second},
+			rtt:      10 * time.Millisecond,
+			nretries: 0,
+			expect:   time.Second,
+		},
+		{
+			name:     "adaptive unmeasured",
+			cfg:      transportConfig{RetryTimeout: time.Second, RetryMode: RetryModeAdaptive},
+			nretries: 1,
+			expect:   2 * time.Second,
+		},
+		{
+			name:     "adaptive",
+			cfg:      transportConfig{RetryTimeout: time.Second, RetryMode: RetryModeAdaptive},
+			rtt:      10 * time.Millisecond,
+			nretries: 1,
+			expect:   60 * time.Millisecond,
+		},
+		{
+			name:     "adaptive capped",
+			cfg:      transportConfig{RetryTimeout: time.Second, RetryMode: RetryModeAdaptive},
+			rtt:      600 * time.Millisecond,
+			nretries: 3,
+			expect:   maxRetryTimeout,
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			xport := &transport{config: c.cfg}
+			if c.rtt != 0 {
+				xport.rtt.update(c.rtt)
+			}
+			got := xport.scaleRetryTimeout(&ctlMsg{nretries: c.nretries})
+			if got != c.expect {
+				t.Errorf("expected %v, got %v", c.expect, got)
+			}
+		})
+	}
+}